@@ -0,0 +1,92 @@
+// Command h264captions extracts CEA-608 closed captions carried in the SEI
+// of an H.264 Annex B byte stream and writes them as SRT or WebVTT.
+//
+//	h264captions [-channel 1] [-format srt|vtt] [-o out.srt] in.h264
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mrmod/cvnightlife/h264"
+)
+
+func main() {
+	channel := flag.Int("channel", 1, "CEA-608 caption channel, 1 to 4")
+	format := flag.String("format", "", "srt or vtt; by default taken from the -o extension, else srt")
+	output := flag.String("o", "", "output file; standard output when empty")
+	fps := flag.Float64("fps", 29.97, "frame rate used when the SPS has no timing info")
+	flag.Parse()
+	if flag.NArg() != 1 || *channel < 1 || *channel > 4 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *format == "" {
+		*format = "srt"
+		if filepath.Ext(*output) == ".vtt" {
+			*format = "vtt"
+		}
+	}
+	if *format != "srt" && *format != "vtt" {
+		fail(fmt.Errorf("unknown format %q", *format))
+	}
+
+	in, err := os.Open(flag.Arg(0))
+	if err != nil {
+		fail(err)
+	}
+	defer in.Close()
+
+	captions := h264.NewCEA608Decoder(*channel)
+	var t time.Duration
+	extractor := &h264.CaptionExtractor{
+		Handler: func(index int, frame *h264.Frame, triplets []h264.CCTriplet) {
+			captions.Decode(t, triplets)
+			t += pictureDuration(frame, *fps)
+		},
+	}
+	if err := h264.NewDecoder(h264.WithFrameHandler(extractor)).Decode(in); err != nil {
+		fail(err)
+	}
+	extractor.Flush()
+	captions.Flush(t)
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fail(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if *format == "vtt" {
+		err = h264.WriteWebVTT(w, captions.Cues)
+	} else {
+		err = h264.WriteSRT(w, captions.Cues)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+// Display time of a picture; a field lasts half a frame
+func pictureDuration(frame *h264.Frame, fps float64) time.Duration {
+	if rate := frame.SPS.FrameRate(); rate > 0 {
+		fps = rate
+	}
+	frameDuration := time.Duration(float64(time.Second) / fps)
+	if frame.FieldPic {
+		return frameDuration / 2
+	}
+	return frameDuration
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "h264captions: %v\n", err)
+	os.Exit(1)
+}
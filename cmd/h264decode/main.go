@@ -0,0 +1,114 @@
+// Command h264decode decodes an H.264 Annex B byte stream and writes its
+// pictures in display order as YUV4MPEG2 or raw planar YUV.
+//
+// Slices are parsed but their samples are not reconstructed, so every
+// picture is written mid-grey. The output has the size, format, count and
+// timing of the stream's pictures, which is enough to check those against
+// a reference decoder, but its samples cannot be compared. Field pictures
+// are skipped and counted on standard error.
+//
+//	h264decode [-format y4m|i420|i422|i444|p010] [-o out.y4m] in.h264
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mrmod/cvnightlife/h264"
+)
+
+var rawFormats = map[string]int{
+	"i420": h264.YUV_FORMAT_I420,
+	"i422": h264.YUV_FORMAT_I422,
+	"i444": h264.YUV_FORMAT_I444,
+	"p010": h264.YUV_FORMAT_P010,
+}
+
+// writer is a Y4MWriter or a RawYUVWriter
+type writer interface {
+	h264.FrameHandler
+	Err() error
+}
+
+// Returns the field pictures a writer skipped
+func skippedFields(pictures writer) int {
+	switch w := pictures.(type) {
+	case *h264.RawYUVWriter:
+		return w.SkippedFields
+	case *h264.Y4MWriter:
+		return w.SkippedFields
+	}
+	return 0
+}
+
+func main() {
+	format := flag.String("format", "", "y4m, i420, i422, i444 or p010; by default taken from the -o extension, else y4m")
+	output := flag.String("o", "", "output file; standard output when empty")
+	fps := flag.Int("fps", 25, "frame rate written to Y4M when the SPS has no timing info")
+	flag.Parse()
+	if flag.NArg() != 1 || *fps < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *format == "" {
+		*format = "y4m"
+		ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(*output), "."))
+		if _, ok := rawFormats[ext]; ok {
+			*format = ext
+		}
+	}
+	rawFormat, raw := rawFormats[*format]
+	if !raw && *format != "y4m" {
+		fail(fmt.Errorf("unknown format %q", *format))
+	}
+
+	in, err := os.Open(flag.Arg(0))
+	if err != nil {
+		fail(err)
+	}
+	defer in.Close()
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fail(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	buffered := bufio.NewWriter(w)
+
+	var pictures writer
+	if raw {
+		pictures = h264.NewRawYUVWriter(buffered, rawFormat)
+	} else {
+		y4m := h264.NewY4MWriter(buffered)
+		y4m.FrameRate = [2]int{*fps, 1}
+		pictures = y4m
+	}
+	order := &h264.DisplayOrder{Handler: pictures}
+	if err := h264.NewDecoder(h264.WithFrameHandler(order)).Decode(in); err != nil {
+		fail(err)
+	}
+	order.Flush()
+	if err := pictures.Err(); err != nil {
+		fail(err)
+	}
+	if err := buffered.Flush(); err != nil {
+		fail(err)
+	}
+	if n := skippedFields(pictures); n > 0 {
+		fmt.Fprintf(os.Stderr, "h264decode: skipped %d field pictures\n", n)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "h264decode: %v\n", err)
+	os.Exit(1)
+}
@@ -0,0 +1,215 @@
+// Command h264inspect describes an H.264 Annex B byte stream: one line per
+// NAL unit with its offset, size, type and nal_ref_idc, every field of its
+// parameter sets, its slice headers, and a summary of the stream. The
+// stream is read from a file, or from standard input without one or when
+// the file is -. CSV holds the NAL units alone.
+//
+//	h264inspect [-format table|jsonl|csv] [in.h264]
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mrmod/cvnightlife/h264"
+)
+
+// nalRecord is a NAL unit as a JSON line
+type nalRecord struct {
+	Offset   int64           `json:"offset"`
+	Size     int             `json:"size"`
+	Type     int             `json:"type"`
+	TypeName string          `json:"type_name"`
+	RefIdc   int             `json:"ref_idc"`
+	SPS      *h264.SPS       `json:"sps,omitempty"`
+	PPS      *h264.PPS       `json:"pps,omitempty"`
+	Slice    *h264.SliceInfo `json:"slice,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+var csvHeader = []string{"offset", "size", "type", "type_name", "ref_idc",
+	"slice_type", "first_mb", "frame_num", "poc", "qp", "refs_l0", "refs_l1", "fields", "error"}
+
+func main() {
+	format := flag.String("format", "table", "table, jsonl or csv")
+	flag.Parse()
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *format != "table" && *format != "jsonl" && *format != "csv" {
+		fail(fmt.Errorf("unknown format %q", *format))
+	}
+
+	var in io.Reader = os.Stdin
+	if flag.NArg() == 1 && flag.Arg(0) != "-" {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			fail(err)
+		}
+		defer f.Close()
+		in = f
+	}
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	inspector := h264.NewInspector()
+	var err error
+	switch *format {
+	case "table":
+		table := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "OFFSET\tSIZE\tTYPE\tREF\tDETAILS")
+		err = inspector.Inspect(in, func(nal *h264.NALInfo) error {
+			fmt.Fprintf(table, "%d\t%d\t%s\t%d\t%s\n", nal.Offset, nal.Size, h264.NALUnitType[nal.Type], nal.RefIdc, details(nal))
+			for _, field := range fields(nal) {
+				fmt.Fprintf(table, "\t\t\t\t  %s\n", field)
+			}
+			return nil
+		})
+		table.Flush()
+		if err == nil {
+			writeSummary(out, &inspector.Summary)
+		}
+	case "jsonl":
+		encoder := json.NewEncoder(out)
+		err = inspector.Inspect(in, func(nal *h264.NALInfo) error {
+			record := nalRecord{Offset: nal.Offset, Size: nal.Size, Type: nal.Type, TypeName: h264.NALUnitType[nal.Type],
+				RefIdc: nal.RefIdc, SPS: nal.SPS, PPS: nal.PPS, Slice: nal.Slice}
+			if nal.Err != nil {
+				record.Error = nal.Err.Error()
+			}
+			return encoder.Encode(record)
+		})
+		if err == nil {
+			err = encoder.Encode(map[string]*h264.InspectSummary{"summary": &inspector.Summary})
+		}
+	case "csv":
+		w := csv.NewWriter(out)
+		w.Write(csvHeader)
+		err = inspector.Inspect(in, func(nal *h264.NALInfo) error {
+			row := []string{fmt.Sprint(nal.Offset), fmt.Sprint(nal.Size), fmt.Sprint(nal.Type), h264.NALUnitType[nal.Type], fmt.Sprint(nal.RefIdc)}
+			if slice := nal.Slice; slice != nil {
+				row = append(row, slice.Type, fmt.Sprint(slice.FirstMb), fmt.Sprint(slice.FrameNum), fmt.Sprint(slice.PicOrderCnt),
+					fmt.Sprint(slice.QP), fmt.Sprint(slice.RefsL0), fmt.Sprint(slice.RefsL1))
+			} else {
+				row = append(row, "", "", "", "", "", "", "")
+			}
+			row = append(row, strings.Join(fields(nal), " "), "")
+			if nal.Err != nil {
+				row[len(row)-1] = nal.Err.Error()
+			}
+			return w.Write(row)
+		})
+		w.Flush()
+		if err == nil {
+			err = w.Error()
+		}
+	}
+	if err != nil {
+		out.Flush()
+		fail(err)
+	}
+}
+
+// Returns the one line description of a NAL unit
+func details(nal *h264.NALInfo) string {
+	switch {
+	case nal.Err != nil:
+		return "error: " + nal.Err.Error()
+	case nal.SPS != nil:
+		width, height := nal.SPS.DisplaySize()
+		return fmt.Sprintf("id %d, %s level %s, %dx%d", nal.SPS.ID, nal.SPS.ProfileName(), nal.SPS.LevelName(), width, height)
+	case nal.PPS != nil:
+		entropy := "CAVLC"
+		if nal.PPS.EntropyCodingMode == 1 {
+			entropy = "CABAC"
+		}
+		return fmt.Sprintf("id %d on SPS %d, %s", nal.PPS.ID, nal.PPS.SPSID, entropy)
+	case nal.Slice != nil:
+		slice := nal.Slice
+		line := fmt.Sprintf("%s slice, first_mb %d, frame_num %d, poc %d, qp %d", slice.Type, slice.FirstMb, slice.FrameNum, slice.PicOrderCnt, slice.QP)
+		switch {
+		case slice.RefsL1 > 0:
+			line += fmt.Sprintf(", refs %d/%d", slice.RefsL0, slice.RefsL1)
+		case slice.RefsL0 > 0:
+			line += fmt.Sprintf(", refs %d", slice.RefsL0)
+		}
+		if slice.IDR {
+			line += fmt.Sprintf(", idr_pic_id %d", slice.IDRPicID)
+		}
+		return line
+	}
+	return ""
+}
+
+// Returns every exported field of a parameter set as name=value
+func fields(nal *h264.NALInfo) []string {
+	var v reflect.Value
+	switch {
+	case nal.SPS != nil:
+		v = reflect.ValueOf(nal.SPS).Elem()
+	case nal.PPS != nil:
+		v = reflect.ValueOf(nal.PPS).Elem()
+	default:
+		return nil
+	}
+	fields := []string{}
+	for i := 0; i < v.NumField(); i++ {
+		if field := v.Type().Field(i); field.IsExported() {
+			fields = append(fields, fmt.Sprintf("%s=%v", field.Name, v.Field(i).Interface()))
+		}
+	}
+	return fields
+}
+
+func writeSummary(w io.Writer, summary *h264.InspectSummary) {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	defer table.Flush()
+	fmt.Fprintln(table, "\nSummary")
+	fmt.Fprintf(table, "  NAL units\t%d, %d bytes\n", summary.NALUnits, summary.Bytes)
+	types := []int{}
+	for nalType := range summary.NALUnitTypes {
+		types = append(types, nalType)
+	}
+	sort.Ints(types)
+	for _, nalType := range types {
+		fmt.Fprintf(table, "    %s\t%d\n", h264.NALUnitType[nalType], summary.NALUnitTypes[nalType])
+	}
+	if summary.Profile == "" {
+		fmt.Fprintln(table, "  No SPS")
+		return
+	}
+	fmt.Fprintf(table, "  Resolution\t%dx%d\n", summary.Width, summary.Height)
+	fmt.Fprintf(table, "  Profile\t%s, level %s (%s)\n", summary.Profile, summary.Level, summary.Codec)
+	fmt.Fprintf(table, "  Chroma\t%s, %d bit\n", []string{"monochrome", "4:2:0", "4:2:2", "4:4:4"}[summary.ChromaFormat], summary.BitDepth)
+	if summary.FrameRate > 0 {
+		fmt.Fprintf(table, "  Frame rate\t%.3f fps\n", summary.FrameRate)
+	} else {
+		fmt.Fprintln(table, "  Frame rate\tnot signalled")
+	}
+	fmt.Fprintf(table, "  Pictures\t%d, %d IDR\n", summary.Pictures, summary.IDRPictures)
+	if summary.GOPStructure != "" {
+		fmt.Fprintf(table, "  GOP\t%s\n", summary.GOPStructure)
+	}
+	if lengths := summary.GOPLengths; len(lengths) > 0 {
+		shortest, longest, total := lengths[0], lengths[0], 0
+		for _, length := range lengths {
+			shortest, longest, total = min(shortest, length), max(longest, length), total+length
+		}
+		fmt.Fprintf(table, "  GOP length\t%d to %d, %.1f on average\n", shortest, longest, float64(total)/float64(len(lengths)))
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "h264inspect: %v\n", err)
+	os.Exit(1)
+}
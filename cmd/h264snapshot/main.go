@@ -0,0 +1,88 @@
+// Command h264snapshot decodes an H.264 Annex B byte stream and writes
+// still images of its IDR pictures, or of every Nth picture, named by
+// presentation time. The stream is read from a file, or from standard
+// input when the file is -.
+//
+// Samples are not reconstructed, so the images are mid-grey; they show
+// which pictures were taken and at what size, not what the pictures hold.
+//
+//	h264snapshot [-count 1] [-every 0] [-format jpeg|png] [-quality 90] [-width 0] [-height 0] [-metadata] [-o dir] in.h264
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mrmod/cvnightlife/h264"
+)
+
+var formats = map[string]int{
+	"jpeg": h264.SNAPSHOT_FORMAT_JPEG,
+	"jpg":  h264.SNAPSHOT_FORMAT_JPEG,
+	"png":  h264.SNAPSHOT_FORMAT_PNG,
+}
+
+// untilDone ends a stream once the snapshots are taken
+type untilDone struct {
+	r         io.Reader
+	snapshots *h264.Snapshotter
+}
+
+func (u untilDone) Read(p []byte) (int, error) {
+	if u.snapshots.Done() {
+		return 0, io.EOF
+	}
+	return u.r.Read(p)
+}
+
+func main() {
+	count := flag.Int("count", 1, "snapshots to write; 0 for every one in the stream")
+	every := flag.Int("every", 0, "take every Nth picture instead of IDR pictures")
+	format := flag.String("format", "jpeg", "jpeg or png")
+	quality := flag.Int("quality", 90, "JPEG quality from 1 to 100")
+	width := flag.Int("width", 0, "image width; follows the aspect ratio when 0")
+	height := flag.Int("height", 0, "image height; follows the aspect ratio when 0")
+	metadata := flag.Bool("metadata", false, "write a JSON file of stream metadata beside each image")
+	output := flag.String("o", ".", "output directory")
+	flag.Parse()
+	if flag.NArg() != 1 || *count < 0 || *every < 0 || *quality < 1 || *quality > 100 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	imageFormat, ok := formats[*format]
+	if !ok {
+		fail(fmt.Errorf("unknown format %q", *format))
+	}
+	if err := os.MkdirAll(*output, 0o755); err != nil {
+		fail(err)
+	}
+
+	var in io.Reader = os.Stdin
+	if flag.Arg(0) != "-" {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			fail(err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	snapshots := h264.NewSnapshotter(*output, imageFormat)
+	snapshots.Count, snapshots.Every = *count, *every
+	snapshots.Quality = *quality
+	snapshots.Width, snapshots.Height = *width, *height
+	snapshots.Metadata = *metadata
+	if err := h264.NewDecoder(h264.WithFrameHandler(snapshots)).Decode(untilDone{in, snapshots}); err != nil {
+		fail(err)
+	}
+	if err := snapshots.Err(); err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "h264snapshot: %v\n", err)
+	os.Exit(1)
+}
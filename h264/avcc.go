@@ -0,0 +1,322 @@
+package h264
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// Framing of the NAL units in the input
+const (
+	// FRAMING_AUTO detects the framing from the start of the stream
+	FRAMING_AUTO = iota
+	// FRAMING_ANNEX_B separates NAL units with start codes, Annex B
+	FRAMING_ANNEX_B
+	// FRAMING_AVCC prefixes each NAL unit with its big-endian length,
+	// ISO/IEC 14496-15
+	FRAMING_AVCC
+)
+
+var (
+	Framing = map[int]string{
+		FRAMING_AUTO:    "auto",
+		FRAMING_ANNEX_B: "Annex B",
+		FRAMING_AVCC:    "AVCC",
+	}
+	// ErrInvalidAVCConfig is returned for data that is not an
+	// AVCDecoderConfigurationRecord
+	ErrInvalidAVCConfig = errors.New("h264: invalid AVCDecoderConfigurationRecord")
+)
+
+// Bytes looked at to detect the framing
+const framingPeekBytes = 512
+
+// AVCDecoderConfigurationRecord is the avcC box payload, ISO/IEC 14496-15
+// 5.3.3.1. It carries the parameter sets and the size of the NAL unit
+// length field of AVCC samples.
+type AVCDecoderConfigurationRecord struct {
+	ConfigurationVersion int
+	AVCProfileIndication int
+	ProfileCompatibility int
+	AVCLevelIndication   int
+	LengthSizeMinusOne   int
+	// SPS, PPS and SPSExt hold whole NAL units, header byte included
+	SPS [][]byte
+	PPS [][]byte
+	// HighProfileExtension is set when the chroma format, bit depth and
+	// SPS extension fields of High profiles are present
+	HighProfileExtension bool
+	ChromaFormat         int
+	BitDepthLumaMinus8   int
+	BitDepthChromaMinus8 int
+	SPSExt               [][]byte
+}
+
+// LengthSize is the size in bytes of the NAL unit length field
+func (c *AVCDecoderConfigurationRecord) LengthSize() int {
+	return c.LengthSizeMinusOne + 1
+}
+
+// NewAVCDecoderConfigurationRecord parses an avcC box payload
+func NewAVCDecoderConfigurationRecord(data []byte) (*AVCDecoderConfigurationRecord, error) {
+	record, _, err := parseAVCDecoderConfigurationRecord(data)
+	return record, err
+}
+
+// Returns the record at the start of data and its size in bytes
+func parseAVCDecoderConfigurationRecord(data []byte) (*AVCDecoderConfigurationRecord, int, error) {
+	b := &BitReader{bytes: data}
+	record := &AVCDecoderConfigurationRecord{
+		ConfigurationVersion: b.NextField("ConfigurationVersion", 8),
+		AVCProfileIndication: b.NextField("AVCProfileIndication", 8),
+		ProfileCompatibility: b.NextField("ProfileCompatibility", 8),
+		AVCLevelIndication:   b.NextField("AVCLevelIndication", 8),
+	}
+	_ = b.NextField("Reserved", 6)
+	record.LengthSizeMinusOne = b.NextField("LengthSizeMinusOne", 2)
+	_ = b.NextField("Reserved", 3)
+	numOfSequenceParameterSets := b.NextField("NumOfSequenceParameterSets", 5)
+	record.SPS = readParameterSetNalUnits(b, numOfSequenceParameterSets, "SequenceParameterSetLength")
+	numOfPictureParameterSets := b.NextField("NumOfPictureParameterSets", 8)
+	record.PPS = readParameterSetNalUnits(b, numOfPictureParameterSets, "PictureParameterSetLength")
+	if err := b.Err(); err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", ErrInvalidAVCConfig, err)
+	}
+	if record.ConfigurationVersion != 1 {
+		return nil, 0, fmt.Errorf("%w: %v", ErrInvalidAVCConfig, ErrInvalidValue{Field: "ConfigurationVersion", Value: record.ConfigurationVersion, Range: [2]int{1, 1}})
+	}
+	if record.LengthSizeMinusOne == 2 {
+		return nil, 0, fmt.Errorf("%w: %v", ErrInvalidAVCConfig, ErrInvalidValue{Field: "LengthSizeMinusOne", Value: 2, Range: [2]int{0, 3}})
+	}
+
+	// Many writers leave the extension out, so it is only read when its
+	// reserved bits are there
+	switch {
+	case isInList(chromaFormatProfiles, record.AVCProfileIndication):
+		next, err := b.PeekBytes(4)
+		if err != nil || next[0]&0xfc != 0xfc || next[1]&0xf8 != 0xf8 || next[2]&0xf8 != 0xf8 {
+			break
+		}
+		extension := b.child(b.Bytes()[b.byteOffset:])
+		_ = extension.NextField("Reserved", 6)
+		chromaFormat := extension.NextField("ChromaFormat", 2)
+		_ = extension.NextField("Reserved", 5)
+		bitDepthLumaMinus8 := extension.NextField("BitDepthLumaMinus8", 3)
+		_ = extension.NextField("Reserved", 5)
+		bitDepthChromaMinus8 := extension.NextField("BitDepthChromaMinus8", 3)
+		numOfSequenceParameterSetExt := extension.NextField("NumOfSequenceParameterSetExt", 8)
+		spsExt := readParameterSetNalUnits(extension, numOfSequenceParameterSetExt, "SequenceParameterSetExtLength")
+		if extension.Err() != nil {
+			break
+		}
+		record.HighProfileExtension = true
+		record.ChromaFormat = chromaFormat
+		record.BitDepthLumaMinus8 = bitDepthLumaMinus8
+		record.BitDepthChromaMinus8 = bitDepthChromaMinus8
+		record.SPSExt = spsExt
+		b.Fastforward(extension.bitsRead)
+	}
+	return record, b.byteOffset, nil
+}
+
+// Reads count NAL units each preceded by a 16 bit length
+func readParameterSetNalUnits(b *BitReader, count int, lengthField string) [][]byte {
+	nalUnits := [][]byte{}
+	for i := 0; i < count && b.Err() == nil; i++ {
+		length := b.NextField(lengthField, 16)
+		nalUnit, err := b.ReadBytes(length)
+		if err != nil {
+			b.setErr(fmt.Errorf("%w: %s %d", ErrTruncated, lengthField, length))
+			break
+		}
+		nalUnits = append(nalUnits, nalUnit)
+	}
+	return nalUnits
+}
+
+// Feeds the parameter sets of record to the decoder ahead of the stream
+func (h *H264Reader) useAVCDecoderConfigurationRecord(record *AVCDecoderConfigurationRecord) {
+	h.AVCConfig = record
+	h.Framing = FRAMING_AVCC
+	h.NALLengthSize = record.LengthSize()
+	for _, parameterSets := range [][][]byte{record.SPS, record.PPS, record.SPSExt} {
+		h.queuedNalUnits = append(h.queuedNalUnits, parameterSets...)
+	}
+}
+
+// Returns the next NAL unit in whichever framing the stream uses
+func readNalUnit(r *H264Reader) (*NalUnit, *BitReader, error) {
+	if r.Samples != nil && len(r.queuedNalUnits) == 0 {
+		if err := r.readSample(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if r.Framing == FRAMING_AUTO && r.Samples == nil {
+		if err := r.detectFraming(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(r.queuedNalUnits) > 0 {
+		buf := r.queuedNalUnits[0]
+		r.queuedNalUnits = r.queuedNalUnits[1:]
+		r.prefixBytes = 0
+		return r.nalUnitFromBytes(buf)
+	}
+	if r.Framing == FRAMING_AVCC {
+		return readLengthPrefixedNalUnit(r)
+	}
+	return readAnnexBNalUnit(r)
+}
+
+// Returns the next NAL unit of an AVCC stream, each preceded by its length
+// in NALLengthSize bytes
+func readLengthPrefixedNalUnit(r *H264Reader) (*NalUnit, *BitReader, error) {
+	lengthSize := r.NALLengthSize
+	if lengthSize == 0 {
+		lengthSize = 4
+	}
+	lengthField, buf, err := readLengthPrefixed(r.Stream, lengthSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.DebugFile != nil {
+		r.DebugFile.Write(lengthField)
+		r.DebugFile.Write(buf)
+	}
+	r.prefixBytes = lengthSize
+	if len(buf) == 0 {
+		// Skipped by the caller like any NAL unit that fails to parse
+		return nil, r.child(buf), fmt.Errorf("%w: empty NAL unit", ErrTruncated)
+	}
+	return r.nalUnitFromBytes(buf)
+}
+
+// Reads a NAL unit preceded by its length in lengthSize bytes, returning
+// io.EOF at the end of r. The length is checked against what is left of a
+// reader that tells, such as a bytes.Reader; other readers fill a buffer
+// as the data arrives, so a corrupt length costs no more memory than the
+// stream holds.
+func readLengthPrefixed(r io.Reader, lengthSize int) (lengthField, nalUnit []byte, err error) {
+	if err := checkRange("NALLengthSize", lengthSize, 1, 4); err != nil {
+		return nil, nil, err
+	}
+	lengthField = make([]byte, lengthSize)
+	if _, err := io.ReadFull(r, lengthField); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("%w: NAL unit length", ErrTruncated)
+		}
+		return nil, nil, err
+	}
+	length := 0
+	for _, b := range lengthField {
+		length = length<<8 | int(b)
+	}
+	if remaining, ok := r.(interface{ Len() int }); ok {
+		if length > remaining.Len() {
+			return nil, nil, fmt.Errorf("%w: NAL unit of %d bytes, %d left", ErrTruncated, length, remaining.Len())
+		}
+		nalUnit = make([]byte, length)
+		if _, err := io.ReadFull(r, nalUnit); err != nil {
+			return nil, nil, err
+		}
+		return lengthField, nalUnit, nil
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(length)); err != nil {
+		if err == io.EOF {
+			err = fmt.Errorf("%w: NAL unit of %d bytes", ErrTruncated, length)
+		}
+		return nil, nil, err
+	}
+	return lengthField, buf.Bytes(), nil
+}
+
+// Parses a NAL unit read by any of the framings
+func (r *H264Reader) nalUnitFromBytes(buf []byte) (*NalUnit, *BitReader, error) {
+	nalUnitReader := r.child(buf)
+	r.NalUnits = append(r.NalUnits, nalUnitReader)
+	if r.logEnabled(slog.LevelDebug) {
+		r.logger().Debug("found NAL unit", "framing", Framing[r.Framing], "bytes", len(buf), "head", headBytes(buf, 8))
+	}
+	nalUnit, err := parseNalUnit(nalUnitReader.child(buf), len(buf))
+	return nalUnit, nalUnitReader, err
+}
+
+// Looks at the start of the stream to choose between an Annex B byte
+// stream, an avcC record followed by AVCC samples and bare AVCC samples.
+// Annex B is assumed when nothing fits.
+func (h *H264Reader) detectFraming() error {
+	stream, ok := h.Stream.(*bufio.Reader)
+	if !ok {
+		stream = bufio.NewReader(h.Stream)
+		h.Stream = stream
+	}
+	head, err := stream.Peek(framingPeekBytes)
+	if len(head) == 0 {
+		if err == nil {
+			err = io.EOF
+		}
+		return err
+	}
+	atEOF := err != nil
+
+	h.Framing = FRAMING_ANNEX_B
+	switch {
+	case hasStartCode(head):
+	case head[0] == 1:
+		record, n, err := parseAVCDecoderConfigurationRecord(head)
+		if err != nil || len(record.SPS) == 0 || record.SPS[0][0]&0x1f != NALU_TYPE_SPS {
+			break
+		}
+		if _, err := stream.Discard(n); err != nil {
+			return err
+		}
+		h.useAVCDecoderConfigurationRecord(record)
+	default:
+		for _, lengthSize := range []int{4, 2, 1} {
+			if isLengthPrefixed(head, lengthSize, atEOF) {
+				h.Framing = FRAMING_AVCC
+				h.NALLengthSize = lengthSize
+				break
+			}
+		}
+	}
+	h.logger().Info("input framing", "framing", Framing[h.Framing], "nalLengthSize", h.NALLengthSize)
+	return nil
+}
+
+// Reports whether head begins with zero bytes then 0x000001
+func hasStartCode(head []byte) bool {
+	zeros := 0
+	for zeros < len(head) && head[zeros] == 0 {
+		zeros++
+	}
+	return zeros >= 2 && zeros < len(head) && head[zeros] == 1
+}
+
+// Reports whether head reads as NAL units with lengthSize byte lengths.
+// The last one may run past head unless the stream ends there.
+func isLengthPrefixed(head []byte, lengthSize int, atEOF bool) bool {
+	offset, nalUnits := 0, 0
+	for offset+lengthSize < len(head) {
+		length := 0
+		for _, b := range head[offset : offset+lengthSize] {
+			length = length<<8 | int(b)
+		}
+		header := head[offset+lengthSize]
+		// forbidden_zero_bit and the unspecified and reserved types
+		nalUnitType := int(header & 0x1f)
+		if length == 0 || header&0x80 != 0 || nalUnitType == 0 || nalUnitType > 23 {
+			return false
+		}
+		offset += lengthSize + length
+		nalUnits++
+	}
+	if atEOF {
+		return nalUnits > 0 && offset == len(head)
+	}
+	return nalUnits > 0
+}
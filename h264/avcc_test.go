@@ -0,0 +1,146 @@
+package h264
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+	"testing/iotest"
+)
+
+func lengthPrefixed(lengthSize int, nalUnits ...[]byte) []byte {
+	stream := []byte{}
+	for _, nalUnit := range nalUnits {
+		for i := lengthSize - 1; i >= 0; i-- {
+			stream = append(stream, byte(len(nalUnit)>>uint(8*i)))
+		}
+		stream = append(stream, nalUnit...)
+	}
+	return stream
+}
+
+// A recovery point SEI with recovery_frame_cnt 0 lets decoding start at
+// the P slice after it
+func recoveryPointSEI() []byte {
+	return nal(0x06, []byte{SEI_TYPE_RECOVERY_POINT, 1, 0x84, 0x80})
+}
+
+func TestNewAVCDecoderConfigurationRecord(t *testing.T) {
+	sps := nal(0x67, bitsToBytes(baselineSPSBits))
+	pps := nal(0x68, bitsToBytes(baselinePPSBits))
+	spsExt := []byte{0x6d, 0x80}
+	data := []byte{1, PROFILE_IDC_HIGH, 0, 30, 0xff, 0xe1, 0, byte(len(sps))}
+	data = append(data, sps...)
+	data = append(data, 1, 0, byte(len(pps)))
+	data = append(data, pps...)
+	// 4:2:0, 10 bit luma, 8 bit chroma, one SPS extension
+	data = append(data, 0xfd, 0xfa, 0xf8, 1, 0, byte(len(spsExt)))
+	data = append(data, spsExt...)
+
+	record, err := NewAVCDecoderConfigurationRecord(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if record.AVCProfileIndication != PROFILE_IDC_HIGH || record.AVCLevelIndication != 30 || record.LengthSize() != 4 {
+		t.Fatalf("unexpected record %+v\n", record)
+	}
+	if len(record.SPS) != 1 || !bytes.Equal(record.SPS[0], sps) || len(record.PPS) != 1 || !bytes.Equal(record.PPS[0], pps) {
+		t.Fatalf("unexpected parameter sets %x %x\n", record.SPS, record.PPS)
+	}
+	if !record.HighProfileExtension || record.ChromaFormat != 1 || record.BitDepthLumaMinus8 != 2 || record.BitDepthChromaMinus8 != 0 {
+		t.Fatalf("unexpected High profile extension %+v\n", record)
+	}
+	if len(record.SPSExt) != 1 || !bytes.Equal(record.SPSExt[0], spsExt) {
+		t.Fatalf("unexpected SPS extension %x\n", record.SPSExt)
+	}
+
+	// Without the optional extension
+	record, err = NewAVCDecoderConfigurationRecord(data[:len(data)-8])
+	if err != nil || record.HighProfileExtension {
+		t.Fatalf("expected a record without extension, got %+v %v\n", record, err)
+	}
+	if _, err := NewAVCDecoderConfigurationRecord(data[:10]); err == nil {
+		t.Fatalf("expected an error for a truncated record\n")
+	}
+}
+
+func TestDecodeFraming(t *testing.T) {
+	sps, pps, sei, p1, p2 := roundTripNalUnits()
+	samples := [][]byte{sei, p1, p2}
+	record := []byte{1, PROFILE_IDC_BASELINE, 0, 30, 0xfd, 0xe1, 0, byte(len(sps))}
+	record = append(record, sps...)
+	record = append(record, 1, 0, byte(len(pps)))
+	record = append(record, pps...)
+	inBand := append([][]byte{sps, pps}, samples...)
+
+	annexB3 := []byte{}
+	for _, nalUnit := range inBand {
+		annexB3 = append(annexB3, Initial3BNALU...)
+		annexB3 = append(annexB3, nalUnit...)
+	}
+	tests := []struct {
+		name       string
+		stream     []byte
+		framing    int
+		lengthSize int
+	}{
+		{"Annex B", annexB(inBand...), FRAMING_ANNEX_B, 0},
+		{"Annex B 3 byte start codes", annexB3, FRAMING_ANNEX_B, 0},
+		{"AVCC", lengthPrefixed(4, inBand...), FRAMING_AVCC, 4},
+		{"AVCC 2 byte lengths", lengthPrefixed(2, inBand...), FRAMING_AVCC, 2},
+		{"avcC record", append(record, lengthPrefixed(2, samples...)...), FRAMING_AVCC, 2},
+	}
+	for _, test := range tests {
+		decodeRoundTrip(t, test.name, func(d *Decoder) error {
+			reader := d.NewReader(bytes.NewReader(test.stream))
+			if err := reader.Decode(); err != nil {
+				return err
+			}
+			if reader.Framing != test.framing || reader.NALLengthSize != test.lengthSize {
+				t.Fatalf("%s: detected %s with %d byte lengths\n", test.name, Framing[reader.Framing], reader.NALLengthSize)
+			}
+			return nil
+		})
+	}
+
+	// Out of band parameter sets
+	config, err := NewAVCDecoderConfigurationRecord(record)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	var got frameNums
+	stream := bytes.NewReader(lengthPrefixed(2, samples...))
+	if err := NewDecoder(WithFrameHandler(&got), WithAVCDecoderConfigurationRecord(config)).Decode(stream); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 pictures with an avcC record option, got %v\n", got)
+	}
+}
+
+func TestReadLengthPrefixedCorruptLength(t *testing.T) {
+	// A length of 4 GiB before a single byte is not allocated, whether
+	// the reader tells its length or not
+	data := []byte{0xff, 0xff, 0xff, 0xff, 0x01}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := SplitLengthPrefixed(data, 4); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("expected ErrTruncated, got %v\n", err)
+	}
+	if _, _, err := readLengthPrefixed(iotest.OneByteReader(bytes.NewReader(data)), 4); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("expected ErrTruncated, got %v\n", err)
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Fatalf("allocated %d bytes\n", allocated)
+	}
+
+	// A whole NAL unit is read from either
+	data = lengthPrefixed(2, []byte{0x65, 1, 2, 3})
+	for _, r := range []io.Reader{bytes.NewReader(data), iotest.OneByteReader(bytes.NewReader(data))} {
+		if _, nalUnit, err := readLengthPrefixed(r, 2); err != nil || !bytes.Equal(nalUnit, []byte{0x65, 1, 2, 3}) {
+			t.Fatalf("unexpected NAL unit %x %v\n", nalUnit, err)
+		}
+	}
+}
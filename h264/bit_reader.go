@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/mrmod/degolomb"
 	"io"
+	"log/slog"
 	"math"
 	"os"
 )
@@ -14,6 +15,11 @@ type BitReader struct {
 	bitOffset  int
 	bitsRead   int
 	Debug      bool
+	// err is the first read error. Once set, reads return zero values so a
+	// parser can check Err once at the end of a syntax structure.
+	err   error
+	log   *slog.Logger
+	trace SyntaxTracer
 }
 type H264Reader struct {
 	IsStarted    bool
@@ -21,13 +27,49 @@ type H264Reader struct {
 	NalUnits     []*BitReader
 	VideoStreams []*VideoStream
 	DebugFile    *os.File
+	// FrameHandler receives pictures as they complete
+	FrameHandler FrameHandler
+	// accessUnitHandler receives every picture, including those ahead of
+	// the recovery point that FrameHandler does not
+	accessUnitHandler FrameHandler
+	// RandomAccess is where decoding started, nil until the first IDR
+	// picture or recovery point SEI
+	RandomAccess *RandomAccessPoint
+	// Framing is how NAL units are delimited in Stream. FRAMING_AUTO is
+	// replaced by the detected framing when reading starts.
+	Framing int
+	// NALLengthSize is the size of the AVCC NAL unit length field
+	NALLengthSize int
+	// AVCConfig is the avcC record given to the decoder or found at the
+	// start of Stream
+	AVCConfig *AVCDecoderConfigurationRecord
+	// Samples replaces Stream when NAL units come from a container
+	Samples SampleReader
+	// sample is the one whose NAL units are queued
+	sample *Sample
+	// Parameter sets from AVCConfig, read before Stream, then the NAL
+	// units of sample
+	queuedNalUnits [][]byte
+	// Size of the start code or length field of the last NAL unit read
+	prefixBytes int
+	// SEI messages waiting for the first slice of their access unit
+	pendingSEI   []*SEIMessage
+	pendingBytes int
+	// NAL units of the next access unit ahead of its first slice
+	pendingNalUnits [][]byte
+	skippedNalUnits int
+	// spsByID holds the latest SPS of each seq_parameter_set_id
+	spsByID map[int]*SPS
+	// outputStarted is set once the recovery point picture is reached
+	outputStarted bool
+	timestamps    timestampState
 	*BitReader
 }
 
 func (h *H264Reader) BufferToReader(cntBytes int) error {
 	buf := make([]byte, cntBytes)
 	if _, err := h.Stream.Read(buf); err != nil {
-		logger.Printf("error: while reading %d bytes: %v\n", cntBytes, err)
+		h.logger().Debug("stream read failed", "bytes", cntBytes, "err", err)
 		return err
 	}
 	h.bytes = append(h.bytes, buf...)
@@ -40,7 +82,7 @@ func (h *H264Reader) BufferToReader(cntBytes int) error {
 func (h *H264Reader) Discard(cntBytes int) error {
 	buf := make([]byte, cntBytes)
 	if _, err := h.Stream.Read(buf); err != nil {
-		logger.Printf("error: while discarding %d bytes: %v\n", cntBytes, err)
+		h.logger().Debug("stream discard failed", "bytes", cntBytes, "err", err)
 		return err
 	}
 	h.byteOffset += cntBytes
@@ -157,11 +199,22 @@ func te(bits []int, rangeMax int) int {
 // 9.1.1 Table 9-3
 func se(bits []int) int {
 	codeNum := bitVal(bits) - 1
-	return int(math.Pow(float64(-1), float64(codeNum+1)) * math.Ceil(float64(codeNum/2)))
+	return int(math.Pow(float64(-1), float64(codeNum+1)) * math.Ceil(float64(codeNum)/2))
 }
 func (b *BitReader) Bytes() []byte {
 	return b.bytes
 }
+
+// Err returns the first error encountered while reading, if any
+func (b *BitReader) Err() error {
+	return b.err
+}
+
+func (b *BitReader) setErr(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
 func (b *BitReader) Fastforward(bits int) {
 	b.bitsRead += bits
 	b.setOffset()
@@ -171,12 +224,23 @@ func (b *BitReader) setOffset() {
 	b.bitOffset = b.bitsRead % 8
 }
 
+// Reads an Exp-Golomb code. On error the code for 0 is returned and the
+// error is recorded on the reader.
 func (b *BitReader) golomb() []int {
 	zeros := -1
 	bit := 0
 	bits := []int{}
 	for bit != 1 {
 		zeros += 1
+		// 9.1 codeNum is at most 2^32 - 2
+		if zeros > 31 {
+			b.setErr(ErrInvalidValue{Field: "ExpGolombLeadingZeroBits", Value: zeros, Range: [2]int{0, 31}})
+			return []int{1}
+		}
+		if b.err != nil || b.byteOffset >= len(b.bytes) {
+			b.setErr(ErrTruncated)
+			return []int{1}
+		}
 		bit = degolomb.BitArray(b.bytes[b.byteOffset])[b.bitOffset]
 		b.bitsRead += 1
 		b.setOffset()
@@ -186,6 +250,10 @@ func (b *BitReader) golomb() []int {
 		return bits
 	}
 	for i := 0; i < zeros; i++ {
+		if b.byteOffset >= len(b.bytes) {
+			b.setErr(ErrTruncated)
+			return []int{1}
+		}
 		bit = degolomb.BitArray(b.bytes[b.byteOffset])[b.bitOffset]
 		b.bitsRead += 1
 		b.setOffset()
@@ -195,32 +263,30 @@ func (b *BitReader) golomb() []int {
 	return bits
 }
 
-// TODO: MoreRBSPData Section 7.2 p 62
+// MoreRBSPData reports whether syntax remains before rbsp_trailing_bits,
+// Section 7.2. The reader does not advance.
 func (b *BitReader) MoreRBSPData() bool {
-	logger.Printf("moreRBSPData: %d [byteO: %d, bitO: %d]\n", len(b.bytes), b.byteOffset, b.bitOffset)
-	if len(b.bytes)-b.byteOffset == 0 {
+	// The rbsp_stop_one_bit is the last bit set in the RBSP
+	last := len(b.bytes) - 1
+	for last >= 0 && b.bytes[last] == 0 {
+		last--
+	}
+	if last < 0 {
 		return false
 	}
-	// Read until the least significant bit of any remaining bytes
-	// If the least significant bit is 1, that marks the first bit
-	// of the rbspTrailingBits() struct. If the bits read is more
-	// than 0, then there is more RBSP data
-	buf := make([]int, 1)
-	cnt := 0
-	for buf[0] != 1 {
-		if _, err := b.Read(buf); err != nil {
-			logger.Printf("moreRBSPData error: %v\n", err)
-			return false
-		}
-		cnt++
+	stopBit := last*8 + 7
+	for v := b.bytes[last]; v&1 == 0; v >>= 1 {
+		stopBit--
 	}
-	logger.Printf("moreRBSPData: read %d additional bits\n", cnt)
-	return cnt > 0
+	position := b.byteOffset*8 + b.bitOffset
+	if b.logEnabled(slog.LevelDebug) {
+		b.logger().Debug("moreRBSPData", "position", position, "stopBit", stopBit)
+	}
+	return position < stopBit
 }
 func (b *BitReader) HasMoreData() bool {
-	if b.Debug {
-		logger.Printf("\tHasMoreData: %+v\n", b)
-		logger.Printf("\tHas %d more bytes\n", len(b.bytes)-b.byteOffset)
+	if b.Debug && b.logEnabled(slog.LevelDebug) {
+		b.logger().Debug("HasMoreData", "remainingBytes", len(b.bytes)-b.byteOffset)
 	}
 	return len(b.bytes)-b.byteOffset > 0
 }
@@ -264,18 +330,19 @@ func (b *BitReader) PeekBytes(n int) ([]byte, error) {
 	if len(b.bytes) >= b.byteOffset+n {
 		return b.bytes[b.byteOffset : b.byteOffset+n], nil
 	}
-	return []byte{}, fmt.Errorf("EOF: not enough bytes to give %d (%d @ offset %d", n, len(b.bytes), b.byteOffset)
+	return []byte{}, fmt.Errorf("%w: not enough bytes to give %d (%d @ offset %d)", ErrTruncated, n, len(b.bytes), b.byteOffset)
 
 }
 
-// io.ByteReader interface
+// io.ByteReader interface. Bit reads continue from the following byte.
 func (b *BitReader) ReadByte() (byte, error) {
 	if len(b.bytes) > b.byteOffset {
 		bt := b.bytes[b.byteOffset]
-		b.byteOffset += 1
+		b.bitsRead = (b.byteOffset + 1) * 8
+		b.setOffset()
 		return bt, nil
 	}
-	return byte(0), fmt.Errorf("EOF:  no more bytes")
+	return byte(0), io.EOF
 }
 func (b *BitReader) ReadBytes(n int) ([]byte, error) {
 	buf := []byte{}
@@ -290,11 +357,14 @@ func (b *BitReader) ReadBytes(n int) ([]byte, error) {
 }
 
 func (b *BitReader) Read(buf []int) (int, error) {
-	if b.byteOffset > len(b.bytes) {
-		return 0, fmt.Errorf("EOF: %d > %d\n", b.byteOffset, len(b.bytes))
+	if len(buf) == 0 {
+		return 0, nil
 	}
 	i := 0
 	for {
+		if b.byteOffset >= len(b.bytes) {
+			return i, fmt.Errorf("%w: byte %d of %d", ErrTruncated, b.byteOffset, len(b.bytes))
+		}
 		for _, bit := range degolomb.BitArray(b.bytes[b.byteOffset])[b.bitOffset:8] {
 			buf[i] = bit
 			i++
@@ -304,29 +374,36 @@ func (b *BitReader) Read(buf []int) (int, error) {
 				return len(buf), nil
 			}
 		}
-		if b.byteOffset > len(b.bytes) {
-			return len(buf), fmt.Errorf("EOF: %d > %d\n", b.byteOffset, len(b.bytes))
-		}
-
 	}
-	return len(buf), nil
-
 }
+
+// NextField reads a fixed length field. On error it returns 0 and records
+// the error for Err.
 func (b *BitReader) NextField(name string, bits int) int {
+	if b.err != nil {
+		return 0
+	}
+	bitPosition := b.byteOffset*8 + b.bitOffset
 	buf := make([]int, bits)
 	if _, err := b.Read(buf); err != nil {
-		fmt.Printf("error reading %d bits for %s: %v\n", bits, name, err)
-		return -1
+		b.setErr(fmt.Errorf("reading %d bits for %s: %w", bits, name, err))
+		return 0
 	}
-	if b.Debug {
-		logger.Printf("\t[%s] %d bits = value[%d]\n", name, bits, bitVal(buf))
+	value := bitVal(buf)
+	if b.trace != nil {
+		b.trace(name, bitPosition, value)
 	}
-	return bitVal(buf)
+	if b.Debug && b.logEnabled(slog.LevelDebug) {
+		b.logger().Debug("field", "name", name, "bits", bits, "value", value)
+	}
+	return value
 }
 func (b *BitReader) StreamPosition() (int, int, int) {
 	return len(b.bytes), b.byteOffset, b.bitOffset
 }
 
 func (b *BitReader) LogStreamPosition() {
-	logger.Printf("debug: %d byte stream @ byte %d bit %d\n", len(b.bytes), b.byteOffset, b.bitOffset)
+	if b.logEnabled(slog.LevelDebug) {
+		b.logger().Debug("stream position", "bytes", len(b.bytes), "byteOffset", b.byteOffset, "bitOffset", b.bitOffset)
+	}
 }
@@ -1,5 +1,7 @@
 package h264
 
+import "log/slog"
+
 const (
 	NaCtxId            = 10000
 	NA_SUFFIX          = -1
@@ -99,7 +101,9 @@ func (bin *Binarization) Decode(sliceContext *SliceContext, b *BitReader, rbsp [
 	if bin.SyntaxElement == "MbType" {
 		bin.binString = binIdxMbMap[sliceContext.Slice.Data.SliceTypeName][sliceContext.Slice.Data.MbType]
 	} else {
-		logger.Printf("TODO: no means to find binString for %s\n", bin.SyntaxElement)
+		if b.logEnabled(slog.LevelDebug) {
+			b.logger().Debug("TODO: no means to find binString", "syntaxElement", bin.SyntaxElement)
+		}
 	}
 }
 
@@ -339,7 +343,9 @@ type BinarizationType struct {
 // 9.3.2.5
 func NewBinarization(syntaxElement string, data *SliceData) *Binarization {
 	sliceTypeName := data.SliceTypeName
-	logger.Printf("debug: binarization of %s in sliceType %s\n", syntaxElement, sliceTypeName)
+	if data.BitReader.logEnabled(slog.LevelDebug) {
+		data.BitReader.logger().Debug("binarization", "syntaxElement", syntaxElement, "sliceType", sliceTypeName)
+	}
 	binarization := &Binarization{SyntaxElement: syntaxElement}
 	switch syntaxElement {
 	case "CodedBlockPattern":
@@ -379,7 +385,9 @@ func NewBinarization(syntaxElement string, data *SliceData) *Binarization {
 		}
 		// 9.3.2.5
 	case "MbType":
-		logger.Printf("debug: \tMbType is %s\n", data.MbTypeName)
+		if data.BitReader.logEnabled(slog.LevelDebug) {
+			data.BitReader.logger().Debug("binarization", "mbType", data.MbTypeName)
+		}
 		switch sliceTypeName {
 		case "SI":
 			binarization.BinarizationType = BinarizationType{PrefixSuffix: true}
@@ -437,18 +445,21 @@ func (b *Binarization) IsBinStringMatch(bits []int) bool {
 
 // 9.3.1.2: output is codIRange and codIOffset
 func initDecodingEngine(bitReader *BitReader) (int, int) {
-	logger.Printf("debug: initializing arithmetic decoding engine\n")
 	bitReader.LogStreamPosition()
 	codIRange := 510
 	codIOffset := bitReader.NextField("Initial CodIOffset", 9)
-	logger.Printf("debug: codIRange: %d :: codIOffsset: %d\n", codIRange, codIOffset)
+	if bitReader.logEnabled(slog.LevelDebug) {
+		bitReader.logger().Debug("arithmetic decoding engine initialized", "codIRange", codIRange, "codIOffset", codIOffset)
+	}
 	return codIRange, codIOffset
 }
 
 // 9.3.3.2: output is value of the bin
 func NewArithmeticDecoding(context *SliceContext, binarization *Binarization, ctxIdx, codIRange, codIOffset int) ArithmeticDecoding {
 	a := ArithmeticDecoding{Context: context, Binarization: binarization}
-	logger.Printf("debug: decoding bypass %d, for ctx %d\n", binarization.UseDecodeBypass, ctxIdx)
+	if b := context.Slice.Data.BitReader; b.logEnabled(slog.LevelDebug) {
+		b.logger().Debug("arithmetic decoding", "decodeBypass", binarization.UseDecodeBypass, "ctxIdx", ctxIdx)
+	}
 	// TODO: Implement
 	if binarization.UseDecodeBypass == 1 {
 		// TODO: 9.3.3.2.3 : DecodeBypass()
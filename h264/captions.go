@@ -0,0 +1,189 @@
+package h264
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ITU-T T.35 and ATSC A/53 Part 4 identifiers of caption data
+const (
+	T35_COUNTRY_CODE_USA = 0xb5
+	T35_PROVIDER_ATSC    = 0x0031
+	ATSC_USER_ID_GA94    = 0x47413934
+	ATSC_USER_DATA_CC    = 0x03
+	CC_TYPE_608_FIELD_1  = 0
+	CC_TYPE_608_FIELD_2  = 1
+	CC_TYPE_708_DATA     = 2
+	CC_TYPE_708_START    = 3
+	t35CountryCodeEscape = 0xff
+	// Used when the SPS does not bound reordering; the largest DPB
+	defaultReorderFrames = 16
+)
+
+func init() {
+	RegisterSEIDecoder(SEI_TYPE_USER_DATA_REGISTERED_ITU_T_T35, decodeUserDataRegisteredT35)
+}
+
+// UserDataRegisteredT35 is the user_data_registered_itu_t_t35 payload,
+// D.1.5. CC holds the cc_data triplets when the payload is ATSC A/53 GA94
+// caption data.
+type UserDataRegisteredT35 struct {
+	CountryCode          int
+	CountryCodeExtension int
+	// Data is everything after the country code
+	Data []byte
+	CC   []CCTriplet
+}
+
+// CCTriplet is one cc_data_pkt of CEA-708 section 4.4. Type is one of the
+// CC_TYPE values; Data holds the two bytes with their parity bits.
+type CCTriplet struct {
+	Valid bool
+	Type  int
+	Data  [2]byte
+}
+
+func decodeUserDataRegisteredT35(videoStream *VideoStream, b *BitReader) (interface{}, error) {
+	t35 := UserDataRegisteredT35{
+		CountryCode: b.NextField("ITUTT35CountryCode", 8),
+	}
+	if t35.CountryCode == t35CountryCodeEscape {
+		t35.CountryCodeExtension = b.NextField("ITUTT35CountryCodeExtensionByte", 8)
+	}
+	if err := b.Err(); err != nil {
+		return nil, fmt.Errorf("user data registered: %w", err)
+	}
+	t35.Data = b.Bytes()[b.byteOffset:]
+	if t35.CountryCode != T35_COUNTRY_CODE_USA {
+		return t35, nil
+	}
+	// ATSC A/53 Part 4 Table 6.4 ATSC1_data
+	if b.NextField("ITUTT35ProviderCode", 16) != T35_PROVIDER_ATSC ||
+		b.NextField("UserIdentifier", 32) != ATSC_USER_ID_GA94 ||
+		b.NextField("UserDataTypeCode", 8) != ATSC_USER_DATA_CC {
+		return t35, nil
+	}
+	cc, err := parseCCData(b)
+	if err != nil {
+		return nil, err
+	}
+	t35.CC = cc
+	return t35, nil
+}
+
+// CEA-708 section 4.4 cc_data
+func parseCCData(b *BitReader) ([]CCTriplet, error) {
+	b.NextField("ProcessEmDataFlag", 1)
+	processCCData := b.NextField("ProcessCCDataFlag", 1)
+	b.NextField("AdditionalDataFlag", 1)
+	ccCount := b.NextField("CCCount", 5)
+	b.NextField("EmData", 8)
+	triplets := make([]CCTriplet, 0, ccCount)
+	for i := 0; i < ccCount; i++ {
+		b.NextField("MarkerBits", 5)
+		triplet := CCTriplet{
+			Valid: b.NextField("CCValid", 1) == 1,
+			Type:  b.NextField("CCType", 2),
+		}
+		triplet.Data[0] = byte(b.NextField("CCData1", 8))
+		triplet.Data[1] = byte(b.NextField("CCData2", 8))
+		triplets = append(triplets, triplet)
+	}
+	if err := b.Err(); err != nil {
+		return nil, fmt.Errorf("cc_data: %w", err)
+	}
+	if processCCData == 0 {
+		return nil, nil
+	}
+	return triplets, nil
+}
+
+// CCData returns the cc_data triplets carried by the picture's SEI
+func (f *Frame) CCData() []CCTriplet {
+	var triplets []CCTriplet
+	for _, message := range f.SEI {
+		if t35, ok := message.Value.(UserDataRegisteredT35); ok {
+			triplets = append(triplets, t35.CC...)
+		}
+	}
+	return triplets
+}
+
+// CaptionExtractor is a FrameHandler that hands the cc_data of each
+// picture to Handler in display order. Call Flush at the end of the
+// stream.
+type CaptionExtractor struct {
+	// Handler receives pictures in display order. index counts them from 0.
+	Handler func(index int, frame *Frame, triplets []CCTriplet)
+	order   DisplayOrder
+	next    int
+}
+
+func (c *CaptionExtractor) HandleFrame(frame *Frame) {
+	c.order.Handler = FrameHandlerFunc(c.output)
+	c.order.HandleFrame(frame)
+}
+
+// Flush outputs every held picture
+func (c *CaptionExtractor) Flush() {
+	c.order.Handler = FrameHandlerFunc(c.output)
+	c.order.Flush()
+}
+
+func (c *CaptionExtractor) output(frame *Frame) {
+	if c.Handler != nil {
+		c.Handler(c.next, frame, frame.CCData())
+	}
+	c.next++
+}
+
+// DisplayOrder is a FrameHandler that hands pictures to Handler in
+// display order. Pictures arrive in decoding order and are held until the
+// SPS reorder depth allows them out. Call Flush at the end of the stream.
+type DisplayOrder struct {
+	Handler FrameHandler
+	pending []*Frame
+}
+
+func (d *DisplayOrder) HandleFrame(frame *Frame) {
+	if frame.IDR || frame.MMCO5 {
+		// Picture order count restarts; everything held is output first
+		d.Flush()
+	}
+	d.pending = append(d.pending, frame)
+	sort.SliceStable(d.pending, func(i, j int) bool {
+		return d.pending[i].PicOrderCnt < d.pending[j].PicOrderCnt
+	})
+	for len(d.pending) > reorderFrames(frame.SPS) {
+		d.output()
+	}
+}
+
+// Flush outputs every held picture
+func (d *DisplayOrder) Flush() {
+	for len(d.pending) > 0 {
+		d.output()
+	}
+}
+
+func (d *DisplayOrder) output() {
+	frame := d.pending[0]
+	d.pending = d.pending[1:]
+	d.Handler.HandleFrame(frame)
+}
+
+// Pictures that may precede a picture in display order while following it
+// in decoding order, E.2.1 max_num_reorder_frames
+func reorderFrames(sps *SPS) int {
+	if sps == nil {
+		return defaultReorderFrames
+	}
+	if sps.BitstreamRestriction {
+		return sps.MaxNumReorderFrames
+	}
+	if sps.Profile == PROFILE_IDC_BASELINE {
+		// No B slices, so decoding order is display order
+		return 0
+	}
+	return defaultReorderFrames
+}
@@ -0,0 +1,350 @@
+package h264
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// CEA-608 caption memory is 15 rows of 32 columns
+const (
+	cea608Rows    = 15
+	cea608Columns = 32
+)
+
+// CEA-608 caption modes
+const (
+	cea608PopOn = iota
+	cea608RollUp
+	cea608PaintOn
+)
+
+// Cue is caption text shown from Start until End
+type Cue struct {
+	Start, End time.Duration
+	Text       string
+}
+
+// CEA608Decoder turns the cc_data byte pairs of one caption channel into
+// cues. Channels 1 and 2 are carried in field 1, channels 3 and 4 in
+// field 2. Pop-on, roll-up and paint-on captions are supported; styles and
+// colours are dropped.
+type CEA608Decoder struct {
+	Channel int
+	// Cues holds every cue that has ended
+	Cues []Cue
+
+	displayed, nonDisplayed [cea608Rows][cea608Columns]rune
+	mode                    int
+	rollUpRows              int
+	row, column             int
+	// dataChannel is the channel of the last control code in the field;
+	// characters belong to it
+	dataChannel int
+	// lastControl suppresses the redundant copy of a control code
+	lastControl [2]byte
+	cue         *Cue
+}
+
+func NewCEA608Decoder(channel int) *CEA608Decoder {
+	return &CEA608Decoder{
+		Channel:     channel,
+		row:         cea608Rows - 1,
+		dataChannel: 1,
+	}
+}
+
+// Decode processes the triplets of the picture displayed at t
+func (d *CEA608Decoder) Decode(t time.Duration, triplets []CCTriplet) {
+	field := CC_TYPE_608_FIELD_1
+	if d.Channel > 2 {
+		field = CC_TYPE_608_FIELD_2
+	}
+	for _, triplet := range triplets {
+		if !triplet.Valid || triplet.Type != field {
+			continue
+		}
+		d.decodePair(t, triplet.Data[0]&0x7f, triplet.Data[1]&0x7f)
+	}
+}
+
+// Flush ends the cue on screen at t
+func (d *CEA608Decoder) Flush(t time.Duration) {
+	d.endCue(t)
+}
+
+func (d *CEA608Decoder) channelInField() int {
+	return (d.Channel-1)%2 + 1
+}
+
+func (d *CEA608Decoder) decodePair(t time.Duration, b1, b2 byte) {
+	if b1 == 0 && b2 == 0 {
+		return
+	}
+	if b1 >= 0x10 && b1 <= 0x1f {
+		pair := [2]byte{b1, b2}
+		if pair == d.lastControl {
+			// Control codes are sent twice
+			d.lastControl = [2]byte{}
+			return
+		}
+		d.lastControl = pair
+		d.dataChannel = 1
+		if b1&0x08 != 0 {
+			d.dataChannel = 2
+		}
+		if d.dataChannel != d.channelInField() {
+			return
+		}
+		d.control(t, b1&^0x08, b2)
+		return
+	}
+	d.lastControl = [2]byte{}
+	if d.dataChannel != d.channelInField() {
+		return
+	}
+	d.putChar(cea608Standard(b1))
+	if b2 >= 0x20 {
+		d.putChar(cea608Standard(b2))
+	}
+}
+
+// b1 has the channel bit cleared
+func (d *CEA608Decoder) control(t time.Duration, b1, b2 byte) {
+	switch {
+	case (b1 == 0x14 || b1 == 0x15) && b2 >= 0x20 && b2 <= 0x2f:
+		d.command(t, b2)
+	case b1 == 0x17 && b2 >= 0x21 && b2 <= 0x23:
+		// Tab offsets
+		d.column += int(b2 - 0x20)
+		if d.column >= cea608Columns {
+			d.column = cea608Columns - 1
+		}
+	case b1 == 0x11 && b2 >= 0x30 && b2 <= 0x3f:
+		d.putChar(cea608Special[b2-0x30])
+	case (b1 == 0x12 || b1 == 0x13) && b2 >= 0x20 && b2 <= 0x3f:
+		// Extended characters replace the standard fallback sent before
+		if d.column > 0 {
+			d.column--
+		}
+		if b1 == 0x12 {
+			d.putChar(cea608ExtendedSpanishFrench[b2-0x20])
+		} else {
+			d.putChar(cea608ExtendedPortugueseGerman[b2-0x20])
+		}
+	case b1 == 0x11 && b2 >= 0x20 && b2 <= 0x2f:
+		// Mid-row style codes show as a space
+		d.putChar(' ')
+	case b2 >= 0x40 && b2 <= 0x7f:
+		d.preambleAddress(b1, b2)
+	}
+}
+
+// Table 50 miscellaneous control codes
+func (d *CEA608Decoder) command(t time.Duration, code byte) {
+	switch code {
+	case 0x20: // RCL resume caption loading
+		d.mode = cea608PopOn
+	case 0x21: // BS backspace
+		if d.column > 0 {
+			d.column--
+			d.memory()[d.row][d.column] = 0
+		}
+	case 0x24: // DER delete to end of row
+		for c := d.column; c < cea608Columns; c++ {
+			d.memory()[d.row][c] = 0
+		}
+	case 0x25, 0x26, 0x27: // RU2, RU3, RU4 roll-up captions
+		if d.mode != cea608RollUp {
+			d.displayed = [cea608Rows][cea608Columns]rune{}
+			d.nonDisplayed = [cea608Rows][cea608Columns]rune{}
+			d.row = cea608Rows - 1
+		}
+		d.mode = cea608RollUp
+		d.rollUpRows = int(code-0x25) + 2
+		d.column = 0
+	case 0x29: // RDC resume direct captioning
+		d.mode = cea608PaintOn
+	case 0x2c: // EDM erase displayed memory
+		d.displayed = [cea608Rows][cea608Columns]rune{}
+	case 0x2d: // CR carriage return
+		if d.mode == cea608RollUp {
+			// The finished line is shown until the next one completes
+			d.update(t)
+			top := d.row - d.rollUpRows + 1
+			if top < 0 {
+				top = 0
+			}
+			for r := top; r < d.row; r++ {
+				d.displayed[r] = d.displayed[r+1]
+			}
+			d.displayed[d.row] = [cea608Columns]rune{}
+			for r := 0; r < top; r++ {
+				d.displayed[r] = [cea608Columns]rune{}
+			}
+			d.column = 0
+			return
+		}
+		if d.row < cea608Rows-1 {
+			d.row++
+		}
+		d.column = 0
+	case 0x2e: // ENM erase non-displayed memory
+		d.nonDisplayed = [cea608Rows][cea608Columns]rune{}
+	case 0x2f: // EOC end of caption
+		d.displayed, d.nonDisplayed = d.nonDisplayed, d.displayed
+		d.mode = cea608PopOn
+	}
+	d.update(t)
+}
+
+// Table 53 preamble address codes
+func (d *CEA608Decoder) preambleAddress(b1, b2 byte) {
+	rows := map[byte]int{0x11: 0, 0x12: 2, 0x15: 4, 0x16: 6, 0x17: 8, 0x10: 10, 0x13: 11, 0x14: 13}
+	row, ok := rows[b1]
+	if !ok {
+		return
+	}
+	if b2&0x20 != 0 && b1 != 0x10 {
+		row++
+	}
+	if d.mode == cea608RollUp && row != d.row {
+		// The roll-up window moves with its base row
+		moved := [cea608Rows][cea608Columns]rune{}
+		for i := 0; i < d.rollUpRows; i++ {
+			from, to := d.row-i, row-i
+			if from >= 0 && to >= 0 {
+				moved[to] = d.displayed[from]
+			}
+		}
+		d.displayed = moved
+	}
+	d.row = row
+	d.column = 0
+	if b2&0x10 != 0 {
+		d.column = int(b2&0x0e) >> 1 * 4
+	}
+}
+
+// Pop-on captions are built off screen
+func (d *CEA608Decoder) memory() *[cea608Rows][cea608Columns]rune {
+	if d.mode == cea608PopOn {
+		return &d.nonDisplayed
+	}
+	return &d.displayed
+}
+
+func (d *CEA608Decoder) putChar(r rune) {
+	d.memory()[d.row][d.column] = r
+	if d.column < cea608Columns-1 {
+		d.column++
+	}
+}
+
+// Starts a new cue when the text on screen changed. Characters drawn
+// directly on screen are picked up at the next control code.
+func (d *CEA608Decoder) update(t time.Duration) {
+	text := d.screenText()
+	if d.cue != nil && d.cue.Text == text {
+		return
+	}
+	d.endCue(t)
+	if text != "" {
+		d.cue = &Cue{Start: t, Text: text}
+	}
+}
+
+func (d *CEA608Decoder) endCue(t time.Duration) {
+	if d.cue == nil {
+		return
+	}
+	if t > d.cue.Start {
+		d.cue.End = t
+		d.Cues = append(d.Cues, *d.cue)
+	}
+	d.cue = nil
+}
+
+func (d *CEA608Decoder) screenText() string {
+	lines := []string{}
+	for _, row := range d.displayed {
+		line := strings.Builder{}
+		for _, r := range row {
+			if r == 0 {
+				r = ' '
+			}
+			line.WriteRune(r)
+		}
+		if text := strings.TrimSpace(line.String()); text != "" {
+			lines = append(lines, text)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Table 49, the standard set differs from ASCII in a few places
+func cea608Standard(b byte) rune {
+	switch b {
+	case 0x2a:
+		return 'á'
+	case 0x5c:
+		return 'é'
+	case 0x5e:
+		return 'í'
+	case 0x5f:
+		return 'ó'
+	case 0x60:
+		return 'ú'
+	case 0x7b:
+		return 'ç'
+	case 0x7c:
+		return '÷'
+	case 0x7d:
+		return 'Ñ'
+	case 0x7e:
+		return 'ñ'
+	case 0x7f:
+		return '█'
+	}
+	return rune(b)
+}
+
+var (
+	// Table 50 special characters, 0x1130 to 0x113f
+	cea608Special = []rune("®°½¿™¢£♪à èâêîôû")
+	// Table 5 and 6 extended characters, 0x1220 to 0x123f
+	cea608ExtendedSpanishFrench = []rune("ÁÉÓÚÜü‘¡*'—©℠•“”ÀÂÇÈÊËëÎÏïÔÙùÛ«»")
+	// 0x1320 to 0x133f
+	cea608ExtendedPortugueseGerman = []rune("ÃãÍÌìÒòÕõ{}\\^_|~ÄäÖöß¥¤│ÅåØø┌┐└┘")
+)
+
+// WriteSRT writes cues as SubRip
+func WriteSRT(w io.Writer, cues []Cue) error {
+	for i, cue := range cues {
+		_, err := fmt.Fprintf(w, "%d\n%s --> %s\n%s\n\n", i+1, cueTimestamp(cue.Start, ","), cueTimestamp(cue.End, ","), cue.Text)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteWebVTT writes cues as a WebVTT file
+func WriteWebVTT(w io.Writer, cues []Cue) error {
+	if _, err := io.WriteString(w, "WEBVTT\n\n"); err != nil {
+		return err
+	}
+	for _, cue := range cues {
+		_, err := fmt.Fprintf(w, "%s --> %s\n%s\n\n", cueTimestamp(cue.Start, "."), cueTimestamp(cue.End, "."), cue.Text)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cueTimestamp(t time.Duration, fractionSeparator string) string {
+	ms := t.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, fractionSeparator, ms%1000)
+}
@@ -0,0 +1,97 @@
+package h264
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// Sets odd parity on a CEA-608 byte
+func parity(b byte) byte {
+	ones := 0
+	for v := b; v != 0; v >>= 1 {
+		ones += int(v & 1)
+	}
+	if ones%2 == 0 {
+		b |= 0x80
+	}
+	return b
+}
+
+func cc608(pairs ...[2]byte) []CCTriplet {
+	triplets := []CCTriplet{}
+	for _, pair := range pairs {
+		triplets = append(triplets, CCTriplet{Valid: true, Type: CC_TYPE_608_FIELD_1, Data: [2]byte{parity(pair[0]), parity(pair[1])}})
+	}
+	return triplets
+}
+
+func TestGA94CaptionSEI(t *testing.T) {
+	payload := []byte{T35_COUNTRY_CODE_USA, 0x00, 0x31, 'G', 'A', '9', '4', ATSC_USER_DATA_CC,
+		0x40 | 2, 0xff,
+		0xfc, 0x94, 0x20,
+		0xfd, 0x80, 0x80,
+		0xff}
+	rbsp := append([]byte{SEI_TYPE_USER_DATA_REGISTERED_ITU_T_T35, byte(len(payload))}, payload...)
+	rbsp = append(rbsp, 0x80)
+	messages, err := NewSEI(nil, rbsp)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	frame := &Frame{SEI: messages}
+	cc := frame.CCData()
+	if len(cc) != 2 {
+		t.Fatalf("expected 2 triplets, got %+v\n", cc)
+	}
+	if !cc[0].Valid || cc[0].Type != CC_TYPE_608_FIELD_1 || cc[0].Data != [2]byte{0x94, 0x20} {
+		t.Fatalf("unexpected first triplet %+v\n", cc[0])
+	}
+	if cc[1].Type != CC_TYPE_608_FIELD_2 {
+		t.Fatalf("unexpected second triplet %+v\n", cc[1])
+	}
+}
+
+func TestCEA608PopOn(t *testing.T) {
+	d := NewCEA608Decoder(1)
+	rcl := [2]byte{0x14, 0x20}
+	eoc := [2]byte{0x14, 0x2f}
+	edm := [2]byte{0x14, 0x2c}
+	// Row 15 preamble, then HI! with a backspaced typo
+	d.Decode(0, cc608(rcl, rcl, [2]byte{0x14, 0x70}, [2]byte{'H', 'I'}, [2]byte{'?', 0}))
+	d.Decode(time.Second/2, cc608([2]byte{0x14, 0x21}, [2]byte{'!', 0}))
+	d.Decode(time.Second, cc608(eoc, eoc))
+	d.Decode(3*time.Second, cc608(edm, edm))
+	d.Flush(4 * time.Second)
+	if len(d.Cues) != 1 {
+		t.Fatalf("expected 1 cue, got %+v\n", d.Cues)
+	}
+	want := Cue{Start: time.Second, End: 3 * time.Second, Text: "HI!"}
+	if d.Cues[0] != want {
+		t.Fatalf("expected %+v, got %+v\n", want, d.Cues[0])
+	}
+
+	srt := &bytes.Buffer{}
+	if err := WriteSRT(srt, d.Cues); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if s := srt.String(); s != "1\n00:00:01,000 --> 00:00:03,000\nHI!\n\n" {
+		t.Fatalf("unexpected SRT %q\n", s)
+	}
+}
+
+func TestCEA608RollUp(t *testing.T) {
+	d := NewCEA608Decoder(1)
+	ru2 := [2]byte{0x14, 0x25}
+	cr := [2]byte{0x14, 0x2d}
+	d.Decode(0, cc608(ru2, [2]byte{'A', 'B'}, cr))
+	d.Decode(time.Second, cc608([2]byte{'C', 'D'}, cr))
+	d.Decode(2*time.Second, cc608([2]byte{'E', 'F'}, cr))
+	d.Flush(3 * time.Second)
+	texts := []string{}
+	for _, cue := range d.Cues {
+		texts = append(texts, cue.Text)
+	}
+	if len(texts) != 3 || texts[0] != "AB" || texts[1] != "AB\nCD" || texts[2] != "CD\nEF" {
+		t.Fatalf("unexpected roll-up cues %q\n", texts)
+	}
+}
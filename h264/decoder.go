@@ -0,0 +1,94 @@
+package h264
+
+import (
+	"io"
+	"log/slog"
+)
+
+// Decoder holds the options used to read H.264 streams. Logging is
+// disabled unless a logger is supplied with WithLogger.
+type Decoder struct {
+	logger        *slog.Logger
+	tracer        SyntaxTracer
+	frameHandler  FrameHandler
+	framing       int
+	nalLengthSize int
+	avcConfig     *AVCDecoderConfigurationRecord
+}
+
+type DecoderOption func(*Decoder)
+
+// WithLogger sends decoder logs to logger. Levels are those of log/slog:
+// per syntax element detail is Debug, per picture events are Info and
+// skipped NAL units are Warn.
+func WithLogger(logger *slog.Logger) DecoderOption {
+	return func(d *Decoder) {
+		d.logger = logger
+	}
+}
+
+// WithSyntaxTracer calls tracer for every fixed length syntax element read
+func WithSyntaxTracer(tracer SyntaxTracer) DecoderOption {
+	return func(d *Decoder) {
+		d.tracer = tracer
+	}
+}
+
+// WithFrameHandler hands each completed picture to handler
+func WithFrameHandler(handler FrameHandler) DecoderOption {
+	return func(d *Decoder) {
+		d.frameHandler = handler
+	}
+}
+
+// WithFraming sets how NAL units are delimited in the input, one of the
+// FRAMING_ constants. By default it is detected.
+func WithFraming(framing int) DecoderOption {
+	return func(d *Decoder) {
+		d.framing = framing
+	}
+}
+
+// WithNALLengthSize sets the size of the NAL unit length field of AVCC
+// input, 1, 2 or 4 bytes. It is 4 when not set.
+func WithNALLengthSize(size int) DecoderOption {
+	return func(d *Decoder) {
+		d.nalLengthSize = size
+	}
+}
+
+// WithAVCDecoderConfigurationRecord decodes AVCC samples using the length
+// size and parameter sets of record, as taken from an avcC box
+func WithAVCDecoderConfigurationRecord(record *AVCDecoderConfigurationRecord) DecoderOption {
+	return func(d *Decoder) {
+		d.avcConfig = record
+	}
+}
+
+func NewDecoder(opts ...DecoderOption) *Decoder {
+	d := &Decoder{}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// NewReader returns an H264Reader over stream using the decoder's options
+func (d *Decoder) NewReader(stream io.Reader) *H264Reader {
+	h := &H264Reader{
+		Stream:        stream,
+		BitReader:     &BitReader{bytes: []byte{}, log: d.logger, trace: d.tracer},
+		FrameHandler:  d.frameHandler,
+		Framing:       d.framing,
+		NALLengthSize: d.nalLengthSize,
+	}
+	if d.avcConfig != nil {
+		h.useAVCDecoderConfigurationRecord(d.avcConfig)
+	}
+	return h
+}
+
+// Decode reads stream until it ends. The end of the stream is not an error.
+func (d *Decoder) Decode(stream io.Reader) error {
+	return d.NewReader(stream).Decode()
+}
@@ -0,0 +1,45 @@
+package h264
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrTruncated is returned when a syntax structure runs past the end of
+	// its NAL unit or RBSP
+	ErrTruncated = errors.New("h264: truncated data")
+	// ErrUnsupportedProfile is returned for a profile_idc this package
+	// cannot parse
+	ErrUnsupportedProfile = errors.New("h264: unsupported profile")
+)
+
+// ErrInvalidValue reports a syntax element outside the semantic limits of
+// clause 7.4. Range is inclusive.
+type ErrInvalidValue struct {
+	Field string
+	Value int
+	Range [2]int
+}
+
+func (e ErrInvalidValue) Error() string {
+	return fmt.Sprintf("h264: %s value %d outside %d..%d", e.Field, e.Value, e.Range[0], e.Range[1])
+}
+
+// Returns an ErrInvalidValue when v is outside min..max inclusive
+func checkRange(field string, v, min, max int) error {
+	if v < min || v > max {
+		return ErrInvalidValue{Field: field, Value: v, Range: [2]int{min, max}}
+	}
+	return nil
+}
+
+// Returns the first of errs that is not nil
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
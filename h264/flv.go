@@ -0,0 +1,176 @@
+package h264
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// ErrInvalidFLV is returned for a file or tag that is not FLV
+var ErrInvalidFLV = errors.New("h264: invalid FLV data")
+
+// FLV tag types, E.4.1 of the FLV specification version 10.1, and RTMP
+// message types for the same payloads
+const (
+	flvTagAudio  = 8
+	flvTagVideo  = 9
+	flvTagScript = 18
+)
+
+// The VIDEODATA header, E.4.3.1: FrameType in the high nibble and CodecID
+// in the low one, then AVCPacketType and CompositionTime for AVC
+const (
+	flvFrameKeyframe = 1
+	flvFrameCommand  = 5
+	flvCodecAVC      = 7
+
+	flvAVCSequenceHeader = 0
+	flvAVCNalu           = 1
+	flvAVCEndOfSequence  = 2
+)
+
+// flvVideo turns the VIDEODATA of FLV tags and RTMP video messages into
+// samples. The avcC record of the AVC sequence header gives the NAL unit
+// length size, and its parameter sets lead the next sample.
+type flvVideo struct {
+	config *AVCDecoderConfigurationRecord
+	// newConfig is set until the parameter sets of config are sent
+	newConfig bool
+	// warned is set once frames of another codec are reported
+	warned bool
+}
+
+// Returns the sample of the VIDEODATA of a tag with timestamp, the DTS,
+// or nil for tags without pictures
+func (v *flvVideo) sample(data []byte, timestamp time.Duration, logger *slog.Logger) (*Sample, error) {
+	if len(data) < 1 {
+		return nil, fmt.Errorf("%w: empty video tag", ErrInvalidFLV)
+	}
+	frameType, codec := int(data[0]>>4), int(data[0]&0x0f)
+	if frameType == flvFrameCommand {
+		return nil, nil
+	}
+	if codec != flvCodecAVC {
+		if !v.warned {
+			logger.Warn("skipping video that is not H.264", "codec", codec)
+			v.warned = true
+		}
+		return nil, nil
+	}
+	if len(data) < 5 {
+		return nil, fmt.Errorf("%w: AVC video tag of %d bytes", ErrInvalidFLV, len(data))
+	}
+	// CompositionTime is a signed 24 bit millisecond offset
+	compositionTime := int32(uint32(data[2])<<24|uint32(data[3])<<16|uint32(data[4])<<8) >> 8
+	switch data[1] {
+	case flvAVCSequenceHeader:
+		config, err := NewAVCDecoderConfigurationRecord(data[5:])
+		if err != nil {
+			return nil, err
+		}
+		v.config, v.newConfig = config, true
+		logger.Info("AVC sequence header", "profile", config.AVCProfileIndication, "level", config.AVCLevelIndication, "length_size", config.LengthSize())
+		return nil, nil
+	case flvAVCNalu:
+	default:
+		return nil, nil
+	}
+	if v.config == nil {
+		return nil, fmt.Errorf("%w: AVC NALUs before the sequence header", ErrInvalidFLV)
+	}
+	nalUnits, err := SplitLengthPrefixed(data[5:], v.config.LengthSize())
+	if err != nil {
+		return nil, err
+	}
+	sample := &Sample{
+		DTS:         timestamp,
+		PTS:         timestamp + time.Duration(compositionTime)*time.Millisecond,
+		Timestamped: true,
+		Keyframe:    frameType == flvFrameKeyframe,
+	}
+	if v.newConfig {
+		for _, parameterSets := range [][][]byte{v.config.SPS, v.config.PPS, v.config.SPSExt} {
+			sample.NalUnits = append(sample.NalUnits, parameterSets...)
+		}
+		v.newConfig = false
+	}
+	sample.NalUnits = append(sample.NalUnits, nalUnits...)
+	return sample, nil
+}
+
+// FLVDemuxer reads the H.264 video of an FLV file, Annex E of the FLV
+// specification, a tag at a time. Other tags are skipped.
+//
+//	err := NewDecoder(WithFrameHandler(handler)).DecodeSamples(NewFLVDemuxer(file))
+type FLVDemuxer struct {
+	Logger *slog.Logger
+
+	r io.Reader
+	// headerRead is set once the FLV header is read
+	headerRead bool
+	video      flvVideo
+}
+
+// NewFLVDemuxer returns a demuxer reading r from its FLV header
+func NewFLVDemuxer(r io.Reader) *FLVDemuxer {
+	return &FLVDemuxer{r: r}
+}
+
+func (d *FLVDemuxer) logger() *slog.Logger {
+	if d.Logger == nil {
+		return discardLogger
+	}
+	return d.Logger
+}
+
+// ReadSample returns the next H.264 access unit of the file
+func (d *FLVDemuxer) ReadSample() (*Sample, error) {
+	if !d.headerRead {
+		// E.2 then PreviousTagSize0
+		header := make([]byte, 9)
+		if _, err := io.ReadFull(d.r, header); err != nil {
+			return nil, fmt.Errorf("%w: header: %v", ErrInvalidFLV, err)
+		}
+		if string(header[:3]) != "FLV" {
+			return nil, fmt.Errorf("%w: signature %q", ErrInvalidFLV, header[:3])
+		}
+		offset := int64(be32(header[5:]))
+		if offset < 9 {
+			return nil, fmt.Errorf("%w: header of %d bytes", ErrInvalidFLV, offset)
+		}
+		if _, err := io.CopyN(io.Discard, d.r, offset-9+4); err != nil {
+			return nil, fmt.Errorf("%w: header: %v", ErrInvalidFLV, err)
+		}
+		d.headerRead = true
+	}
+	header := make([]byte, 11)
+	for {
+		// E.4.1, each tag followed by its PreviousTagSize
+		if _, err := io.ReadFull(d.r, header); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return nil, err
+		}
+		size := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+		timestamp := uint32(header[7])<<24 | uint32(header[4])<<16 | uint32(header[5])<<8 | uint32(header[6])
+		data := make([]byte, size+4)
+		if _, err := io.ReadFull(d.r, data); err != nil {
+			// A file cut short ends at its last whole tag
+			return nil, io.EOF
+		}
+		// The Filter bit marks encrypted tags
+		if header[0]&0x20 != 0 || header[0]&0x1f != flvTagVideo {
+			continue
+		}
+		sample, err := d.video.sample(data[:size], time.Duration(timestamp)*time.Millisecond, d.logger())
+		if err != nil {
+			return nil, err
+		}
+		if sample != nil {
+			return sample, nil
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package h264
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// Returns the VIDEODATA of an AVC tag
+func flvVideoTag(frameType, packetType byte, compositionTime int32, data []byte) []byte {
+	return append([]byte{frameType<<4 | flvCodecAVC, packetType,
+		byte(compositionTime >> 16), byte(compositionTime >> 8), byte(compositionTime)}, data...)
+}
+
+type flvTestTag struct {
+	tagType   byte
+	timestamp uint32
+	data      []byte
+}
+
+func flvTestFile(tags ...flvTestTag) []byte {
+	file := []byte{'F', 'L', 'V', 1, 0x05, 0, 0, 0, 9, 0, 0, 0, 0}
+	for _, tag := range tags {
+		size := len(tag.data)
+		file = append(file, tag.tagType, byte(size>>16), byte(size>>8), byte(size),
+			byte(tag.timestamp>>16), byte(tag.timestamp>>8), byte(tag.timestamp), byte(tag.timestamp>>24), 0, 0, 0)
+		file = append(file, tag.data...)
+		file = append(file, mp4Uint32(uint32(11+size))...)
+	}
+	return file
+}
+
+func TestFLVDemuxer(t *testing.T) {
+	// Timestamps past 24 bits use TimestampExtended
+	base := uint32(0xffffe0)
+	file := flvTestFile(
+		flvTestTag{flvTagScript, 0, []byte{amf0String, 0, 10, 'o', 'n', 'M', 'e', 't', 'a', 'D', 'a', 't', 'a'}},
+		flvTestTag{flvTagVideo, base, flvVideoTag(flvFrameKeyframe, flvAVCSequenceHeader, 0, mp4TestConfig(t).Bytes())},
+		flvTestTag{flvTagAudio, base, []byte{0xaf, 1, 0x21}},
+		flvTestTag{flvTagVideo, base, flvVideoTag(flvFrameKeyframe, flvAVCNalu, 80,
+			lengthPrefixed(4, recoveryPointSEI(), nal(0x41, bitsToBytes(pSliceBits(1)))))},
+		flvTestTag{flvTagVideo, base + 40, flvVideoTag(2, flvAVCNalu, -40+80,
+			lengthPrefixed(4, nal(0x41, bitsToBytes(pSliceBits(2)))))},
+	)
+	// A file cut short ends at its last whole tag
+	file = append(file, flvTagVideo, 0, 1)
+
+	var frames frameList
+	if err := NewDecoder(WithFrameHandler(&frames)).DecodeSamples(NewFLVDemuxer(bytes.NewReader(file))); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("expected 2 pictures, got %d\n", len(frames))
+	}
+	dts := time.Duration(base) * time.Millisecond
+	for i, want := range [][2]time.Duration{{dts, dts + 80*time.Millisecond}, {dts + 40*time.Millisecond, dts + 80*time.Millisecond}} {
+		if frames[i].FrameNum != i+1 || frames[i].DTS != want[0] || frames[i].PTS != want[1] {
+			t.Fatalf("picture %d: expected DTS %v PTS %v, got %d %v %v\n", i, want[0], want[1], frames[i].FrameNum, frames[i].DTS, frames[i].PTS)
+		}
+	}
+}
+
+func TestFLVDemuxerNegativeCompositionTime(t *testing.T) {
+	v := &flvVideo{config: mp4TestConfig(t)}
+	sample, err := v.sample(flvVideoTag(2, flvAVCNalu, -40, lengthPrefixed(4, nal(0x41, bitsToBytes(pSliceBits(2))))), time.Second, discardLogger)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if sample.PTS != 960*time.Millisecond || sample.Keyframe {
+		t.Fatalf("unexpected sample %+v\n", sample)
+	}
+}
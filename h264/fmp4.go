@@ -0,0 +1,204 @@
+package h264
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Fragmented MP4, ISO/IEC 14496-12 with the AVC file format of ISO/IEC
+// 14496-15. Video uses the 90 kHz MPEG clock as its timescale.
+const fmp4Timescale = 90000
+
+// sample_flags of the trun box, 8.8.3.1: a sync sample depends on no other
+// sample, any other is a non sync sample depending on others
+const (
+	fmp4SyncSampleFlags    = 0x02000000
+	fmp4NonSyncSampleFlags = 0x01010000
+)
+
+// fmp4Sample is one access unit of a fragment
+type fmp4Sample struct {
+	// data holds the NAL units with 4 byte lengths
+	data []byte
+	// duration and compositionOffset are in fmp4Timescale units
+	duration          uint32
+	compositionOffset int32
+	sync              bool
+}
+
+func mp4Box(boxType string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	box := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(box, uint32(size))
+	copy(box[4:], boxType)
+	for _, p := range payload {
+		box = append(box, p...)
+	}
+	return box
+}
+
+func mp4FullBox(boxType string, version byte, flags uint32, payload ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return mp4Box(boxType, append([][]byte{header}, payload...)...)
+}
+
+// The unity transformation matrix of mvhd and tkhd, 8.2.2.3
+var mp4UnityMatrix = []byte{
+	0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0, 0, 0,
+}
+
+// Returns the ftyp and moov boxes of a single video track of the given
+// display size described by config
+func fmp4InitSegment(config *AVCDecoderConfigurationRecord, width, height int) []byte {
+	ftyp := mp4Box("ftyp", []byte("iso5"), []byte{0, 0, 2, 0}, []byte("iso5iso6mp41avc1"))
+
+	mvhd := mp4FullBox("mvhd", 0, 0,
+		make([]byte, 8), mp4Uint32(1000), make([]byte, 4),
+		[]byte{0, 1, 0, 0, 1, 0}, make([]byte, 10), mp4UnityMatrix, make([]byte, 24), mp4Uint32(2))
+	// track_enabled | track_in_movie
+	tkhd := mp4FullBox("tkhd", 0, 3,
+		make([]byte, 8), mp4Uint32(1), make([]byte, 4), make([]byte, 4),
+		make([]byte, 8), make([]byte, 8), mp4UnityMatrix,
+		mp4Uint32(uint32(width)<<16), mp4Uint32(uint32(height)<<16))
+	// language und
+	mdhd := mp4FullBox("mdhd", 0, 0, make([]byte, 8), mp4Uint32(fmp4Timescale), make([]byte, 4), []byte{0x55, 0xc4, 0, 0})
+	hdlr := mp4FullBox("hdlr", 0, 0, make([]byte, 4), []byte("vide"), make([]byte, 12), []byte("VideoHandler\x00"))
+	vmhd := mp4FullBox("vmhd", 0, 1, make([]byte, 8))
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, mp4Uint32(1), mp4FullBox("url ", 0, 1)))
+
+	// 14496-15 5.4.2.1 with the VisualSampleEntry of 14496-12 12.1.3
+	avc1 := mp4Box("avc1",
+		make([]byte, 6), []byte{0, 1}, make([]byte, 16),
+		[]byte{byte(width >> 8), byte(width), byte(height >> 8), byte(height)},
+		[]byte{0, 0x48, 0, 0, 0, 0x48, 0, 0}, make([]byte, 4), []byte{0, 1},
+		make([]byte, 32), []byte{0, 0x18, 0xff, 0xff},
+		mp4Box("avcC", config.Bytes()))
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, mp4Uint32(1), avc1),
+		mp4FullBox("stts", 0, 0, mp4Uint32(0)),
+		mp4FullBox("stsc", 0, 0, mp4Uint32(0)),
+		mp4FullBox("stsz", 0, 0, mp4Uint32(0), mp4Uint32(0)),
+		mp4FullBox("stco", 0, 0, mp4Uint32(0)))
+	trak := mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, mp4Box("minf", vmhd, dinf, stbl)))
+	// Samples default to description 1, 8.8.3
+	trex := mp4FullBox("trex", 0, 0, mp4Uint32(1), mp4Uint32(1), mp4Uint32(0), mp4Uint32(0), mp4Uint32(0))
+	moov := mp4Box("moov", mvhd, trak, mp4Box("mvex", trex))
+	return append(ftyp, moov...)
+}
+
+// Returns the moof and mdat boxes of one fragment of track 1 starting at
+// baseDecodeTime
+func fmp4Fragment(sequenceNumber uint32, baseDecodeTime uint64, samples []fmp4Sample) []byte {
+	mfhd := mp4FullBox("mfhd", 0, 0, mp4Uint32(sequenceNumber))
+	// default-base-is-moof
+	tfhd := mp4FullBox("tfhd", 0, 0x020000, mp4Uint32(1))
+	tfdt := mp4FullBox("tfdt", 1, 0, binary.BigEndian.AppendUint64(nil, baseDecodeTime))
+
+	// data-offset, sample duration, size, flags and composition time
+	// offset present; version 1 for signed offsets
+	entries := make([]byte, 0, 8+16*len(samples))
+	entries = append(entries, mp4Uint32(uint32(len(samples)))...)
+	entries = append(entries, 0, 0, 0, 0)
+	mdatSize := 8
+	for _, sample := range samples {
+		flags := uint32(fmp4NonSyncSampleFlags)
+		if sample.sync {
+			flags = fmp4SyncSampleFlags
+		}
+		entries = append(entries, mp4Uint32(sample.duration)...)
+		entries = append(entries, mp4Uint32(uint32(len(sample.data)))...)
+		entries = append(entries, mp4Uint32(flags)...)
+		entries = append(entries, mp4Uint32(uint32(sample.compositionOffset))...)
+		mdatSize += len(sample.data)
+	}
+	trun := mp4FullBox("trun", 1, 0x000f01, entries)
+	moof := mp4Box("moof", mfhd, mp4Box("traf", tfhd, tfdt, trun))
+	// data_offset counts from the start of moof to the first sample
+	dataOffset := len(moof) - len(trun) + 12 + 4
+	binary.BigEndian.PutUint32(moof[dataOffset:], uint32(len(moof)+8))
+
+	fragment := make([]byte, 0, len(moof)+mdatSize)
+	fragment = append(fragment, moof...)
+	fragment = binary.BigEndian.AppendUint32(fragment, uint32(mdatSize))
+	fragment = append(fragment, "mdat"...)
+	for _, sample := range samples {
+		fragment = append(fragment, sample.data...)
+	}
+	return fragment
+}
+
+// accessUnit keeps what a muxer needs of a picture while it waits to be
+// written, leaving out the decoded samples
+type accessUnit struct {
+	nalUnits   [][]byte
+	sliceTypes []int
+	idr        bool
+	// sync is set for IDR pictures and the picture decoding started at
+	sync     bool
+	pts, dts time.Duration
+	sps      *SPS
+	pps      *PPS
+}
+
+func newAccessUnit(frame *Frame) accessUnit {
+	au := accessUnit{
+		nalUnits: frame.NalUnits,
+		idr:      frame.IDR,
+		sync:     frame.IDR || frame.RandomAccess != nil,
+		pts:      frame.PTS,
+		dts:      frame.DTS,
+		sps:      frame.SPS,
+		pps:      frame.PPS,
+	}
+	for _, slice := range frame.Slices {
+		au.sliceTypes = append(au.sliceTypes, slice.Slice.Header.SliceType)
+	}
+	return au
+}
+
+// Returns how long the last picture of a stream lasts, which is as long as
+// the one before it: the step from previousDTS to dts, or fallback when
+// the timestamps do not step forward
+func lastPictureDuration(previousDTS, dts, fallback time.Duration) time.Duration {
+	if duration := dts - previousDTS; duration > 0 {
+		return duration
+	}
+	return fallback
+}
+
+// Returns when the last of aus ends
+func lastPictureEnd(aus []accessUnit) time.Duration {
+	n := len(aus)
+	if n < 2 {
+		return aus[n-1].dts
+	}
+	return aus[n-1].dts + lastPictureDuration(aus[n-2].dts, aus[n-1].dts, 0)
+}
+
+// Returns the samples of a fragment of access units, the last of which
+// lasts until end
+func fmp4Samples(aus []accessUnit, end time.Duration) []fmp4Sample {
+	samples := make([]fmp4Sample, len(aus))
+	for i, au := range aus {
+		next := end
+		if i+1 < len(aus) {
+			next = aus[i+1].dts
+		}
+		samples[i] = fmp4Sample{
+			data:              lengthPrefixedSampleData(au.nalUnits),
+			duration:          uint32(ticks90kHz(next) - ticks90kHz(au.dts)),
+			compositionOffset: int32(ticks90kHz(au.pts) - ticks90kHz(au.dts)),
+			sync:              au.sync,
+		}
+	}
+	return samples
+}
+
+func mp4Uint32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
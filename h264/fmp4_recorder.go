@@ -0,0 +1,137 @@
+package h264
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// ErrSequenceChanged is returned by an FMP4Recorder when the stream moves
+// to a new SPS, which its init segment cannot describe. A new recording
+// can be started with a new recorder.
+var ErrSequenceChanged = errors.New("h264: sequence parameter set changed")
+
+// FMP4Recorder remuxes the pictures a decoder reads into a fragmented MP4
+// file without re-encoding them. The init segment, with the avcC record
+// of the active SPS and PPS, is written with the first picture; each
+// fragment is then written with a single Write and, when the writer is an
+// *os.File, synced to disk. A recording cut short by a crash loses at most
+// the fragment being gathered and plays up to the last whole fragment.
+//
+//	file, _ := os.Create("camera.mp4")
+//	recorder := NewFMP4Recorder(file)
+//	err := NewDecoder(WithFrameHandler(recorder)).Decode(connection)
+//	recorder.Close()
+type FMP4Recorder struct {
+	// FragmentDuration cuts a fragment once it spans this long. When 0
+	// each fragment holds one group of pictures, up to the next IDR
+	// picture.
+	FragmentDuration time.Duration
+	Logger           *slog.Logger
+
+	w         io.Writer
+	err       error
+	sps       *SPS
+	pending   []accessUnit
+	fragments uint32
+	firstDTS  time.Duration
+}
+
+// NewFMP4Recorder returns a recorder writing a fragment per group of
+// pictures to w
+func NewFMP4Recorder(w io.Writer) *FMP4Recorder {
+	return &FMP4Recorder{w: w}
+}
+
+func (r *FMP4Recorder) logger() *slog.Logger {
+	if r.Logger == nil {
+		return discardLogger
+	}
+	return r.Logger
+}
+
+// Err returns the first error of the recording. Once set, frames are
+// ignored.
+func (r *FMP4Recorder) Err() error {
+	return r.err
+}
+
+// HandleFrame adds a picture to the fragment being gathered, first
+// writing that fragment out when the picture starts the next one
+func (r *FMP4Recorder) HandleFrame(frame *Frame) {
+	if r.err != nil || len(frame.NalUnits) == 0 {
+		return
+	}
+	switch {
+	case r.sps == nil:
+		r.err = r.writeInit(frame)
+		if r.err != nil {
+			return
+		}
+	case !sameSequence(r.sps, frame.SPS):
+		r.err = r.writeFragment(frame.DTS)
+		if r.err == nil {
+			r.err = ErrSequenceChanged
+		}
+		return
+	}
+	au := newAccessUnit(frame)
+	if len(r.pending) > 0 {
+		cut := au.sync
+		if r.FragmentDuration > 0 {
+			cut = au.dts-r.pending[0].dts >= r.FragmentDuration
+		}
+		if cut {
+			if r.err = r.writeFragment(au.dts); r.err != nil {
+				return
+			}
+		}
+	}
+	r.pending = append(r.pending, au)
+}
+
+// Close writes the last fragment. The writer is left open.
+func (r *FMP4Recorder) Close() error {
+	if r.err != nil || len(r.pending) == 0 {
+		return r.err
+	}
+	r.err = r.writeFragment(lastPictureEnd(r.pending))
+	return r.err
+}
+
+func (r *FMP4Recorder) writeInit(frame *Frame) error {
+	config, err := NewAVCDecoderConfigurationRecordFor(frame.SPS, frame.PPS)
+	if err != nil {
+		return err
+	}
+	width, height := frame.SPS.DisplaySize()
+	r.sps, r.firstDTS = frame.SPS, frame.DTS
+	r.logger().Info("starting MP4 recording", "codec", frame.SPS.Codec(), "width", width, "height", height)
+	return r.write(fmp4InitSegment(config, width, height))
+}
+
+// Writes the pending pictures as a fragment lasting until end
+func (r *FMP4Recorder) writeFragment(end time.Duration) error {
+	aus := r.pending
+	r.pending = nil
+	if len(aus) == 0 {
+		return nil
+	}
+	r.fragments++
+	fragment := fmp4Fragment(r.fragments, uint64(ticks90kHz(aus[0].dts-r.firstDTS)), fmp4Samples(aus, end))
+	r.logger().Debug("writing MP4 fragment", "sequence", r.fragments, "pictures", len(aus), "bytes", len(fragment))
+	return r.write(fragment)
+}
+
+// Writes data in one call, syncing files so whole fragments survive a
+// crash
+func (r *FMP4Recorder) write(data []byte) error {
+	if _, err := r.w.Write(data); err != nil {
+		return err
+	}
+	if file, ok := r.w.(interface{ Sync() error }); ok {
+		return file.Sync()
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package h264
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFMP4Recorder(t *testing.T) {
+	out := &bytes.Buffer{}
+	r := NewFMP4Recorder(out)
+	for _, frame := range hlsTestFrames(t, 12) {
+		r.HandleFrame(frame)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	// A fragment per group of pictures
+	if types := fmt.Sprint(mp4BoxTypes(out.Bytes())); types != "[ftyp moov moof mdat moof mdat moof mdat]" {
+		t.Fatalf("unexpected boxes %s\n", types)
+	}
+
+	d, err := NewMP4Demuxer(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if d.Track.Width != 320 || d.Track.Height != 240 || d.Track.Samples != 12 {
+		t.Fatalf("unexpected track %+v\n", d.Track)
+	}
+	for i, sample := range readSamples(t, d) {
+		dts := time.Duration(i) * 100 * time.Millisecond
+		if sample.DTS != dts || sample.PTS != dts+100*time.Millisecond {
+			t.Fatalf("sample %d: unexpected PTS %v DTS %v\n", i, sample.PTS, sample.DTS)
+		}
+		if sample.Keyframe != (i%5 == 0) {
+			t.Fatalf("sample %d: unexpected keyframe %v\n", i, sample.Keyframe)
+		}
+	}
+
+	// A recording cut short in its last fragment plays the samples written
+	// whole
+	data := out.Bytes()
+	lastMoof := 0
+	for offset := 0; offset < len(data); offset += int(binary.BigEndian.Uint32(data[offset:])) {
+		if string(data[offset+4:offset+8]) == "moof" {
+			lastMoof = offset
+		}
+	}
+	for cut, expected := range map[int]int{len(data) - 10: 11, lastMoof + 20: 10} {
+		d, err = NewMP4Demuxer(bytes.NewReader(data[:cut]))
+		if err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+		if samples := readSamples(t, d); len(samples) != expected {
+			t.Fatalf("expected %d samples of a file cut at %d, got %d\n", expected, cut, len(samples))
+		}
+	}
+}
+
+func TestFMP4RecorderFragmentDuration(t *testing.T) {
+	out := &bytes.Buffer{}
+	r := NewFMP4Recorder(out)
+	r.FragmentDuration = 300 * time.Millisecond
+	for _, frame := range hlsTestFrames(t, 10) {
+		r.HandleFrame(frame)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if types := fmt.Sprint(mp4BoxTypes(out.Bytes())); types != "[ftyp moov moof mdat moof mdat moof mdat moof mdat]" {
+		t.Fatalf("unexpected boxes %s\n", types)
+	}
+}
+
+// writeRecorder keeps the data of each Write
+type writeRecorder [][]byte
+
+func (w *writeRecorder) Write(data []byte) (int, error) {
+	*w = append(*w, append([]byte{}, data...))
+	return len(data), nil
+}
+
+func TestFMP4RecorderWholeFragmentWrites(t *testing.T) {
+	var writes writeRecorder
+	r := NewFMP4Recorder(&writes)
+	for _, frame := range hlsTestFrames(t, 12) {
+		r.HandleFrame(frame)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	// The init segment, then one Write per fragment
+	expected := []string{"[ftyp moov]", "[moof mdat]", "[moof mdat]", "[moof mdat]"}
+	if len(writes) != len(expected) {
+		t.Fatalf("expected %d writes, got %d\n", len(expected), len(writes))
+	}
+	for i, data := range writes {
+		if types := fmt.Sprint(mp4BoxTypes(data)); types != expected[i] {
+			t.Fatalf("write %d: unexpected boxes %s\n", i, types)
+		}
+	}
+}
+
+func TestFMP4RecorderSequenceChange(t *testing.T) {
+	out := &bytes.Buffer{}
+	r := NewFMP4Recorder(out)
+	frames := hlsTestFrames(t, 12)
+	changed := *frames[0].SPS
+	changed.ID = 1
+	for _, frame := range frames[10:] {
+		frame.SPS = &changed
+	}
+	for _, frame := range frames {
+		r.HandleFrame(frame)
+	}
+	if err := r.Close(); !errors.Is(err, ErrSequenceChanged) {
+		t.Fatalf("expected ErrSequenceChanged, got %v\n", err)
+	}
+	d, err := NewMP4Demuxer(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if samples := readSamples(t, d); len(samples) != 10 {
+		t.Fatalf("expected the 10 pictures before the change, got %d\n", len(samples))
+	}
+}
@@ -1,6 +1,9 @@
 package h264
 
-import "github.com/mrmod/degolomb"
+import (
+	"github.com/mrmod/degolomb"
+	"time"
+)
 
 const (
 	NALU_TYPE_UNSPECIFIED = iota
@@ -99,3 +102,176 @@ func rbspBytes(frame []byte) []byte {
 	}
 	return frame
 }
+
+// Frame is a picture assembled from the slices of one access unit. It is
+// handed to a FrameHandler once the next picture starts, with the
+// macroblocks that no slice decoded concealed and counted in Loss.
+type Frame struct {
+	SPS *SPS
+	PPS *PPS
+	// IDR is set when the picture was coded as NALU_TYPE_SLICE_IDR_PICTURE
+	IDR bool
+	// Intra is set when every decoded slice was an I or SI slice
+	Intra bool
+	// Reference is set when the picture had a non-zero nal_ref_idc
+	Reference      bool
+	FrameNum       int
+	PicOrderCntLsb int
+	// PicOrderCnt orders pictures for display, 8.2.1. It is zero when the
+	// first slice of the picture was unreadable.
+	PicOrderCnt int
+	// MMCO5 is set when the picture had memory_management_control_operation
+	// 5, which like an IDR restarts picture order counting
+	MMCO5       bool
+	FieldPic    bool
+	BottomField bool
+	// Dimensions in macroblocks and samples
+	MbWidth, MbHeight         int
+	Width, Height             int
+	ChromaWidth, ChromaHeight int
+	BitDepthLuma              int
+	BitDepthChroma            int
+	// Sample planes in raster order; Cb and Cr are empty for monochrome.
+	// Slice data is parsed but not reconstructed, so every sample holds
+	// the mid-grey of its bit depth.
+	Luma, Cb, Cr []uint16
+	// MbDecoded is indexed by macroblock address and is true for every
+	// macroblock covered by a slice that parsed without error
+	MbDecoded []bool
+	Slices    []*SliceContext
+	// sliceStarts records the first macroblock of every slice seen for the
+	// picture, decoded or not, so coverage can be derived per 7.4.3
+	sliceStarts []sliceStart
+	// lastSlice is the latest slice whose header was read, used to detect
+	// the first slice of the next picture
+	lastSlice *SliceContext
+	Loss      LossStats
+	// Bytes is the size of the access unit in the byte stream, start codes
+	// included. VCLBytes counts only its slice and filler data NAL units,
+	// without start codes, as the VCL HRD does, C.1.
+	Bytes    int
+	VCLBytes int
+	// NalUnits are the NAL units of the access unit as they appeared in
+	// the stream, without start codes or length fields
+	NalUnits [][]byte
+	// PTS and DTS are also given as 90 kHz ticks. They come from the
+	// container when there is one, passed through as the container's
+	// absolute timestamps. Otherwise they count from the first picture and
+	// come from pic timing SEI, else VUI timing info, else arrival time.
+	PTS, DTS       time.Duration
+	PTS90k, DTS90k int64
+	// Timing is set when the access unit carried a pic timing SEI
+	Timing *PictureTiming
+	// RandomAccess is set on the first picture output, describing where
+	// decoding started
+	RandomAccess *RandomAccessPoint
+	// SEI holds the messages of the SEI NAL units that preceded the
+	// picture's first slice within its access unit
+	SEI []*SEIMessage
+}
+
+type sliceStart struct {
+	firstMb int
+	ok      bool
+}
+
+// FrameHandler receives each picture once all of its slices have been read
+type FrameHandler interface {
+	HandleFrame(*Frame)
+}
+
+// FrameHandlerFunc is a function used as a FrameHandler
+type FrameHandlerFunc func(*Frame)
+
+func (f FrameHandlerFunc) HandleFrame(frame *Frame) {
+	f(frame)
+}
+
+func NewFrame(sps *SPS, pps *PPS, header *SliceHeader) *Frame {
+	frame := &Frame{
+		SPS:            sps,
+		PPS:            pps,
+		Intra:          true,
+		FrameNum:       header.FrameNum,
+		PicOrderCntLsb: header.PicOrderCntLsb,
+		FieldPic:       header.FieldPic,
+		MMCO5:          header.MMCO5,
+		BottomField:    header.BottomField,
+		MbWidth:        PicWidthInMbs(sps),
+		MbHeight:       PicHeightInMbs(sps, header),
+		BitDepthLuma:   8 + sps.BitDepthLumaMinus8,
+		BitDepthChroma: 8 + sps.BitDepthChromaMinus8,
+	}
+	frame.Width = frame.MbWidth * 16
+	frame.Height = frame.MbHeight * 16
+	if mbWidthC, mbHeightC := MbWidthC(sps), MbHeightC(sps); mbWidthC > 0 {
+		frame.ChromaWidth = frame.MbWidth * mbWidthC
+		frame.ChromaHeight = frame.MbHeight * mbHeightC
+	}
+	numMbs := frame.MbWidth * frame.MbHeight
+	frame.MbDecoded = make([]bool, numMbs)
+	frame.Luma = newPlane(frame.Width*frame.Height, frame.BitDepthLuma)
+	frame.Cb = newPlane(frame.ChromaWidth*frame.ChromaHeight, frame.BitDepthChroma)
+	frame.Cr = newPlane(frame.ChromaWidth*frame.ChromaHeight, frame.BitDepthChroma)
+	return frame
+}
+
+// Samples are mid-range so the unreconstructed picture reads as neutral
+// grey
+func newPlane(size, bitDepth int) []uint16 {
+	plane := make([]uint16, size)
+	mid := uint16(1 << uint(bitDepth-1))
+	for i := range plane {
+		plane[i] = mid
+	}
+	return plane
+}
+
+// Records a slice that parsed cleanly
+func (f *Frame) addSlice(sliceContext *SliceContext) {
+	header := sliceContext.Slice.Header
+	f.Slices = append(f.Slices, sliceContext)
+	f.lastSlice = sliceContext
+	if sliceContext.NalUnit.Type == NALU_TYPE_SLICE_IDR_PICTURE {
+		f.IDR = true
+	}
+	if sliceContext.NalUnit.RefIdc != 0 {
+		f.Reference = true
+	}
+	if name := sliceTypeMap[header.SliceType]; name != "I" && name != "SI" {
+		f.Intra = false
+	}
+	f.sliceStarts = append(f.sliceStarts, sliceStart{
+		firstMb: sliceFirstMbAddr(sliceContext.SPS, header),
+		ok:      true,
+	})
+}
+
+// Records a slice that failed to parse. header holds at least
+// first_mb_in_slice and field_pic_flag, and is nil when they were
+// unreadable, leaving where the slice lies unknown.
+func (f *Frame) addLostSlice(sps *SPS, nalUnit *NalUnit, header *SliceHeader) {
+	f.Loss.LostSlices++
+	if nalUnit.Type == NALU_TYPE_SLICE_IDR_PICTURE {
+		f.IDR = true
+	}
+	if nalUnit.RefIdc != 0 {
+		f.Reference = true
+	}
+	firstMb := -1
+	if header != nil {
+		firstMb = sliceFirstMbAddr(sps, header)
+	}
+	f.sliceStarts = append(f.sliceStarts, sliceStart{firstMb: firstMb})
+}
+
+// Reports whether a slice starting at firstMb was already seen, which can
+// only happen when a new picture has started
+func (f *Frame) hasSliceStart(firstMb int) bool {
+	for _, start := range f.sliceStarts {
+		if start.firstMb == firstMb {
+			return true
+		}
+	}
+	return false
+}
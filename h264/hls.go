@@ -0,0 +1,326 @@
+package h264
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Segment formats of an HLS stream
+const (
+	HLS_SEGMENT_TS = iota
+	HLS_SEGMENT_FMP4
+)
+
+var HLSSegmentFormat = map[int]string{
+	HLS_SEGMENT_TS:   "MPEG-TS",
+	HLS_SEGMENT_FMP4: "fragmented MP4",
+}
+
+// HLSSegmenter writes a live HTTP Live Streaming presentation, RFC 8216,
+// into Dir: media segments cut at IDR pictures, a sliding window media
+// playlist and a multivariant playlist naming the codec. Any static file
+// server can serve the directory.
+//
+// An HLSSegmenter is a FrameHandler:
+//
+//	hls := NewHLSSegmenter("/var/www/camera", HLS_SEGMENT_TS)
+//	err := NewDecoder(WithFrameHandler(hls)).Decode(connection)
+//	hls.Close()
+type HLSSegmenter struct {
+	Dir    string
+	Format int
+	// TargetDuration is the segment length aimed for. A segment is cut at
+	// the first IDR picture once it is this long, or at any picture once
+	// it reaches the EXT-X-TARGETDURATION of the playlist, TargetDuration
+	// rounded up to whole seconds, which no segment may exceed, 4.4.3.1.
+	// It must not change once pictures are handled.
+	TargetDuration time.Duration
+	// PlaylistSize is the number of segments listed. Segment files are
+	// deleted once they are PlaylistSize segments past the window, so
+	// clients that loaded an older playlist can still fetch them.
+	PlaylistSize int
+	// PlaylistName and MultivariantName are the file names of the
+	// playlists
+	PlaylistName     string
+	MultivariantName string
+	// StartTime is the wall clock time of the first picture, given by
+	// EXT-X-PROGRAM-DATE-TIME. It is the time of the first picture's
+	// arrival when zero.
+	StartTime time.Time
+	Logger    *slog.Logger
+
+	err error
+	// Access units of the segment being gathered
+	pending []accessUnit
+	// Segments written, oldest first, including those past the window
+	segments []hlsSegment
+	sequence int
+	firstDTS time.Duration
+	ts       *TSMuxer
+	// The init section of fragmented MP4 segments and the codec of the
+	// multivariant playlist follow the parameter sets
+	sps           *SPS
+	pps           *PPS
+	initName      string
+	initCount     int
+	fragments     uint32
+	codec         string
+	width, height int
+	bandwidth     int
+}
+
+type hlsSegment struct {
+	name     string
+	initName string
+	sequence int
+	duration time.Duration
+	start    time.Time
+}
+
+// NewHLSSegmenter returns a segmenter writing 2 second segments with a
+// playlist of 6
+func NewHLSSegmenter(dir string, format int) *HLSSegmenter {
+	return &HLSSegmenter{
+		Dir:              dir,
+		Format:           format,
+		TargetDuration:   2 * time.Second,
+		PlaylistSize:     6,
+		PlaylistName:     "index.m3u8",
+		MultivariantName: "master.m3u8",
+	}
+}
+
+func (s *HLSSegmenter) logger() *slog.Logger {
+	if s.Logger == nil {
+		return discardLogger
+	}
+	return s.Logger
+}
+
+// Err returns the first error writing the presentation. Once set, frames
+// are ignored.
+func (s *HLSSegmenter) Err() error {
+	return s.err
+}
+
+// HandleFrame adds a picture to the segment being gathered, first writing
+// that segment out when the picture is an IDR picture past the target
+// duration
+func (s *HLSSegmenter) HandleFrame(frame *Frame) {
+	if s.err != nil || len(frame.NalUnits) == 0 {
+		return
+	}
+	if len(s.segments) == 0 && len(s.pending) == 0 {
+		s.firstDTS = frame.DTS
+		if s.StartTime.IsZero() {
+			s.StartTime = time.Now()
+		}
+	}
+	if len(s.pending) > 0 {
+		duration := frame.DTS - s.pending[0].dts
+		switch {
+		case frame.IDR && duration >= s.TargetDuration:
+			s.err = s.writeSegment(frame.DTS)
+		case duration >= s.maxSegmentDuration():
+			// Cameras often send IDR pictures less often than the target
+			s.logger().Debug("HLS segment cut without an IDR picture", "duration", duration)
+			end := frame.DTS
+			if segmentSeconds(end-s.pending[0].dts) > s.targetDuration() {
+				// A gap in the timestamps ends the segment at its last
+				// picture
+				end = lastPictureEnd(s.pending)
+			}
+			s.err = s.writeSegment(end)
+		}
+	}
+	s.pending = append(s.pending, newAccessUnit(frame))
+}
+
+// The EXT-X-TARGETDURATION of the playlist in seconds
+func (s *HLSSegmenter) targetDuration() int {
+	return int(math.Ceil(s.TargetDuration.Seconds()))
+}
+
+// The length at which a segment is cut at any picture
+func (s *HLSSegmenter) maxSegmentDuration() time.Duration {
+	return time.Duration(s.targetDuration()) * time.Second
+}
+
+// The duration of a segment rounded to whole seconds, as compared with the
+// target duration, 4.4.3.1
+func segmentSeconds(duration time.Duration) int {
+	return int(math.Round(duration.Seconds()))
+}
+
+// Close writes out the last segment and ends the playlist
+func (s *HLSSegmenter) Close() error {
+	if s.err == nil && len(s.pending) > 0 {
+		s.err = s.writeSegment(lastPictureEnd(s.pending))
+	}
+	if s.err == nil {
+		s.err = s.writePlaylist(true)
+	}
+	return s.err
+}
+
+// Writes the pending pictures as a segment lasting until end
+func (s *HLSSegmenter) writeSegment(end time.Duration) error {
+	aus := s.pending
+	s.pending = nil
+	segment := hlsSegment{
+		sequence: s.sequence,
+		duration: end - aus[0].dts,
+		start:    s.StartTime.Add(aus[0].dts - s.firstDTS),
+	}
+	s.sequence++
+	if seconds := segmentSeconds(segment.duration); seconds > s.targetDuration() {
+		return fmt.Errorf("h264: HLS segment %d lasts %v, beyond the target duration of %d s", segment.sequence, segment.duration, s.targetDuration())
+	}
+
+	if s.sps == nil || !sameSequence(s.sps, aus[0].sps) || !bytes.Equal(s.pps.RBSP(), aus[0].pps.RBSP()) {
+		if err := s.useParameterSets(aus[0].sps, aus[0].pps); err != nil {
+			return err
+		}
+	}
+	buf := &bytes.Buffer{}
+	switch s.Format {
+	case HLS_SEGMENT_FMP4:
+		segment.name = fmt.Sprintf("segment%d.m4s", segment.sequence)
+		segment.initName = s.initName
+		s.fragments++
+		buf.Write(fmp4Fragment(s.fragments, uint64(ticks90kHz(aus[0].dts-s.firstDTS)), fmp4Samples(aus, end)))
+	default:
+		segment.name = fmt.Sprintf("segment%d.ts", segment.sequence)
+		if s.ts == nil {
+			s.ts = NewTSMuxer(buf)
+		}
+		s.ts.w = buf
+		// Every segment starts with the PAT and PMT
+		s.ts.psiWritten = false
+		for _, au := range aus {
+			s.ts.write(au.nalUnits, au.sliceTypes, au.idr, au.pts, au.dts)
+		}
+		if err := s.ts.Err(); err != nil {
+			return err
+		}
+	}
+	if err := writeFileAtomic(filepath.Join(s.Dir, segment.name), buf.Bytes()); err != nil {
+		return err
+	}
+	s.logger().Info("wrote HLS segment", "name", segment.name, "duration", segment.duration, "pictures", len(aus), "bytes", buf.Len())
+
+	if segment.duration > 0 {
+		if bandwidth := int(float64(buf.Len()*8) / segment.duration.Seconds()); bandwidth > s.bandwidth {
+			s.bandwidth = bandwidth
+			if err := s.writeMultivariantPlaylist(); err != nil {
+				return err
+			}
+		}
+	}
+	s.segments = append(s.segments, segment)
+	if err := s.writePlaylist(false); err != nil {
+		return err
+	}
+	return s.deleteExpiredSegments()
+}
+
+// Writes a new init section when the parameter sets change and notes the
+// codec for the multivariant playlist
+func (s *HLSSegmenter) useParameterSets(sps *SPS, pps *PPS) error {
+	s.sps, s.pps = sps, pps
+	s.codec = sps.Codec()
+	s.width, s.height = sps.DisplaySize()
+	if s.Format == HLS_SEGMENT_FMP4 {
+		config, err := NewAVCDecoderConfigurationRecordFor(sps, pps)
+		if err != nil {
+			return err
+		}
+		s.initName = fmt.Sprintf("init%d.mp4", s.initCount)
+		s.initCount++
+		if err := writeFileAtomic(filepath.Join(s.Dir, s.initName), fmp4InitSegment(config, s.width, s.height)); err != nil {
+			return err
+		}
+	}
+	return s.writeMultivariantPlaylist()
+}
+
+// The media playlist, 4.4.3
+func (s *HLSSegmenter) writePlaylist(ended bool) error {
+	window := s.segments
+	if len(window) > s.PlaylistSize {
+		window = window[len(window)-s.PlaylistSize:]
+	}
+	version := 3
+	if s.Format == HLS_SEGMENT_FMP4 {
+		version = 7
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:%d\n", version)
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", s.targetDuration())
+	if len(window) > 0 {
+		fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", window[0].sequence)
+	}
+	initName := ""
+	for _, segment := range window {
+		if segment.initName != initName {
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"%s\"\n", segment.initName)
+			initName = segment.initName
+		}
+		fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", segment.start.UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s\n", segment.duration.Seconds(), segment.name)
+	}
+	if ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return writeFileAtomic(filepath.Join(s.Dir, s.PlaylistName), []byte(b.String()))
+}
+
+// The multivariant playlist, 4.4.6, with one variant
+func (s *HLSSegmenter) writeMultivariantPlaylist() error {
+	bandwidth := s.bandwidth
+	if bandwidth == 0 {
+		// Unknown until the first segment is written
+		bandwidth = 1
+	}
+	playlist := fmt.Sprintf("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"%s\",RESOLUTION=%dx%d\n%s\n",
+		bandwidth, s.codec, s.width, s.height, s.PlaylistName)
+	return writeFileAtomic(filepath.Join(s.Dir, s.MultivariantName), []byte(playlist))
+}
+
+// Deletes segments more than PlaylistSize segments behind the window,
+// 6.2.2, and the init sections no remaining segment uses
+func (s *HLSSegmenter) deleteExpiredSegments() error {
+	for len(s.segments) > 2*s.PlaylistSize {
+		segment := s.segments[0]
+		s.segments = s.segments[1:]
+		if err := os.Remove(filepath.Join(s.Dir, segment.name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		s.logger().Debug("deleted HLS segment", "name", segment.name)
+		if segment.initName == "" || segment.initName == s.initName || (len(s.segments) > 0 && segment.initName == s.segments[0].initName) {
+			continue
+		}
+		// Segments keep the order of their init sections
+		if err := os.Remove(filepath.Join(s.Dir, segment.initName)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		s.logger().Debug("deleted HLS init section", "name", segment.initName)
+	}
+	return nil
+}
+
+// Writes a file under a temporary name and renames it into place, so a
+// server never hands out a partial file
+func writeFileAtomic(name string, data []byte) error {
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
@@ -0,0 +1,187 @@
+package h264
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Pictures at 10 per second with an IDR picture every 5
+func hlsTestFrames(t *testing.T, count int) []*Frame {
+	sps, err := NewSPS(bitsToBytes(baselineSPSBits), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	pps, err := NewPPS(sps, bitsToBytes(baselinePPSBits), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	frames := make([]*Frame, count)
+	for i := range frames {
+		frames[i] = &Frame{SPS: sps, PPS: pps, IDR: i%5 == 0, FrameNum: i % 16}
+		frames[i].DTS = time.Duration(i) * 100 * time.Millisecond
+		frames[i].PTS = frames[i].DTS + 100*time.Millisecond
+		if frames[i].IDR {
+			frames[i].NalUnits = [][]byte{nal(0x67, sps.RBSP()), nal(0x68, pps.RBSP()), nal(0x65, bitsToBytes("1 0001000 1"))}
+		} else {
+			frames[i].NalUnits = [][]byte{nal(0x41, bitsToBytes(pSliceBits(i%16)))}
+		}
+	}
+	return frames
+}
+
+// Returns the types of the boxes of data, not looking inside them
+func mp4BoxTypes(data []byte) []string {
+	types := []string{}
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			break
+		}
+		types = append(types, string(data[4:8]))
+		data = data[size:]
+	}
+	return types
+}
+
+func TestHLSSegmenter(t *testing.T) {
+	dir := t.TempDir()
+	s := NewHLSSegmenter(dir, HLS_SEGMENT_TS)
+	s.TargetDuration = time.Second
+	s.PlaylistSize = 2
+	s.StartTime = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, frame := range hlsTestFrames(t, 75) {
+		s.HandleFrame(frame)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+
+	playlist, err := os.ReadFile(filepath.Join(dir, "index.m3u8"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	expected := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:6\n" +
+		"#EXT-X-PROGRAM-DATE-TIME:2024-05-01T12:00:06.000Z\n#EXTINF:1.000,\nsegment6.ts\n" +
+		"#EXT-X-PROGRAM-DATE-TIME:2024-05-01T12:00:07.000Z\n#EXTINF:0.500,\nsegment7.ts\n" +
+		"#EXT-X-ENDLIST\n"
+	if string(playlist) != expected {
+		t.Fatalf("unexpected playlist\n%s\n", playlist)
+	}
+	multivariant, err := os.ReadFile(filepath.Join(dir, "master.m3u8"))
+	if err != nil || !strings.Contains(string(multivariant), `CODECS="avc1.42001e",RESOLUTION=320x240`) {
+		t.Fatalf("unexpected multivariant playlist %q %v\n", multivariant, err)
+	}
+	// Segments 0 to 3 are past the window by more than its size
+	for i, want := range []bool{false, false, false, false, true, true, true, true} {
+		_, err := os.Stat(filepath.Join(dir, fmt.Sprintf("segment%d.ts", i)))
+		if (err == nil) != want {
+			t.Fatalf("segment %d: expected present %v, got %v\n", i, want, err)
+		}
+	}
+
+	segment, _ := os.ReadFile(filepath.Join(dir, "segment6.ts"))
+	samples := readSamples(t, NewTSDemuxer(bytes.NewReader(segment)))
+	if len(samples) != 10 || !samples[0].Keyframe || !samples[5].Keyframe {
+		t.Fatalf("expected 10 samples starting at an IDR picture, got %d\n", len(samples))
+	}
+}
+
+func TestHLSSegmenterFMP4(t *testing.T) {
+	dir := t.TempDir()
+	s := NewHLSSegmenter(dir, HLS_SEGMENT_FMP4)
+	s.TargetDuration = time.Second
+	for _, frame := range hlsTestFrames(t, 20) {
+		s.HandleFrame(frame)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	playlist, _ := os.ReadFile(filepath.Join(dir, "index.m3u8"))
+	if !strings.Contains(string(playlist), "#EXT-X-MAP:URI=\"init0.mp4\"\n") || strings.Count(string(playlist), ".m4s") != 2 {
+		t.Fatalf("unexpected playlist\n%s\n", playlist)
+	}
+	init, _ := os.ReadFile(filepath.Join(dir, "init0.mp4"))
+	if types := strings.Join(mp4BoxTypes(init), " "); types != "ftyp moov" || !bytes.Contains(init, []byte("avcC")) {
+		t.Fatalf("unexpected init section %s\n", types)
+	}
+	segment, _ := os.ReadFile(filepath.Join(dir, "segment1.m4s"))
+	if types := strings.Join(mp4BoxTypes(segment), " "); types != "moof mdat" {
+		t.Fatalf("unexpected segment %s\n", types)
+	}
+	// tfdt of the second segment is 1 second
+	tfdt := bytes.Index(segment, []byte("tfdt"))
+	if tfdt < 0 || binary.BigEndian.Uint64(segment[tfdt+8:]) != 90000 {
+		t.Fatalf("unexpected tfdt\n")
+	}
+}
+
+func TestHLSSegmenterLongGOP(t *testing.T) {
+	dir := t.TempDir()
+	s := NewHLSSegmenter(dir, HLS_SEGMENT_TS)
+	frames := hlsTestFrames(t, 100)
+	for i, frame := range frames {
+		// An IDR picture every 5 seconds
+		frame.IDR = i%50 == 0
+		if i == 70 {
+			// A gap in the timestamps
+			for _, later := range frames[i:] {
+				later.DTS += 3 * time.Second
+			}
+		}
+		s.HandleFrame(frame)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	playlist, _ := os.ReadFile(filepath.Join(dir, "index.m3u8"))
+	expected := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:0\n"
+	if !strings.HasPrefix(string(playlist), expected) {
+		t.Fatalf("unexpected playlist\n%s\n", playlist)
+	}
+	// Cut at 2 seconds, before and after the gap
+	for _, extinf := range []string{"#EXTINF:2.000,\nsegment0.ts", "#EXTINF:2.000,\nsegment2.ts", "#EXTINF:1.000,\nsegment3.ts", "#EXTINF:2.000,\nsegment4.ts"} {
+		if !strings.Contains(string(playlist), extinf) {
+			t.Fatalf("expected %q in playlist\n%s\n", extinf, playlist)
+		}
+	}
+}
+
+func TestHLSSegmenterParameterSetChange(t *testing.T) {
+	dir := t.TempDir()
+	s := NewHLSSegmenter(dir, HLS_SEGMENT_FMP4)
+	s.TargetDuration = time.Second
+	s.PlaylistSize = 1
+	frames := hlsTestFrames(t, 40)
+	// pic_init_qp_minus26 1 from the third segment on
+	pps, err := NewPPS(frames[0].SPS, bitsToBytes("1 1 0 0 1 1 1 0 00 010 1 1 0 0 0 1"), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	for _, frame := range frames[20:] {
+		frame.PPS = pps
+	}
+	for _, frame := range frames {
+		s.HandleFrame(frame)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	playlist, _ := os.ReadFile(filepath.Join(dir, "index.m3u8"))
+	if !strings.Contains(string(playlist), "#EXT-X-MAP:URI=\"init1.mp4\"\n") {
+		t.Fatalf("expected a new init section\n%s\n", playlist)
+	}
+	init, _ := os.ReadFile(filepath.Join(dir, "init1.mp4"))
+	if !bytes.Contains(init, nal(0x68, pps.RBSP())) {
+		t.Fatalf("expected the new PPS in the init section\n")
+	}
+	// No segment left uses the first init section
+	if _, err := os.Stat(filepath.Join(dir, "init0.mp4")); !os.IsNotExist(err) {
+		t.Fatalf("expected init0.mp4 to be deleted, got %v\n", err)
+	}
+}
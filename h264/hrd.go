@@ -0,0 +1,289 @@
+package h264
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// CPB conformance events, Annex C.3
+const (
+	CPB_UNDERFLOW = iota
+	CPB_OVERFLOW
+)
+
+var (
+	CPBEventType = map[int]string{
+		CPB_UNDERFLOW: "underflow",
+		CPB_OVERFLOW:  "overflow",
+	}
+	// ErrNoHRD is returned by CheckHRD for a stream whose SPS has no
+	// hrd_parameters
+	ErrNoHRD = errors.New("h264: SPS has no HRD parameters")
+)
+
+// CPBEvent is a point where the coded picture buffer would underflow, an
+// access unit not having fully arrived by its removal time, or overflow,
+// holding more than CpbSize bits just before a removal.
+type CPBEvent struct {
+	Type int
+	// AccessUnit is the index of the access unit in decoding order
+	AccessUnit int
+	Time       time.Duration
+	// Fullness is the CPB content in bits at Time
+	Fullness int64
+}
+
+// HRDReport is the result of simulating the CPB of a stream with the
+// parameters of one SchedSelIdx
+type HRDReport struct {
+	SchedSelIdx int
+	// The signalled bit rate in bits per second and CPB size in bits
+	BitRate int64
+	CpbSize int64
+	CBR     bool
+	// VCL is set when the VCL HRD was checked, which counts the VCL and
+	// filler data NAL units alone, a Type I bitstream. Otherwise the NAL
+	// HRD counts the whole byte stream, a Type II bitstream. C.1.
+	VCL         bool
+	AccessUnits int
+	Events      []CPBEvent
+	// PeakBitRate is the most bits removed within any one second;
+	// AverageBitRate covers the whole stream
+	PeakBitRate    float64
+	AverageBitRate float64
+}
+
+// Conforms reports whether the CPB neither underflowed nor overflowed
+func (r *HRDReport) Conforms() bool {
+	return len(r.Events) == 0
+}
+
+// An access unit as the CPB sees it
+type hrdAccessUnit struct {
+	bits int64
+	// removal is t_r,n(n), the nominal removal time
+	removal time.Duration
+	// initialDelay and initialDelayOffset are those of the buffering period
+	// the access unit belongs to, in 90 kHz ticks
+	initialDelay       int
+	initialDelayOffset int
+	// firstInBufferingPeriod is set for access units carrying a buffering
+	// period SEI
+	firstInBufferingPeriod bool
+}
+
+// CheckHRD decodes the Annex B stream and simulates its coded picture
+// buffer per Annex C using the hrd_parameters of schedSelIdx, returning a
+// report for each HRD the SPS has: the NAL HRD first, then the VCL HRD.
+// Every access unit from where decoding starts is simulated, including
+// those ahead of a recovery point that are not output. Removal times come
+// from pic timing SEI when present, otherwise from the VUI frame rate.
+func CheckHRD(stream io.Reader, schedSelIdx int, opts ...DecoderOption) ([]*HRDReport, error) {
+	frames := []*Frame{}
+	reader := NewDecoder(opts...).NewReader(stream)
+	reader.accessUnitHandler = FrameHandlerFunc(func(frame *Frame) { frames = append(frames, frame) })
+	if err := reader.Decode(); err != nil {
+		return nil, err
+	}
+	if len(frames) == 0 {
+		return nil, fmt.Errorf("h264: no pictures in stream")
+	}
+	sps := frames[0].SPS
+	reports := []*HRDReport{}
+	if sps.NalHrdParametersPresent {
+		report, err := checkHRD(frames, &sps.HRDParameters, schedSelIdx, false)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	if sps.VclHrdParametersPresent {
+		report, err := checkHRD(frames, &sps.VclHrd, schedSelIdx, true)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	if len(reports) == 0 {
+		return nil, ErrNoHRD
+	}
+	return reports, nil
+}
+
+// Simulates the CPB of one HRD
+func checkHRD(frames []*Frame, hrd *HRDParameters, schedSelIdx int, vcl bool) (*HRDReport, error) {
+	if err := checkRange("SchedSelIdx", schedSelIdx, 0, hrd.CpbCntMinus1); err != nil {
+		return nil, err
+	}
+	report := &HRDReport{
+		SchedSelIdx: schedSelIdx,
+		// E-37 and E-38
+		BitRate:     int64(hrd.BitRateValueMinus1[schedSelIdx]+1) << uint(6+hrd.BitRateScale),
+		CpbSize:     int64(hrd.CpbSizeValueMinus1[schedSelIdx]+1) << uint(4+hrd.CpbSizeScale),
+		CBR:         hrd.Cbr[schedSelIdx],
+		VCL:         vcl,
+		AccessUnits: len(frames),
+	}
+	accessUnits, err := hrdAccessUnits(frames, schedSelIdx, report)
+	if err != nil {
+		return nil, err
+	}
+	report.Events = simulateCPB(accessUnits, report.BitRate, report.CpbSize, report.CBR)
+	report.PeakBitRate, report.AverageBitRate = measureBitRate(accessUnits)
+	return report, nil
+}
+
+// Derives the size and nominal removal time of every access unit
+func hrdAccessUnits(frames []*Frame, schedSelIdx int, report *HRDReport) ([]hrdAccessUnit, error) {
+	accessUnits := make([]hrdAccessUnit, len(frames))
+	var bufferingPeriodRemoval time.Duration
+	initialDelay, initialDelayOffset := -1, 0
+	var nextRemoval time.Duration
+	for n, frame := range frames {
+		au := &accessUnits[n]
+		au.bits = int64(frame.Bytes) * 8
+		if report.VCL {
+			au.bits = int64(frame.VCLBytes) * 8
+		}
+		var picTiming *PicTiming
+		for _, message := range frame.SEI {
+			switch v := message.Value.(type) {
+			case BufferingPeriod:
+				delays, offsets := v.NalInitialCpbRemovalDelay, v.NalInitialCpbRemovalDelayOffset
+				if report.VCL {
+					delays, offsets = v.VclInitialCpbRemovalDelay, v.VclInitialCpbRemovalDelayOffset
+				}
+				if schedSelIdx < len(delays) {
+					initialDelay, initialDelayOffset = delays[schedSelIdx], offsets[schedSelIdx]
+					au.firstInBufferingPeriod = true
+				}
+			case PicTiming:
+				picTiming = &v
+			}
+		}
+		if n == 0 && initialDelay < 0 {
+			// Without a buffering period SEI decoding starts with the CPB full
+			initialDelay = int(report.CpbSize * 90000 / report.BitRate)
+			au.firstInBufferingPeriod = true
+		}
+		au.initialDelay, au.initialDelayOffset = initialDelay, initialDelayOffset
+
+		tick := frame.SPS.tick()
+		switch {
+		case n == 0:
+			// C-6
+			au.removal = time.Duration(int64(initialDelay) * int64(time.Second) / 90000)
+		case picTiming != nil && picTiming.CpbDpbDelaysPresent && tick > 0:
+			// C-7
+			au.removal = bufferingPeriodRemoval + time.Duration(picTiming.CpbRemovalDelay)*tick
+		case tick > 0:
+			au.removal = nextRemoval
+		default:
+			return nil, fmt.Errorf("h264: access unit %d has no removal time: no pic timing SEI or VUI timing info", n)
+		}
+		if au.firstInBufferingPeriod {
+			bufferingPeriodRemoval = au.removal
+		}
+		// The VUI rate predicts the next removal when pic timing is absent
+		nextRemoval = au.removal + 2*tick
+		if frame.FieldPic {
+			nextRemoval -= tick
+		}
+	}
+	return accessUnits, nil
+}
+
+// C.1.1 and C.1.2: Returns where the CPB underflows or overflows when filled
+// at bitRate bits per second
+func simulateCPB(accessUnits []hrdAccessUnit, bitRate, cpbSize int64, cbr bool) []CPBEvent {
+	events := []CPBEvent{}
+	bitDuration := func(bits int64) time.Duration {
+		return time.Duration(bits * int64(time.Second) / bitRate)
+	}
+	initialArrival := make([]time.Duration, len(accessUnits))
+	finalArrival := make([]time.Duration, len(accessUnits))
+	for n, au := range accessUnits {
+		if n > 0 {
+			initialArrival[n] = finalArrival[n-1]
+			if !cbr {
+				// C-3 and C-4: VBR delivery pauses until the earliest
+				// arrival the buffering period allows
+				delay := au.initialDelay
+				if !au.firstInBufferingPeriod {
+					delay += au.initialDelayOffset
+				}
+				earliest := au.removal - time.Duration(int64(delay)*int64(time.Second)/90000)
+				if earliest > initialArrival[n] {
+					initialArrival[n] = earliest
+				}
+			}
+		}
+		finalArrival[n] = initialArrival[n] + bitDuration(au.bits)
+		if finalArrival[n] > au.removal {
+			events = append(events, CPBEvent{
+				Type:       CPB_UNDERFLOW,
+				AccessUnit: n,
+				Time:       au.removal,
+			})
+		}
+	}
+
+	// Fullness peaks just before each removal
+	var removed int64
+	arrived := 0
+	var arrivedBits int64
+	for n, au := range accessUnits {
+		for arrived < len(accessUnits) && finalArrival[arrived] <= au.removal {
+			arrivedBits += accessUnits[arrived].bits
+			arrived++
+		}
+		fullness := arrivedBits - removed
+		if arrived < len(accessUnits) && initialArrival[arrived] < au.removal {
+			partial := int64(au.removal-initialArrival[arrived]) * bitRate / int64(time.Second)
+			fullness += partial
+		}
+		if fullness > cpbSize {
+			events = append(events, CPBEvent{
+				Type:       CPB_OVERFLOW,
+				AccessUnit: n,
+				Time:       au.removal,
+				Fullness:   fullness,
+			})
+		}
+		removed += au.bits
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].AccessUnit < events[j].AccessUnit
+	})
+	return events
+}
+
+// Returns the most bits removed in any one second window and the average
+// over the stream, both in bits per second
+func measureBitRate(accessUnits []hrdAccessUnit) (peak, average float64) {
+	var total, window int64
+	start := 0
+	for _, au := range accessUnits {
+		total += au.bits
+		window += au.bits
+		for au.removal-accessUnits[start].removal >= time.Second {
+			window -= accessUnits[start].bits
+			start++
+		}
+		if float64(window) > peak {
+			peak = float64(window)
+		}
+	}
+	last := accessUnits[len(accessUnits)-1].removal
+	first := accessUnits[0].removal
+	if duration := last - first; duration > 0 {
+		// Each access unit is counted over the interval up to the next
+		average = float64(total-accessUnits[len(accessUnits)-1].bits) / duration.Seconds()
+	} else {
+		average = float64(total)
+	}
+	return peak, average
+}
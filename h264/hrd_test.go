@@ -0,0 +1,115 @@
+package h264
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+)
+
+func cpbAccessUnits(bits ...int64) []hrdAccessUnit {
+	accessUnits := []hrdAccessUnit{}
+	for n, b := range bits {
+		accessUnits = append(accessUnits, hrdAccessUnit{
+			bits:    b,
+			removal: time.Duration(200+100*n) * time.Millisecond,
+		})
+	}
+	return accessUnits
+}
+
+func TestSimulateCPB(t *testing.T) {
+	// 10 kbit/s fills 1000 bits in 100 ms, one removal every 100 ms
+	if events := simulateCPB(cpbAccessUnits(1000, 1000, 1000), 10000, 5000, true); len(events) != 0 {
+		t.Fatalf("expected a conforming stream, got %+v\n", events)
+	}
+	events := simulateCPB(cpbAccessUnits(1000, 5000, 1000), 10000, 8000, true)
+	if len(events) == 0 || events[0].Type != CPB_UNDERFLOW || events[0].AccessUnit != 1 {
+		t.Fatalf("expected underflow at access unit 1, got %+v\n", events)
+	}
+	events = simulateCPB(cpbAccessUnits(1000, 1000, 1000), 10000, 1500, true)
+	if len(events) == 0 || events[0].Type != CPB_OVERFLOW || events[0].AccessUnit != 0 || events[0].Fullness != 2000 {
+		t.Fatalf("expected overflow of 2000 bits at access unit 0, got %+v\n", events)
+	}
+}
+
+func TestMeasureBitRate(t *testing.T) {
+	// 15 access units over 1.4 s, one of them large
+	bits := []int64{}
+	for i := 0; i < 15; i++ {
+		bits = append(bits, 1000)
+	}
+	bits[12] = 6000
+	peak, average := measureBitRate(cpbAccessUnits(bits...))
+	if peak != 15000 {
+		t.Fatalf("expected peak 15000 bit/s, got %v\n", peak)
+	}
+	if math.Abs(average-19000/1.4) > 1e-6 {
+		t.Fatalf("expected average %v bit/s, got %v\n", 19000/1.4, average)
+	}
+}
+
+// baselineSPSBits with VUI timing at 25 frames per second and both HRDs:
+// the NAL HRD at 6400 bit/s and the VCL HRD at 3200 bit/s, each with a
+// 2000 bit CBR CPB
+const hrdSPSBits = "01000010 00000000 00011110" +
+	" 1 1 1 011 010 0" +
+	" 000010100 0001111" +
+	" 1 1 0" +
+	" 1 0 0 0 0" +
+	" 1 00000000000000000000000000000001 00000000000000000000000000110010 1" +
+	" 1 1 0000 0000 0000001100100 0000001111101 1 10111 10111 10111 11000" +
+	" 1 1 0000 0000 00000110010 0000001111101 1 10111 10111 10111 11000" +
+	" 0 0 0 1"
+
+func TestCheckHRD(t *testing.T) {
+	recoveryPoint := bitsToBytes("011 1 0 00 1")
+	sei := append([]byte{SEI_TYPE_RECOVERY_POINT, byte(len(recoveryPoint))}, recoveryPoint...)
+	sei = append(sei, 0x80)
+	nalUnits := [][]byte{nal(0x67, bitsToBytes(hrdSPSBits)), nal(0x68, bitsToBytes(baselinePPSBits)), nal(0x06, sei)}
+	var vclBits int64
+	for frameNum := 5; frameNum <= 8; frameNum++ {
+		slice := nal(0x41, bitsToBytes(pSliceBits(frameNum)))
+		vclBits += int64(len(slice)) * 8
+		nalUnits = append(nalUnits, slice)
+	}
+	// Filler data belongs to the last access unit and both HRDs count it
+	filler := nal(NALU_TYPE_FILLER_DATA, []byte{0xff, 0xff, 0x80})
+	vclBits += int64(len(filler)) * 8
+	nalUnits = append(nalUnits, filler)
+	stream := annexB(nalUnits...)
+	nalBits := int64(len(stream)) * 8
+	stream = append(stream, annexB(nal(0x09, []byte{0x10}))...)
+
+	reports, err := CheckHRD(bytes.NewReader(stream), 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if len(reports) != 2 || reports[0].VCL || !reports[1].VCL {
+		t.Fatalf("expected NAL and VCL reports, got %+v\n", reports)
+	}
+	for i, c := range []struct {
+		bitRate int64
+		bits    int64
+	}{
+		{6400, nalBits},
+		{3200, vclBits},
+	} {
+		report := reports[i]
+		// Pictures 5 and 6 ahead of the recovery point are not output but
+		// still pass through the CPB
+		if report.AccessUnits != 4 {
+			t.Fatalf("report %d: expected 4 access units, got %d\n", i, report.AccessUnits)
+		}
+		if report.BitRate != c.bitRate || report.CpbSize != 2000 || !report.CBR {
+			t.Fatalf("report %d: unexpected HRD %+v\n", i, report)
+		}
+		// Every access unit falls within one second
+		if report.PeakBitRate != float64(c.bits) {
+			t.Fatalf("report %d: expected %d bits, got %v\n", i, c.bits, report.PeakBitRate)
+		}
+		if !report.Conforms() {
+			t.Fatalf("report %d: unexpected CPB events %+v\n", i, report.Events)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package h264
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// NALInfo describes a NAL unit of a stream read by an Inspector
+type NALInfo struct {
+	// Offset is where the start code of the NAL unit is in the stream.
+	// Size counts the start code.
+	Offset int64
+	Size   int
+	Type   int
+	RefIdc int
+	// SPS, PPS and Slice are set for NAL units of those kinds that parsed
+	SPS   *SPS
+	PPS   *PPS
+	Slice *SliceInfo
+	// Err is why the NAL unit could not be parsed
+	Err error
+}
+
+// SliceInfo is the slice header of a slice NAL unit with what it implies
+type SliceInfo struct {
+	// Type is the slice_type name of Table 7-6, such as P
+	Type        string `json:"type"`
+	IDR         bool   `json:"idr"`
+	FirstMb     int    `json:"first_mb"`
+	PPSID       int    `json:"pps_id"`
+	FrameNum    int    `json:"frame_num"`
+	IDRPicID    int    `json:"idr_pic_id"`
+	PicOrderCnt int    `json:"poc"`
+	// QP is SliceQPY, 7-30
+	QP int `json:"qp"`
+	// RefsL0 and RefsL1 are the active reference indices of each list
+	RefsL0 int `json:"refs_l0"`
+	RefsL1 int `json:"refs_l1"`
+	// NewPicture is set on the first slice of a picture
+	NewPicture bool `json:"new_picture"`
+}
+
+// InspectSummary describes a stream an Inspector has read
+type InspectSummary struct {
+	NALUnits int   `json:"nal_units"`
+	Bytes    int64 `json:"bytes"`
+	// NALUnitTypes counts the NAL units of each nal_unit_type
+	NALUnitTypes map[int]int `json:"nal_unit_types"`
+	Pictures     int         `json:"pictures"`
+	IDRPictures  int         `json:"idr_pictures"`
+	// Width, Height and the names are of the last SPS
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	Profile      string `json:"profile"`
+	Level        string `json:"level"`
+	Codec        string `json:"codec"`
+	ChromaFormat int    `json:"chroma_format"`
+	BitDepth     int    `json:"bit_depth"`
+	// FrameRate is of the VUI timing info, zero without it
+	FrameRate float64 `json:"frame_rate"`
+	// GOPLengths counts the pictures from each IDR picture to the next,
+	// for the GOPs the stream holds whole
+	GOPLengths []int `json:"gop_lengths"`
+	// GOPStructure is the picture types of the first GOP in decoding
+	// order, such as IPBBPBB, of at most 64 pictures
+	GOPStructure string `json:"gop_structure"`
+}
+
+// Inspector reads an Annex B byte stream and describes each NAL unit and
+// its parameter sets and slice headers without decoding pictures, for
+// tools that look at streams.
+//
+//	inspector := NewInspector()
+//	err := inspector.Inspect(file, func(nal *NALInfo) error {
+//		fmt.Println(nal.Offset, NALUnitType[nal.Type])
+//		return nil
+//	})
+//	fmt.Println(inspector.Summary.GOPStructure)
+type Inspector struct {
+	Summary InspectSummary
+
+	// sps and pps hold the parameter sets received by id. stream holds
+	// the ones of the last slice and its picture order count state.
+	sps    map[int]*SPS
+	pps    map[int]*PPS
+	stream VideoStream
+	// prev is the last slice whose header parsed
+	prev        *SliceContext
+	pictureType string
+	picOrderCnt int
+	// gop is the picture types of the GOP being read, gopLength its
+	// pictures
+	gop       []byte
+	gopLength int
+	gopDone   bool
+}
+
+// NewInspector returns an inspector for one stream
+func NewInspector() *Inspector {
+	return &Inspector{
+		Summary: InspectSummary{NALUnitTypes: map[int]int{}},
+		sps:     map[int]*SPS{},
+		pps:     map[int]*PPS{},
+	}
+}
+
+// Inspect reads r until it ends, calling fn with each NAL unit. An error
+// from fn stops reading and is returned.
+func (i *Inspector) Inspect(r io.Reader, fn func(*NALInfo) error) error {
+	buf := []byte{}
+	var offset int64
+	eof := false
+	// Reads more of the stream into buf
+	chunk := make([]byte, 1<<16)
+	fill := func() error {
+		n, err := r.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		if err == io.EOF {
+			eof = true
+			return nil
+		}
+		return err
+	}
+	startCode := []byte{0, 0, 1}
+	for {
+		start := bytes.Index(buf, startCode)
+		if start < 0 {
+			if eof {
+				i.finishGOP(false)
+				return nil
+			}
+			// Keep what could begin a start code
+			if len(buf) > 3 {
+				offset += int64(len(buf) - 3)
+				buf = buf[len(buf)-3:]
+			}
+			if err := fill(); err != nil {
+				return err
+			}
+			continue
+		}
+		end := bytes.Index(buf[start+3:], startCode)
+		if end < 0 && !eof {
+			if err := fill(); err != nil {
+				return err
+			}
+			continue
+		}
+		end = start + 3 + end
+		if end < start+3 {
+			end = len(buf)
+		}
+		// A NAL unit never ends in a zero byte, B.2; these are
+		// trailing_zero_8bits or the zero_byte of the next start code
+		nalEnd := end
+		for nalEnd > start+3 && buf[nalEnd-1] == 0 {
+			nalEnd--
+		}
+		prefix := 3
+		if start > 0 && buf[start-1] == 0 {
+			prefix = 4
+		}
+		if nalEnd > start+3 {
+			info := i.inspect(buf[start+3 : nalEnd])
+			info.Offset = offset + int64(start+3-prefix)
+			info.Size = prefix + nalEnd - start - 3
+			i.Summary.NALUnits++
+			i.Summary.Bytes += int64(info.Size)
+			if err := fn(info); err != nil {
+				return err
+			}
+		}
+		offset += int64(nalEnd)
+		buf = buf[nalEnd:]
+	}
+}
+
+// Parses a NAL unit, updating the summary
+func (i *Inspector) inspect(data []byte) *NALInfo {
+	info := &NALInfo{}
+	nalUnit, err := NewNalUnit(data, len(data))
+	if err != nil {
+		info.Err = err
+		return info
+	}
+	info.Type, info.RefIdc = nalUnit.Type, nalUnit.RefIdc
+	i.Summary.NALUnitTypes[nalUnit.Type]++
+	switch nalUnit.Type {
+	case NALU_TYPE_SPS:
+		info.SPS, info.Err = NewSPS(nalUnit.RBSP(), false)
+		if info.Err != nil {
+			return info
+		}
+		sps := info.SPS
+		i.sps[sps.ID] = sps
+		i.Summary.Width, i.Summary.Height = sps.DisplaySize()
+		i.Summary.Profile, i.Summary.Level, i.Summary.Codec = sps.ProfileName(), sps.LevelName(), sps.Codec()
+		i.Summary.ChromaFormat, i.Summary.BitDepth = sps.ChromaFormat, sps.BitDepthLumaMinus8+8
+		i.Summary.FrameRate = sps.FrameRate()
+	case NALU_TYPE_PPS:
+		// pic_parameter_set_id then seq_parameter_set_id, 7.3.2.2
+		ids := readLeadingUE(nalUnit.RBSP(), 2)
+		if ids == nil {
+			info.Err = fmt.Errorf("PPS: %w", ErrTruncated)
+			return info
+		}
+		sps, ok := i.sps[ids[1]]
+		if !ok {
+			info.Err = fmt.Errorf("PPS names SPS %d, which was not received", ids[1])
+			return info
+		}
+		info.PPS, info.Err = NewPPS(sps, nalUnit.RBSP(), false)
+		if info.Err == nil {
+			i.pps[info.PPS.ID] = info.PPS
+		}
+	case NALU_TYPE_SLICE_IDR_PICTURE, NALU_TYPE_SLICE_NON_IDR_PICTURE:
+		info.Slice, info.Err = i.inspectSlice(nalUnit)
+	}
+	return info
+}
+
+// Parses a slice header, counting the picture it starts
+func (i *Inspector) inspectSlice(nalUnit *NalUnit) (slice *SliceInfo, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			slice, err = nil, fmt.Errorf("slice header: %v", r)
+		}
+	}()
+	if err := i.activate(nalUnit.RBSP()); err != nil {
+		return nil, err
+	}
+	sliceContext, err := parseSliceHeader(&i.stream, nalUnit, &BitReader{bytes: nalUnit.RBSP()})
+	if err != nil {
+		return nil, err
+	}
+	header, pps := sliceContext.Slice.Header, sliceContext.PPS
+	slice = &SliceInfo{
+		Type:     sliceTypeMap[header.SliceType],
+		IDR:      nalUnit.Type == NALU_TYPE_SLICE_IDR_PICTURE,
+		FirstMb:  header.FirstMbInSlice,
+		PPSID:    header.PPSID,
+		FrameNum: header.FrameNum,
+		IDRPicID: header.IDRPicID,
+		QP:       26 + pps.PicInitQpMinus26 + header.SliceQpDelta,
+	}
+	switch slice.Type {
+	case "P", "SP":
+		slice.RefsL0 = header.NumRefIdxL0ActiveMinus1 + 1
+	case "B":
+		slice.RefsL0, slice.RefsL1 = header.NumRefIdxL0ActiveMinus1+1, header.NumRefIdxL1ActiveMinus1+1
+	}
+	slice.NewPicture = i.prev == nil || header.FirstMbInSlice == 0 || sliceContext.IsNewPicture(i.prev)
+	if slice.NewPicture {
+		i.picOrderCnt = i.stream.poc.picOrderCnt(sliceContext.SPS, nalUnit, header)
+		i.startPicture(slice)
+	} else if sliceTypeRank[slice.Type] > sliceTypeRank[i.pictureType] {
+		// A picture is as intra as its least intra slice
+		i.pictureType = slice.Type
+		if n := len(i.gop); n > 0 && n == i.gopLength && !i.gopDone {
+			i.gop[n-1] = slice.Type[0]
+		}
+	}
+	slice.PicOrderCnt = i.picOrderCnt
+	i.prev = sliceContext
+	return slice, nil
+}
+
+// Makes the PPS a slice names and its SPS those of the stream. An SPS
+// that starts a new coded video sequence resets the picture order count.
+func (i *Inspector) activate(rbsp []byte) error {
+	// first_mb_in_slice, slice_type then pic_parameter_set_id, 7.3.3
+	ids := readLeadingUE(rbsp, 3)
+	if ids == nil {
+		return fmt.Errorf("slice header: %w", ErrTruncated)
+	}
+	pps, ok := i.pps[ids[2]]
+	if !ok {
+		return fmt.Errorf("slice names PPS %d, which was not received", ids[2])
+	}
+	sps, ok := i.sps[pps.SPSID]
+	if !ok {
+		return fmt.Errorf("PPS %d names SPS %d, which was not received", pps.ID, pps.SPSID)
+	}
+	if i.stream.SPS == nil || !sameSequence(i.stream.SPS, sps) {
+		i.stream = VideoStream{}
+		i.prev = nil
+	}
+	i.stream.SPS, i.stream.PPS = sps, pps
+	return nil
+}
+
+// Reads the n ue(v) fields that begin an RBSP, returning nil when they
+// are unreadable
+func readLeadingUE(rbsp []byte, n int) (values []int) {
+	defer func() {
+		if r := recover(); r != nil {
+			values = nil
+		}
+	}()
+	b := &BitReader{bytes: rbsp}
+	for ; n > 0; n-- {
+		values = append(values, ue(b.golomb()))
+	}
+	if err := b.Err(); err != nil {
+		return nil
+	}
+	return values
+}
+
+// Orders slice types from the most intra
+var sliceTypeRank = map[string]int{"I": 0, "SI": 0, "P": 1, "SP": 1, "B": 2}
+
+// Counts a picture starting with slice towards the summary and its GOP
+func (i *Inspector) startPicture(slice *SliceInfo) {
+	i.Summary.Pictures++
+	if slice.IDR {
+		i.finishGOP(true)
+		i.Summary.IDRPictures++
+	}
+	i.gopLength++
+	i.pictureType = slice.Type
+	// Pictures ahead of the first IDR picture are not a GOP
+	if i.Summary.IDRPictures > 0 && !i.gopDone && len(i.gop) < 64 {
+		i.gop = append(i.gop, slice.Type[0])
+	}
+}
+
+// Ends the GOP being read, whole when the next IDR picture ends it rather
+// than the end of the stream
+func (i *Inspector) finishGOP(whole bool) {
+	if len(i.gop) > 0 && !i.gopDone {
+		i.Summary.GOPStructure = string(i.gop)
+		i.gopDone = true
+	}
+	if whole && i.Summary.IDRPictures > 0 {
+		i.Summary.GOPLengths = append(i.Summary.GOPLengths, i.gopLength)
+	}
+	i.gopLength = 0
+}
@@ -0,0 +1,117 @@
+package h264
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// An I slice of an IDR picture with idr_pic_id 0, its header alone
+const idrSliceHeaderBits = "1 0001000 1 0000 1 000000 0 0 1 1"
+
+func TestInspector(t *testing.T) {
+	sps := nal(0x67, bitsToBytes(baselineSPSBits))
+	pps := nal(0x68, bitsToBytes(baselinePPSBits))
+	idr := nal(0x65, bitsToBytes(idrSliceHeaderBits))
+	stream := annexB(sps, pps, idr, nal(0x41, bitsToBytes(pSliceBits(1))), nal(0x41, bitsToBytes(pSliceBits(2))), idr)
+	// A 3 byte start code, then trailing_zero_8bits
+	tail, nonReference := len(stream), nal(0x21, bitsToBytes(pSliceBits(1)))
+	stream = append(stream, 0, 0, 1)
+	stream = append(stream, nonReference...)
+	stream = append(stream, 0, 0)
+
+	inspector := NewInspector()
+	var lines []string
+	err := inspector.Inspect(iotest.OneByteReader(bytes.NewReader(stream)), func(nal *NALInfo) error {
+		line := fmt.Sprintf("%d %d %s %d", nal.Offset, nal.Size, NALUnitType[nal.Type], nal.RefIdc)
+		if nal.Err != nil {
+			t.Fatalf("%s: unexpected error: %v\n", line, nal.Err)
+		}
+		if slice := nal.Slice; slice != nil {
+			line += fmt.Sprintf(" %s %d %d %d %d %v", slice.Type, slice.FrameNum, slice.PicOrderCnt, slice.QP, slice.RefsL0, slice.NewPicture)
+		}
+		lines = append(lines, line)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	offset := 0
+	expected := []string{}
+	for i, nalUnit := range [][]byte{sps, pps, idr} {
+		expected = append(expected, fmt.Sprintf("%d %d %s 3", offset, 4+len(nalUnit), NALUnitType[[]int{7, 8, 5}[i]]))
+		offset += 4 + len(nalUnit)
+	}
+	for i := range expected {
+		if !strings.HasPrefix(lines[i], expected[i]) {
+			t.Fatalf("unexpected NAL units\n%s\n", strings.Join(lines, "\n"))
+		}
+	}
+	for i, suffix := range []string{"I 0 0 26 0 true", "P 1 2 26 1 true", "P 2 4 26 1 true", "I 0 0 26 0 true", "P 1 2 26 1 true"} {
+		if !strings.HasSuffix(lines[2+i], suffix) {
+			t.Fatalf("unexpected slice %q, expected %q\n", lines[2+i], suffix)
+		}
+	}
+	last := lines[len(lines)-1]
+	if !strings.HasPrefix(last, fmt.Sprintf("%d %d ", tail, 3+len(nonReference))) || !strings.Contains(last, " 1 P ") {
+		t.Fatalf("unexpected last NAL unit %q\n", last)
+	}
+
+	summary := inspector.Summary
+	if summary.NALUnits != 7 || summary.Bytes != int64(len(stream)-2) || summary.Pictures != 5 || summary.IDRPictures != 2 {
+		t.Fatalf("unexpected counts %+v\n", summary)
+	}
+	if summary.Width != 320 || summary.Height != 240 || summary.Profile != "Baseline" || summary.Level != "3" {
+		t.Fatalf("unexpected stream %+v\n", summary)
+	}
+	if fmt.Sprint(summary.GOPLengths) != "[3]" || summary.GOPStructure != "IPP" {
+		t.Fatalf("unexpected GOPs %v %q\n", summary.GOPLengths, summary.GOPStructure)
+	}
+}
+
+func TestInspectorErrors(t *testing.T) {
+	// A PPS before any SPS and a slice before any PPS are reported, and
+	// reading goes on
+	stream := annexB(nal(0x68, bitsToBytes(baselinePPSBits)), nal(0x67, bitsToBytes(baselineSPSBits)), nal(0x41, bitsToBytes(pSliceBits(1))))
+	var errs []string
+	err := NewInspector().Inspect(bytes.NewReader(stream), func(nal *NALInfo) error {
+		errs = append(errs, fmt.Sprint(nal.Err != nil))
+		return nil
+	})
+	if err != nil || fmt.Sprint(errs) != "[true false true]" {
+		t.Fatalf("unexpected errors %v %v\n", errs, err)
+	}
+}
+
+func TestInspectorParameterSetIDs(t *testing.T) {
+	// SPS 1 has a 5 bit frame_num. Slices naming PPS 0 are read with
+	// SPS 0 however many parameter sets follow it, and a repeated SPS 0
+	// keeps PPS 0.
+	sps1Bits := "01000010 00000000 00011110 010 010 1 011 010 0 000010100 0001111 1 1 0 0 1"
+	pps1Bits := "010 010 0 0 1 1 1 0 00 1 1 1 0 0 0 1"
+	sps := nal(0x67, bitsToBytes(baselineSPSBits))
+	stream := annexB(sps, nal(0x67, bitsToBytes(sps1Bits)), nal(0x68, bitsToBytes(baselinePPSBits)),
+		nal(0x68, bitsToBytes(pps1Bits)), nal(0x65, bitsToBytes(idrSliceHeaderBits)),
+		nal(0x41, bitsToBytes(pSliceBits(1))), sps, nal(0x41, bitsToBytes(pSliceBits(2))))
+	var lines []string
+	err := NewInspector().Inspect(bytes.NewReader(stream), func(nal *NALInfo) error {
+		if nal.Err != nil {
+			t.Fatalf("%s: unexpected error: %v\n", NALUnitType[nal.Type], nal.Err)
+		}
+		if pps := nal.PPS; pps != nil {
+			lines = append(lines, fmt.Sprintf("PPS %d %d", pps.ID, pps.SPSID))
+		}
+		if slice := nal.Slice; slice != nil {
+			lines = append(lines, fmt.Sprintf("%s %d %d %v", slice.Type, slice.FrameNum, slice.PicOrderCnt, slice.NewPicture))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if fmt.Sprint(lines) != "[PPS 0 0 PPS 1 1 I 0 0 true P 1 2 true P 2 4 true]" {
+		t.Fatalf("unexpected NAL units %v\n", lines)
+	}
+}
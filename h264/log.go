@@ -0,0 +1,51 @@
+package h264
+
+import (
+	"context"
+	"log/slog"
+)
+
+// SyntaxTracer receives every fixed length syntax element read by
+// BitReader.NextField: its name, the bit position it started at within
+// the RBSP and its value
+type SyntaxTracer func(name string, bitPosition int, value int)
+
+// discardHandler is the default handler so logging is opt-in and a
+// disabled logger costs only an Enabled check
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+var discardLogger = slog.New(discardHandler{})
+
+func (b *BitReader) logger() *slog.Logger {
+	if b == nil || b.log == nil {
+		return discardLogger
+	}
+	return b.log
+}
+
+// Callers on hot paths check this before building log arguments
+func (b *BitReader) logEnabled(level slog.Level) bool {
+	return b != nil && b.log != nil && b.log.Enabled(context.Background(), level)
+}
+
+// Returns a reader over buf sharing b's logger and syntax tracer
+func (b *BitReader) child(buf []byte) *BitReader {
+	child := &BitReader{bytes: buf}
+	if b != nil {
+		child.log = b.log
+		child.trace = b.trace
+	}
+	return child
+}
+
+// Logs a syntax element or process the decoder does not implement yet
+func (b *BitReader) todo(what string) {
+	if b.logEnabled(slog.LevelDebug) {
+		b.logger().Debug("TODO: not implemented", "what", what)
+	}
+}
@@ -0,0 +1,236 @@
+package h264
+
+import "sort"
+
+// Accounting and concealment of the macroblocks that no slice decoded. A
+// slice that fails to parse is dropped without ending the stream, and the
+// picture records which of its macroblocks that slice would have covered.
+// Lost macroblocks of intra pictures, or of pictures without a reference
+// picture of their size, are interpolated from their neighbours; those of
+// inter pictures are copied from the co-located macroblocks of the last
+// reference picture. Concealment works on the sample planes of the
+// picture, which stay mid-grey while slice data is not reconstructed.
+
+// LossStats reports how many of a picture's macroblocks were lost and how
+// they were concealed
+type LossStats struct {
+	TotalMbs   int
+	DecodedMbs int
+	LostMbs    int
+	// LostSlices counts the slices of the picture that failed to parse
+	LostSlices int
+	// SpatialMbs counts the lost macroblocks interpolated from their
+	// neighbours, TemporalMbs those copied from the reference picture
+	SpatialMbs  int
+	TemporalMbs int
+}
+
+// Returns the address of the first macroblock of a slice, which is
+// first_mb_in_slice in macroblock pairs for MBAFF frames, 7-33
+func sliceFirstMbAddr(sps *SPS, header *SliceHeader) int {
+	return header.FirstMbInSlice * (1 + MbaffFrameFlag(sps, header))
+}
+
+// Reads the slice header of rbsp up to field_pic_flag, enough to place a
+// slice that failed to parse within its picture. Returns nil when that
+// much is unreadable.
+func readSliceStart(sps *SPS, rbsp []byte) (header *SliceHeader) {
+	defer func() {
+		if r := recover(); r != nil {
+			header = nil
+		}
+	}()
+	b := &BitReader{bytes: rbsp}
+	header = &SliceHeader{FirstMbInSlice: ue(b.golomb())}
+	if sps == nil {
+		// Without an SPS a slice is only placed outside MBAFF
+		return header
+	}
+	header.SliceType = ue(b.golomb())
+	header.PPSID = ue(b.golomb())
+	if sps.UseSeparateColorPlane {
+		header.ColorPlaneID = b.NextField("ColorPlaneID", 2)
+	}
+	header.FrameNum = b.NextField("FrameNum", sps.Log2MaxFrameNumMinus4+4)
+	if !sps.FrameMbsOnly {
+		header.FieldPic = b.NextField("FieldPic", 1) == 1
+	}
+	if err := b.Err(); err != nil {
+		return nil
+	}
+	return header
+}
+
+// Marks the macroblocks covered by decoded slices. Without slice groups a
+// slice runs in raster order until the first macroblock of the next slice.
+// A lost slice whose first macroblock is unknown lies somewhere after the
+// slice received before it, so that slice is not counted as decoded.
+func (f *Frame) markDecoded() {
+	starts := []sliceStart{}
+	for i, start := range f.sliceStarts {
+		if start.firstMb < 0 {
+			continue
+		}
+		if i+1 < len(f.sliceStarts) && f.sliceStarts[i+1].firstMb < 0 {
+			start.ok = false
+		}
+		starts = append(starts, start)
+	}
+	sort.SliceStable(starts, func(i, j int) bool { return starts[i].firstMb < starts[j].firstMb })
+	for i, start := range starts {
+		if !start.ok {
+			continue
+		}
+		end := len(f.MbDecoded)
+		if i+1 < len(starts) && starts[i+1].firstMb < end {
+			end = starts[i+1].firstMb
+		}
+		for mbAddr := start.firstMb; mbAddr < end; mbAddr++ {
+			f.MbDecoded[mbAddr] = true
+		}
+	}
+}
+
+// Marks the decoded macroblocks of the picture and counts those lost
+func (f *Frame) countLost() {
+	f.markDecoded()
+	f.Loss.TotalMbs = len(f.MbDecoded)
+	f.Loss.DecodedMbs = 0
+	for _, decoded := range f.MbDecoded {
+		if decoded {
+			f.Loss.DecodedMbs++
+		}
+	}
+	f.Loss.LostMbs = f.Loss.TotalMbs - f.Loss.DecodedMbs
+}
+
+// Fills the lost macroblocks of the picture, counting them in Loss. ref is
+// the last reference picture of the stream and may be nil.
+func (f *Frame) conceal(ref *Frame) {
+	if f.Loss.LostMbs == 0 {
+		return
+	}
+	temporal := !f.Intra && ref != nil && samePlanes(f, ref)
+	// available holds the decoded and the concealed macroblocks, so holes
+	// are filled from their edges inwards
+	available := append([]bool{}, f.MbDecoded...)
+	for mbAddr, decoded := range f.MbDecoded {
+		if decoded {
+			continue
+		}
+		if temporal {
+			f.copyMb(ref, mbAddr)
+			f.Loss.TemporalMbs++
+		} else {
+			f.interpolateMb(mbAddr, available)
+			f.Loss.SpatialMbs++
+		}
+		available[mbAddr] = true
+	}
+}
+
+func samePlanes(a, b *Frame) bool {
+	return a.Width == b.Width && a.Height == b.Height &&
+		a.ChromaWidth == b.ChromaWidth && a.ChromaHeight == b.ChromaHeight &&
+		a.BitDepthLuma == b.BitDepthLuma && a.BitDepthChroma == b.BitDepthChroma
+}
+
+// Reports whether macroblock addresses count macroblock pairs top to
+// bottom, as in MBAFF frames, 6.4.1
+func (f *Frame) mbaff() bool {
+	return f.SPS != nil && f.SPS.MBAdaptiveFrameField && !f.FieldPic
+}
+
+// Returns the column and row in macroblocks of the macroblock at mbAddr
+func (f *Frame) mbPosition(mbAddr int) (int, int) {
+	if f.mbaff() {
+		pair := mbAddr / 2
+		return pair % f.MbWidth, pair/f.MbWidth*2 + mbAddr%2
+	}
+	return mbAddr % f.MbWidth, mbAddr / f.MbWidth
+}
+
+// Returns the address of the macroblock at a column and row
+func (f *Frame) mbAddress(x, y int) int {
+	if f.mbaff() {
+		return 2*(y/2*f.MbWidth+x) + y%2
+	}
+	return y*f.MbWidth + x
+}
+
+// MbWidthC and MbHeightC of the picture, 0 for monochrome
+func (f *Frame) mbChromaSize() (int, int) {
+	if f.ChromaWidth == 0 {
+		return 0, 0
+	}
+	return f.ChromaWidth / f.MbWidth, f.ChromaHeight / f.MbHeight
+}
+
+// Copies the co-located macroblock at mbAddr from ref
+func (f *Frame) copyMb(ref *Frame, mbAddr int) {
+	mbX, mbY := f.mbPosition(mbAddr)
+	copyBlock(f.Luma, ref.Luma, f.Width, mbX*16, mbY*16, 16, 16)
+	if mbWidthC, mbHeightC := f.mbChromaSize(); mbWidthC > 0 {
+		copyBlock(f.Cb, ref.Cb, f.ChromaWidth, mbX*mbWidthC, mbY*mbHeightC, mbWidthC, mbHeightC)
+		copyBlock(f.Cr, ref.Cr, f.ChromaWidth, mbX*mbWidthC, mbY*mbHeightC, mbWidthC, mbHeightC)
+	}
+}
+
+func copyBlock(dst, src []uint16, width, x0, y0, w, h int) {
+	for y := y0; y < y0+h; y++ {
+		copy(dst[y*width+x0:y*width+x0+w], src[y*width+x0:])
+	}
+}
+
+// Fills the macroblock at mbAddr from the edge samples of its available
+// left, right, top and bottom neighbours
+func (f *Frame) interpolateMb(mbAddr int, available []bool) {
+	mbX, mbY := f.mbPosition(mbAddr)
+	isAvailable := func(x, y int) bool {
+		return x >= 0 && y >= 0 && x < f.MbWidth && y < f.MbHeight && available[f.mbAddress(x, y)]
+	}
+	neighbours := [4]bool{
+		isAvailable(mbX-1, mbY),
+		isAvailable(mbX+1, mbY),
+		isAvailable(mbX, mbY-1),
+		isAvailable(mbX, mbY+1),
+	}
+	interpolateBlock(f.Luma, f.Width, mbX*16, mbY*16, 16, 16, neighbours, f.BitDepthLuma)
+	if mbWidthC, mbHeightC := f.mbChromaSize(); mbWidthC > 0 {
+		interpolateBlock(f.Cb, f.ChromaWidth, mbX*mbWidthC, mbY*mbHeightC, mbWidthC, mbHeightC, neighbours, f.BitDepthChroma)
+		interpolateBlock(f.Cr, f.ChromaWidth, mbX*mbWidthC, mbY*mbHeightC, mbWidthC, mbHeightC, neighbours, f.BitDepthChroma)
+	}
+}
+
+// Weights each neighbour's edge sample by the distance from the opposite
+// edge of the block, so samples follow the nearer neighbours. neighbours
+// is left, right, top and bottom; a block without any is mid-grey.
+func interpolateBlock(plane []uint16, width, x0, y0, w, h int, neighbours [4]bool, bitDepth int) {
+	left, right, top, bottom := neighbours[0], neighbours[1], neighbours[2], neighbours[3]
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sum, weights := 0, 0
+			if left {
+				sum += int(plane[(y0+y)*width+x0-1]) * (w - x)
+				weights += w - x
+			}
+			if right {
+				sum += int(plane[(y0+y)*width+x0+w]) * (x + 1)
+				weights += x + 1
+			}
+			if top {
+				sum += int(plane[(y0-1)*width+x0+x]) * (h - y)
+				weights += h - y
+			}
+			if bottom {
+				sum += int(plane[(y0+h)*width+x0+x]) * (y + 1)
+				weights += y + 1
+			}
+			v := 1 << (bitDepth - 1)
+			if weights > 0 {
+				v = (sum + weights/2) / weights
+			}
+			plane[(y0+y)*width+x0+x] = uint16(v)
+		}
+	}
+}
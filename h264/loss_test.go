@@ -0,0 +1,145 @@
+package h264
+
+import (
+	"fmt"
+	"testing"
+)
+
+func lossTestFrame(mbWidth, mbHeight int, sps *SPS) *Frame {
+	sps.ChromaFormat = 1
+	sps.PicWidthInMbsMinus1 = mbWidth - 1
+	sps.PicHeightInMapUnitsMinus1 = mbHeight - 1
+	return NewFrame(sps, &PPS{}, &SliceHeader{})
+}
+
+func TestCountLost(t *testing.T) {
+	frame := lossTestFrame(3, 2, &SPS{FrameMbsOnly: true})
+	// Slices at 0 and 4 decoded, the slice at 2 was lost
+	frame.sliceStarts = []sliceStart{{0, true}, {2, false}, {4, true}}
+	frame.countLost()
+	if fmt.Sprint(frame.MbDecoded) != "[true true false false true true]" {
+		t.Fatalf("unexpected decoded macroblocks %v\n", frame.MbDecoded)
+	}
+	if loss := frame.Loss; loss.TotalMbs != 6 || loss.DecodedMbs != 4 || loss.LostMbs != 2 {
+		t.Fatalf("unexpected loss %+v\n", loss)
+	}
+}
+
+func TestCountLostUnknownStart(t *testing.T) {
+	// A lost slice of unknown first_mb_in_slice arrived after the slice at
+	// 0, so it lies within 0 to 3 and none of them counts as decoded
+	frame := lossTestFrame(3, 2, &SPS{FrameMbsOnly: true})
+	frame.sliceStarts = []sliceStart{{0, true}, {-1, false}, {4, true}}
+	frame.countLost()
+	if fmt.Sprint(frame.MbDecoded) != "[false false false false true true]" {
+		t.Fatalf("unexpected decoded macroblocks %v\n", frame.MbDecoded)
+	}
+	if frame.Loss.LostMbs != 4 {
+		t.Fatalf("unexpected loss %+v\n", frame.Loss)
+	}
+}
+
+func TestAddLostSliceMbaff(t *testing.T) {
+	// first_mb_in_slice counts macroblock pairs in MBAFF frames
+	sps := &SPS{MBAdaptiveFrameField: true}
+	// One row of map units is two macroblock rows
+	frame := lossTestFrame(2, 1, sps)
+	nalUnit := &NalUnit{Type: NALU_TYPE_SLICE_NON_IDR_PICTURE, RefIdc: 1}
+	frame.sliceStarts = []sliceStart{{0, true}}
+	frame.addLostSlice(sps, nalUnit, &SliceHeader{FirstMbInSlice: 1})
+	if start := frame.sliceStarts[1]; start.firstMb != 2 || start.ok {
+		t.Fatalf("unexpected lost slice start %+v\n", start)
+	}
+	frame.countLost()
+	if fmt.Sprint(frame.MbDecoded) != "[true true false false]" || frame.Loss.LostSlices != 1 {
+		t.Fatalf("unexpected decoded macroblocks %v %+v\n", frame.MbDecoded, frame.Loss)
+	}
+	// A field slice is not scaled
+	frame.addLostSlice(sps, nalUnit, &SliceHeader{FirstMbInSlice: 1, FieldPic: true})
+	if start := frame.sliceStarts[2]; start.firstMb != 1 {
+		t.Fatalf("unexpected field slice start %+v\n", start)
+	}
+}
+
+func TestReadSliceStart(t *testing.T) {
+	// first_mb_in_slice 3, P slice, PPS 0, frame_num 5 in 4 bits,
+	// field_pic_flag 0, then a slice that ends early
+	sps := &SPS{MBAdaptiveFrameField: true}
+	header := readSliceStart(sps, bitsToBytes("00100 1 1 0101 0 1"))
+	if header == nil || header.FirstMbInSlice != 3 || header.FrameNum != 5 || header.FieldPic {
+		t.Fatalf("unexpected slice start %+v\n", header)
+	}
+	if addr := sliceFirstMbAddr(sps, header); addr != 6 {
+		t.Fatalf("expected macroblock 6, got %d\n", addr)
+	}
+	if header := readSliceStart(sps, []byte{0}); header != nil {
+		t.Fatalf("expected no slice start, got %+v\n", header)
+	}
+}
+
+func TestConcealSpatial(t *testing.T) {
+	// The middle macroblock of an intra picture three wide is lost and
+	// interpolated between its left and right neighbours
+	frame := lossTestFrame(3, 1, &SPS{FrameMbsOnly: true})
+	for i := range frame.Luma {
+		frame.Luma[i] = []uint16{100, 0, 200}[i%48/16]
+	}
+	frame.sliceStarts = []sliceStart{{0, true}, {1, false}, {2, true}}
+	frame.countLost()
+	frame.conceal(nil)
+	if frame.Loss.SpatialMbs != 1 || frame.Loss.TemporalMbs != 0 {
+		t.Fatalf("unexpected concealment %+v\n", frame.Loss)
+	}
+	if first, last := frame.Luma[16], frame.Luma[31]; first != 106 || last != 194 {
+		t.Fatalf("unexpected interpolated samples %d %d\n", first, last)
+	}
+	if frame.Luma[15] != 100 || frame.Luma[32] != 200 {
+		t.Fatalf("decoded samples changed\n")
+	}
+}
+
+func TestConcealTemporal(t *testing.T) {
+	// A lost macroblock of an inter picture is copied from the reference
+	sps := &SPS{FrameMbsOnly: true}
+	ref := lossTestFrame(2, 1, sps)
+	for i := range ref.Luma {
+		ref.Luma[i] = 50
+	}
+	for i := range ref.Cb {
+		ref.Cb[i], ref.Cr[i] = 60, 70
+	}
+	frame := lossTestFrame(2, 1, sps)
+	frame.Intra = false
+	frame.sliceStarts = []sliceStart{{0, true}, {1, false}}
+	frame.countLost()
+	frame.conceal(ref)
+	if frame.Loss.TemporalMbs != 1 || frame.Loss.SpatialMbs != 0 {
+		t.Fatalf("unexpected concealment %+v\n", frame.Loss)
+	}
+	if frame.Luma[15] != 128 || frame.Luma[16] != 50 || frame.Luma[32*15+31] != 50 {
+		t.Fatalf("unexpected luma %d %d %d\n", frame.Luma[15], frame.Luma[16], frame.Luma[32*15+31])
+	}
+	if frame.Cb[7] != 128 || frame.Cb[8] != 60 || frame.Cr[16*7+15] != 70 {
+		t.Fatalf("unexpected chroma %d %d %d\n", frame.Cb[7], frame.Cb[8], frame.Cr[16*7+15])
+	}
+
+	// A reference of another size leaves spatial concealment
+	frame = lossTestFrame(2, 1, sps)
+	frame.Intra = false
+	frame.sliceStarts = []sliceStart{{0, true}, {1, false}}
+	frame.countLost()
+	frame.conceal(lossTestFrame(3, 1, sps))
+	if frame.Loss.SpatialMbs != 1 {
+		t.Fatalf("unexpected concealment %+v\n", frame.Loss)
+	}
+}
+
+func TestMbPositionMbaff(t *testing.T) {
+	// MBAFF addresses run down each macroblock pair
+	frame := lossTestFrame(2, 1, &SPS{MBAdaptiveFrameField: true})
+	for mbAddr, want := range [][2]int{{0, 0}, {0, 1}, {1, 0}, {1, 1}} {
+		if x, y := frame.mbPosition(mbAddr); x != want[0] || y != want[1] || frame.mbAddress(x, y) != mbAddr {
+			t.Fatalf("macroblock %d at %d,%d\n", mbAddr, x, y)
+		}
+	}
+}
@@ -0,0 +1,697 @@
+package h264
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"sort"
+	"time"
+)
+
+// ErrInvalidMKV is returned for a file that is not Matroska
+var ErrInvalidMKV = errors.New("h264: invalid Matroska file")
+
+// EBML element IDs, RFC 8794 11.2, and Matroska element IDs, RFC 9559 5.1,
+// with their length markers
+const (
+	ebmlIDHeader             = 0x1a45dfa3
+	ebmlIDVersion            = 0x4286
+	ebmlIDReadVersion        = 0x42f7
+	ebmlIDMaxIDLength        = 0x42f2
+	ebmlIDMaxSizeLength      = 0x42f3
+	ebmlIDDocType            = 0x4282
+	ebmlIDDocTypeVersion     = 0x4287
+	ebmlIDDocTypeReadVersion = 0x4285
+
+	mkvIDSegment             = 0x18538067
+	mkvIDSeekHead            = 0x114d9b74
+	mkvIDSeek                = 0x4dbb
+	mkvIDSeekID              = 0x53ab
+	mkvIDSeekPosition        = 0x53ac
+	mkvIDInfo                = 0x1549a966
+	mkvIDTimestampScale      = 0x2ad7b1
+	mkvIDDuration            = 0x4489
+	mkvIDMuxingApp           = 0x4d80
+	mkvIDWritingApp          = 0x5741
+	mkvIDTracks              = 0x1654ae6b
+	mkvIDTrackEntry          = 0xae
+	mkvIDTrackNumber         = 0xd7
+	mkvIDTrackUID            = 0x73c5
+	mkvIDTrackType           = 0x83
+	mkvIDFlagLacing          = 0x9c
+	mkvIDDefaultDuration     = 0x23e383
+	mkvIDCodecID             = 0x86
+	mkvIDCodecPrivate        = 0x63a2
+	mkvIDVideo               = 0xe0
+	mkvIDPixelWidth          = 0xb0
+	mkvIDPixelHeight         = 0xba
+	mkvIDContentEncodings    = 0x6d80
+	mkvIDContentEncoding     = 0x6240
+	mkvIDContentCompression  = 0x5034
+	mkvIDContentCompAlgo     = 0x4254
+	mkvIDContentCompSettings = 0x4255
+	mkvIDContentEncryption   = 0x5035
+	mkvIDCluster             = 0x1f43b675
+	mkvIDTimestamp           = 0xe7
+	mkvIDSimpleBlock         = 0xa3
+	mkvIDBlockGroup          = 0xa0
+	mkvIDBlock               = 0xa1
+	mkvIDReferenceBlock      = 0xfb
+	mkvIDCues                = 0x1c53bb6b
+	mkvIDCuePoint            = 0xbb
+	mkvIDCueTime             = 0xb3
+	mkvIDCueTrackPositions   = 0xb7
+	mkvIDCueTrack            = 0xf7
+	mkvIDCueClusterPosition  = 0xf1
+	mkvIDTags                = 0x1254c367
+	mkvIDChapters            = 0x1043a770
+	mkvIDAttachments         = 0x1941a469
+)
+
+// The CodecID of H.264 tracks, whose CodecPrivate is the avcC record
+const mkvCodecH264 = "V_MPEG4/ISO/AVC"
+
+const mkvTrackTypeVideo = 1
+
+// Header stripping, the one ContentCompAlgo read
+const mkvCompressionHeaderStripping = 3
+
+// Elements of a Segment. A Cluster of unknown size ends at the next one.
+var mkvSegmentChildren = map[uint32]bool{
+	mkvIDSeekHead:    true,
+	mkvIDInfo:        true,
+	mkvIDTracks:      true,
+	mkvIDCluster:     true,
+	mkvIDCues:        true,
+	mkvIDTags:        true,
+	mkvIDChapters:    true,
+	mkvIDAttachments: true,
+}
+
+// MKVTrack is a track of a Matroska file
+type MKVTrack struct {
+	Number  int
+	Type    int
+	CodecID string
+	// Width and Height are the pixel size of a video track
+	Width, Height int
+	// DefaultDuration is the duration of a frame when the file gives it
+	DefaultDuration time.Duration
+	// AVCConfig is the CodecPrivate avcC record of an H.264 track
+	AVCConfig *AVCDecoderConfigurationRecord
+	// Samples counts the frames of the track's blocks
+	Samples int
+
+	samples []mkvSample
+	// strippedHeader is removed from the start of every frame by header
+	// stripping compression
+	strippedHeader []byte
+	// unsupportedEncoding names a content encoding frames cannot be read
+	// through
+	unsupportedEncoding string
+}
+
+type mkvSample struct {
+	offset   int64
+	size     int64
+	pts, dts time.Duration
+	keyframe bool
+}
+
+// MKVDemuxer reads the frames of the first H.264 track of a Matroska or
+// WebM file, RFC 9559, from the blocks of its clusters in decoding order.
+// Clusters and the Segment may be of unknown size, as live recordings
+// write them, and a file cut short ends at its last whole frame.
+//
+// Matroska stores presentation timestamps only. Decode timestamps are
+// the presentation timestamps in increasing order, delayed by the
+// deepest reordering of the track so none follows its presentation.
+//
+//	demuxer, err := NewMKVDemuxer(file)
+//	err = NewDecoder(WithFrameHandler(handler)).DecodeSamples(demuxer)
+type MKVDemuxer struct {
+	DocType string
+	// Duration of the segment when the file gives it
+	Duration time.Duration
+	Tracks   []*MKVTrack
+	// Track is the H.264 track samples are read from
+	Track *MKVTrack
+
+	r io.ReadSeeker
+	// timestampScale is the nanoseconds of a timestamp tick
+	timestampScale int64
+	end            int64
+	next           int
+}
+
+// NewMKVDemuxer reads the elements of r, leaving the frames to be read a
+// sample at a time
+func NewMKVDemuxer(r io.ReadSeeker) (*MKVDemuxer, error) {
+	d := &MKVDemuxer{r: r, timestampScale: 1000000}
+	if err := d.readElements(); err != nil {
+		return nil, err
+	}
+	for _, track := range d.Tracks {
+		// A recording cut short ends in a partial frame
+		for n := len(track.samples); n > 0 && track.samples[n-1].offset+track.samples[n-1].size > d.end; n-- {
+			track.samples = track.samples[:n-1]
+		}
+		track.Samples = len(track.samples)
+		mkvDecodeTimestamps(track.samples)
+		if d.Track == nil && track.AVCConfig != nil {
+			d.Track = track
+		}
+	}
+	if d.Track == nil {
+		return nil, fmt.Errorf("%w: no H.264 track", ErrInvalidMKV)
+	}
+	return d, nil
+}
+
+// ebmlElementHeader is the ID and data size of an element in the file
+type ebmlElementHeader struct {
+	id uint32
+	// size is -1 when unknown
+	size       int64
+	dataOffset int64
+}
+
+// Returns the length of a variable size integer from its first byte, 4 of
+// RFC 8794. A first byte of 0 gives 9, which is invalid.
+func ebmlVintLength(b byte) int {
+	return bits.LeadingZeros8(b) + 1
+}
+
+// Reads a variable size integer of data. IDs keep their length marker;
+// sizes of all ones are unknown, -1.
+func ebmlVint(data []byte, id bool) (v int64, n int) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0
+	}
+	n = ebmlVintLength(data[0])
+	if n > len(data) {
+		return 0, 0
+	}
+	if id {
+		v = int64(data[0])
+	} else {
+		v = int64(data[0] & (0xff >> n))
+	}
+	for _, b := range data[1:n] {
+		v = v<<8 | int64(b)
+	}
+	if !id && v == 1<<(7*n)-1 {
+		v = -1
+	}
+	return v, n
+}
+
+// Reads the header of the element at offset
+func (d *MKVDemuxer) readElementHeader(offset int64) (ebmlElementHeader, error) {
+	if _, err := d.r.Seek(offset, io.SeekStart); err != nil {
+		return ebmlElementHeader{}, err
+	}
+	header := make([]byte, 12)
+	n := 0
+	for _, id := range []bool{true, false} {
+		if _, err := io.ReadFull(d.r, header[n:n+1]); err != nil {
+			return ebmlElementHeader{}, err
+		}
+		length := ebmlVintLength(header[n])
+		if length > 8 || (id && length > 4) {
+			return ebmlElementHeader{}, fmt.Errorf("%w: element header at %d", ErrInvalidMKV, offset)
+		}
+		if _, err := io.ReadFull(d.r, header[n+1:n+length]); err != nil {
+			return ebmlElementHeader{}, err
+		}
+		n += length
+	}
+	id, idLength := ebmlVint(header, true)
+	size, _ := ebmlVint(header[idLength:], false)
+	return ebmlElementHeader{id: uint32(id), size: size, dataOffset: offset + int64(n)}, nil
+}
+
+// Reads the data of an element of known size whole
+func (d *MKVDemuxer) readElementData(e ebmlElementHeader) ([]byte, error) {
+	if e.size < 0 || e.dataOffset+e.size > d.end {
+		return nil, fmt.Errorf("%w: element %x at %d", ErrTruncated, e.id, e.dataOffset)
+	}
+	if _, err := d.r.Seek(e.dataOffset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data := make([]byte, e.size)
+	_, err := io.ReadFull(d.r, data)
+	return data, err
+}
+
+// Calls fn with each child of the data of a master element read whole
+func forEachEBMLElement(data []byte, fn func(id uint32, payload []byte) error) error {
+	for len(data) > 0 {
+		id, idLength := ebmlVint(data, true)
+		size, sizeLength := ebmlVint(data[idLength:], false)
+		if idLength == 0 || sizeLength == 0 || size < 0 || int64(len(data)-idLength-sizeLength) < size {
+			return fmt.Errorf("%w: element of %d bytes", ErrInvalidMKV, size)
+		}
+		data = data[idLength+sizeLength:]
+		if err := fn(uint32(id), data[:size]); err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+func ebmlUint(data []byte) uint64 {
+	v := uint64(0)
+	for _, b := range data {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+func ebmlFloat(data []byte) float64 {
+	switch len(data) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(data))
+	}
+	return 0
+}
+
+// Reads the EBML header and the first Segment
+func (d *MKVDemuxer) readElements() error {
+	end, err := d.r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	d.end = end
+	header, err := d.readElementHeader(0)
+	if err != nil || header.id != ebmlIDHeader {
+		return fmt.Errorf("%w: no EBML header", ErrInvalidMKV)
+	}
+	data, err := d.readElementData(header)
+	if err != nil {
+		return err
+	}
+	if err := forEachEBMLElement(data, func(id uint32, payload []byte) error {
+		if id == ebmlIDDocType {
+			d.DocType = string(payload)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if d.DocType != "matroska" && d.DocType != "webm" {
+		return fmt.Errorf("%w: document type %q", ErrInvalidMKV, d.DocType)
+	}
+
+	offset := header.dataOffset + header.size
+	for {
+		segment, err := d.readElementHeader(offset)
+		if err != nil {
+			return fmt.Errorf("%w: no Segment", ErrInvalidMKV)
+		}
+		if segment.id == mkvIDSegment {
+			segmentEnd := segment.dataOffset + segment.size
+			if segment.size < 0 || segmentEnd > end {
+				segmentEnd = end
+			}
+			return d.readSegment(segment.dataOffset, segmentEnd)
+		}
+		if segment.size < 0 {
+			return fmt.Errorf("%w: element %x of unknown size", ErrInvalidMKV, segment.id)
+		}
+		offset = segment.dataOffset + segment.size
+	}
+}
+
+func (d *MKVDemuxer) readSegment(offset, end int64) error {
+	for offset < end {
+		e, err := d.readElementHeader(offset)
+		if err != nil {
+			// Cut short in an element header
+			return nil
+		}
+		switch e.id {
+		case mkvIDInfo, mkvIDTracks:
+			data, err := d.readElementData(e)
+			if err != nil {
+				return err
+			}
+			if e.id == mkvIDInfo {
+				err = d.parseInfo(data)
+			} else {
+				err = d.parseTracks(data)
+			}
+			if err != nil {
+				return err
+			}
+		case mkvIDCluster:
+			clusterEnd := e.dataOffset + e.size
+			if e.size < 0 || clusterEnd > end {
+				clusterEnd = end
+			}
+			if offset, err = d.readCluster(e.dataOffset, clusterEnd, e.size < 0); err != nil {
+				return err
+			}
+			continue
+		}
+		if e.size < 0 {
+			return fmt.Errorf("%w: element %x of unknown size", ErrInvalidMKV, e.id)
+		}
+		offset = e.dataOffset + e.size
+	}
+	return nil
+}
+
+func (d *MKVDemuxer) parseInfo(info []byte) error {
+	duration := 0.0
+	err := forEachEBMLElement(info, func(id uint32, payload []byte) error {
+		switch id {
+		case mkvIDTimestampScale:
+			if scale := int64(ebmlUint(payload)); scale > 0 {
+				d.timestampScale = scale
+			}
+		case mkvIDDuration:
+			duration = ebmlFloat(payload)
+		}
+		return nil
+	})
+	d.Duration = time.Duration(duration * float64(d.timestampScale))
+	return err
+}
+
+func (d *MKVDemuxer) parseTracks(tracks []byte) error {
+	return forEachEBMLElement(tracks, func(id uint32, entry []byte) error {
+		if id != mkvIDTrackEntry {
+			return nil
+		}
+		track := &MKVTrack{}
+		var codecPrivate []byte
+		err := forEachEBMLElement(entry, func(id uint32, payload []byte) error {
+			switch id {
+			case mkvIDTrackNumber:
+				track.Number = int(ebmlUint(payload))
+			case mkvIDTrackType:
+				track.Type = int(ebmlUint(payload))
+			case mkvIDCodecID:
+				track.CodecID = string(payload)
+			case mkvIDCodecPrivate:
+				codecPrivate = payload
+			case mkvIDDefaultDuration:
+				track.DefaultDuration = time.Duration(ebmlUint(payload))
+			case mkvIDVideo:
+				return forEachEBMLElement(payload, func(id uint32, payload []byte) error {
+					switch id {
+					case mkvIDPixelWidth:
+						track.Width = int(ebmlUint(payload))
+					case mkvIDPixelHeight:
+						track.Height = int(ebmlUint(payload))
+					}
+					return nil
+				})
+			case mkvIDContentEncodings:
+				return track.parseContentEncodings(payload)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if track.CodecID == mkvCodecH264 {
+			if track.AVCConfig, err = NewAVCDecoderConfigurationRecord(codecPrivate); err != nil {
+				return fmt.Errorf("track %d: %w", track.Number, err)
+			}
+		}
+		d.Tracks = append(d.Tracks, track)
+		return nil
+	})
+}
+
+// Notes header stripping, the compression muxers use on H.264 tracks;
+// frames of any other content encoding cannot be read
+func (t *MKVTrack) parseContentEncodings(encodings []byte) error {
+	return forEachEBMLElement(encodings, func(id uint32, encoding []byte) error {
+		if id != mkvIDContentEncoding {
+			return nil
+		}
+		return forEachEBMLElement(encoding, func(id uint32, payload []byte) error {
+			switch id {
+			case mkvIDContentCompression:
+				algorithm := uint64(0)
+				var settings []byte
+				err := forEachEBMLElement(payload, func(id uint32, payload []byte) error {
+					switch id {
+					case mkvIDContentCompAlgo:
+						algorithm = ebmlUint(payload)
+					case mkvIDContentCompSettings:
+						settings = payload
+					}
+					return nil
+				})
+				if algorithm == mkvCompressionHeaderStripping {
+					t.strippedHeader = settings
+				} else {
+					t.unsupportedEncoding = fmt.Sprintf("compression %d", algorithm)
+				}
+				return err
+			case mkvIDContentEncryption:
+				t.unsupportedEncoding = "encryption"
+			}
+			return nil
+		})
+	})
+}
+
+// Reads the blocks of a cluster, returning the offset after it. A cluster
+// of unknown size ends at the next element of the Segment.
+func (d *MKVDemuxer) readCluster(offset, end int64, unknownSize bool) (int64, error) {
+	clusterTime := int64(0)
+	for offset < end {
+		e, err := d.readElementHeader(offset)
+		if err != nil {
+			return end, nil
+		}
+		if unknownSize && mkvSegmentChildren[e.id] {
+			return offset, nil
+		}
+		if e.size < 0 {
+			return 0, fmt.Errorf("%w: element %x of unknown size", ErrInvalidMKV, e.id)
+		}
+		if e.dataOffset+e.size > end {
+			// Cut short in the element
+			return end, nil
+		}
+		switch e.id {
+		case mkvIDTimestamp:
+			data, err := d.readElementData(e)
+			if err != nil {
+				return end, nil
+			}
+			clusterTime = int64(ebmlUint(data))
+		case mkvIDSimpleBlock:
+			if err := d.readBlock(e, clusterTime, true, false); err != nil {
+				return 0, err
+			}
+		case mkvIDBlockGroup:
+			// A block without ReferenceBlock references no other frame
+			var block *ebmlElementHeader
+			keyframe := true
+			for child := e.dataOffset; child < e.dataOffset+e.size; {
+				c, err := d.readElementHeader(child)
+				if err != nil || c.size < 0 || c.dataOffset+c.size > e.dataOffset+e.size {
+					break
+				}
+				switch c.id {
+				case mkvIDBlock:
+					block = &c
+				case mkvIDReferenceBlock:
+					keyframe = false
+				}
+				child = c.dataOffset + c.size
+			}
+			if block != nil {
+				if err := d.readBlock(*block, clusterTime, false, keyframe); err != nil {
+					return 0, err
+				}
+			}
+		}
+		offset = e.dataOffset + e.size
+	}
+	return offset, nil
+}
+
+// Adds the frames of a Block or SimpleBlock, 10 and 10.2 of RFC 9559, to
+// their track. The frame data is read from the file later.
+func (d *MKVDemuxer) readBlock(e ebmlElementHeader, clusterTime int64, simple, keyframe bool) error {
+	if e.size < 0 || e.dataOffset+e.size > d.end {
+		return fmt.Errorf("%w: block at %d", ErrTruncated, e.dataOffset)
+	}
+	if _, err := d.r.Seek(e.dataOffset, io.SeekStart); err != nil {
+		return err
+	}
+	header := make([]byte, min(e.size, 12))
+	if _, err := io.ReadFull(d.r, header); err != nil {
+		return nil
+	}
+	trackNumber, n := ebmlVint(header, false)
+	if n == 0 || n+3 > len(header) {
+		return fmt.Errorf("%w: block at %d", ErrInvalidMKV, e.dataOffset)
+	}
+	var track *MKVTrack
+	for _, t := range d.Tracks {
+		if int64(t.Number) == trackNumber {
+			track = t
+		}
+	}
+	if track == nil {
+		return nil
+	}
+	timestamp := time.Duration((clusterTime + int64(int16(binary.BigEndian.Uint16(header[n:])))) * d.timestampScale)
+	flags := header[n+2]
+	if simple {
+		keyframe = flags&0x80 != 0
+	}
+
+	// Lacing, 10.3
+	frameOffset := e.dataOffset + int64(n) + 3
+	sizes := []int64{e.size - int64(n) - 3}
+	if lacing := flags & 0x06; lacing != 0 {
+		block := make([]byte, e.size)
+		if _, err := d.r.Seek(e.dataOffset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(d.r, block); err != nil {
+			return nil
+		}
+		laceSizes, laceHeader, err := mkvLaceSizes(block[n+3:], lacing)
+		if err != nil {
+			return fmt.Errorf("block at %d: %w", e.dataOffset, err)
+		}
+		frameOffset += int64(laceHeader)
+		sizes = laceSizes
+	}
+	for i, size := range sizes {
+		track.samples = append(track.samples, mkvSample{
+			offset: frameOffset,
+			size:   size,
+			// Laced frames follow each other by the default duration
+			pts:      timestamp + time.Duration(i)*track.DefaultDuration,
+			keyframe: keyframe && i == 0,
+		})
+		frameOffset += size
+	}
+	return nil
+}
+
+// Returns the frame sizes of a laced block from its data after the flags,
+// and the length of the lacing header
+func mkvLaceSizes(data []byte, lacing byte) ([]int64, int, error) {
+	if len(data) == 0 {
+		return nil, 0, ErrTruncated
+	}
+	count := int(data[0]) + 1
+	n := 1
+	sizes := make([]int64, count)
+	total := int64(0)
+	for i := 0; i < count-1; i++ {
+		switch lacing {
+		case 0x02:
+			// Xiph lacing
+			for {
+				if n >= len(data) {
+					return nil, 0, ErrTruncated
+				}
+				sizes[i] += int64(data[n])
+				n++
+				if data[n-1] != 0xff {
+					break
+				}
+			}
+		case 0x06:
+			// EBML lacing, later sizes as signed differences
+			v, length := ebmlVint(data[n:], false)
+			if length == 0 || v < 0 {
+				return nil, 0, fmt.Errorf("%w: EBML lace size", ErrInvalidMKV)
+			}
+			if i > 0 {
+				v += sizes[i-1] - (1<<(7*length-1) - 1)
+			}
+			sizes[i] = v
+			n += length
+		}
+		total += sizes[i]
+	}
+	if lacing == 0x04 {
+		// Fixed size lacing
+		for i := range sizes {
+			sizes[i] = int64(len(data)-1) / int64(count)
+		}
+		return sizes, n, nil
+	}
+	sizes[count-1] = int64(len(data)-n) - total
+	for _, size := range sizes {
+		if size < 0 {
+			return nil, 0, fmt.Errorf("%w: lace sizes", ErrInvalidMKV)
+		}
+	}
+	return sizes, n, nil
+}
+
+// Gives frames in decoding order the presentation timestamps in
+// increasing order as decode timestamps, delayed so that no frame is
+// decoded after it is presented
+func mkvDecodeTimestamps(samples []mkvSample) {
+	sorted := make([]time.Duration, len(samples))
+	for i, sample := range samples {
+		sorted[i] = sample.pts
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	delay := time.Duration(0)
+	for i, sample := range samples {
+		if d := sorted[i] - sample.pts; d > delay {
+			delay = d
+		}
+	}
+	for i := range samples {
+		samples[i].dts = sorted[i] - delay
+	}
+}
+
+// ReadSample returns the next frame of Track. The first carries the
+// parameter sets of the CodecPrivate record.
+func (d *MKVDemuxer) ReadSample() (*Sample, error) {
+	track := d.Track
+	if d.next >= len(track.samples) {
+		return nil, io.EOF
+	}
+	if track.unsupportedEncoding != "" {
+		return nil, fmt.Errorf("%w: track %d uses %s", errors.ErrUnsupported, track.Number, track.unsupportedEncoding)
+	}
+	s := track.samples[d.next]
+	d.next++
+	if _, err := d.r.Seek(s.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data := make([]byte, len(track.strippedHeader)+int(s.size))
+	copy(data, track.strippedHeader)
+	if _, err := io.ReadFull(d.r, data[len(track.strippedHeader):]); err != nil {
+		return nil, fmt.Errorf("%w: frame %d of %d bytes at %d: %v", ErrInvalidMKV, d.next-1, s.size, s.offset, err)
+	}
+	sample := &Sample{PTS: s.pts, DTS: s.dts, Timestamped: true, Keyframe: s.keyframe}
+	if d.next == 1 {
+		for _, parameterSets := range [][][]byte{track.AVCConfig.SPS, track.AVCConfig.PPS, track.AVCConfig.SPSExt} {
+			sample.NalUnits = append(sample.NalUnits, parameterSets...)
+		}
+	}
+	nalUnits, err := SplitLengthPrefixed(data, track.AVCConfig.LengthSize())
+	if err != nil {
+		return nil, fmt.Errorf("frame %d: %w", d.next-1, err)
+	}
+	sample.NalUnits = append(sample.NalUnits, nalUnits...)
+	return sample, nil
+}
@@ -0,0 +1,307 @@
+package h264
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"math"
+	"time"
+)
+
+// MKVMuxer writes the pictures a decoder reads to a Matroska file, RFC
+// 9559, as one H.264 track without re-encoding them. Blocks carry
+// presentation timestamps in milliseconds. A cluster starts at every IDR
+// picture and at least every ClusterDuration, and Cues list the clusters
+// starting at IDR pictures so players can seek. Close writes the Cues and
+// fills in the sizes, the duration and the SeekHead. Until then the
+// Segment is of unknown size, so a recording cut short still plays up to
+// its last whole cluster.
+//
+//	file, _ := os.Create("camera.mkv")
+//	muxer := NewMKVMuxer(file)
+//	err := NewDecoder(WithFrameHandler(muxer)).Decode(connection)
+//	muxer.Close()
+type MKVMuxer struct {
+	// ClusterDuration cuts a cluster without an IDR picture once it spans
+	// this long. Block timestamps reach 32 seconds into a cluster.
+	ClusterDuration time.Duration
+	Logger          *slog.Logger
+
+	w   io.WriteSeeker
+	err error
+	sps *SPS
+	// segmentOffset is the file offset of the Segment data, from which
+	// positions are given
+	segmentOffset int64
+	// The offsets of the values Close fills in
+	segmentSizeOffset, cuesPositionOffset, durationOffset int64
+	// firstDTS is the timestamp written as 0
+	firstDTS time.Duration
+	// end is the presentation end of the pictures written
+	end, lastDTS, frameDuration time.Duration
+
+	cluster       bytes.Buffer
+	clusterTime   int64
+	clusterBlocks int
+	cues          []mkvCuePoint
+}
+
+type mkvCuePoint struct {
+	time            int64
+	clusterPosition int64
+}
+
+// NewMKVMuxer returns a muxer writing to w with clusters of at most 5
+// seconds
+func NewMKVMuxer(w io.WriteSeeker) *MKVMuxer {
+	return &MKVMuxer{w: w, ClusterDuration: 5 * time.Second}
+}
+
+func (m *MKVMuxer) logger() *slog.Logger {
+	if m.Logger == nil {
+		return discardLogger
+	}
+	return m.Logger
+}
+
+// Err returns the first error writing the file. Once set, frames are
+// ignored.
+func (m *MKVMuxer) Err() error {
+	return m.err
+}
+
+// HandleFrame writes a picture as a SimpleBlock. The first picture
+// writes the headers with the avcC record of its SPS and PPS. A picture
+// of another SPS sets ErrSequenceChanged.
+func (m *MKVMuxer) HandleFrame(frame *Frame) {
+	if m.err != nil || len(frame.NalUnits) == 0 {
+		return
+	}
+	switch {
+	case m.sps == nil:
+		if m.err = m.writeHeaders(frame); m.err != nil {
+			return
+		}
+	case !sameSequence(m.sps, frame.SPS):
+		m.err = ErrSequenceChanged
+		return
+	}
+	keyframe := frame.IDR || frame.RandomAccess != nil
+	pts := int64((frame.PTS - m.firstDTS + time.Millisecond/2) / time.Millisecond)
+	if m.clusterBlocks > 0 {
+		relative := pts - m.clusterTime
+		if keyframe || relative > math.MaxInt16 || relative < math.MinInt16 ||
+			time.Duration(relative)*time.Millisecond >= m.ClusterDuration {
+			if m.err = m.writeCluster(); m.err != nil {
+				return
+			}
+		}
+	}
+	if m.clusterBlocks == 0 {
+		m.clusterTime = pts
+		if keyframe {
+			position, err := m.w.Seek(0, io.SeekCurrent)
+			if err != nil {
+				m.err = err
+				return
+			}
+			m.cues = append(m.cues, mkvCuePoint{time: pts, clusterPosition: position - m.segmentOffset})
+		}
+		m.cluster.Write(ebmlUintElement(mkvIDTimestamp, uint64(pts)))
+	}
+
+	// 10.2 of RFC 9559, track 1 without lacing
+	flags := byte(0)
+	if keyframe {
+		flags |= 0x80
+	}
+	relative := uint16(int16(pts - m.clusterTime))
+	block := []byte{0x81, byte(relative >> 8), byte(relative), flags}
+	m.cluster.Write(ebmlElement(mkvIDSimpleBlock, block, lengthPrefixedSampleData(frame.NalUnits)))
+	m.clusterBlocks++
+
+	m.frameDuration = lastPictureDuration(m.lastDTS, frame.DTS, m.frameDuration)
+	if end := frame.PTS + m.frameDuration; end > m.end {
+		m.end = end
+	}
+	m.lastDTS = frame.DTS
+}
+
+// Close writes the last cluster and the Cues and fills in the headers.
+// The writer is left open.
+func (m *MKVMuxer) Close() error {
+	if m.sps == nil {
+		return m.err
+	}
+	// A file ended by a change of sequence is still closed properly
+	if m.err != nil && m.err != ErrSequenceChanged {
+		return m.err
+	}
+	if m.clusterBlocks > 0 {
+		if err := m.writeCluster(); err != nil {
+			m.err = err
+			return err
+		}
+	}
+	cuesPosition, err := m.w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	// 6.2.1 of RFC 9559
+	cues := []byte{}
+	for _, cue := range m.cues {
+		cues = append(cues, ebmlElement(mkvIDCuePoint,
+			ebmlUintElement(mkvIDCueTime, uint64(cue.time)),
+			ebmlElement(mkvIDCueTrackPositions,
+				ebmlUintElement(mkvIDCueTrack, 1),
+				ebmlUintElement(mkvIDCueClusterPosition, uint64(cue.clusterPosition))))...)
+	}
+	if _, err := m.w.Write(ebmlElement(mkvIDCues, cues)); err != nil {
+		return err
+	}
+	end, err := m.w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	duration := float64(m.end-m.firstDTS) / float64(time.Millisecond)
+	for _, patch := range []struct {
+		offset int64
+		value  []byte
+	}{
+		{m.segmentSizeOffset, binary.BigEndian.AppendUint64(nil, 1<<56|uint64(end-m.segmentOffset))},
+		{m.cuesPositionOffset, binary.BigEndian.AppendUint64(nil, uint64(cuesPosition-m.segmentOffset))},
+		{m.durationOffset, binary.BigEndian.AppendUint64(nil, math.Float64bits(duration))},
+	} {
+		if _, err := m.w.Seek(patch.offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := m.w.Write(patch.value); err != nil {
+			return err
+		}
+	}
+	if _, err := m.w.Seek(end, io.SeekStart); err != nil {
+		return err
+	}
+	m.logger().Info("closed Matroska file", "duration", m.end-m.firstDTS, "cues", len(m.cues), "bytes", end)
+	return m.err
+}
+
+// Writes the EBML header, the Segment of unknown size, a SeekHead naming
+// the Info, Tracks and Cues, the Info and the Tracks
+func (m *MKVMuxer) writeHeaders(frame *Frame) error {
+	config, err := NewAVCDecoderConfigurationRecordFor(frame.SPS, frame.PPS)
+	if err != nil {
+		return err
+	}
+	width, height := frame.SPS.DisplaySize()
+	m.sps, m.firstDTS, m.lastDTS = frame.SPS, frame.DTS, frame.DTS
+
+	start, err := m.w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	// 8.1 of RFC 8794 with the doc type versions of RFC 9559 for
+	// SimpleBlock
+	header := ebmlElement(ebmlIDHeader,
+		ebmlUintElement(ebmlIDVersion, 1),
+		ebmlUintElement(ebmlIDReadVersion, 1),
+		ebmlUintElement(ebmlIDMaxIDLength, 4),
+		ebmlUintElement(ebmlIDMaxSizeLength, 8),
+		ebmlElement(ebmlIDDocType, []byte("matroska")),
+		ebmlUintElement(ebmlIDDocTypeVersion, 4),
+		ebmlUintElement(ebmlIDDocTypeReadVersion, 2))
+	// An 8 byte size of all ones is unknown until Close
+	header = append(header, ebmlID(mkvIDSegment)...)
+	m.segmentSizeOffset = start + int64(len(header))
+	header = append(header, 0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	m.segmentOffset = start + int64(len(header))
+
+	// Duration is last so it can be filled in
+	info := ebmlElement(mkvIDInfo,
+		ebmlUintElement(mkvIDTimestampScale, uint64(time.Millisecond)),
+		ebmlElement(mkvIDMuxingApp, []byte("h264")),
+		ebmlElement(mkvIDWritingApp, []byte("h264")),
+		ebmlElement(mkvIDDuration, make([]byte, 8)))
+	tracks := ebmlElement(mkvIDTracks, ebmlElement(mkvIDTrackEntry,
+		ebmlUintElement(mkvIDTrackNumber, 1),
+		ebmlUintElement(mkvIDTrackUID, 1),
+		ebmlUintElement(mkvIDTrackType, mkvTrackTypeVideo),
+		ebmlUintElement(mkvIDFlagLacing, 0),
+		ebmlElement(mkvIDCodecID, []byte(mkvCodecH264)),
+		ebmlElement(mkvIDCodecPrivate, config.Bytes()),
+		ebmlElement(mkvIDVideo,
+			ebmlUintElement(mkvIDPixelWidth, uint64(width)),
+			ebmlUintElement(mkvIDPixelHeight, uint64(height)))))
+	// Positions are 8 bytes, so the SeekHead's size does not depend on
+	// them. The Cues position is last so it can be filled in.
+	seek := func(id uint32, position int) []byte {
+		return ebmlElement(mkvIDSeek,
+			ebmlElement(mkvIDSeekID, ebmlID(id)),
+			ebmlElement(mkvIDSeekPosition, binary.BigEndian.AppendUint64(nil, uint64(position))))
+	}
+	seekHeadSize := len(ebmlElement(mkvIDSeekHead, seek(mkvIDInfo, 0), seek(mkvIDTracks, 0), seek(mkvIDCues, 0)))
+	seekHead := ebmlElement(mkvIDSeekHead,
+		seek(mkvIDInfo, seekHeadSize),
+		seek(mkvIDTracks, seekHeadSize+len(info)),
+		seek(mkvIDCues, 0))
+	m.cuesPositionOffset = m.segmentOffset + int64(len(seekHead)) - 8
+	m.durationOffset = m.segmentOffset + int64(len(seekHead)+len(info)) - 8
+
+	m.logger().Info("starting Matroska file", "codec", frame.SPS.Codec(), "width", width, "height", height)
+	_, err = m.w.Write(bytes.Join([][]byte{header, seekHead, info, tracks}, nil))
+	return err
+}
+
+// Writes the gathered blocks as a Cluster of known size
+func (m *MKVMuxer) writeCluster() error {
+	cluster := ebmlElement(mkvIDCluster, m.cluster.Bytes())
+	m.cluster.Reset()
+	m.clusterBlocks = 0
+	_, err := m.w.Write(cluster)
+	return err
+}
+
+// Returns the bytes of an element ID, which keeps its length marker
+func ebmlID(id uint32) []byte {
+	b := binary.BigEndian.AppendUint32(nil, id)
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	return b
+}
+
+// Returns an element with the shortest size field for its data. Sizes
+// of all ones are avoided, as they mean unknown.
+func ebmlElement(id uint32, data ...[]byte) []byte {
+	size := 0
+	for _, d := range data {
+		size += len(d)
+	}
+	length := 1
+	for uint64(size) >= 1<<(7*length)-1 {
+		length++
+	}
+	element := ebmlID(id)
+	for i := length - 1; i >= 0; i-- {
+		b := byte(size >> (8 * i))
+		if i == length-1 {
+			b |= 0x80 >> (length - 1)
+		}
+		element = append(element, b)
+	}
+	for _, d := range data {
+		element = append(element, d...)
+	}
+	return element
+}
+
+// Returns an unsigned integer element in the fewest bytes
+func ebmlUintElement(id uint32, v uint64) []byte {
+	b := binary.BigEndian.AppendUint64(nil, v)
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	return ebmlElement(id, b)
+}
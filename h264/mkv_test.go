@@ -0,0 +1,214 @@
+package h264
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Records frames to a Matroska file, closing it when close is set
+func mkvTestFile(t *testing.T, frames []*Frame, close bool) string {
+	name := filepath.Join(t.TempDir(), "test.mkv")
+	file, err := os.Create(name)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	defer file.Close()
+	m := NewMKVMuxer(file)
+	for _, frame := range frames {
+		m.HandleFrame(frame)
+	}
+	if close {
+		if err := m.Close(); err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+	}
+	return name
+}
+
+func openMKV(t *testing.T, name string) *MKVDemuxer {
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	t.Cleanup(func() { file.Close() })
+	d, err := NewMKVDemuxer(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	return d
+}
+
+func TestMKVRoundTrip(t *testing.T) {
+	name := mkvTestFile(t, hlsTestFrames(t, 12), true)
+	d := openMKV(t, name)
+	if d.DocType != "matroska" || d.Duration != 1300*time.Millisecond {
+		t.Fatalf("unexpected file %q of %v\n", d.DocType, d.Duration)
+	}
+	if d.Track.Width != 320 || d.Track.Height != 240 || d.Track.Samples != 12 || d.Track.CodecID != "V_MPEG4/ISO/AVC" {
+		t.Fatalf("unexpected track %+v\n", d.Track)
+	}
+	samples := readSamples(t, d)
+	for i, sample := range samples {
+		// Without reordering the decode timestamps are the presentation
+		// timestamps
+		pts := time.Duration(i+1) * 100 * time.Millisecond
+		if sample.PTS != pts || sample.DTS != pts {
+			t.Fatalf("sample %d: unexpected PTS %v DTS %v\n", i, sample.PTS, sample.DTS)
+		}
+		if sample.Keyframe != (i%5 == 0) {
+			t.Fatalf("sample %d: unexpected keyframe %v\n", i, sample.Keyframe)
+		}
+	}
+	// The first sample carries the parameter sets, and no sample repeats
+	// them
+	if len(samples[0].NalUnits) != 3 || len(samples[5].NalUnits) != 1 {
+		t.Fatalf("unexpected NAL units %d %d\n", len(samples[0].NalUnits), len(samples[5].NalUnits))
+	}
+
+	// The SeekHead leads to the Cues, whose points lead to the clusters
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	var segment []byte
+	forEachEBMLElement(data, func(id uint32, payload []byte) error {
+		if id == mkvIDSegment {
+			segment = payload
+		}
+		return nil
+	})
+	if segment == nil {
+		t.Fatalf("no Segment of known size\n")
+	}
+	positions := map[uint32]uint64{}
+	forEachEBMLElement(segment, func(id uint32, payload []byte) error {
+		if id != mkvIDSeekHead {
+			return nil
+		}
+		return forEachEBMLElement(payload, func(_ uint32, seek []byte) error {
+			var seekID []byte
+			var position uint64
+			forEachEBMLElement(seek, func(id uint32, payload []byte) error {
+				switch id {
+				case mkvIDSeekID:
+					seekID = payload
+				case mkvIDSeekPosition:
+					position = ebmlUint(payload)
+				}
+				return nil
+			})
+			positions[uint32(ebmlUint(seekID))] = position
+			return nil
+		})
+	})
+	for _, id := range []uint32{mkvIDInfo, mkvIDTracks, mkvIDCues} {
+		if position := positions[id]; !bytes.HasPrefix(segment[position:], ebmlID(id)) {
+			t.Fatalf("SeekHead position %d of %x is not the element\n", position, id)
+		}
+	}
+	var cues []string
+	forEachEBMLElement(segment[positions[mkvIDCues]:], func(id uint32, payload []byte) error {
+		return forEachEBMLElement(payload, func(_ uint32, point []byte) error {
+			var cueTime, position uint64
+			forEachEBMLElement(point, func(id uint32, payload []byte) error {
+				switch id {
+				case mkvIDCueTime:
+					cueTime = ebmlUint(payload)
+				case mkvIDCueTrackPositions:
+					return forEachEBMLElement(payload, func(id uint32, payload []byte) error {
+						if id == mkvIDCueClusterPosition {
+							position = ebmlUint(payload)
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+			if !bytes.HasPrefix(segment[position:], ebmlID(mkvIDCluster)) {
+				t.Fatalf("cue at %d ms does not lead to a Cluster\n", cueTime)
+			}
+			cues = append(cues, fmt.Sprint(cueTime))
+			return nil
+		})
+	})
+	if fmt.Sprint(cues) != "[100 600 1100]" {
+		t.Fatalf("unexpected cues %v\n", cues)
+	}
+}
+
+func TestMKVDemuxerCutShort(t *testing.T) {
+	// Without Close the Segment is of unknown size and the last cluster
+	// is not written
+	name := mkvTestFile(t, hlsTestFrames(t, 12), false)
+	if samples := readSamples(t, openMKV(t, name)); len(samples) != 10 {
+		t.Fatalf("expected 10 samples of an unclosed file, got %d\n", len(samples))
+	}
+
+	name = mkvTestFile(t, hlsTestFrames(t, 12), true)
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	// Cut in the last cluster's last block
+	last := bytes.LastIndex(data, ebmlID(mkvIDCues))
+	if err := os.WriteFile(name, data[:last-2], 0o644); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if samples := readSamples(t, openMKV(t, name)); len(samples) != 11 {
+		t.Fatalf("expected 11 samples of a truncated file, got %d\n", len(samples))
+	}
+}
+
+func TestMKVDemuxerBlockPastEnd(t *testing.T) {
+	// A cluster of unknown size whose Xiph laced SimpleBlock claims more
+	// bytes than the file holds is left out
+	name := mkvTestFile(t, hlsTestFrames(t, 12), false)
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	data = append(data, ebmlID(mkvIDCluster)...)
+	data = append(data, 0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	data = append(data, ebmlID(mkvIDSimpleBlock)...)
+	data = append(data, 0x01, 0x7f, 0, 0, 0, 0, 0, 0, 0x81, 0, 0, 0x82, 1, 4, 0, 0, 0, 0, 0, 0, 0, 0)
+	if err := os.WriteFile(name, data, 0o644); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if samples := readSamples(t, openMKV(t, name)); len(samples) != 10 {
+		t.Fatalf("expected 10 samples, got %d\n", len(samples))
+	}
+}
+
+func TestMKVDecodeTimestamps(t *testing.T) {
+	// I P B B in decoding order
+	samples := []mkvSample{{pts: 0}, {pts: 300}, {pts: 100}, {pts: 200}}
+	mkvDecodeTimestamps(samples)
+	for i, expected := range []time.Duration{-100, 0, 100, 200} {
+		if samples[i].dts != expected {
+			t.Fatalf("sample %d: expected DTS %v, got %v\n", i, expected, samples[i].dts)
+		}
+	}
+}
+
+func TestMKVLaceSizes(t *testing.T) {
+	payload := make([]byte, 307)
+	for _, test := range []struct {
+		lacing byte
+		header []byte
+		sizes  string
+	}{
+		{0x02, []byte{2, 255, 45, 2}, "[300 2 5]"},
+		// 300, then 2 as the difference -298
+		{0x06, []byte{2, 0x41, 0x2c, 0x5e, 0xd5}, "[300 2 5]"},
+		{0x04, []byte{0}, "[307]"},
+	} {
+		sizes, n, err := mkvLaceSizes(append(test.header, payload...), test.lacing)
+		if err != nil || n != len(test.header) || fmt.Sprint(sizes) != test.sizes {
+			t.Fatalf("lacing %x: unexpected sizes %v header %d error %v\n", test.lacing, sizes, n, err)
+		}
+	}
+}
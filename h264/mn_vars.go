@@ -182,10 +182,8 @@ func MNSecond(ctxIdx, cabacInitIdc int) {}
 // Coded block pattern (luma y chroma)
 // map[ctxIdx][cabacInitIdc]MN
 func CodedblockPatternMN(ctxIdx, cabacInitIdc int, sliceType string) MN {
+	// Only the I and SI slice values are tabulated here
 	var mn MN
-	if sliceType != "I" && sliceType != "SI" {
-		logger.Printf("warning: trying to initialize %s slice type\n", sliceType)
-	}
 	switch ctxIdx {
 	case 70:
 		if cabacInitIdc >= 0 && cabacInitIdc <= 2 {
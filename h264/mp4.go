@@ -0,0 +1,636 @@
+package h264
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ErrInvalidMP4 is returned for a file that is not ISO base media
+var ErrInvalidMP4 = errors.New("h264: invalid MP4 file")
+
+// tfhd and trun flags, ISO/IEC 14496-12 8.8.7 and 8.8.8
+const (
+	mp4TfhdBaseDataOffset         = 0x000001
+	mp4TfhdSampleDescriptionIndex = 0x000002
+	mp4TfhdDefaultSampleDuration  = 0x000008
+	mp4TfhdDefaultSampleSize      = 0x000010
+	mp4TfhdDefaultSampleFlags     = 0x000020
+	mp4TrunDataOffset             = 0x000001
+	mp4TrunFirstSampleFlags       = 0x000004
+	mp4TrunSampleDuration         = 0x000100
+	mp4TrunSampleSize             = 0x000200
+	mp4TrunSampleFlags            = 0x000400
+	mp4TrunCompositionTimeOffset  = 0x000800
+	// sample_is_non_sync_sample of sample_flags
+	mp4SampleIsNonSync = 0x00010000
+)
+
+// MP4Track is a track of an MP4 file
+type MP4Track struct {
+	ID        int
+	Handler   string
+	Timescale uint32
+	// Width and Height are the display size of a video track
+	Width, Height int
+	// SampleEntry is the four character code of the first sample
+	// description, avc1 or avc3 for H.264
+	SampleEntry string
+	// AVCConfig is the avcC record of an H.264 track
+	AVCConfig *AVCDecoderConfigurationRecord
+	// Samples counts the samples of the sample tables and of every
+	// fragment
+	Samples int
+
+	samples []mp4Sample
+	// Defaults of trex, 8.8.3
+	defaultDuration, defaultSize, defaultFlags uint32
+	// fragmentEnd is the decode time after the last fragment sample
+	fragmentEnd int64
+}
+
+type mp4Sample struct {
+	offset            int64
+	size              uint32
+	dts               int64
+	compositionOffset int32
+	sync              bool
+}
+
+// MP4Demuxer reads the samples of the first H.264 track of an ISO base
+// media file, ISO/IEC 14496-12 and 14496-15, from its sample tables and
+// then from any movie fragments, in decoding order.
+//
+//	demuxer, err := NewMP4Demuxer(file)
+//	err = NewDecoder(WithFrameHandler(handler)).DecodeSamples(demuxer)
+type MP4Demuxer struct {
+	MajorBrand string
+	Tracks     []*MP4Track
+	// Track is the H.264 track samples are read from
+	Track *MP4Track
+
+	r io.ReadSeeker
+	// end is the size of the file
+	end  int64
+	next int
+}
+
+// NewMP4Demuxer reads the boxes of r, leaving the media data to be read
+// a sample at a time
+func NewMP4Demuxer(r io.ReadSeeker) (*MP4Demuxer, error) {
+	d := &MP4Demuxer{r: r}
+	if err := d.readBoxes(); err != nil {
+		return nil, err
+	}
+	for _, track := range d.Tracks {
+		if track.AVCConfig != nil {
+			d.Track = track
+			break
+		}
+	}
+	if d.Track == nil {
+		return nil, fmt.Errorf("%w: no H.264 track", ErrInvalidMP4)
+	}
+	return d, nil
+}
+
+// Reads the top level boxes. Only ftyp, moov and moof are read whole. A
+// recording cut short ends in a partial fragment, which is left out; an
+// ftyp or moov box past the end of the file is an error.
+func (d *MP4Demuxer) readBoxes() error {
+	end, err := d.r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	d.end = end
+	defer d.dropTruncatedSamples(end)
+	offset := int64(0)
+	header := make([]byte, 16)
+	for {
+		if _, err := d.r.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(d.r, header[:8]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("%w: box header at %d: %v", ErrInvalidMP4, offset, err)
+		}
+		size, headerSize := int64(binary.BigEndian.Uint32(header)), int64(8)
+		boxType := string(header[4:8])
+		switch size {
+		case 0:
+			// The last box extends to the end of the file
+			if boxType != "moov" && boxType != "moof" {
+				return nil
+			}
+			size = end - offset
+			d.r.Seek(offset+8, io.SeekStart)
+		case 1:
+			if _, err := io.ReadFull(d.r, header[8:16]); err != nil {
+				return fmt.Errorf("%w: box size at %d", ErrInvalidMP4, offset)
+			}
+			size, headerSize = int64(binary.BigEndian.Uint64(header[8:])), 16
+		}
+		if size < headerSize {
+			return fmt.Errorf("%w: %q box of %d bytes at %d", ErrInvalidMP4, boxType, size, offset)
+		}
+		switch boxType {
+		case "ftyp", "moov", "moof":
+			if size > end-offset {
+				if boxType == "moof" {
+					return nil
+				}
+				return fmt.Errorf("%w: %q box of %d bytes at %d past the end at %d", ErrInvalidMP4, boxType, size, offset, end)
+			}
+			payload := make([]byte, size-headerSize)
+			if _, err := io.ReadFull(d.r, payload); err != nil {
+				return fmt.Errorf("%w: %q box at %d: %v", ErrInvalidMP4, boxType, offset, err)
+			}
+			var err error
+			switch boxType {
+			case "ftyp":
+				if len(payload) >= 4 {
+					d.MajorBrand = string(payload[:4])
+				}
+			case "moov":
+				err = d.parseMoov(payload)
+			case "moof":
+				err = d.parseMoof(payload, offset)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		offset += size
+	}
+}
+
+// Drops the samples of the last fragment that lie past the end of the file
+func (d *MP4Demuxer) dropTruncatedSamples(end int64) {
+	for _, track := range d.Tracks {
+		n := len(track.samples)
+		for n > 0 && track.samples[n-1].offset+int64(track.samples[n-1].size) > end {
+			n--
+		}
+		track.Samples -= len(track.samples) - n
+		track.samples = track.samples[:n]
+	}
+}
+
+// Calls fn with the type and payload of each box in data
+func forEachMP4Box(data []byte, fn func(boxType string, payload []byte) error) error {
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return fmt.Errorf("%w: %d bytes left in box", ErrInvalidMP4, len(data))
+		}
+		size, headerSize := uint64(binary.BigEndian.Uint32(data)), uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return fmt.Errorf("%w: box size", ErrInvalidMP4)
+			}
+			size, headerSize = binary.BigEndian.Uint64(data[8:]), 16
+		}
+		if size < headerSize || size > uint64(len(data)) {
+			return fmt.Errorf("%w: %q box of %d bytes in %d", ErrInvalidMP4, data[4:8], size, len(data))
+		}
+		if err := fn(string(data[4:8]), data[headerSize:size]); err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+// mp4Reader reads the fields of a box payload. Reads past the end return
+// zero and set err, like a BitReader.
+type mp4Reader struct {
+	data []byte
+	err  error
+}
+
+func (r *mp4Reader) bytes(n int) []byte {
+	if r.err != nil || n > len(r.data) {
+		if r.err == nil {
+			r.err = fmt.Errorf("%w: box too short", ErrInvalidMP4)
+		}
+		return make([]byte, n)
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *mp4Reader) u32() uint32 { return binary.BigEndian.Uint32(r.bytes(4)) }
+func (r *mp4Reader) u64() uint64 { return binary.BigEndian.Uint64(r.bytes(8)) }
+
+// Reads the version and flags of a full box
+func (r *mp4Reader) fullBox() (version, flags uint32) {
+	v := r.u32()
+	return v >> 24, v & 0xffffff
+}
+
+// 8.2.1
+func (d *MP4Demuxer) parseMoov(moov []byte) error {
+	trex := map[uint32][3]uint32{}
+	err := forEachMP4Box(moov, func(boxType string, payload []byte) error {
+		switch boxType {
+		case "trak":
+			track := &MP4Track{}
+			if err := parseTrak(track, payload); err != nil {
+				return err
+			}
+			d.Tracks = append(d.Tracks, track)
+		case "mvex":
+			return forEachMP4Box(payload, func(boxType string, payload []byte) error {
+				if boxType == "trex" {
+					r := &mp4Reader{data: payload}
+					r.fullBox()
+					id := r.u32()
+					// default_sample_description_index is not used
+					r.u32()
+					trex[id] = [3]uint32{r.u32(), r.u32(), r.u32()}
+					return r.err
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	for _, track := range d.Tracks {
+		defaults := trex[uint32(track.ID)]
+		track.defaultDuration, track.defaultSize, track.defaultFlags = defaults[0], defaults[1], defaults[2]
+		if n := len(track.samples); n > 0 {
+			// Fragments continue from the end of the sample tables
+			track.fragmentEnd = track.samples[n-1].dts
+			if n > 1 {
+				track.fragmentEnd += track.samples[n-1].dts - track.samples[n-2].dts
+			}
+		}
+	}
+	return err
+}
+
+// mp4SampleTables are the boxes of stbl, 8.5 to 8.7
+type mp4SampleTables struct {
+	stts, ctts, stsz, stsc, stco, co64, stss []byte
+}
+
+func parseTrak(track *MP4Track, trak []byte) error {
+	tables := &mp4SampleTables{}
+	var walk func(boxType string, payload []byte) error
+	walk = func(boxType string, payload []byte) error {
+		r := &mp4Reader{data: payload}
+		switch boxType {
+		case "mdia", "minf", "stbl":
+			return forEachMP4Box(payload, walk)
+		case "tkhd":
+			version, _ := r.fullBox()
+			if version == 1 {
+				r.bytes(16)
+			} else {
+				r.bytes(8)
+			}
+			track.ID = int(r.u32())
+			r.bytes(4)
+			if version == 1 {
+				r.bytes(8)
+			} else {
+				r.bytes(4)
+			}
+			r.bytes(8 + 8 + 36)
+			track.Width, track.Height = int(r.u32()>>16), int(r.u32()>>16)
+		case "mdhd":
+			version, _ := r.fullBox()
+			if version == 1 {
+				r.bytes(16)
+			} else {
+				r.bytes(8)
+			}
+			track.Timescale = r.u32()
+		case "hdlr":
+			r.fullBox()
+			r.bytes(4)
+			track.Handler = string(r.bytes(4))
+		case "stsd":
+			r.fullBox()
+			if r.u32() == 0 {
+				return nil
+			}
+			// Only the first sample description is used
+			return forEachMP4Box(r.data, func(entryType string, entry []byte) error {
+				if track.SampleEntry != "" {
+					return nil
+				}
+				track.SampleEntry = entryType
+				if (entryType != "avc1" && entryType != "avc3") || len(entry) < 78 {
+					return nil
+				}
+				// 14496-12 12.1.3 VisualSampleEntry, then its boxes
+				return forEachMP4Box(entry[78:], func(boxType string, payload []byte) error {
+					if boxType != "avcC" {
+						return nil
+					}
+					config, err := NewAVCDecoderConfigurationRecord(payload)
+					track.AVCConfig = config
+					return err
+				})
+			})
+		case "stts":
+			tables.stts = payload
+		case "ctts":
+			tables.ctts = payload
+		case "stsz":
+			tables.stsz = payload
+		case "stsc":
+			tables.stsc = payload
+		case "stco":
+			tables.stco = payload
+		case "co64":
+			tables.co64 = payload
+		case "stss":
+			tables.stss = payload
+		}
+		return r.err
+	}
+	if err := forEachMP4Box(trak, walk); err != nil {
+		return err
+	}
+	if track.Timescale == 0 {
+		return fmt.Errorf("%w: track %d has no timescale", ErrInvalidMP4, track.ID)
+	}
+	samples, err := tables.samples()
+	if err != nil {
+		return fmt.Errorf("track %d: %w", track.ID, err)
+	}
+	track.samples = samples
+	track.Samples = len(samples)
+	return nil
+}
+
+// Returns the samples of the sample tables, in decoding order
+func (t *mp4SampleTables) samples() ([]mp4Sample, error) {
+	if t.stsz == nil {
+		return nil, nil
+	}
+	// 8.7.3.2
+	stsz := &mp4Reader{data: t.stsz}
+	stsz.fullBox()
+	sampleSize, count := stsz.u32(), int(stsz.u32())
+	if stsz.err != nil || (sampleSize == 0 && count > len(stsz.data)/4) {
+		return nil, fmt.Errorf("%w: stsz", ErrInvalidMP4)
+	}
+	samples := make([]mp4Sample, count)
+	for i := range samples {
+		samples[i].size = sampleSize
+		if sampleSize == 0 {
+			samples[i].size = stsz.u32()
+		}
+		samples[i].sync = t.stss == nil
+	}
+
+	// 8.6.1.2 decoding times
+	stts := &mp4Reader{data: t.stts}
+	if t.stts != nil {
+		stts.fullBox()
+		entries := stts.u32()
+		dts, i := int64(0), 0
+		for e := uint32(0); e < entries && stts.err == nil; e++ {
+			n, delta := stts.u32(), stts.u32()
+			for j := uint32(0); j < n && i < count; j++ {
+				samples[i].dts = dts
+				dts += int64(delta)
+				i++
+			}
+		}
+		if stts.err != nil {
+			return nil, fmt.Errorf("%w: stts", ErrInvalidMP4)
+		}
+	}
+	// 8.6.1.3 composition offsets, signed in version 1 and by common
+	// practice in version 0
+	if t.ctts != nil {
+		ctts := &mp4Reader{data: t.ctts}
+		ctts.fullBox()
+		entries, i := ctts.u32(), 0
+		for e := uint32(0); e < entries && ctts.err == nil; e++ {
+			n, offset := ctts.u32(), int32(ctts.u32())
+			for j := uint32(0); j < n && i < count; j++ {
+				samples[i].compositionOffset = offset
+				i++
+			}
+		}
+		if ctts.err != nil {
+			return nil, fmt.Errorf("%w: ctts", ErrInvalidMP4)
+		}
+	}
+	// 8.6.2
+	if t.stss != nil {
+		stss := &mp4Reader{data: t.stss}
+		stss.fullBox()
+		entries := stss.u32()
+		for e := uint32(0); e < entries && stss.err == nil; e++ {
+			if n := int(stss.u32()); n >= 1 && n <= count {
+				samples[n-1].sync = true
+			}
+		}
+	}
+
+	// 8.7.5 chunk offsets and 8.7.4 samples per chunk
+	chunkOffsets := []int64{}
+	if t.co64 != nil {
+		co64 := &mp4Reader{data: t.co64}
+		co64.fullBox()
+		for n := co64.u32(); n > 0 && co64.err == nil; n-- {
+			chunkOffsets = append(chunkOffsets, int64(co64.u64()))
+		}
+	} else if t.stco != nil {
+		stco := &mp4Reader{data: t.stco}
+		stco.fullBox()
+		for n := stco.u32(); n > 0 && stco.err == nil; n-- {
+			chunkOffsets = append(chunkOffsets, int64(stco.u32()))
+		}
+	}
+	stsc := &mp4Reader{data: t.stsc}
+	type chunkRun struct{ firstChunk, samplesPerChunk uint32 }
+	runs := []chunkRun{}
+	if t.stsc != nil {
+		stsc.fullBox()
+		for n := stsc.u32(); n > 0 && stsc.err == nil; n-- {
+			runs = append(runs, chunkRun{stsc.u32(), stsc.u32()})
+			// sample_description_index
+			stsc.u32()
+		}
+	}
+	i := 0
+	for r, run := range runs {
+		lastChunk := uint32(len(chunkOffsets))
+		if r+1 < len(runs) {
+			lastChunk = runs[r+1].firstChunk - 1
+		}
+		for chunk := run.firstChunk; chunk <= lastChunk && chunk >= 1 && int(chunk) <= len(chunkOffsets); chunk++ {
+			offset := chunkOffsets[chunk-1]
+			for j := uint32(0); j < run.samplesPerChunk && i < count; j++ {
+				samples[i].offset = offset
+				offset += int64(samples[i].size)
+				i++
+			}
+		}
+	}
+	if i < count {
+		return nil, fmt.Errorf("%w: %d of %d samples are in chunks", ErrInvalidMP4, i, count)
+	}
+	return samples, nil
+}
+
+// 8.8.4
+func (d *MP4Demuxer) parseMoof(moof []byte, moofOffset int64) error {
+	return forEachMP4Box(moof, func(boxType string, payload []byte) error {
+		if boxType != "traf" {
+			return nil
+		}
+		return d.parseTraf(payload, moofOffset)
+	})
+}
+
+func (d *MP4Demuxer) parseTraf(traf []byte, moofOffset int64) error {
+	var track *MP4Track
+	var baseOffset int64
+	var defaultDuration, defaultSize, defaultFlags uint32
+	dataOffset := int64(-1)
+	return forEachMP4Box(traf, func(boxType string, payload []byte) error {
+		r := &mp4Reader{data: payload}
+		switch boxType {
+		case "tfhd":
+			_, flags := r.fullBox()
+			id := int(r.u32())
+			for _, t := range d.Tracks {
+				if t.ID == id {
+					track = t
+				}
+			}
+			if track == nil {
+				return fmt.Errorf("%w: fragment of unknown track %d", ErrInvalidMP4, id)
+			}
+			baseOffset = moofOffset
+			defaultDuration, defaultSize, defaultFlags = track.defaultDuration, track.defaultSize, track.defaultFlags
+			if flags&mp4TfhdBaseDataOffset != 0 {
+				baseOffset = int64(r.u64())
+			}
+			// Only the first sample description is used
+			if flags&mp4TfhdSampleDescriptionIndex != 0 {
+				r.u32()
+			}
+			if flags&mp4TfhdDefaultSampleDuration != 0 {
+				defaultDuration = r.u32()
+			}
+			if flags&mp4TfhdDefaultSampleSize != 0 {
+				defaultSize = r.u32()
+			}
+			if flags&mp4TfhdDefaultSampleFlags != 0 {
+				defaultFlags = r.u32()
+			}
+		case "tfdt":
+			if track == nil {
+				return fmt.Errorf("%w: tfdt before tfhd", ErrInvalidMP4)
+			}
+			if version, _ := r.fullBox(); version == 1 {
+				track.fragmentEnd = int64(r.u64())
+			} else {
+				track.fragmentEnd = int64(r.u32())
+			}
+		case "trun":
+			if track == nil {
+				return fmt.Errorf("%w: trun before tfhd", ErrInvalidMP4)
+			}
+			_, flags := r.fullBox()
+			count := r.u32()
+			// A run without a data offset follows the data of the one
+			// before it
+			if flags&mp4TrunDataOffset != 0 {
+				dataOffset = baseOffset + int64(int32(r.u32()))
+			} else if dataOffset < 0 {
+				dataOffset = baseOffset
+			}
+			firstFlags, hasFirstFlags := uint32(0), flags&mp4TrunFirstSampleFlags != 0
+			if hasFirstFlags {
+				firstFlags = r.u32()
+			}
+			for i := uint32(0); i < count && r.err == nil; i++ {
+				sample := mp4Sample{offset: dataOffset, dts: track.fragmentEnd}
+				duration, size, sampleFlags := defaultDuration, defaultSize, defaultFlags
+				if flags&mp4TrunSampleDuration != 0 {
+					duration = r.u32()
+				}
+				if flags&mp4TrunSampleSize != 0 {
+					size = r.u32()
+				}
+				if flags&mp4TrunSampleFlags != 0 {
+					sampleFlags = r.u32()
+				} else if i == 0 && hasFirstFlags {
+					sampleFlags = firstFlags
+				}
+				if flags&mp4TrunCompositionTimeOffset != 0 {
+					sample.compositionOffset = int32(r.u32())
+				}
+				sample.size = size
+				sample.sync = sampleFlags&mp4SampleIsNonSync == 0
+				track.samples = append(track.samples, sample)
+				track.Samples++
+				track.fragmentEnd += int64(duration)
+				dataOffset += int64(size)
+			}
+		}
+		return r.err
+	})
+}
+
+// ReadSample returns the next sample of the H.264 track. The parameter
+// sets of the avcC record lead the first sample.
+func (d *MP4Demuxer) ReadSample() (*Sample, error) {
+	track := d.Track
+	if d.next >= len(track.samples) {
+		return nil, io.EOF
+	}
+	s := track.samples[d.next]
+	d.next++
+	if s.offset < 0 || s.offset > d.end-int64(s.size) {
+		return nil, fmt.Errorf("%w: sample %d of %d bytes at %d past the end at %d", ErrInvalidMP4, d.next-1, s.size, s.offset, d.end)
+	}
+	if _, err := d.r.Seek(s.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data := make([]byte, s.size)
+	if _, err := io.ReadFull(d.r, data); err != nil {
+		return nil, fmt.Errorf("%w: sample %d of %d bytes at %d: %v", ErrInvalidMP4, d.next-1, s.size, s.offset, err)
+	}
+	sample := &Sample{
+		DTS:         mp4Duration(s.dts, track.Timescale),
+		PTS:         mp4Duration(s.dts+int64(s.compositionOffset), track.Timescale),
+		Timestamped: true,
+		Keyframe:    s.sync,
+	}
+	if d.next == 1 {
+		for _, parameterSets := range [][][]byte{track.AVCConfig.SPS, track.AVCConfig.PPS, track.AVCConfig.SPSExt} {
+			sample.NalUnits = append(sample.NalUnits, parameterSets...)
+		}
+	}
+	nalUnits, err := SplitLengthPrefixed(data, track.AVCConfig.LengthSize())
+	if err != nil {
+		return nil, fmt.Errorf("sample %d: %w", d.next-1, err)
+	}
+	sample.NalUnits = append(sample.NalUnits, nalUnits...)
+	return sample, nil
+}
+
+// Converts a time in timescale units to a duration, rounding up like
+// duration90kHz
+func mp4Duration(t int64, timescale uint32) time.Duration {
+	scale := int64(timescale)
+	return time.Duration(t/scale)*time.Second + time.Duration((t%scale*int64(time.Second)+scale-1)/scale)
+}
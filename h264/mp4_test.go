@@ -0,0 +1,124 @@
+package h264
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+func mp4TestConfig(t *testing.T) *AVCDecoderConfigurationRecord {
+	config, err := NewAVCDecoderConfigurationRecord(append(
+		[]byte{1, PROFILE_IDC_BASELINE, 0, 30, 0xff, 0xe1, 0, byte(len(bitsToBytes(baselineSPSBits)) + 1)},
+		append(append(nal(0x67, bitsToBytes(baselineSPSBits)), 1, 0, byte(len(bitsToBytes(baselinePPSBits))+1)),
+			nal(0x68, bitsToBytes(baselinePPSBits))...)...))
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	return config
+}
+
+func TestMP4DemuxerFragmented(t *testing.T) {
+	config := mp4TestConfig(t)
+	file := fmp4InitSegment(config, 320, 240)
+	file = append(file, fmp4Fragment(1, 0, []fmp4Sample{
+		{data: lengthPrefixed(4, recoveryPointSEI(), nal(0x41, bitsToBytes(pSliceBits(1)))), duration: 3000, compositionOffset: 6000, sync: true},
+		{data: lengthPrefixed(4, nal(0x41, bitsToBytes(pSliceBits(2)))), duration: 3000},
+	})...)
+	file = append(file, fmp4Fragment(2, 6000, []fmp4Sample{
+		{data: lengthPrefixed(4, nal(0x41, bitsToBytes(pSliceBits(3)))), duration: 3000, compositionOffset: 3000},
+	})...)
+
+	demuxer, err := NewMP4Demuxer(bytes.NewReader(file))
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if demuxer.MajorBrand != "iso5" || demuxer.Track.SampleEntry != "avc1" || demuxer.Track.Width != 320 || demuxer.Track.Samples != 3 {
+		t.Fatalf("unexpected track %+v\n", demuxer.Track)
+	}
+	var frames frameList
+	if err := NewDecoder(WithFrameHandler(&frames)).DecodeSamples(demuxer); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if len(frames) != 3 {
+		t.Fatalf("expected 3 pictures, got %d\n", len(frames))
+	}
+	for i, want := range [][2]int64{{0, 6000}, {3000, 3000}, {6000, 9000}} {
+		if frames[i].FrameNum != i+1 || frames[i].DTS90k != want[0] || frames[i].PTS90k != want[1] {
+			t.Fatalf("picture %d: expected DTS %d PTS %d, got %d %d %d\n", i, want[0], want[1], frames[i].FrameNum, frames[i].DTS90k, frames[i].PTS90k)
+		}
+	}
+}
+
+func TestMP4DemuxerSampleTables(t *testing.T) {
+	config := mp4TestConfig(t)
+	samples := [][]byte{
+		lengthPrefixed(4, recoveryPointSEI(), nal(0x41, bitsToBytes(pSliceBits(1)))),
+		lengthPrefixed(4, nal(0x41, bitsToBytes(pSliceBits(2)))),
+		lengthPrefixed(4, nal(0x41, bitsToBytes(pSliceBits(3)))),
+	}
+	ftyp := mp4Box("ftyp", []byte("isom"), make([]byte, 4), []byte("isomavc1"))
+	mdat := mp4Box("mdat", bytes.Join(samples, nil))
+	// Two chunks, of two samples and of one
+	chunk1 := int64(len(ftyp) + 8)
+	chunk2 := chunk1 + int64(len(samples[0])+len(samples[1]))
+	u32 := mp4Uint32
+	stsz := mp4FullBox("stsz", 0, 0, u32(0), u32(3), u32(uint32(len(samples[0]))), u32(uint32(len(samples[1]))), u32(uint32(len(samples[2]))))
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, u32(1), mp4Box("avc1", make([]byte, 78), mp4Box("avcC", config.Bytes()))),
+		mp4FullBox("stts", 0, 0, u32(1), u32(3), u32(4500)),
+		mp4FullBox("ctts", 0, 0, u32(2), u32(1), u32(4500), u32(2), u32(0)),
+		stsz,
+		mp4FullBox("stsc", 0, 0, u32(2), u32(1), u32(2), u32(1), u32(2), u32(1), u32(1)),
+		mp4FullBox("co64", 0, 0, u32(2), binary.BigEndian.AppendUint64(nil, uint64(chunk1)), binary.BigEndian.AppendUint64(nil, uint64(chunk2))),
+		mp4FullBox("stss", 0, 0, u32(1), u32(1)),
+	)
+	mdhd := mp4FullBox("mdhd", 0, 0, make([]byte, 8), u32(90000), make([]byte, 8))
+	hdlr := mp4FullBox("hdlr", 0, 0, make([]byte, 4), []byte("vide"), make([]byte, 13))
+	tkhd := mp4FullBox("tkhd", 0, 3, make([]byte, 8), u32(7), make([]byte, 60), u32(320<<16), u32(240<<16))
+	moov := mp4Box("moov", mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, mp4Box("minf", stbl))))
+	file := append(append(ftyp, mdat...), moov...)
+
+	demuxer, err := NewMP4Demuxer(bytes.NewReader(file))
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if demuxer.Track.ID != 7 || demuxer.Track.Handler != "vide" || demuxer.Track.Height != 240 {
+		t.Fatalf("unexpected track %+v\n", demuxer.Track)
+	}
+	read := readSamples(t, demuxer)
+	if len(read) != 3 || !read[0].Keyframe || read[1].Keyframe {
+		t.Fatalf("unexpected samples %v\n", read)
+	}
+	// The parameter sets of avcC lead the first sample
+	if len(read[0].NalUnits) != 4 || read[0].NalUnits[0][0] != 0x67 || len(read[2].NalUnits) != 1 {
+		t.Fatalf("unexpected NAL units %x\n", read[0].NalUnits)
+	}
+	if read[2].DTS != 100*time.Millisecond || read[0].PTS != 50*time.Millisecond || read[1].PTS != 50*time.Millisecond {
+		t.Fatalf("unexpected timestamps %v %v %v\n", read[2].DTS, read[0].PTS, read[1].PTS)
+	}
+	var got frameNums
+	demuxer, _ = NewMP4Demuxer(bytes.NewReader(file))
+	if err := NewDecoder(WithFrameHandler(&got)).DecodeSamples(demuxer); err != nil || len(got) != 3 {
+		t.Fatalf("expected 3 pictures, got %v %v\n", got, err)
+	}
+
+	// A sample past the end of the file ahead of others is not read
+	corrupt := mp4FullBox("stsz", 0, 0, u32(0), u32(3), u32(0x7fffffff), u32(uint32(len(samples[1]))), u32(uint32(len(samples[2]))))
+	demuxer, err = NewMP4Demuxer(bytes.NewReader(bytes.Replace(file, stsz, corrupt, 1)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if _, err := demuxer.ReadSample(); !errors.Is(err, ErrInvalidMP4) {
+		t.Fatalf("expected ErrInvalidMP4, got %v\n", err)
+	}
+}
+
+func TestMP4DemuxerBoxPastEnd(t *testing.T) {
+	// A moov box of 0x7f00000000000000 bytes by its 64 bit size
+	file := []byte{0, 0, 0, 1, 'm', 'o', 'o', 'v', 0x7f, 0, 0, 0, 0, 0, 0, 0}
+	if _, err := NewMP4Demuxer(bytes.NewReader(file)); !errors.Is(err, ErrInvalidMP4) {
+		t.Fatalf("expected ErrInvalidMP4, got %v\n", err)
+	}
+}
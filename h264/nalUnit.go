@@ -1,5 +1,7 @@
 package h264
 
+import "fmt"
+
 type NalUnit struct {
 	NumBytes                     int
 	ForbiddenZeroBit             int
@@ -72,16 +74,30 @@ func NalUnitHeaderMvcExtension(nalUnit *NalUnit, b *BitReader) {
 func (n *NalUnit) RBSP() []byte {
 	return n.rbsp
 }
-func NewNalUnit(frame []byte, numBytesInNal int) *NalUnit {
-	logger.Printf("debug: reading %d byte NAL\n", numBytesInNal)
+func NewNalUnit(frame []byte, numBytesInNal int) (*NalUnit, error) {
+	return parseNalUnit(&BitReader{bytes: frame}, numBytesInNal)
+}
+
+// Parses the NAL unit held by b, removing emulation prevention bytes from
+// its payload
+func parseNalUnit(b *BitReader, numBytesInNal int) (*NalUnit, error) {
+	frame := b.Bytes()
+	if len(frame) == 0 || numBytesInNal < 1 {
+		return nil, ErrTruncated
+	}
+	if numBytesInNal > len(frame) {
+		numBytesInNal = len(frame)
+	}
 	nalUnit := NalUnit{
 		NumBytes:    numBytesInNal,
 		HeaderBytes: 1,
 	}
-	b := &BitReader{bytes: frame}
 	nalUnit.ForbiddenZeroBit = b.NextField("ForbiddenZeroBit", 1)
 	nalUnit.RefIdc = b.NextField("NalRefIdc", 2)
 	nalUnit.Type = b.NextField("NalUnitType", 5)
+	if err := checkRange("ForbiddenZeroBit", nalUnit.ForbiddenZeroBit, 0, 0); err != nil {
+		return nil, err
+	}
 
 	if nalUnit.Type == 14 || nalUnit.Type == 20 || nalUnit.Type == 21 {
 		if nalUnit.Type != 21 {
@@ -100,32 +116,29 @@ func NewNalUnit(frame []byte, numBytesInNal int) *NalUnit {
 			nalUnit.HeaderBytes += 3
 
 		}
+		if err := b.Err(); err != nil {
+			return nil, fmt.Errorf("%s NAL header: %w", NALUnitType[nalUnit.Type], err)
+		}
 	}
 	b.LogStreamPosition()
-	logger.Printf("debug: found %d byte header. Reading body\n", nalUnit.HeaderBytes)
 	for i := nalUnit.HeaderBytes; i < nalUnit.NumBytes; i++ {
-		next3Bytes, err := b.PeekBytes(3)
-		if err != nil {
-			logger.Printf("error: while reading next 3 NAL bytes: %v\n", err)
-			break
-		}
-		// Little odd, the err above and the i+2 check might be synonyms
+		// Fewer than 3 bytes left can't hold an emulation prevention sequence
+		next3Bytes, _ := b.PeekBytes(3)
 		if i+2 < nalUnit.NumBytes && isEmulationPreventionThreeByte(next3Bytes) {
 			_b, _ := b.ReadBytes(3)
 			nalUnit.rbsp = append(nalUnit.rbsp, _b[:2]...)
 			i += 2
 			nalUnit.EmulationPreventionThreeByte = _b[2]
 		} else {
-			if _b, err := b.ReadByte(); err == nil {
-				nalUnit.rbsp = append(nalUnit.rbsp, _b)
-			} else {
-				logger.Printf("error: while reading byte %d of %d nal bytes: %v\n", i, nalUnit.NumBytes, err)
-				break
+			_b, err := b.ReadByte()
+			if err != nil {
+				return nil, fmt.Errorf("%w: byte %d of %d NAL bytes", ErrTruncated, i, nalUnit.NumBytes)
 			}
+			nalUnit.rbsp = append(nalUnit.rbsp, _b)
 		}
 	}
 
 	// nalUnit.rbsp = frame[nalUnit.HeaderBytes:]
-	logger.Printf("info: decoded %s NAL with %d RBSP bytes\n", NALUnitType[nalUnit.Type], len(nalUnit.rbsp))
-	return &nalUnit
+	b.logger().Debug("NAL unit", "type", NALUnitType[nalUnit.Type], "refIdc", nalUnit.RefIdc, "rbspBytes", len(nalUnit.rbsp))
+	return &nalUnit, nil
 }
@@ -0,0 +1,173 @@
+package h264
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Link types of libpcap captures
+const (
+	PCAP_LINKTYPE_NULL      = 0
+	PCAP_LINKTYPE_ETHERNET  = 1
+	PCAP_LINKTYPE_RAW       = 101
+	PCAP_LINKTYPE_LINUX_SLL = 113
+	PCAP_LINKTYPE_IPV4      = 228
+	PCAP_LINKTYPE_IPV6      = 229
+)
+
+// The largest snapshot length libpcap writes
+const pcapMaxSnaplen = 262144
+
+// ErrInvalidCapture is returned for a file that is not a libpcap capture
+var ErrInvalidCapture = errors.New("h264: invalid packet capture")
+
+// CapturedRTPPacket is an RTP packet read from a capture file
+type CapturedRTPPacket struct {
+	*RTPPacket
+	Time    time.Time
+	SrcPort int
+	DstPort int
+}
+
+// ReadRTPCapture reads the UDP datagrams of a libpcap capture, as written
+// by tcpdump -w, as RTP packets. Only datagrams to dstPort are kept unless
+// it is 0. Datagrams that are not RTP are skipped.
+//
+// A capture of a single stream can be made with
+//
+//	tcpdump -i any -w camera.pcap udp dst port 5004
+func ReadRTPCapture(r io.Reader, dstPort int) ([]CapturedRTPPacket, error) {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: file header: %v", ErrInvalidCapture, err)
+	}
+	var order binary.ByteOrder
+	nanoseconds := false
+	switch binary.LittleEndian.Uint32(header) {
+	case 0xa1b2c3d4:
+		order = binary.LittleEndian
+	case 0xa1b23c4d:
+		order, nanoseconds = binary.LittleEndian, true
+	case 0xd4c3b2a1:
+		order = binary.BigEndian
+	case 0x4d3cb2a1:
+		order, nanoseconds = binary.BigEndian, true
+	default:
+		return nil, fmt.Errorf("%w: magic %x", ErrInvalidCapture, header[:4])
+	}
+	linkType := int(order.Uint32(header[20:]) & 0xffff)
+	// Records longer than the snapshot length are corrupt
+	snaplen := int64(order.Uint32(header[16:]))
+	if snaplen == 0 || snaplen > pcapMaxSnaplen {
+		snaplen = pcapMaxSnaplen
+	}
+
+	packets := []CapturedRTPPacket{}
+	record := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(r, record); err != nil {
+			if err == io.EOF {
+				return packets, nil
+			}
+			return packets, fmt.Errorf("%w: record header: %v", ErrInvalidCapture, err)
+		}
+		fraction := time.Duration(order.Uint32(record[4:]))
+		if !nanoseconds {
+			fraction *= time.Microsecond
+		}
+		captured := time.Unix(int64(order.Uint32(record[0:])), int64(fraction))
+		length := int64(order.Uint32(record[8:]))
+		if length > snaplen {
+			return packets, fmt.Errorf("%w: record of %d bytes exceeds the snapshot length %d", ErrInvalidCapture, length, snaplen)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return packets, fmt.Errorf("%w: record of %d bytes: %v", ErrInvalidCapture, len(data), err)
+		}
+		srcPort, port, payload, ok := udpPayload(linkType, data)
+		if !ok || (dstPort != 0 && port != dstPort) {
+			continue
+		}
+		packet, err := NewRTPPacket(payload)
+		// RTCP multiplexed on the port has payload types 72 to 76, RFC 5761
+		if err != nil || (packet.PayloadType >= 72 && packet.PayloadType <= 76) {
+			continue
+		}
+		packets = append(packets, CapturedRTPPacket{RTPPacket: packet, Time: captured, SrcPort: srcPort, DstPort: port})
+	}
+}
+
+// Returns the ports and payload of a UDP datagram in an unfragmented IPv4
+// or IPv6 packet
+func udpPayload(linkType int, frame []byte) (srcPort, dstPort int, payload []byte, ok bool) {
+	var packet []byte
+	switch linkType {
+	case PCAP_LINKTYPE_ETHERNET:
+		if len(frame) < 14 {
+			return
+		}
+		etherType, offset := int(frame[12])<<8|int(frame[13]), 14
+		// 802.1Q VLAN tags
+		for (etherType == 0x8100 || etherType == 0x88a8) && len(frame) >= offset+4 {
+			etherType, offset = int(frame[offset+2])<<8|int(frame[offset+3]), offset+4
+		}
+		if etherType != 0x0800 && etherType != 0x86dd {
+			return
+		}
+		packet = frame[offset:]
+	case PCAP_LINKTYPE_LINUX_SLL:
+		if len(frame) < 16 {
+			return
+		}
+		packet = frame[16:]
+	case PCAP_LINKTYPE_NULL:
+		if len(frame) < 4 {
+			return
+		}
+		packet = frame[4:]
+	case PCAP_LINKTYPE_RAW, PCAP_LINKTYPE_IPV4, PCAP_LINKTYPE_IPV6:
+		packet = frame
+	default:
+		return
+	}
+	if len(packet) < 1 {
+		return
+	}
+	var udp []byte
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return
+		}
+		headerLength := int(packet[0]&0x0f) * 4
+		// Reassembly is not supported
+		fragmented := packet[6]&0x20 != 0 || (int(packet[6]&0x1f)<<8|int(packet[7])) != 0
+		if headerLength < 20 || len(packet) < headerLength || packet[9] != 17 || fragmented {
+			return
+		}
+		totalLength := int(packet[2])<<8 | int(packet[3])
+		if totalLength < headerLength || totalLength > len(packet) {
+			totalLength = len(packet)
+		}
+		udp = packet[headerLength:totalLength]
+	case 6:
+		// No extension headers
+		if len(packet) < 40 || packet[6] != 17 {
+			return
+		}
+		udp = packet[40:]
+	default:
+		return
+	}
+	if len(udp) < 8 {
+		return
+	}
+	length := int(udp[4])<<8 | int(udp[5])
+	if length < 8 || length > len(udp) {
+		length = len(udp)
+	}
+	return int(udp[0])<<8 | int(udp[1]), int(udp[2])<<8 | int(udp[3]), udp[8:length], true
+}
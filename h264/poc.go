@@ -0,0 +1,142 @@
+package h264
+
+// pocState holds what 8.2.1 needs from previously decoded pictures
+type pocState struct {
+	prevPicOrderCntMsb int
+	prevPicOrderCntLsb int
+	prevFrameNumOffset int
+	prevFrameNum       int
+	// prevMMCO5 is set when the previous picture had
+	// memory_management_control_operation 5
+	prevMMCO5 bool
+}
+
+// 8.2.1: Derives PicOrderCnt of the picture starting with header and
+// updates the state for the next picture
+func (p *pocState) picOrderCnt(sps *SPS, nalUnit *NalUnit, header *SliceHeader) int {
+	idr := nalUnit.Type == NALU_TYPE_SLICE_IDR_PICTURE
+	reference := nalUnit.RefIdc != 0
+	maxFrameNum := 1 << uint(sps.Log2MaxFrameNumMinus4+4)
+	deltaPicOrderCnt := func(i int) int {
+		if i < len(header.DeltaPicOrderCnt) {
+			return header.DeltaPicOrderCnt[i]
+		}
+		return 0
+	}
+
+	// 8-6, 8-11: FrameNumOffset for types 1 and 2
+	frameNumOffset := 0
+	if !idr {
+		prevFrameNumOffset := p.prevFrameNumOffset
+		if p.prevMMCO5 {
+			prevFrameNumOffset = 0
+		}
+		frameNumOffset = prevFrameNumOffset
+		if p.prevFrameNum > header.FrameNum {
+			frameNumOffset += maxFrameNum
+		}
+	}
+
+	var top, bottom int
+	switch sps.PicOrderCountType {
+	case 0:
+		// 8.2.1.1
+		if idr {
+			p.prevPicOrderCntMsb, p.prevPicOrderCntLsb = 0, 0
+		}
+		maxPicOrderCntLsb := 1 << uint(sps.Log2MaxPicOrderCntLSBMin4+4)
+		lsb := header.PicOrderCntLsb
+		msb := p.prevPicOrderCntMsb
+		if lsb < p.prevPicOrderCntLsb && p.prevPicOrderCntLsb-lsb >= maxPicOrderCntLsb/2 {
+			msb += maxPicOrderCntLsb
+		} else if lsb > p.prevPicOrderCntLsb && lsb-p.prevPicOrderCntLsb > maxPicOrderCntLsb/2 {
+			msb -= maxPicOrderCntLsb
+		}
+		top = msb + lsb
+		bottom = top
+		if !header.FieldPic {
+			bottom = top + header.DeltaPicOrderCntBottom
+		}
+		if reference {
+			p.prevPicOrderCntMsb, p.prevPicOrderCntLsb = msb, lsb
+			if header.MMCO5 {
+				// 8.2.1: after memory_management_control_operation 5
+				// the picture's order count is relative to itself
+				p.prevPicOrderCntMsb = 0
+				p.prevPicOrderCntLsb = 0
+				if !header.BottomField {
+					p.prevPicOrderCntLsb = top - minInt(top, bottom)
+				}
+			}
+		}
+	case 1:
+		// 8.2.1.2
+		expectedPicOrderCnt := 0
+		cycle := sps.NumRefFramesInPicOrderCntCycle
+		absFrameNum := 0
+		if cycle != 0 {
+			absFrameNum = frameNumOffset + header.FrameNum
+		}
+		if !reference && absFrameNum > 0 {
+			absFrameNum--
+		}
+		if absFrameNum > 0 {
+			expectedDeltaPerCycle := 0
+			for _, offset := range sps.OffsetForRefFrameList {
+				expectedDeltaPerCycle += offset
+			}
+			cycleCnt := (absFrameNum - 1) / cycle
+			frameNumInCycle := (absFrameNum - 1) % cycle
+			expectedPicOrderCnt = cycleCnt * expectedDeltaPerCycle
+			for i := 0; i <= frameNumInCycle && i < len(sps.OffsetForRefFrameList); i++ {
+				expectedPicOrderCnt += sps.OffsetForRefFrameList[i]
+			}
+		}
+		if !reference {
+			expectedPicOrderCnt += sps.OffsetForNonRefPic
+		}
+		if !header.FieldPic {
+			top = expectedPicOrderCnt + deltaPicOrderCnt(0)
+			bottom = top + sps.OffsetForTopToBottomField + deltaPicOrderCnt(1)
+		} else if !header.BottomField {
+			top = expectedPicOrderCnt + deltaPicOrderCnt(0)
+			bottom = top
+		} else {
+			bottom = expectedPicOrderCnt + sps.OffsetForTopToBottomField + deltaPicOrderCnt(0)
+			top = bottom
+		}
+	case 2:
+		// 8.2.1.3
+		tempPicOrderCnt := 0
+		if !idr {
+			tempPicOrderCnt = 2 * (frameNumOffset + header.FrameNum)
+			if !reference {
+				tempPicOrderCnt--
+			}
+		}
+		top, bottom = tempPicOrderCnt, tempPicOrderCnt
+	}
+
+	p.prevFrameNumOffset = frameNumOffset
+	p.prevFrameNum = header.FrameNum
+	p.prevMMCO5 = header.MMCO5
+	if header.MMCO5 {
+		p.prevFrameNum = 0
+	}
+
+	// 8-1
+	if !header.FieldPic {
+		return minInt(top, bottom)
+	}
+	if header.BottomField {
+		return bottom
+	}
+	return top
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -35,13 +35,32 @@ type PPS struct {
 	PicScalingMatrixPresent           bool
 	PicScalingListPresent             []bool
 	SecondChromaQpIndexOffset         int
+	rbsp                              []byte
+	// refIdc is the nal_ref_idc of the NAL unit carrying the PPS, 0 when
+	// it was parsed from the RBSP alone
+	refIdc int
 }
 
-func NewPPS(sps *SPS, rbsp []byte, showPacket bool) *PPS {
-	logger.Printf("debug: PPS RBSP %d bytes %d bits == \n", len(rbsp), len(rbsp)*8)
-	logger.Printf("debug: \t%#v\n", rbsp[0:8])
-	pps := PPS{}
-	b := &BitReader{bytes: rbsp}
+// RBSP is the pic_parameter_set_rbsp the PPS was parsed from
+func (pps *PPS) RBSP() []byte {
+	return pps.rbsp
+}
+
+func NewPPS(sps *SPS, rbsp []byte, showPacket bool) (*PPS, error) {
+	return parsePPS(sps, &BitReader{bytes: rbsp}, showPacket)
+}
+
+// Parses the pic_parameter_set_rbsp held by b
+func parsePPS(sps *SPS, b *BitReader, showPacket bool) (*PPS, error) {
+	rbsp := b.Bytes()
+	b.logger().Debug("PPS RBSP", "bytes", len(rbsp), "head", headBytes(rbsp, 8))
+	if len(rbsp) == 0 {
+		return nil, fmt.Errorf("PPS: %w", ErrTruncated)
+	}
+	if sps == nil {
+		return nil, fmt.Errorf("PPS: no active SPS")
+	}
+	pps := PPS{rbsp: rbsp}
 	flagField := func() bool {
 		if v := b.NextField("", 1); v == 1 {
 			return true
@@ -54,26 +73,40 @@ func NewPPS(sps *SPS, rbsp []byte, showPacket bool) *PPS {
 	pps.EntropyCodingMode = b.NextField("EntropyCodingModeFlag", 1)
 	pps.BottomFieldPicOrderInFramePresent = flagField()
 	pps.NumSliceGroupsMinus1 = ue(b.golomb())
+	if err := firstError(
+		checkRange("PPSID", pps.ID, 0, 255),
+		checkRange("SPSID", pps.SPSID, 0, 31),
+		checkRange("NumSliceGroupsMinus1", pps.NumSliceGroupsMinus1, 0, 7),
+	); err != nil {
+		return nil, err
+	}
 	if pps.NumSliceGroupsMinus1 > 0 {
 		pps.SliceGroupMapType = ue(b.golomb())
+		if err := checkRange("SliceGroupMapType", pps.SliceGroupMapType, 0, 6); err != nil {
+			return nil, err
+		}
 		if pps.SliceGroupMapType == 0 {
 			for iGroup := 0; iGroup <= pps.NumSliceGroupsMinus1; iGroup++ {
-				pps.RunLengthMinus1[iGroup] = ue(b.golomb())
+				pps.RunLengthMinus1 = append(pps.RunLengthMinus1, ue(b.golomb()))
 			}
 		} else if pps.SliceGroupMapType == 2 {
 			for iGroup := 0; iGroup < pps.NumSliceGroupsMinus1; iGroup++ {
-				pps.TopLeft[iGroup] = ue(b.golomb())
-				pps.BottomRight[iGroup] = ue(b.golomb())
+				pps.TopLeft = append(pps.TopLeft, ue(b.golomb()))
+				pps.BottomRight = append(pps.BottomRight, ue(b.golomb()))
 			}
 		} else if pps.SliceGroupMapType > 2 && pps.SliceGroupMapType < 6 {
 			pps.SliceGroupChangeDirection = flagField()
 			pps.SliceGroupChangeRateMinus1 = ue(b.golomb())
 		} else if pps.SliceGroupMapType == 6 {
 			pps.PicSizeInMapUnitsMinus1 = ue(b.golomb())
+			// 7.4.2.2 equal to PicSizeInMapUnits - 1
+			if err := checkRange("PicSizeInMapUnitsMinus1", pps.PicSizeInMapUnitsMinus1, PicSizeInMapUnits(sps)-1, PicSizeInMapUnits(sps)-1); err != nil {
+				return nil, err
+			}
 			for i := 0; i <= pps.PicSizeInMapUnitsMinus1; i++ {
-				pps.SliceGroupId[i] = b.NextField(
+				pps.SliceGroupId = append(pps.SliceGroupId, b.NextField(
 					fmt.Sprintf("SliceGroupId[%d]", i),
-					int(math.Ceil(math.Log2(float64(pps.NumSliceGroupsMinus1+1)))))
+					int(math.Ceil(math.Log2(float64(pps.NumSliceGroupsMinus1+1))))))
 			}
 		}
 
@@ -89,9 +122,8 @@ func NewPPS(sps *SPS, rbsp []byte, showPacket bool) *PPS {
 	pps.ConstrainedIntraPred = flagField()
 	pps.RedundantPicCntPresent = flagField()
 
-	logger.Printf("debug: \tChecking for more PPS data")
-	if b.HasMoreData() {
-		logger.Printf("debug: \tProcessing additional PPS data")
+	if b.MoreRBSPData() {
+		b.logger().Debug("PPS has transform_8x8_mode_flag and later fields")
 		pps.Transform8x8Mode = b.NextField("Transform8x8ModeFlag", 1)
 		pps.PicScalingMatrixPresent = flagField()
 		if pps.PicScalingMatrixPresent {
@@ -100,7 +132,7 @@ func NewPPS(sps *SPS, rbsp []byte, showPacket bool) *PPS {
 				v = 2
 			}
 			for i := 0; i < 6+(v*pps.Transform8x8Mode); i++ {
-				pps.PicScalingListPresent[i] = flagField()
+				pps.PicScalingListPresent = append(pps.PicScalingListPresent, flagField())
 				if pps.PicScalingListPresent[i] {
 					if i < 6 {
 						scalingList(
@@ -121,13 +153,31 @@ func NewPPS(sps *SPS, rbsp []byte, showPacket bool) *PPS {
 			}
 			pps.SecondChromaQpIndexOffset = se(b.golomb())
 		}
-		b.MoreRBSPData()
-		// rbspTrailingBits()
+	}
+	if err := b.Err(); err != nil {
+		return nil, fmt.Errorf("PPS: %w", err)
+	}
+	if err := pps.validate(sps); err != nil {
+		return nil, err
 	}
 
 	if showPacket {
-		debugPacket("PPS", pps)
+		debugPacket(b, "PPS", pps)
 	}
-	return &pps
+	return &pps, nil
+
+}
 
+// 7.4.2.2 semantic limits
+func (pps *PPS) validate(sps *SPS) error {
+	qpBdOffsetY := 6 * sps.BitDepthLumaMinus8
+	return firstError(
+		checkRange("NumRefIdxL0DefaultActiveMinus1", pps.NumRefIdxL0DefaultActiveMinus1, 0, 31),
+		checkRange("NumRefIdxL1DefaultActiveMinus1", pps.NumRefIdxL1DefaultActiveMinus1, 0, 31),
+		checkRange("WeightedBipredIDC", pps.WeightedBipred, 0, 2),
+		checkRange("PicInitQpMinus26", pps.PicInitQpMinus26, -(26+qpBdOffsetY), 25),
+		checkRange("PicInitQsMinus26", pps.PicInitQsMinus26, -26, 25),
+		checkRange("ChromaQpIndexOffset", pps.ChromaQpIndexOffset, -12, 12),
+		checkRange("SecondChromaQpIndexOffset", pps.SecondChromaQpIndexOffset, -12, 12),
+	)
 }
@@ -1,7 +1,5 @@
 package h264
 
-import "fmt"
-
 const (
 	PROFILE_IDC_BASELINE            = 66
 	PROFILE_IDC_MAIN                = 77
@@ -25,20 +23,17 @@ var (
 )
 
 // 7.3.2.11
-func rbspTrailingBits(b *BitReader) {
-	rbspStopOneBit := make([]int, 1)
-	if _, err := b.Read(rbspStopOneBit); err != nil {
-		fmt.Println("error reading StopOneBit: %v\n", err)
+func rbspTrailingBits(b *BitReader) error {
+	if v := b.NextField("RBSPStopOneBit", 1); v != 1 && b.Err() == nil {
+		return ErrInvalidValue{Field: "RBSPStopOneBit", Value: v, Range: [2]int{1, 1}}
 	}
 	// 7.2
-	for !b.IsByteAligned() {
-		// RBSPAlignmentZeroBit
-		rbspAlignmentZeroBit := make([]int, 1)
-		if _, err := b.Read(rbspAlignmentZeroBit); err != nil {
-			fmt.Println("error reading AligntmentZeroBit: %v\n", err)
-			break
+	for !b.IsByteAligned() && b.Err() == nil {
+		if v := b.NextField("RBSPAlignmentZeroBit", 1); v != 0 {
+			return ErrInvalidValue{Field: "RBSPAlignmentZeroBit", Value: v, Range: [2]int{0, 0}}
 		}
 	}
+	return b.Err()
 }
 func NewRBSP(frame []byte) []byte {
 	// TODO: NALUType 14,20,21 add padding to 3rd or 4th byte
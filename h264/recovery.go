@@ -0,0 +1,117 @@
+package h264
+
+import (
+	"fmt"
+)
+
+func init() {
+	RegisterSEIDecoder(SEI_TYPE_RECOVERY_POINT, decodeRecoveryPoint)
+}
+
+// RecoveryPoint is the recovery_point payload, D.1.8. Output is correct
+// from recovery_frame_cnt frames after the picture it is attached to.
+type RecoveryPoint struct {
+	RecoveryFrameCnt      int
+	ExactMatch            bool
+	BrokenLink            bool
+	ChangingSliceGroupIDC int
+}
+
+func decodeRecoveryPoint(videoStream *VideoStream, b *BitReader) (interface{}, error) {
+	recoveryPoint := RecoveryPoint{
+		RecoveryFrameCnt:      ue(b.golomb()),
+		ExactMatch:            b.NextField("ExactMatchFlag", 1) == 1,
+		BrokenLink:            b.NextField("BrokenLinkFlag", 1) == 1,
+		ChangingSliceGroupIDC: b.NextField("ChangingSliceGroupIDC", 2),
+	}
+	if err := b.Err(); err != nil {
+		return nil, fmt.Errorf("recovery point: %w", err)
+	}
+	if videoStream != nil && videoStream.SPS != nil {
+		maxFrameNum := 1 << uint(videoStream.SPS.Log2MaxFrameNumMinus4+4)
+		if err := checkRange("RecoveryFrameCnt", recoveryPoint.RecoveryFrameCnt, 0, maxFrameNum-1); err != nil {
+			return nil, err
+		}
+	}
+	return recoveryPoint, nil
+}
+
+// RandomAccessPoint describes where decoding of a stream started. Pictures
+// are not output until recovery_frame_cnt frames after FrameNum, which is
+// the picture at RecoveryFrameNum or, when that frame_num was lost or
+// skipped, the first one after it.
+type RandomAccessPoint struct {
+	// IDR is set when decoding started at an IDR picture rather than at a
+	// recovery point SEI
+	IDR           bool
+	RecoveryPoint RecoveryPoint
+	// FrameNum is the frame_num of the first picture decoded. It is -1
+	// until a slice header of that picture has been read.
+	FrameNum         int
+	RecoveryFrameNum int
+	// SkippedNalUnits counts the NAL units discarded while waiting for
+	// parameter sets and an access point
+	SkippedNalUnits int
+}
+
+// Reports whether the slice may start decoding: an IDR picture or one whose
+// access unit carried a recovery point SEI. It records the access point.
+func (h *H264Reader) acquireRandomAccess(nalUnit *NalUnit) bool {
+	if h.RandomAccess != nil {
+		return true
+	}
+	if nalUnit.Type == NALU_TYPE_SLICE_IDR_PICTURE {
+		h.RandomAccess = &RandomAccessPoint{IDR: true, FrameNum: -1}
+	}
+	for _, message := range h.pendingSEI {
+		if recoveryPoint, ok := message.Value.(RecoveryPoint); ok && h.RandomAccess == nil {
+			h.RandomAccess = &RandomAccessPoint{RecoveryPoint: recoveryPoint, FrameNum: -1}
+		}
+	}
+	if h.RandomAccess == nil {
+		h.skippedNalUnits++
+		return false
+	}
+	h.RandomAccess.SkippedNalUnits = h.skippedNalUnits
+	return true
+}
+
+// Records the first picture decoded after the access point
+func (h *H264Reader) startRandomAccess(sps *SPS, header *SliceHeader) {
+	ra := h.RandomAccess
+	if ra == nil || ra.FrameNum >= 0 {
+		return
+	}
+	maxFrameNum := 1 << uint(sps.Log2MaxFrameNumMinus4+4)
+	ra.FrameNum = header.FrameNum
+	ra.RecoveryFrameNum = (header.FrameNum + ra.RecoveryPoint.RecoveryFrameCnt) % maxFrameNum
+	h.logger().Info("random access point",
+		"idr", ra.IDR,
+		"frameNum", ra.FrameNum,
+		"recoveryFrameNum", ra.RecoveryFrameNum,
+		"exactMatch", ra.RecoveryPoint.ExactMatch,
+		"brokenLink", ra.RecoveryPoint.BrokenLink,
+		"skippedNalUnits", ra.SkippedNalUnits)
+}
+
+// Reports whether frame may be output. Pictures decoded before the
+// recovery point may reference pictures that were never received.
+func (h *H264Reader) recovered(frame *Frame) bool {
+	if h.outputStarted {
+		return true
+	}
+	ra := h.RandomAccess
+	if frame.IDR || (ra != nil && ra.FrameNum >= 0 && frame.lastSlice != nil && framesSince(frame, ra.FrameNum) >= ra.RecoveryPoint.RecoveryFrameCnt) {
+		h.outputStarted = true
+		frame.RandomAccess = ra
+		return true
+	}
+	return false
+}
+
+// Returns the frames elapsed from frameNum to the frame_num of frame,
+// modulo MaxFrameNum, 7-10
+func framesSince(frame *Frame, frameNum int) int {
+	maxFrameNum := 1 << uint(frame.SPS.Log2MaxFrameNumMinus4+4)
+	return ((frame.FrameNum-frameNum)%maxFrameNum + maxFrameNum) % maxFrameNum
+}
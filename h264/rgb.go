@@ -0,0 +1,256 @@
+package h264
+
+import (
+	"errors"
+	"image"
+	"math"
+)
+
+// ErrNoSamples is returned when converting a frame that was not decoded to
+// samples
+var ErrNoSamples = errors.New("h264: frame has no samples")
+
+// matrix_coefficients, Table E-5
+const (
+	MATRIX_GBR         = 0
+	MATRIX_BT709       = 1
+	MATRIX_UNSPECIFIED = 2
+	MATRIX_FCC         = 4
+	MATRIX_BT470BG     = 5
+	MATRIX_SMPTE170M   = 6
+	MATRIX_SMPTE240M   = 7
+	MATRIX_YCGCO       = 8
+	MATRIX_BT2020_NCL  = 9
+	MATRIX_BT2020_CL   = 10
+)
+
+// Kr and Kb of matrix_coefficients, Table E-5. Constant luminance BT.2020
+// is converted as non-constant luminance.
+var matrixKrKb = map[int][2]float64{
+	MATRIX_BT709:      {0.2126, 0.0722},
+	MATRIX_FCC:        {0.30, 0.11},
+	MATRIX_BT470BG:    {0.299, 0.114},
+	MATRIX_SMPTE170M:  {0.299, 0.114},
+	MATRIX_SMPTE240M:  {0.212, 0.087},
+	MATRIX_BT2020_NCL: {0.2627, 0.0593},
+	MATRIX_BT2020_CL:  {0.2627, 0.0593},
+}
+
+// ColorMatrix is the matrix_coefficients the samples of the SPS are
+// converted to RGB with. Without a colour description, or with a value
+// this package does not convert, HD pictures are taken as BT.709 and
+// smaller ones as BT.601, as most players do.
+func (sps *SPS) ColorMatrix() int {
+	if sps.ColorDescriptionPresent {
+		if _, ok := matrixKrKb[sps.MatrixCoefficients]; ok {
+			return sps.MatrixCoefficients
+		}
+		if sps.MatrixCoefficients == MATRIX_GBR || sps.MatrixCoefficients == MATRIX_YCGCO {
+			return sps.MatrixCoefficients
+		}
+	}
+	if _, height := sps.DisplaySize(); height > 576 {
+		return MATRIX_BT709
+	}
+	return MATRIX_SMPTE170M
+}
+
+// rgbConverter turns the Y, Cb and Cr samples of a frame into 8 bit RGB,
+// E.2.1
+type rgbConverter struct {
+	matrix int
+	kr, kb float64
+	// Samples are normalised as (v - offset) * scale, luma to 0 to 1 and
+	// chroma to -0.5 to 0.5. Chroma of GBR is normalised as luma.
+	lumaOffset, lumaScale     float64
+	chromaOffset, chromaScale float64
+	// The chroma samples and weights in quarters of each column and row
+	columns, rows []chromaTap
+}
+
+// chromaTap interpolates a chroma sample between two neighbours,
+// weighting the second by weight quarters
+type chromaTap struct {
+	first, second, weight int
+}
+
+func newRGBConverter(frame *Frame, window yuvWindow) *rgbConverter {
+	sps := frame.SPS
+	c := &rgbConverter{matrix: sps.ColorMatrix()}
+	c.kr, c.kb = matrixKrKb[c.matrix][0], matrixKrKb[c.matrix][1]
+
+	// E-4 to E-15: limited range puts black at 16 and white at 235, and
+	// chroma within 16 to 240, scaled up with the bit depth
+	lumaShift, chromaShift := frame.BitDepthLuma-8, frame.BitDepthChroma-8
+	c.chromaOffset = float64(int(1) << (frame.BitDepthChroma - 1))
+	if sps.VideoFullRange {
+		c.lumaScale = 1 / float64(int(1)<<frame.BitDepthLuma-1)
+		c.chromaScale = 1 / float64(int(1)<<frame.BitDepthChroma-1)
+	} else {
+		c.lumaOffset = float64(int(16) << lumaShift)
+		c.lumaScale = 1 / float64(int(219)<<lumaShift)
+		c.chromaScale = 1 / float64(int(224)<<chromaShift)
+	}
+	if c.matrix == MATRIX_GBR {
+		// Cb and Cr carry B and R, in the range of luma
+		c.chromaOffset, c.chromaScale = 0, 1/float64(int(1)<<frame.BitDepthChroma-1)
+		if !sps.VideoFullRange {
+			c.chromaOffset, c.chromaScale = float64(int(16)<<chromaShift), 1/float64(int(219)<<chromaShift)
+		}
+	}
+	if window.subWidth == 0 {
+		return c
+	}
+
+	// Figure E-1: chroma_sample_loc_type gives where 4:2:0 chroma samples
+	// sit between luma samples, in half luma samples from the top left.
+	// 4:2:2 chroma is co-sited with the even luma columns.
+	x, y := 0, 1
+	if frameChromaFormat(frame) == 1 && sps.ChromaLocInfoPresent {
+		locType := sps.ChromaSampleLocTypeTopField
+		x, y = locType%2, []int{1, 0, 2}[locType/2]
+	}
+	c.columns = chromaTaps(window.x, window.width, window.subWidth, x, frame.ChromaWidth)
+	c.rows = chromaTaps(window.y, window.height, window.subHeight, y, frame.ChromaHeight)
+	return c
+}
+
+// Returns the chroma taps of count luma positions from start, with chroma
+// subsampled by sub and sited offset half luma samples past the luma grid
+func chromaTaps(start, count, sub, offset, chromaSize int) []chromaTap {
+	taps := make([]chromaTap, count)
+	for i := range taps {
+		// The position in quarter chroma samples
+		position := 4 * (start + i)
+		if sub == 2 {
+			position = 2*(start+i) - offset
+		}
+		first := position >> 2
+		tap := chromaTap{first: first, second: first + 1, weight: position & 3}
+		tap.first = min(max(tap.first, 0), chromaSize-1)
+		tap.second = min(max(tap.second, 0), chromaSize-1)
+		taps[i] = tap
+	}
+	return taps
+}
+
+// Returns a chroma sample interpolated at a column and row, in sixteenths
+func (c *rgbConverter) chroma(plane []uint16, stride int, column, row chromaTap) int {
+	top := int(plane[row.first*stride+column.first])*(4-column.weight) + int(plane[row.first*stride+column.second])*column.weight
+	bottom := int(plane[row.second*stride+column.first])*(4-column.weight) + int(plane[row.second*stride+column.second])*column.weight
+	return top*(4-row.weight) + bottom*row.weight
+}
+
+// Returns R, G and B from 0 to 1 of normalised Y, Cb and Cr, E-16 to E-30
+func (c *rgbConverter) rgb(y, cb, cr float64) (float64, float64, float64) {
+	switch c.matrix {
+	case MATRIX_GBR:
+		return cr, y, cb
+	case MATRIX_YCGCO:
+		t := y - cb
+		return t + cr, y + cb, t - cr
+	}
+	r := y + 2*(1-c.kr)*cr
+	b := y + 2*(1-c.kb)*cb
+	g := (y - c.kr*r - c.kb*b) / (1 - c.kr - c.kb)
+	return r, g, b
+}
+
+func clamp8(v float64) byte {
+	return byte(min(max(math.Round(v*255), 0), 255))
+}
+
+// Writes the display area of a frame as opaque 8 bit RGBA to pix
+func (c *rgbConverter) convert(frame *Frame, window yuvWindow, pix []byte, stride int) {
+	for j := 0; j < window.height; j++ {
+		out := pix[j*stride:]
+		luma := frame.Luma[(window.y+j)*frame.Width+window.x:]
+		for i := 0; i < window.width; i++ {
+			y := (float64(luma[i]) - c.lumaOffset) * c.lumaScale
+			cb, cr := 0.0, 0.0
+			if c.columns != nil {
+				cb = (float64(c.chroma(frame.Cb, frame.ChromaWidth, c.columns[i], c.rows[j]))/16 - c.chromaOffset) * c.chromaScale
+				cr = (float64(c.chroma(frame.Cr, frame.ChromaWidth, c.columns[i], c.rows[j]))/16 - c.chromaOffset) * c.chromaScale
+			} else if c.matrix == MATRIX_GBR {
+				cb, cr = y, y
+			}
+			r, g, b := c.rgb(y, cb, cr)
+			out[4*i], out[4*i+1], out[4*i+2], out[4*i+3] = clamp8(r), clamp8(g), clamp8(b), 0xff
+		}
+	}
+}
+
+// Writes 8 bit 4:2:0 pictures of a Kr and Kb matrix as convert does, in
+// 16.16 fixed point
+func (c *rgbConverter) convert420(frame *Frame, window yuvWindow, pix []byte, stride int) {
+	const one = 1 << 16
+	fixed := func(v float64) int { return int(math.Round(v * 255 * one)) }
+	lumaOffset, luma := int(c.lumaOffset), fixed(c.lumaScale)
+	// Chroma is in sixteenths
+	chromaOffset := 16 * int(c.chromaOffset)
+	rCr := fixed(2 * (1 - c.kr) * c.chromaScale / 16)
+	bCb := fixed(2 * (1 - c.kb) * c.chromaScale / 16)
+	gCb := fixed(2 * c.kb * (1 - c.kb) / (1 - c.kr - c.kb) * c.chromaScale / 16)
+	gCr := fixed(2 * c.kr * (1 - c.kr) / (1 - c.kr - c.kb) * c.chromaScale / 16)
+	clamp := func(v int) byte {
+		return byte(min(max((v+one/2)>>16, 0), 255))
+	}
+	for j := 0; j < window.height; j++ {
+		out := pix[j*stride:]
+		row := frame.Luma[(window.y+j)*frame.Width+window.x:]
+		for i := 0; i < window.width; i++ {
+			y := (int(row[i]) - lumaOffset) * luma
+			cb := c.chroma(frame.Cb, frame.ChromaWidth, c.columns[i], c.rows[j]) - chromaOffset
+			cr := c.chroma(frame.Cr, frame.ChromaWidth, c.columns[i], c.rows[j]) - chromaOffset
+			out[4*i] = clamp(y + rCr*cr)
+			out[4*i+1] = clamp(y - gCb*cb - gCr*cr)
+			out[4*i+2] = clamp(y + bCb*cb)
+			out[4*i+3] = 0xff
+		}
+	}
+}
+
+// Converts the display area of a frame to opaque RGBA in the pixels of
+// the image newImage makes
+func (frame *Frame) convertRGB(newImage func(image.Rectangle) ([]byte, int)) error {
+	if len(frame.Luma) == 0 {
+		return ErrNoSamples
+	}
+	window, err := newYUVWindow(frame)
+	if err != nil {
+		return err
+	}
+	pix, stride := newImage(image.Rect(0, 0, window.width, window.height))
+	c := newRGBConverter(frame, window)
+	if _, ok := matrixKrKb[c.matrix]; ok && frameChromaFormat(frame) == 1 &&
+		frame.BitDepthLuma == 8 && frame.BitDepthChroma == 8 {
+		c.convert420(frame, window, pix, stride)
+	} else {
+		c.convert(frame, window, pix, stride)
+	}
+	return nil
+}
+
+// RGBA converts the display area of a decoded frame to RGB with the
+// matrix, range and chroma siting of the SPS VUI. 4:2:0 and 4:2:2 chroma
+// is interpolated bilinearly at the luma positions; interlaced frames are
+// sited as their top field. Field pictures return ErrFieldPicture.
+func (frame *Frame) RGBA() (*image.RGBA, error) {
+	var img *image.RGBA
+	err := frame.convertRGB(func(r image.Rectangle) ([]byte, int) {
+		img = image.NewRGBA(r)
+		return img.Pix, img.Stride
+	})
+	return img, err
+}
+
+// NRGBA converts a frame as RGBA does. As pictures are opaque the two
+// hold the same bytes.
+func (frame *Frame) NRGBA() (*image.NRGBA, error) {
+	var img *image.NRGBA
+	err := frame.convertRGB(func(r image.Rectangle) ([]byte, int) {
+		img = image.NewNRGBA(r)
+		return img.Pix, img.Stride
+	})
+	return img, err
+}
@@ -0,0 +1,138 @@
+package h264
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Returns a 16x16 picture of one colour in chromaFormat and bitDepth
+func rgbTestFrame(sps *SPS, chromaFormat, bitDepth int, y, cb, cr uint16) *Frame {
+	frame := &Frame{SPS: sps, Width: 16, Height: 16, BitDepthLuma: bitDepth, BitDepthChroma: bitDepth}
+	frame.ChromaWidth, frame.ChromaHeight = []int{0, 8, 8, 16}[chromaFormat], []int{0, 8, 16, 16}[chromaFormat]
+	frame.Luma = make([]uint16, 16*16)
+	for i := range frame.Luma {
+		frame.Luma[i] = y
+	}
+	if chromaFormat != 0 {
+		frame.Cb, frame.Cr = make([]uint16, frame.ChromaWidth*frame.ChromaHeight), make([]uint16, frame.ChromaWidth*frame.ChromaHeight)
+		for i := range frame.Cb {
+			frame.Cb[i], frame.Cr[i] = cb, cr
+		}
+	}
+	return frame
+}
+
+func colourSPS(matrix int, fullRange bool) *SPS {
+	return &SPS{ChromaFormat: 1, FrameMbsOnly: true, VideoSignalTypePresent: true, VideoFullRange: fullRange,
+		ColorDescriptionPresent: true, MatrixCoefficients: matrix}
+}
+
+func TestFrameRGBA(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		sps          *SPS
+		chromaFormat int
+		bitDepth     int
+		y, cb, cr    uint16
+		r, g, b      byte
+	}{
+		{"BT.709 black", colourSPS(MATRIX_BT709, false), 1, 8, 16, 128, 128, 0, 0, 0},
+		{"BT.709 white", colourSPS(MATRIX_BT709, false), 1, 8, 235, 128, 128, 255, 255, 255},
+		{"BT.709 red", colourSPS(MATRIX_BT709, false), 1, 8, 63, 102, 240, 255, 0, 0},
+		{"BT.601 red", colourSPS(MATRIX_SMPTE170M, false), 1, 8, 81, 90, 240, 255, 0, 0},
+		{"BT.601 full range red", colourSPS(MATRIX_BT470BG, true), 1, 8, 76, 85, 255, 254, 0, 0},
+		{"BT.2020 red", colourSPS(MATRIX_BT2020_NCL, false), 1, 8, 74, 97, 240, 255, 0, 0},
+		{"BT.709 10 bit red", colourSPS(MATRIX_BT709, false), 1, 10, 250, 409, 960, 255, 0, 0},
+		{"BT.709 4:4:4 red", colourSPS(MATRIX_BT709, false), 3, 8, 63, 102, 240, 255, 0, 0},
+		{"YCgCo green", colourSPS(MATRIX_YCGCO, true), 3, 8, 128, 255, 128, 1, 255, 1},
+		{"GBR", colourSPS(MATRIX_GBR, true), 3, 8, 10, 20, 30, 30, 10, 20},
+		{"monochrome", colourSPS(MATRIX_BT709, true), 0, 8, 100, 0, 0, 100, 100, 100},
+	} {
+		frame := rgbTestFrame(test.sps, test.chromaFormat, test.bitDepth, test.y, test.cb, test.cr)
+		img, err := frame.RGBA()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v\n", test.name, err)
+		}
+		// 8 bit codes of a colour are off by one after rounding
+		c := img.RGBAAt(5, 7)
+		near := func(a, b byte) bool { return a-b <= 1 || b-a <= 1 }
+		if !near(c.R, test.r) || !near(c.G, test.g) || !near(c.B, test.b) || c.A != 0xff {
+			t.Fatalf("%s: expected %d %d %d, got %v\n", test.name, test.r, test.g, test.b, c)
+		}
+	}
+}
+
+func TestFrameRGBAFixedPoint(t *testing.T) {
+	// The 8 bit 4:2:0 path agrees with the general one
+	for _, sps := range []*SPS{colourSPS(MATRIX_BT709, false), colourSPS(MATRIX_SMPTE170M, true)} {
+		frame := rgbTestFrame(sps, 1, 8, 0, 0, 0)
+		for i := range frame.Luma {
+			frame.Luma[i] = uint16(i * 7 % 256)
+		}
+		for i := range frame.Cb {
+			frame.Cb[i], frame.Cr[i] = uint16(i*13%256), uint16(255-i*29%256)
+		}
+		img, err := frame.NRGBA()
+		if err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+		window, _ := newYUVWindow(frame)
+		c := newRGBConverter(frame, window)
+		expected := make([]byte, len(img.Pix))
+		c.convert(frame, window, expected, img.Stride)
+		for i := range expected {
+			if d := int(expected[i]) - int(img.Pix[i]); d < -1 || d > 1 {
+				t.Fatalf("byte %d: expected %d, got %d\n", i, expected[i], img.Pix[i])
+			}
+		}
+	}
+}
+
+func TestChromaSiting(t *testing.T) {
+	// Cb rises by 16 a chroma column and Cr by 16 a chroma row
+	frame := rgbTestFrame(colourSPS(MATRIX_BT709, true), 1, 8, 128, 0, 0)
+	for i := range frame.Cb {
+		frame.Cb[i], frame.Cr[i] = uint16(64+16*(i%8)), uint16(64+16*(i/8))
+	}
+	for _, test := range []struct {
+		locType int
+		cb, cr  string
+	}{
+		// Co-sited horizontally and between rows
+		{0, "[64 72 80 88]", "[64 68 76 84]"},
+		// Between columns and rows
+		{1, "[64 68 76 84]", "[64 68 76 84]"},
+		// Co-sited with the top left luma sample
+		{2, "[64 72 80 88]", "[64 72 80 88]"},
+		// Co-sited with the bottom row of luma pairs
+		{4, "[64 72 80 88]", "[64 64 72 80]"},
+	} {
+		frame.SPS.ChromaLocInfoPresent, frame.SPS.ChromaSampleLocTypeTopField = true, test.locType
+		window, _ := newYUVWindow(frame)
+		c := newRGBConverter(frame, window)
+		var cb, cr []int
+		for i := 0; i < 4; i++ {
+			cb = append(cb, c.chroma(frame.Cb, 8, c.columns[i], c.rows[0])/16)
+			cr = append(cr, c.chroma(frame.Cr, 8, c.columns[0], c.rows[i])/16)
+		}
+		if fmt.Sprint(cb) != test.cb || fmt.Sprint(cr) != test.cr {
+			t.Fatalf("type %d: unexpected Cb %v Cr %v\n", test.locType, cb, cr)
+		}
+	}
+}
+
+func TestColorMatrix(t *testing.T) {
+	for _, test := range []struct {
+		sps    *SPS
+		matrix int
+	}{
+		{colourSPS(MATRIX_BT2020_NCL, false), MATRIX_BT2020_NCL},
+		{colourSPS(MATRIX_UNSPECIFIED, false), MATRIX_SMPTE170M},
+		// 1280x720 without a colour description
+		{&SPS{ChromaFormat: 1, FrameMbsOnly: true, PicWidthInMbsMinus1: 79, PicHeightInMapUnitsMinus1: 44}, MATRIX_BT709},
+	} {
+		if matrix := test.sps.ColorMatrix(); matrix != test.matrix {
+			t.Fatalf("expected matrix %d, got %d\n", test.matrix, matrix)
+		}
+	}
+}
@@ -0,0 +1,583 @@
+package h264
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"sort"
+	"time"
+)
+
+// ErrInvalidRTMP is returned when a peer breaks the RTMP protocol
+var ErrInvalidRTMP = errors.New("h264: invalid RTMP message")
+
+// RTMP message types, 5.4 and 7.1 of the Adobe RTMP specification 1.0
+const (
+	rtmpMsgSetChunkSize     = 1
+	rtmpMsgAbort            = 2
+	rtmpMsgAcknowledgement  = 3
+	rtmpMsgUserControl      = 4
+	rtmpMsgWindowAckSize    = 5
+	rtmpMsgSetPeerBandwidth = 6
+	rtmpMsgAudio            = flvTagAudio
+	rtmpMsgVideo            = flvTagVideo
+	rtmpMsgDataAMF0         = flvTagScript
+	rtmpMsgCommandAMF0      = 20
+)
+
+// Chunk streams of the messages sent, 5.3.1.1 reserving 0 to 2 but 2 for
+// protocol control
+const (
+	rtmpChunkStreamControl = 2
+	rtmpChunkStreamCommand = 3
+	rtmpChunkStreamMedia   = 4
+)
+
+const (
+	rtmpHandshakeSize = 1536
+	// The chunk size until a peer sets another, 5.4.1
+	rtmpDefaultChunkSize = 128
+	// The chunk size and acknowledgement window asked of publishers
+	rtmpChunkSize = 4096
+	rtmpWindow    = 2500000
+	// The message stream of a published stream
+	rtmpStreamID = 1
+)
+
+// rtmpMessage is a message read from or written to chunk streams
+type rtmpMessage struct {
+	typeID    byte
+	streamID  uint32
+	timestamp uint32
+	payload   []byte
+}
+
+// rtmpChunkStream keeps the header of the last chunk of a chunk stream,
+// which later chunks compress against, 5.3.1.2
+type rtmpChunkStream struct {
+	timestamp, delta uint32
+	length           int
+	typeID           byte
+	streamID         uint32
+	extended         bool
+	// payload gathers the message being read
+	payload []byte
+}
+
+// RTMPConn is the server side of an RTMP connection publishing one H.264
+// stream, as cameras and encoders such as OBS push it. Accept runs the
+// handshake and the connect, createStream and publish commands; the video
+// messages of the stream are then read as samples, DTS from the message
+// timestamp and PTS adding the FLV composition time.
+//
+//	c := NewRTMPConn(connection)
+//	if err := c.Accept(); err == nil {
+//		err = NewDecoder(WithFrameHandler(handler)).DecodeSamples(c)
+//	}
+type RTMPConn struct {
+	// App and StreamKey are those of the connect and publish commands
+	App       string
+	StreamKey string
+	// Timeout bounds the wait for each message
+	Timeout time.Duration
+	Logger  *slog.Logger
+
+	conn   net.Conn
+	reader *bufio.Reader
+	// Chunk sizes set by either side, 5.4.1
+	readChunkSize, writeChunkSize int
+	chunkStreams                  map[int]*rtmpChunkStream
+	// Bytes read and acknowledged, and the window the peer asked for
+	bytesRead, bytesAcknowledged, window uint32
+	video                                flvVideo
+	publishing                           bool
+}
+
+// NewRTMPConn returns the server side of connection with a 30 second
+// timeout
+func NewRTMPConn(connection net.Conn) *RTMPConn {
+	return &RTMPConn{
+		Timeout:        30 * time.Second,
+		conn:           connection,
+		reader:         bufio.NewReader(connection),
+		readChunkSize:  rtmpDefaultChunkSize,
+		writeChunkSize: rtmpDefaultChunkSize,
+		chunkStreams:   map[int]*rtmpChunkStream{},
+	}
+}
+
+func (c *RTMPConn) logger() *slog.Logger {
+	if c.Logger == nil {
+		return discardLogger
+	}
+	return c.Logger
+}
+
+// Close closes the connection
+func (c *RTMPConn) Close() error {
+	return c.conn.Close()
+}
+
+// Accept runs the handshake and answers commands until the peer
+// publishes a stream
+func (c *RTMPConn) Accept() error {
+	if err := c.acceptHandshake(); err != nil {
+		return err
+	}
+	for !c.publishing {
+		message, err := c.readMessage()
+		if err != nil {
+			return err
+		}
+		if err := c.handleMessage(message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The simple handshake of 5.2: S1 is random and S2 echoes C1
+func (c *RTMPConn) acceptHandshake() error {
+	c.setDeadline()
+	c0c1 := make([]byte, 1+rtmpHandshakeSize)
+	if _, err := io.ReadFull(c.reader, c0c1); err != nil {
+		return fmt.Errorf("%w: handshake: %v", ErrInvalidRTMP, err)
+	}
+	if c0c1[0] != 3 {
+		return fmt.Errorf("%w: version %d", ErrInvalidRTMP, c0c1[0])
+	}
+	s0s1s2 := make([]byte, 1+2*rtmpHandshakeSize)
+	s0s1s2[0] = 3
+	rand.Read(s0s1s2[9 : 1+rtmpHandshakeSize])
+	copy(s0s1s2[1+rtmpHandshakeSize:], c0c1[1:])
+	if _, err := c.conn.Write(s0s1s2); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c.reader, make([]byte, rtmpHandshakeSize)); err != nil {
+		return fmt.Errorf("%w: handshake: %v", ErrInvalidRTMP, err)
+	}
+	return nil
+}
+
+// ReadSample returns the next H.264 access unit published. The end of the
+// stream is io.EOF.
+func (c *RTMPConn) ReadSample() (*Sample, error) {
+	for c.publishing {
+		message, err := c.readMessage()
+		if err == io.EOF || errors.Is(err, net.ErrClosed) {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if message.typeID != rtmpMsgVideo {
+			if err := c.handleMessage(message); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		sample, err := c.video.sample(message.payload, time.Duration(message.timestamp)*time.Millisecond, c.logger())
+		if err != nil {
+			return nil, err
+		}
+		if sample != nil {
+			return sample, nil
+		}
+	}
+	return nil, io.EOF
+}
+
+// Decode accepts the stream and decodes it as a Decoder with opts would
+// until the publisher stops
+func (c *RTMPConn) Decode(opts ...DecoderOption) error {
+	if err := c.Accept(); err != nil {
+		return err
+	}
+	c.logger().Info("RTMP stream published", "app", c.App, "stream", c.StreamKey)
+	return NewDecoder(opts...).DecodeSamples(c)
+}
+
+// RTMPStreamReader decodes the stream an RTMP publisher pushes on
+// connection, as ByteStreamReader does for Annex B byte streams
+func RTMPStreamReader(connection net.Conn, opts ...DecoderOption) {
+	defer connection.Close()
+	c := NewRTMPConn(connection)
+	c.Logger = NewDecoder(opts...).logger
+	defer func() {
+		if r := recover(); r != nil {
+			c.logger().Error("connection aborted", "err", r)
+		}
+	}()
+	if err := c.Decode(opts...); err != nil {
+		c.logger().Error("stream ended", "err", err)
+	}
+}
+
+func (c *RTMPConn) setDeadline() {
+	if c.Timeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	}
+}
+
+// Handles protocol control messages and commands
+func (c *RTMPConn) handleMessage(message *rtmpMessage) error {
+	switch message.typeID {
+	case rtmpMsgSetChunkSize:
+		if len(message.payload) < 4 {
+			return fmt.Errorf("%w: Set Chunk Size", ErrInvalidRTMP)
+		}
+		size := int(be32(message.payload) & 0x7fffffff)
+		if size < 1 {
+			return fmt.Errorf("%w: chunk size %d", ErrInvalidRTMP, size)
+		}
+		c.readChunkSize = size
+	case rtmpMsgAbort:
+		// The message being read on the chunk stream is dropped
+		if len(message.payload) >= 4 {
+			if stream := c.chunkStreams[int(be32(message.payload))]; stream != nil {
+				stream.payload = nil
+			}
+		}
+	case rtmpMsgWindowAckSize:
+		if len(message.payload) >= 4 {
+			c.window = be32(message.payload)
+		}
+	case rtmpMsgCommandAMF0:
+		values, err := amf0Decode(message.payload)
+		if err != nil {
+			return err
+		}
+		return c.handleCommand(values)
+	}
+	return nil
+}
+
+// Answers the commands of 7.2.1 and 7.2.2 a publisher sends
+func (c *RTMPConn) handleCommand(values []any) error {
+	if len(values) < 2 {
+		return fmt.Errorf("%w: command of %d values", ErrInvalidRTMP, len(values))
+	}
+	name, _ := values[0].(string)
+	transaction, _ := values[1].(float64)
+	c.logger().Debug("RTMP command", "name", name, "transaction", transaction)
+	switch name {
+	case "connect":
+		if len(values) > 2 {
+			if object, ok := values[2].(map[string]any); ok {
+				c.App, _ = object["app"].(string)
+			}
+		}
+		c.writeControl(rtmpMsgWindowAckSize, binary.BigEndian.AppendUint32(nil, rtmpWindow))
+		c.writeControl(rtmpMsgSetPeerBandwidth, append(binary.BigEndian.AppendUint32(nil, rtmpWindow), 2))
+		c.writeControl(rtmpMsgSetChunkSize, binary.BigEndian.AppendUint32(nil, rtmpChunkSize))
+		c.writeChunkSize = rtmpChunkSize
+		return c.writeCommand(0, "_result", transaction,
+			map[string]any{"fmsVer": "FMS/3,0,1,123", "capabilities": 31.0},
+			map[string]any{"level": "status", "code": "NetConnection.Connect.Success", "description": "Connection succeeded.", "objectEncoding": 0.0})
+	case "createStream":
+		return c.writeCommand(0, "_result", transaction, nil, float64(rtmpStreamID))
+	case "publish":
+		if len(values) > 3 {
+			c.StreamKey, _ = values[3].(string)
+		}
+		// Stream Begin, 7.1.7
+		c.writeControl(rtmpMsgUserControl, []byte{0, 0, 0, 0, 0, rtmpStreamID})
+		c.publishing = true
+		return c.writeCommand(rtmpStreamID, "onStatus", 0.0, nil,
+			map[string]any{"level": "status", "code": "NetStream.Publish.Start", "description": "Publishing " + c.StreamKey + "."})
+	case "deleteStream", "closeStream", "FCUnpublish":
+		c.publishing = false
+	}
+	return nil
+}
+
+// Reads chunks until a message is whole, 5.3.1
+func (c *RTMPConn) readMessage() (*rtmpMessage, error) {
+	for {
+		c.setDeadline()
+		header, err := c.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		// Every byte of the chunk counts towards the acknowledgement
+		chunkBytes := 1
+		format, id := header>>6, int(header&0x3f)
+		switch id {
+		case 0, 1:
+			extra := make([]byte, id+1)
+			if _, err := io.ReadFull(c.reader, extra); err != nil {
+				return nil, err
+			}
+			chunkBytes += len(extra)
+			id = 64 + int(extra[0])
+			if len(extra) == 2 {
+				id += int(extra[1]) << 8
+			}
+		}
+		stream := c.chunkStreams[id]
+		if stream == nil {
+			if format != 0 {
+				return nil, fmt.Errorf("%w: chunk stream %d starts with format %d", ErrInvalidRTMP, id, format)
+			}
+			stream = &rtmpChunkStream{}
+			c.chunkStreams[id] = stream
+		}
+
+		// 5.3.1.2 with the Extended Timestamp of 5.3.1.3
+		fields := make([]byte, []int{11, 7, 3, 0}[format])
+		if _, err := io.ReadFull(c.reader, fields); err != nil {
+			return nil, err
+		}
+		chunkBytes += len(fields)
+		if format < 3 {
+			timestamp := uint32(fields[0])<<16 | uint32(fields[1])<<8 | uint32(fields[2])
+			stream.extended = timestamp == 0xffffff
+			if stream.extended {
+				extended := make([]byte, 4)
+				if _, err := io.ReadFull(c.reader, extended); err != nil {
+					return nil, err
+				}
+				chunkBytes += len(extended)
+				timestamp = be32(extended)
+			}
+			if format < 2 {
+				stream.length = int(fields[3])<<16 | int(fields[4])<<8 | int(fields[5])
+				stream.typeID = fields[6]
+			}
+			if format == 0 {
+				stream.streamID = binary.LittleEndian.Uint32(fields[7:])
+				stream.timestamp, stream.delta = timestamp, timestamp
+			} else {
+				stream.delta = timestamp
+				stream.timestamp += timestamp
+			}
+		} else {
+			if stream.extended {
+				if _, err := io.ReadFull(c.reader, make([]byte, 4)); err != nil {
+					return nil, err
+				}
+				chunkBytes += 4
+			}
+			if len(stream.payload) == 0 {
+				// A new message of the same header
+				stream.timestamp += stream.delta
+			}
+		}
+
+		n := min(stream.length-len(stream.payload), c.readChunkSize)
+		chunk := make([]byte, n)
+		if _, err := io.ReadFull(c.reader, chunk); err != nil {
+			return nil, err
+		}
+		stream.payload = append(stream.payload, chunk...)
+		if err := c.acknowledge(uint32(chunkBytes + n)); err != nil {
+			return nil, err
+		}
+		if len(stream.payload) < stream.length {
+			continue
+		}
+		message := &rtmpMessage{typeID: stream.typeID, streamID: stream.streamID, timestamp: stream.timestamp, payload: stream.payload}
+		stream.payload = nil
+		return message, nil
+	}
+}
+
+// Counts bytes read, sending an Acknowledgement each window, 5.4.3
+func (c *RTMPConn) acknowledge(n uint32) error {
+	c.bytesRead += n
+	if c.window == 0 || c.bytesRead-c.bytesAcknowledged < c.window {
+		return nil
+	}
+	c.bytesAcknowledged = c.bytesRead
+	return c.writeControl(rtmpMsgAcknowledgement, binary.BigEndian.AppendUint32(nil, c.bytesRead))
+}
+
+func (c *RTMPConn) writeControl(typeID byte, payload []byte) error {
+	return c.writeMessage(rtmpChunkStreamControl, &rtmpMessage{typeID: typeID, payload: payload})
+}
+
+func (c *RTMPConn) writeCommand(streamID uint32, values ...any) error {
+	return c.writeMessage(rtmpChunkStreamCommand, &rtmpMessage{typeID: rtmpMsgCommandAMF0, streamID: streamID, payload: amf0Encode(values...)})
+}
+
+// Writes a message as a chunk of format 0 followed by chunks of format 3
+func (c *RTMPConn) writeMessage(chunkStream int, message *rtmpMessage) error {
+	buf := make([]byte, 0, 12+len(message.payload)+len(message.payload)/c.writeChunkSize)
+	timestamp := min(message.timestamp, 0xffffff)
+	buf = append(buf, byte(chunkStream),
+		byte(timestamp>>16), byte(timestamp>>8), byte(timestamp),
+		byte(len(message.payload)>>16), byte(len(message.payload)>>8), byte(len(message.payload)),
+		message.typeID)
+	buf = binary.LittleEndian.AppendUint32(buf, message.streamID)
+	extended := timestamp == 0xffffff
+	if extended {
+		buf = binary.BigEndian.AppendUint32(buf, message.timestamp)
+	}
+	for payload := message.payload; ; {
+		n := min(len(payload), c.writeChunkSize)
+		buf = append(buf, payload[:n]...)
+		payload = payload[n:]
+		if len(payload) == 0 {
+			break
+		}
+		buf = append(buf, 0xc0|byte(chunkStream))
+		if extended {
+			buf = binary.BigEndian.AppendUint32(buf, message.timestamp)
+		}
+	}
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// AMF0 value markers, 2.1 of the AMF0 specification
+const (
+	amf0Number      = 0x00
+	amf0Boolean     = 0x01
+	amf0String      = 0x02
+	amf0Object      = 0x03
+	amf0Null        = 0x05
+	amf0Undefined   = 0x06
+	amf0ECMAArray   = 0x08
+	amf0ObjectEnd   = 0x09
+	amf0StrictArray = 0x0a
+	amf0Date        = 0x0b
+	amf0LongString  = 0x0c
+)
+
+// Decodes the AMF0 values of a command or data message. Numbers are
+// float64, objects and ECMA arrays map[string]any, null and undefined
+// nil.
+func amf0Decode(data []byte) ([]any, error) {
+	r := &amf0Reader{data: data}
+	values := []any{}
+	for len(r.data) > 0 {
+		values = append(values, amf0DecodeValue(r, 0))
+		if r.err != nil {
+			return nil, fmt.Errorf("%w: AMF0: %v", ErrInvalidRTMP, r.err)
+		}
+	}
+	return values, nil
+}
+
+func amf0DecodeValue(r *amf0Reader, depth int) any {
+	if depth > 16 {
+		r.err = errors.New("values nested too deeply")
+		return nil
+	}
+	marker := r.bytes(1)[0]
+	if r.err != nil {
+		return nil
+	}
+	switch marker {
+	case amf0Number:
+		return math.Float64frombits(r.u64())
+	case amf0Boolean:
+		return r.bytes(1)[0] != 0
+	case amf0String:
+		return amf0DecodeString(r)
+	case amf0LongString:
+		return string(r.bytes(int(r.u32())))
+	case amf0ECMAArray:
+		r.u32()
+		fallthrough
+	case amf0Object:
+		object := map[string]any{}
+		for r.err == nil {
+			key := amf0DecodeString(r)
+			if len(r.data) > 0 && r.data[0] == amf0ObjectEnd {
+				r.bytes(1)
+				break
+			}
+			object[key] = amf0DecodeValue(r, depth+1)
+		}
+		return object
+	case amf0StrictArray:
+		count := int(r.u32())
+		array := []any{}
+		for i := 0; i < count && r.err == nil; i++ {
+			array = append(array, amf0DecodeValue(r, depth+1))
+		}
+		return array
+	case amf0Date:
+		r.bytes(10)
+		return nil
+	case amf0Null, amf0Undefined:
+		return nil
+	}
+	r.err = fmt.Errorf("marker %d", marker)
+	return nil
+}
+
+func amf0DecodeString(r *amf0Reader) string {
+	return string(r.bytes(int(binary.BigEndian.Uint16(r.bytes(2)))))
+}
+
+// amf0Reader reads AMF0 data, keeping the first error. Reads past the
+// end return zeros.
+type amf0Reader struct {
+	data []byte
+	err  error
+}
+
+func (r *amf0Reader) bytes(n int) []byte {
+	if r.err != nil || n > len(r.data) {
+		if r.err == nil {
+			r.err = ErrTruncated
+		}
+		return make([]byte, min(n, 8))
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *amf0Reader) u32() uint32 { return binary.BigEndian.Uint32(r.bytes(4)) }
+func (r *amf0Reader) u64() uint64 { return binary.BigEndian.Uint64(r.bytes(8)) }
+
+// Encodes float64, bool, string, map[string]any as an object with its
+// keys in order, and nil as null
+func amf0Encode(values ...any) []byte {
+	buf := []byte{}
+	for _, value := range values {
+		switch v := value.(type) {
+		case float64:
+			buf = append(buf, amf0Number)
+			buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(v))
+		case bool:
+			b := byte(0)
+			if v {
+				b = 1
+			}
+			buf = append(buf, amf0Boolean, b)
+		case string:
+			buf = append(buf, amf0String)
+			buf = amf0AppendString(buf, v)
+		case map[string]any:
+			buf = append(buf, amf0Object)
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				buf = amf0AppendString(buf, key)
+				buf = append(buf, amf0Encode(v[key])...)
+			}
+			buf = append(buf, 0, 0, amf0ObjectEnd)
+		default:
+			buf = append(buf, amf0Null)
+		}
+	}
+	return buf
+}
+
+func amf0AppendString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
@@ -0,0 +1,209 @@
+package h264
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// rtmpTestPublisher publishes over the client side of an RTMP connection,
+// reusing the chunk stream code of RTMPConn
+type rtmpTestPublisher struct {
+	*RTMPConn
+	t *testing.T
+}
+
+func dialRTMPTest(t *testing.T, addr string) *rtmpTestPublisher {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	p := &rtmpTestPublisher{RTMPConn: NewRTMPConn(conn), t: t}
+	// C0 and C1, then C2 echoing S1
+	c0c1 := make([]byte, 1+rtmpHandshakeSize)
+	c0c1[0] = 3
+	if _, err := conn.Write(c0c1); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	s0s1s2 := make([]byte, 1+2*rtmpHandshakeSize)
+	if _, err := io.ReadFull(p.reader, s0s1s2); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if s0s1s2[0] != 3 || !bytes.Equal(s0s1s2[1+rtmpHandshakeSize:], c0c1[1:]) {
+		t.Fatalf("S2 does not echo C1\n")
+	}
+	if _, err := conn.Write(s0s1s2[1 : 1+rtmpHandshakeSize]); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	return p
+}
+
+// Sends a command and returns the values of the reply, handling the
+// protocol control messages before it
+func (p *rtmpTestPublisher) call(streamID uint32, values ...any) []any {
+	if err := p.writeCommand(streamID, values...); err != nil {
+		p.t.Fatalf("unexpected error: %v\n", err)
+	}
+	for {
+		message, err := p.readMessage()
+		if err != nil {
+			p.t.Fatalf("unexpected error: %v\n", err)
+		}
+		if message.typeID != rtmpMsgCommandAMF0 {
+			p.handleMessage(message)
+			continue
+		}
+		reply, err := amf0Decode(message.payload)
+		if err != nil {
+			p.t.Fatalf("unexpected error: %v\n", err)
+		}
+		return reply
+	}
+}
+
+func (p *rtmpTestPublisher) send(typeID byte, timestamp uint32, payload []byte) {
+	if err := p.writeMessage(rtmpChunkStreamMedia, &rtmpMessage{typeID: typeID, streamID: rtmpStreamID, timestamp: timestamp, payload: payload}); err != nil {
+		p.t.Fatalf("unexpected error: %v\n", err)
+	}
+}
+
+func TestRTMPPublish(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("no loopback TCP: %v\n", err)
+	}
+	defer listener.Close()
+	var frames frameList
+	served := make(chan *RTMPConn, 1)
+	errs := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		c := NewRTMPConn(conn)
+		defer c.Close()
+		err = c.Decode(WithFrameHandler(&frames))
+		served <- c
+		errs <- err
+	}()
+
+	p := dialRTMPTest(t, listener.Addr().String())
+	defer p.Close()
+	reply := p.call(0, "connect", 1.0, map[string]any{"app": "live", "type": "nonprivate", "tcUrl": "rtmp://localhost/live"})
+	if reply[0] != "_result" || reply[3].(map[string]any)["code"] != "NetConnection.Connect.Success" {
+		t.Fatalf("unexpected connect reply %v\n", reply)
+	}
+	if p.readChunkSize != rtmpChunkSize {
+		t.Fatalf("expected chunk size %d, got %d\n", rtmpChunkSize, p.readChunkSize)
+	}
+	// OBS announces the stream first, without waiting for replies
+	p.writeCommand(0, "releaseStream", 2.0, nil, "camera1")
+	p.writeCommand(0, "FCPublish", 3.0, nil, "camera1")
+	reply = p.call(0, "createStream", 4.0, nil)
+	if reply[0] != "_result" || reply[1] != 4.0 || reply[3] != float64(rtmpStreamID) {
+		t.Fatalf("unexpected createStream reply %v\n", reply)
+	}
+	reply = p.call(rtmpStreamID, "publish", 5.0, nil, "camera1", "live")
+	if reply[0] != "onStatus" || reply[3].(map[string]any)["code"] != "NetStream.Publish.Start" {
+		t.Fatalf("unexpected publish reply %v\n", reply)
+	}
+
+	// Small chunks and timestamps past 24 bits for the extended timestamp
+	p.writeControl(rtmpMsgSetChunkSize, mp4Uint32(64))
+	p.writeChunkSize = 64
+	p.writeControl(rtmpMsgWindowAckSize, mp4Uint32(100))
+	base := uint32(0xffffe0)
+	p.send(rtmpMsgDataAMF0, 0, amf0Encode("@setDataFrame", "onMetaData", map[string]any{"width": 320.0, "height": 240.0}))
+	p.send(rtmpMsgVideo, base, flvVideoTag(flvFrameKeyframe, flvAVCSequenceHeader, 0, mp4TestConfig(t).Bytes()))
+	p.send(rtmpMsgAudio, base, []byte{0xaf, 1, 0x21})
+	p.send(rtmpMsgVideo, base, flvVideoTag(flvFrameKeyframe, flvAVCNalu, 40,
+		lengthPrefixed(4, recoveryPointSEI(), nal(0x41, bitsToBytes(pSliceBits(1))))))
+	p.send(rtmpMsgVideo, base+40, flvVideoTag(2, flvAVCNalu, 40, lengthPrefixed(4, nal(0x41, bitsToBytes(pSliceBits(2))))))
+	p.writeCommand(rtmpStreamID, "deleteStream", 6.0, nil, float64(rtmpStreamID))
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("publishing did not end\n")
+	}
+	c := <-served
+	if c.App != "live" || c.StreamKey != "camera1" {
+		t.Fatalf("unexpected app %q and stream %q\n", c.App, c.StreamKey)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("expected 2 pictures, got %d\n", len(frames))
+	}
+	dts := time.Duration(base) * time.Millisecond
+	for i, frame := range frames {
+		want := dts + time.Duration(i)*40*time.Millisecond
+		if frame.FrameNum != i+1 || frame.DTS != want || frame.PTS != want+40*time.Millisecond {
+			t.Fatalf("picture %d: unexpected frame %d DTS %v PTS %v\n", i, frame.FrameNum, frame.DTS, frame.PTS)
+		}
+	}
+
+	// The window asked for is acknowledged
+	acknowledged := false
+	for {
+		message, err := p.readMessage()
+		if err != nil {
+			break
+		}
+		acknowledged = acknowledged || message.typeID == rtmpMsgAcknowledgement
+	}
+	if !acknowledged {
+		t.Fatalf("expected an acknowledgement\n")
+	}
+}
+
+func TestAMF0(t *testing.T) {
+	encoded := amf0Encode("onStatus", 0.0, nil, true, map[string]any{"code": "NetStream.Publish.Start", "nested": map[string]any{"n": 1.5}})
+	values, err := amf0Decode(encoded)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if len(values) != 5 || values[0] != "onStatus" || values[1] != 0.0 || values[2] != nil || values[3] != true {
+		t.Fatalf("unexpected values %v\n", values)
+	}
+	object := values[4].(map[string]any)
+	if object["code"] != "NetStream.Publish.Start" || object["nested"].(map[string]any)["n"] != 1.5 {
+		t.Fatalf("unexpected object %v\n", object)
+	}
+	// ECMA arrays decode as objects
+	if values, err := amf0Decode([]byte{amf0ECMAArray, 0, 0, 0, 1, 0, 1, 'a', amf0Boolean, 1, 0, 0, amf0ObjectEnd}); err != nil || values[0].(map[string]any)["a"] != true {
+		t.Fatalf("unexpected ECMA array %v %v\n", values, err)
+	}
+	if _, err := amf0Decode(encoded[:len(encoded)-5]); err == nil {
+		t.Fatalf("expected an error for truncated data\n")
+	}
+}
+
+func TestRTMPBytesRead(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	c := NewRTMPConn(server)
+	payload := []byte("0123456789")
+	// Chunk stream 100 takes a two byte basic header, and the timestamp
+	// of 0xffffff is followed by an extended timestamp
+	chunks := []byte{0x00, 100 - 64, 0xff, 0xff, 0xff, 0, 0, 10, rtmpMsgVideo, 1, 0, 0, 0, 0x01, 0x00, 0x00, 0x00}
+	chunks = append(chunks, payload...)
+	// The next message of the same header repeats the extended timestamp
+	chunks = append(chunks, 0xc0, 100-64, 0x01, 0x00, 0x00, 0x00)
+	chunks = append(chunks, payload...)
+	go client.Write(chunks)
+	for i := 0; i < 2; i++ {
+		if _, err := c.readMessage(); err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+	}
+	if c.bytesRead != uint32(len(chunks)) {
+		t.Fatalf("expected %d bytes read, got %d\n", len(chunks), c.bytesRead)
+	}
+}
@@ -0,0 +1,529 @@
+package h264
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+)
+
+// RTP payload structures of RFC 6184 5.2, carried in the NAL unit type field
+const (
+	RTP_STAP_A = 24 + iota
+	RTP_STAP_B
+	RTP_MTAP16
+	RTP_MTAP24
+	RTP_FU_A
+	RTP_FU_B
+)
+
+var (
+	RTPPayloadStructure = map[int]string{
+		RTP_STAP_A: "STAP-A",
+		RTP_STAP_B: "STAP-B",
+		RTP_MTAP16: "MTAP16",
+		RTP_MTAP24: "MTAP24",
+		RTP_FU_A:   "FU-A",
+		RTP_FU_B:   "FU-B",
+	}
+	// ErrInvalidRTP is returned for a packet that is not RTP version 2 or
+	// whose H.264 payload is malformed
+	ErrInvalidRTP = errors.New("h264: invalid RTP packet")
+)
+
+// RTPPacket is an RTP packet, RFC 3550 5.1
+type RTPPacket struct {
+	Version        int
+	Padding        bool
+	Extension      bool
+	Marker         bool
+	PayloadType    int
+	SequenceNumber uint16
+	Timestamp      uint32
+	SSRC           uint32
+	CSRC           []uint32
+	// ExtensionProfile and ExtensionData are the header extension, RFC
+	// 3550 5.3.1
+	ExtensionProfile uint16
+	ExtensionData    []byte
+	// Payload excludes padding
+	Payload []byte
+}
+
+// NewRTPPacket parses an RTP packet, as received in one UDP datagram
+func NewRTPPacket(data []byte) (*RTPPacket, error) {
+	if len(data) < 12 {
+		return nil, fmt.Errorf("%w: %d bytes", ErrInvalidRTP, len(data))
+	}
+	p := &RTPPacket{
+		Version:        int(data[0] >> 6),
+		Padding:        data[0]&0x20 != 0,
+		Extension:      data[0]&0x10 != 0,
+		Marker:         data[1]&0x80 != 0,
+		PayloadType:    int(data[1] & 0x7f),
+		SequenceNumber: uint16(data[2])<<8 | uint16(data[3]),
+		Timestamp:      be32(data[4:]),
+		SSRC:           be32(data[8:]),
+	}
+	if p.Version != 2 {
+		return nil, fmt.Errorf("%w: version %d", ErrInvalidRTP, p.Version)
+	}
+	offset := 12
+	for i := 0; i < int(data[0]&0x0f); i++ {
+		if offset+4 > len(data) {
+			return nil, fmt.Errorf("%w: CSRC list", ErrInvalidRTP)
+		}
+		p.CSRC = append(p.CSRC, be32(data[offset:]))
+		offset += 4
+	}
+	if p.Extension {
+		if offset+4 > len(data) {
+			return nil, fmt.Errorf("%w: header extension", ErrInvalidRTP)
+		}
+		p.ExtensionProfile = uint16(data[offset])<<8 | uint16(data[offset+1])
+		length := 4 * (int(data[offset+2])<<8 | int(data[offset+3]))
+		offset += 4
+		if offset+length > len(data) {
+			return nil, fmt.Errorf("%w: header extension of %d bytes", ErrInvalidRTP, length)
+		}
+		p.ExtensionData = data[offset : offset+length]
+		offset += length
+	}
+	end := len(data)
+	if p.Padding {
+		end -= int(data[len(data)-1])
+		if end < offset {
+			return nil, fmt.Errorf("%w: padding", ErrInvalidRTP)
+		}
+	}
+	p.Payload = data[offset:end]
+	return p, nil
+}
+
+func be32(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+// RTPNalUnit is a NAL unit recovered from RTP payloads
+type RTPNalUnit struct {
+	Data []byte
+	// Corrupt is set when fragments of the NAL unit were lost. Data is
+	// then incomplete and must not be decoded.
+	Corrupt bool
+	// DON is the decoding order number in interleaved mode, -1 otherwise
+	DON int
+}
+
+// RTPAccessUnit holds the NAL units sharing an RTP timestamp
+type RTPAccessUnit struct {
+	// Timestamp counts a 90 kHz clock, RFC 6184 5.1
+	Timestamp uint32
+	NalUnits  []RTPNalUnit
+	// PacketsLost counts the sequence numbers missing while the access
+	// unit was received
+	PacketsLost int
+}
+
+// AnnexB returns the NAL units of the access unit that are not corrupt as
+// an Annex B byte stream, ready for a Decoder
+func (au *RTPAccessUnit) AnnexB() []byte {
+	stream := []byte{}
+	for _, nalUnit := range au.NalUnits {
+		if nalUnit.Corrupt || len(nalUnit.Data) == 0 {
+			continue
+		}
+		stream = append(stream, InitialNALU...)
+		stream = append(stream, nalUnit.Data...)
+	}
+	return stream
+}
+
+// RTPStats counts what happened to the packets given to an RTPDepacketizer
+type RTPStats struct {
+	Packets int
+	// Lost sequence numbers never arrived within the jitter buffer
+	Lost int
+	// Late packets arrived after their sequence number was given up on
+	Late       int
+	Duplicates int
+	// Resyncs counts the times the sequence numbers jumped, as when the
+	// sender restarts, and the depacketizer started over from the new ones
+	Resyncs int
+	// Malformed packets had a payload that could not be parsed
+	Malformed       int
+	CorruptNalUnits int
+}
+
+// RTPDepacketizer rebuilds H.264 access units from the RTP packets of one
+// stream, RFC 6184. Packets are reordered by sequence number in a jitter
+// buffer before their payloads are read. Call Flush at the end of the
+// stream.
+type RTPDepacketizer struct {
+	// JitterBufferSize is how many packets may be held waiting for a
+	// missing sequence number before it is declared lost. 32 when 0.
+	JitterBufferSize int
+	// InterleavingDepth is how many NAL units of the interleaved mode are
+	// held to restore decoding order. 64 when 0.
+	InterleavingDepth int
+	// ResyncPackets is how many packets in a row may fall outside the
+	// sequence number window before the depacketizer starts over from
+	// them. 16 when 0.
+	ResyncPackets int
+	// Handler receives access units in decoding order
+	Handler func(*RTPAccessUnit)
+	Stats   RTPStats
+	Logger  *slog.Logger
+
+	started bool
+	// next is the extended sequence number expected next
+	next    int64
+	pending map[int64]*RTPPacket
+	// outOfWindow counts the late packets received in a row
+	outOfWindow int
+	// lost counts missing packets not yet charged to an access unit
+	lost int
+	au   *RTPAccessUnit
+	// fragment is the NAL unit being rebuilt from FU-A or FU-B packets
+	fragment *RTPNalUnit
+	// interleaved holds NAL units of the interleaved mode with their
+	// timestamps until their decoding order is known
+	interleaved []interleavedNalUnit
+}
+
+type interleavedNalUnit struct {
+	RTPNalUnit
+	timestamp uint32
+	lost      int
+}
+
+func NewRTPDepacketizer(handler func(*RTPAccessUnit)) *RTPDepacketizer {
+	return &RTPDepacketizer{Handler: handler}
+}
+
+func (d *RTPDepacketizer) logger() *slog.Logger {
+	if d.Logger == nil {
+		return discardLogger
+	}
+	return d.Logger
+}
+
+// Push adds a packet to the jitter buffer, passing on those now in order
+func (d *RTPDepacketizer) Push(packet *RTPPacket) {
+	d.Stats.Packets++
+	if d.pending == nil {
+		d.pending = map[int64]*RTPPacket{}
+	}
+	if !d.started {
+		d.started = true
+		d.next = int64(packet.SequenceNumber)
+	}
+	// The sequence number closest to the expected one, across wraparound
+	seq := d.next + int64(int16(packet.SequenceNumber-uint16(d.next)))
+	switch _, held := d.pending[seq]; {
+	case seq < d.next:
+		resyncPackets := d.ResyncPackets
+		if resyncPackets == 0 {
+			resyncPackets = 16
+		}
+		d.outOfWindow++
+		if d.outOfWindow < resyncPackets {
+			d.Stats.Late++
+			d.logger().Debug("late RTP packet", "seq", packet.SequenceNumber)
+			return
+		}
+		// So many late packets in a row are a new run of sequence numbers
+		d.logger().Info("RTP sequence numbers jumped", "expected", uint16(d.next), "seq", packet.SequenceNumber)
+		d.Stats.Resyncs++
+		d.Flush()
+		d.next = int64(packet.SequenceNumber)
+		seq = d.next
+	case held:
+		d.Stats.Duplicates++
+		return
+	}
+	d.outOfWindow = 0
+	d.pending[seq] = packet
+	d.release()
+
+	jitterBufferSize := d.JitterBufferSize
+	if jitterBufferSize == 0 {
+		jitterBufferSize = 32
+	}
+	for len(d.pending) > jitterBufferSize {
+		d.skipLost()
+		d.release()
+	}
+}
+
+// Flush passes on every packet still buffered and ends the last access
+// unit
+func (d *RTPDepacketizer) Flush() {
+	for len(d.pending) > 0 {
+		d.skipLost()
+		d.release()
+	}
+	d.endFragment(true)
+	d.endAccessUnit()
+	d.flushInterleaved(0)
+}
+
+// Passes on packets from the expected sequence number onward
+func (d *RTPDepacketizer) release() {
+	for {
+		packet, ok := d.pending[d.next]
+		if !ok {
+			return
+		}
+		delete(d.pending, d.next)
+		d.next++
+		d.depacketize(packet)
+	}
+}
+
+// Gives up on the sequence numbers before the oldest buffered packet
+func (d *RTPDepacketizer) skipLost() {
+	oldest := int64(-1)
+	for seq := range d.pending {
+		if oldest < 0 || seq < oldest {
+			oldest = seq
+		}
+	}
+	if oldest < 0 {
+		return
+	}
+	lost := int(oldest - d.next)
+	d.logger().Info("RTP packets lost", "seq", uint16(d.next), "count", lost)
+	d.Stats.Lost += lost
+	d.next = oldest
+	if d.fragment != nil && d.au != nil {
+		// The fragmented NAL unit lost its middle or end
+		d.fragment.Corrupt = true
+		d.au.PacketsLost += lost
+	} else {
+		d.lost += lost
+	}
+}
+
+func (d *RTPDepacketizer) depacketize(packet *RTPPacket) {
+	if d.au != nil && d.au.Timestamp != packet.Timestamp {
+		// The marker bit of the previous access unit was lost
+		d.endFragment(true)
+		d.endAccessUnit()
+	}
+	if d.au == nil {
+		d.au = &RTPAccessUnit{Timestamp: packet.Timestamp}
+	}
+	d.au.PacketsLost += d.lost
+	d.lost = 0
+	if err := d.readPayload(packet); err != nil {
+		d.Stats.Malformed++
+		d.logger().Warn("skipping RTP payload", "seq", packet.SequenceNumber, "err", err)
+		if d.fragment != nil {
+			d.fragment.Corrupt = true
+		}
+	}
+	if packet.Marker {
+		// RFC 6184 5.1: the last packet of the access unit
+		d.endFragment(true)
+		d.endAccessUnit()
+	}
+}
+
+// 5.6 to 5.8
+func (d *RTPDepacketizer) readPayload(packet *RTPPacket) error {
+	payload := packet.Payload
+	if len(payload) == 0 {
+		return fmt.Errorf("%w: empty payload", ErrInvalidRTP)
+	}
+	nalUnitType := int(payload[0] & 0x1f)
+	if nalUnitType != RTP_FU_A && d.fragment != nil {
+		// The end fragment was lost
+		d.endFragment(true)
+	}
+	switch nalUnitType {
+	case RTP_STAP_A, RTP_STAP_B:
+		offset, don := 1, -1
+		if nalUnitType == RTP_STAP_B {
+			if len(payload) < 3 {
+				return fmt.Errorf("%w: STAP-B DON", ErrInvalidRTP)
+			}
+			don = int(payload[1])<<8 | int(payload[2])
+			offset = 3
+		}
+		for offset < len(payload) {
+			if offset+2 > len(payload) {
+				return fmt.Errorf("%w: %s NAL unit size", ErrInvalidRTP, RTPPayloadStructure[nalUnitType])
+			}
+			size := int(payload[offset])<<8 | int(payload[offset+1])
+			offset += 2
+			if size == 0 || offset+size > len(payload) {
+				return fmt.Errorf("%w: %s NAL unit of %d bytes", ErrInvalidRTP, RTPPayloadStructure[nalUnitType], size)
+			}
+			d.addNalUnit(RTPNalUnit{Data: payload[offset : offset+size], DON: don}, packet.Timestamp)
+			offset += size
+			if don >= 0 {
+				don = (don + 1) % 65536
+			}
+		}
+	case RTP_MTAP16, RTP_MTAP24:
+		if len(payload) < 3 {
+			return fmt.Errorf("%w: MTAP DONB", ErrInvalidRTP)
+		}
+		donb := int(payload[1])<<8 | int(payload[2])
+		offsetSize := 2
+		if nalUnitType == RTP_MTAP24 {
+			offsetSize = 3
+		}
+		for offset := 3; offset < len(payload); {
+			if offset+3+offsetSize > len(payload) {
+				return fmt.Errorf("%w: %s NAL unit header", ErrInvalidRTP, RTPPayloadStructure[nalUnitType])
+			}
+			size := int(payload[offset])<<8 | int(payload[offset+1])
+			dond := int(payload[offset+2])
+			tsOffset := uint32(0)
+			for _, b := range payload[offset+3 : offset+3+offsetSize] {
+				tsOffset = tsOffset<<8 | uint32(b)
+			}
+			// The size covers DOND and the timestamp offset
+			start, end := offset+3+offsetSize, offset+2+size
+			if size <= 1+offsetSize || end > len(payload) {
+				return fmt.Errorf("%w: %s NAL unit of %d bytes", ErrInvalidRTP, RTPPayloadStructure[nalUnitType], size)
+			}
+			d.addNalUnit(RTPNalUnit{Data: payload[start:end], DON: (donb + dond) % 65536}, packet.Timestamp+tsOffset)
+			offset = end
+		}
+	case RTP_FU_A, RTP_FU_B:
+		return d.readFragment(packet, nalUnitType)
+	case 0, 30, 31:
+		return fmt.Errorf("%w: NAL unit type %d", ErrInvalidRTP, nalUnitType)
+	default:
+		// 5.6 single NAL unit packet
+		d.addNalUnit(RTPNalUnit{Data: payload, DON: -1}, packet.Timestamp)
+	}
+	return nil
+}
+
+// 5.8
+func (d *RTPDepacketizer) readFragment(packet *RTPPacket, nalUnitType int) error {
+	payload := packet.Payload
+	headerSize := 2
+	if nalUnitType == RTP_FU_B {
+		headerSize = 4
+	}
+	if len(payload) < headerSize {
+		return fmt.Errorf("%w: %s header", ErrInvalidRTP, RTPPayloadStructure[nalUnitType])
+	}
+	start, end := payload[1]&0x80 != 0, payload[1]&0x40 != 0
+	header := payload[0]&0xe0 | payload[1]&0x1f
+	if start && end {
+		return fmt.Errorf("%w: fragment with both start and end bits", ErrInvalidRTP)
+	}
+	if nalUnitType == RTP_FU_B && !start {
+		return fmt.Errorf("%w: FU-B without start bit", ErrInvalidRTP)
+	}
+	if start {
+		// A new NAL unit before the end of the last one
+		d.endFragment(true)
+		don := -1
+		if nalUnitType == RTP_FU_B {
+			don = int(payload[2])<<8 | int(payload[3])
+		}
+		d.fragment = &RTPNalUnit{Data: []byte{header}, DON: don}
+	} else if d.fragment == nil {
+		// The start fragment was lost
+		d.fragment = &RTPNalUnit{Data: []byte{header}, Corrupt: true, DON: -1}
+	}
+	d.fragment.Data = append(d.fragment.Data, payload[headerSize:]...)
+	if end {
+		d.endFragment(false)
+	}
+	return nil
+}
+
+// Completes the fragmented NAL unit, as corrupt when its end is missing
+func (d *RTPDepacketizer) endFragment(incomplete bool) {
+	if d.fragment == nil {
+		return
+	}
+	fragment := *d.fragment
+	d.fragment = nil
+	fragment.Corrupt = fragment.Corrupt || incomplete
+	timestamp := uint32(0)
+	if d.au != nil {
+		timestamp = d.au.Timestamp
+	}
+	d.addNalUnit(fragment, timestamp)
+}
+
+func (d *RTPDepacketizer) addNalUnit(nalUnit RTPNalUnit, timestamp uint32) {
+	if nalUnit.Corrupt {
+		d.Stats.CorruptNalUnits++
+		d.logger().Info("corrupt NAL unit", "bytes", len(nalUnit.Data), "timestamp", timestamp)
+	}
+	if nalUnit.DON < 0 {
+		if d.au == nil {
+			d.au = &RTPAccessUnit{Timestamp: timestamp}
+		}
+		d.au.NalUnits = append(d.au.NalUnits, nalUnit)
+		return
+	}
+	// 5.5: interleaved NAL units wait for decoding order
+	lost := 0
+	if d.au != nil {
+		lost, d.au.PacketsLost = d.au.PacketsLost, 0
+	}
+	d.interleaved = append(d.interleaved, interleavedNalUnit{RTPNalUnit: nalUnit, timestamp: timestamp, lost: lost})
+	depth := d.InterleavingDepth
+	if depth == 0 {
+		depth = 64
+	}
+	d.flushInterleaved(depth)
+}
+
+// Passes on interleaved NAL units in DON order, keeping the last keep
+func (d *RTPDepacketizer) flushInterleaved(keep int) {
+	if len(d.interleaved) <= keep {
+		return
+	}
+	// DONs compare across wraparound, held ones being within 16384 of the
+	// first, RFC 6184 5.5
+	base := d.interleaved[0].DON - 16384
+	sort.SliceStable(d.interleaved, func(i, j int) bool {
+		return (d.interleaved[i].DON-base+65536)%65536 < (d.interleaved[j].DON-base+65536)%65536
+	})
+	n := len(d.interleaved) - keep
+	// Access units are passed on whole
+	for n > 0 && n < len(d.interleaved) && d.interleaved[n].timestamp == d.interleaved[n-1].timestamp {
+		n++
+	}
+	var au *RTPAccessUnit
+	for _, nalUnit := range d.interleaved[:n] {
+		if au != nil && au.Timestamp != nalUnit.timestamp {
+			d.emit(au)
+			au = nil
+		}
+		if au == nil {
+			au = &RTPAccessUnit{Timestamp: nalUnit.timestamp}
+		}
+		au.NalUnits = append(au.NalUnits, nalUnit.RTPNalUnit)
+		au.PacketsLost += nalUnit.lost
+	}
+	d.interleaved = append([]interleavedNalUnit{}, d.interleaved[n:]...)
+	if au != nil {
+		d.emit(au)
+	}
+}
+
+func (d *RTPDepacketizer) endAccessUnit() {
+	au := d.au
+	d.au = nil
+	if au != nil && len(au.NalUnits) > 0 {
+		d.emit(au)
+	}
+}
+
+func (d *RTPDepacketizer) emit(au *RTPAccessUnit) {
+	if d.Handler != nil {
+		d.Handler(au)
+	}
+}
@@ -0,0 +1,226 @@
+package h264
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"time"
+)
+
+// Bytes serialises the packet. Padding is not added.
+func (p *RTPPacket) Bytes() []byte {
+	buf := make([]byte, 12, 12+4*len(p.CSRC)+4+len(p.ExtensionData)+len(p.Payload))
+	buf[0] = 2<<6 | byte(len(p.CSRC)&0x0f)
+	if p.Extension {
+		buf[0] |= 0x10
+	}
+	buf[1] = byte(p.PayloadType & 0x7f)
+	if p.Marker {
+		buf[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(buf[2:], p.SequenceNumber)
+	binary.BigEndian.PutUint32(buf[4:], p.Timestamp)
+	binary.BigEndian.PutUint32(buf[8:], p.SSRC)
+	for _, csrc := range p.CSRC {
+		buf = binary.BigEndian.AppendUint32(buf, csrc)
+	}
+	if p.Extension {
+		buf = binary.BigEndian.AppendUint16(buf, p.ExtensionProfile)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(p.ExtensionData)/4))
+		buf = append(buf, p.ExtensionData...)
+	}
+	return append(buf, p.Payload...)
+}
+
+// RTPTimestamp converts a presentation time to the 90 kHz RTP clock
+func RTPTimestamp(pts time.Duration) uint32 {
+	return uint32(ticks90kHz(pts))
+}
+
+// RTPPacketizer splits access units into RTP packets in the
+// non-interleaved mode of RFC 6184: single NAL unit packets, STAP-A for
+// runs of small NAL units and FU-A for NAL units larger than the MTU.
+type RTPPacketizer struct {
+	// MTU is the largest RTP packet in bytes, header included. IP and UDP
+	// headers come on top.
+	MTU            int
+	PayloadType    int
+	SSRC           uint32
+	SequenceNumber uint16
+	// RepeatParameterSets sends the last SPS and PPS seen ahead of every
+	// IDR access unit that does not carry its own, so receivers can join
+	// at any IDR picture
+	RepeatParameterSets bool
+
+	sps, pps []byte
+}
+
+// NewRTPPacketizer returns a packetizer for dynamic payload type 96 with a
+// random SSRC and initial sequence number, RFC 3550 5.1
+func NewRTPPacketizer(mtu int) *RTPPacketizer {
+	return &RTPPacketizer{
+		MTU:            mtu,
+		PayloadType:    96,
+		SSRC:           rand.Uint32(),
+		SequenceNumber: uint16(rand.Uint32()),
+	}
+}
+
+// Packetize returns the packets of one access unit. nalUnits are whole NAL
+// units without start codes; timestamp is the 90 kHz sampling time shared
+// by every packet. The last packet has the marker bit set.
+func (p *RTPPacketizer) Packetize(nalUnits [][]byte, timestamp uint32) ([]*RTPPacket, error) {
+	maxPayload := p.MTU - 12
+	// An FU-A carries at least one byte of its NAL unit
+	// and STAP-A carries NAL unit sizes in 16 bits
+	if maxPayload < 3 || p.MTU > 65535 {
+		return nil, ErrInvalidValue{Field: "MTU", Value: p.MTU, Range: [2]int{15, 65535}}
+	}
+	nalUnits = p.withParameterSets(nalUnits)
+	payloads := [][]byte{}
+	for i := 0; i < len(nalUnits); {
+		nalUnit := nalUnits[i]
+		if len(nalUnit) == 0 {
+			return nil, fmt.Errorf("%w: empty NAL unit", ErrTruncated)
+		}
+		if len(nalUnit) > maxPayload {
+			payloads = append(payloads, fragmentFUA(nalUnit, maxPayload)...)
+			i++
+			continue
+		}
+		// 5.7.1 STAP-A when the next NAL units fit with this one
+		n, size := 0, 1
+		for i+n < len(nalUnits) && size+2+len(nalUnits[i+n]) <= maxPayload && len(nalUnits[i+n]) > 0 {
+			size += 2 + len(nalUnits[i+n])
+			n++
+		}
+		if n < 2 {
+			payloads = append(payloads, nalUnit)
+			i++
+			continue
+		}
+		payloads = append(payloads, aggregateSTAPA(nalUnits[i:i+n]))
+		i += n
+	}
+
+	packets := make([]*RTPPacket, len(payloads))
+	for i, payload := range payloads {
+		packets[i] = &RTPPacket{
+			Version:        2,
+			Marker:         i == len(payloads)-1,
+			PayloadType:    p.PayloadType,
+			SequenceNumber: p.SequenceNumber,
+			Timestamp:      timestamp,
+			SSRC:           p.SSRC,
+			Payload:        payload,
+		}
+		p.SequenceNumber++
+	}
+	return packets, nil
+}
+
+// WriteAccessUnit packetizes an access unit and writes each packet with
+// one Write, as to a UDP connection
+func (p *RTPPacketizer) WriteAccessUnit(w io.Writer, nalUnits [][]byte, timestamp uint32) error {
+	packets, err := p.Packetize(nalUnits, timestamp)
+	if err != nil {
+		return err
+	}
+	for _, packet := range packets {
+		if _, err := w.Write(packet.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remembers parameter sets and puts those an IDR access unit lacks ahead
+// of its first slice
+func (p *RTPPacketizer) withParameterSets(nalUnits [][]byte) [][]byte {
+	hasSPS, hasPPS, idr := false, false, false
+	for _, nalUnit := range nalUnits {
+		if len(nalUnit) == 0 {
+			continue
+		}
+		// Copied, as the caller may reuse its buffers
+		switch int(nalUnit[0] & 0x1f) {
+		case NALU_TYPE_SPS:
+			p.sps, hasSPS = append([]byte(nil), nalUnit...), true
+		case NALU_TYPE_PPS:
+			p.pps, hasPPS = append([]byte(nil), nalUnit...), true
+		case NALU_TYPE_SLICE_IDR_PICTURE:
+			idr = true
+		}
+	}
+	if !p.RepeatParameterSets || !idr {
+		return nalUnits
+	}
+	missing := [][]byte{}
+	if !hasSPS && p.sps != nil {
+		missing = append(missing, p.sps)
+	}
+	if !hasPPS && p.pps != nil {
+		missing = append(missing, p.pps)
+	}
+	if len(missing) == 0 {
+		return nalUnits
+	}
+	// A missing SPS goes after an access unit delimiter, 7.4.1.2.3, and a
+	// missing PPS after the SPS the access unit carries
+	at := 0
+	for i, nalUnit := range nalUnits {
+		if len(nalUnit) == 0 {
+			continue
+		}
+		nalUnitType := int(nalUnit[0] & 0x1f)
+		if nalUnitType == NALU_TYPE_ACCESS_UNIT_DELIMITER || nalUnitType == NALU_TYPE_SPS {
+			at = i + 1
+		}
+	}
+	withParameterSets := append([][]byte{}, nalUnits[:at]...)
+	withParameterSets = append(withParameterSets, missing...)
+	return append(withParameterSets, nalUnits[at:]...)
+}
+
+// 5.7.1
+func aggregateSTAPA(nalUnits [][]byte) []byte {
+	var forbidden, nri byte
+	for _, nalUnit := range nalUnits {
+		forbidden |= nalUnit[0] & 0x80
+		if nalUnit[0]&0x60 > nri {
+			nri = nalUnit[0] & 0x60
+		}
+	}
+	payload := []byte{forbidden | nri | RTP_STAP_A}
+	for _, nalUnit := range nalUnits {
+		payload = append(payload, byte(len(nalUnit)>>8), byte(len(nalUnit)))
+		payload = append(payload, nalUnit...)
+	}
+	return payload
+}
+
+// 5.8: the NAL unit header is carried in the FU indicator and header
+func fragmentFUA(nalUnit []byte, maxPayload int) [][]byte {
+	indicator := nalUnit[0]&0xe0 | RTP_FU_A
+	data := nalUnit[1:]
+	size := maxPayload - 2
+	payloads := [][]byte{}
+	for offset := 0; offset < len(data); offset += size {
+		end := offset + size
+		if end > len(data) {
+			end = len(data)
+		}
+		header := nalUnit[0] & 0x1f
+		if offset == 0 {
+			header |= 0x80
+		}
+		if end == len(data) {
+			header |= 0x40
+		}
+		payload := make([]byte, 0, 2+end-offset)
+		payload = append(payload, indicator, header)
+		payloads = append(payloads, append(payload, data[offset:end]...))
+	}
+	return payloads
+}
@@ -0,0 +1,120 @@
+package h264
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRTPPacketizerLoopback(t *testing.T) {
+	receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("no loopback UDP: %v\n", err)
+	}
+	defer receiver.Close()
+	sender, err := net.DialUDP("udp", nil, receiver.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	defer sender.Close()
+
+	filler := append([]byte{NALU_TYPE_FILLER_DATA}, bytes.Repeat([]byte{0xff}, 100)...)
+	filler = append(filler, 0x80)
+	sps, pps, sei, p1, p2 := roundTripNalUnits()
+	accessUnits := [][][]byte{{sps, pps, sei, p1, filler}, {p2}}
+	p := NewRTPPacketizer(48)
+	sent := 0
+	for i, au := range accessUnits {
+		packets, err := p.Packetize(au, RTPTimestamp(time.Duration(i)*40*time.Millisecond))
+		if err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+		for j, packet := range packets {
+			if len(packet.Bytes()) > p.MTU || packet.Marker != (j == len(packets)-1) || packet.Timestamp != uint32(3600*i) {
+				t.Fatalf("unexpected packet %d of access unit %d: %+v\n", j, i, packet)
+			}
+			if _, err := sender.Write(packet.Bytes()); err != nil {
+				t.Fatalf("unexpected error: %v\n", err)
+			}
+			sent++
+		}
+		if i == 0 && (packets[0].Payload[0]&0x1f != RTP_STAP_A || packets[len(packets)-1].Payload[0]&0x1f != RTP_FU_A) {
+			t.Fatalf("expected STAP-A then FU-A packets\n")
+		}
+	}
+
+	received := []*RTPAccessUnit{}
+	d := NewRTPDepacketizer(func(au *RTPAccessUnit) { received = append(received, au) })
+	buf := make([]byte, 1500)
+	receiver.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < sent; i++ {
+		n, err := receiver.Read(buf)
+		if err != nil {
+			t.Fatalf("received %d of %d packets: %v\n", i, sent, err)
+		}
+		packet, err := NewRTPPacket(append([]byte{}, buf[:n]...))
+		if err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+		d.Push(packet)
+	}
+	d.Flush()
+	if len(received) != len(accessUnits) {
+		t.Fatalf("expected %d access units, got %d\n", len(accessUnits), len(received))
+	}
+	stream := &bytes.Buffer{}
+	for i, au := range received {
+		if len(au.NalUnits) != len(accessUnits[i]) {
+			t.Fatalf("access unit %d: expected %d NAL units, got %d\n", i, len(accessUnits[i]), len(au.NalUnits))
+		}
+		for j, nalUnit := range au.NalUnits {
+			if !bytes.Equal(nalUnit.Data, accessUnits[i][j]) {
+				t.Fatalf("access unit %d NAL unit %d: expected %x, got %x\n", i, j, accessUnits[i][j], nalUnit.Data)
+			}
+		}
+		stream.Write(au.AnnexB())
+	}
+	decodeRoundTrip(t, "RTP", func(d *Decoder) error { return d.Decode(stream) })
+}
+
+func TestRTPPacketizerRepeatParameterSets(t *testing.T) {
+	sps := nal(0x67, bitsToBytes(baselineSPSBits))
+	pps := nal(0x68, bitsToBytes(baselinePPSBits))
+	idr := []byte{0x65, 0x88, 0x84, 0x80}
+	p := NewRTPPacketizer(1200)
+	p.RepeatParameterSets = true
+	received := []*RTPAccessUnit{}
+	d := NewRTPDepacketizer(func(au *RTPAccessUnit) { received = append(received, au) })
+	// The caller reuses its buffer for the first SPS
+	reused := append([]byte{}, sps...)
+	for i, au := range [][][]byte{{reused, pps, idr}, {nal(0x41, []byte{0x9a, 0x80})}, {idr}, {sps, idr}} {
+		packets, err := p.Packetize(au, uint32(3000*i))
+		if err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+		for _, packet := range packets {
+			d.Push(packet)
+		}
+		if i == 0 {
+			reused[1] = 0
+		}
+	}
+	d.Flush()
+	if len(received) != 4 || len(received[1].NalUnits) != 1 || len(received[2].NalUnits) != 3 {
+		t.Fatalf("expected parameter sets before the second IDR only, got %+v\n", received)
+	}
+	if !bytes.Equal(received[2].NalUnits[0].Data, sps) || !bytes.Equal(received[2].NalUnits[1].Data, pps) {
+		t.Fatalf("expected SPS and PPS, got %+v\n", received[2].NalUnits)
+	}
+	// Only the missing PPS is added, after the SPS
+	if nalUnits := received[3].NalUnits; len(nalUnits) != 3 || !bytes.Equal(nalUnits[0].Data, sps) || !bytes.Equal(nalUnits[1].Data, pps) {
+		t.Fatalf("expected SPS, PPS and IDR, got %+v\n", nalUnits)
+	}
+	if _, err := NewRTPPacketizer(14).Packetize([][]byte{idr}, 0); err == nil {
+		t.Fatalf("expected an error for an MTU too small for FU-A\n")
+	}
+	if _, err := NewRTPPacketizer(65536).Packetize([][]byte{idr}, 0); err == nil {
+		t.Fatalf("expected an error for an MTU beyond the STAP-A size field\n")
+	}
+}
@@ -0,0 +1,256 @@
+package h264
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func rtpBytes(seq uint16, timestamp uint32, marker bool, payload []byte) []byte {
+	header := []byte{0x80, 96, byte(seq >> 8), byte(seq), 0, 0, 0, 0, 0, 0, 0x12, 0x34}
+	if marker {
+		header[1] |= 0x80
+	}
+	binary.BigEndian.PutUint32(header[4:], timestamp)
+	return append(header, payload...)
+}
+
+func rtpPacket(t *testing.T, seq uint16, timestamp uint32, marker bool, payload []byte) *RTPPacket {
+	packet, err := NewRTPPacket(rtpBytes(seq, timestamp, marker, payload))
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	return packet
+}
+
+func stapA(nalUnits ...[]byte) []byte {
+	payload := []byte{RTP_STAP_A | 0x60}
+	for _, nalUnit := range nalUnits {
+		payload = append(payload, byte(len(nalUnit)>>8), byte(len(nalUnit)))
+		payload = append(payload, nalUnit...)
+	}
+	return payload
+}
+
+// Splits nalUnit into FU-A payloads of at most size bytes of data
+func fuA(nalUnit []byte, size int) [][]byte {
+	payloads := [][]byte{}
+	data := nalUnit[1:]
+	for offset := 0; offset < len(data); offset += size {
+		end := offset + size
+		if end > len(data) {
+			end = len(data)
+		}
+		header := nalUnit[0] & 0x1f
+		if offset == 0 {
+			header |= 0x80
+		}
+		if end == len(data) {
+			header |= 0x40
+		}
+		payload := []byte{nalUnit[0]&0xe0 | RTP_FU_A, header}
+		payloads = append(payloads, append(payload, data[offset:end]...))
+	}
+	return payloads
+}
+
+func TestRTPDepacketizer(t *testing.T) {
+	sps := nal(0x67, bitsToBytes(baselineSPSBits))
+	pps := nal(0x68, bitsToBytes(baselinePPSBits))
+	slice := nal(0x41, bitsToBytes(pSliceBits(1)))
+	fragments := fuA(slice, 2)
+	if len(fragments) < 3 {
+		t.Fatalf("expected at least 3 fragments, got %d\n", len(fragments))
+	}
+	// Sequence numbers wrap during the access unit
+	packets := []*RTPPacket{rtpPacket(t, 65534, 3000, false, stapA(sps, pps, recoveryPointSEI()))}
+	for i, fragment := range fragments {
+		packets = append(packets, rtpPacket(t, uint16(65535+i), 3000, i == len(fragments)-1, fragment))
+	}
+	// Delivered out of order, with a duplicate
+	order := []int{0, 2, 2}
+	for i := 3; i < len(packets); i++ {
+		order = append(order, i)
+	}
+	order = append(order, 1)
+
+	accessUnits := []*RTPAccessUnit{}
+	d := NewRTPDepacketizer(func(au *RTPAccessUnit) { accessUnits = append(accessUnits, au) })
+	for _, i := range order {
+		d.Push(packets[i])
+	}
+	d.Flush()
+	if len(accessUnits) != 1 {
+		t.Fatalf("expected 1 access unit, got %d\n", len(accessUnits))
+	}
+	au := accessUnits[0]
+	if au.Timestamp != 3000 || au.PacketsLost != 0 || len(au.NalUnits) != 4 {
+		t.Fatalf("unexpected access unit %+v\n", au)
+	}
+	for i, want := range [][]byte{sps, pps, recoveryPointSEI(), slice} {
+		if !bytes.Equal(au.NalUnits[i].Data, want) || au.NalUnits[i].Corrupt {
+			t.Fatalf("NAL unit %d: expected %x, got %+v\n", i, want, au.NalUnits[i])
+		}
+	}
+	if d.Stats.Duplicates != 1 || d.Stats.Lost != 0 {
+		t.Fatalf("unexpected stats %+v\n", d.Stats)
+	}
+
+	var got frameNums
+	if err := NewDecoder(WithFrameHandler(&got)).Decode(bytes.NewReader(au.AnnexB())); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if len(got) != 1 || got[0] != 1 {
+		t.Fatalf("expected picture 1, got %v\n", got)
+	}
+}
+
+func TestRTPLostFragment(t *testing.T) {
+	slice := nal(0x41, bitsToBytes(pSliceBits(1)))
+	fragments := fuA(slice, 2)
+	accessUnits := []*RTPAccessUnit{}
+	d := NewRTPDepacketizer(func(au *RTPAccessUnit) { accessUnits = append(accessUnits, au) })
+	d.JitterBufferSize = 2
+	for i, fragment := range fragments {
+		if i == 1 {
+			continue
+		}
+		d.Push(rtpPacket(t, uint16(100+i), 3000, i == len(fragments)-1, fragment))
+	}
+	// The next access unit arrives whole
+	d.Push(rtpPacket(t, uint16(100+len(fragments)), 6000, true, slice))
+	d.Flush()
+	if len(accessUnits) != 2 {
+		t.Fatalf("expected 2 access units, got %d\n", len(accessUnits))
+	}
+	au := accessUnits[0]
+	if au.PacketsLost != 1 || len(au.NalUnits) != 1 || !au.NalUnits[0].Corrupt {
+		t.Fatalf("expected one corrupt NAL unit after 1 lost packet, got %+v\n", au)
+	}
+	if len(au.AnnexB()) != 0 {
+		t.Fatalf("corrupt NAL units must not reach the decoder\n")
+	}
+	if accessUnits[1].NalUnits[0].Corrupt || d.Stats.Lost != 1 || d.Stats.CorruptNalUnits != 1 {
+		t.Fatalf("unexpected second access unit %+v or stats %+v\n", accessUnits[1], d.Stats)
+	}
+}
+
+func TestRTPInterleaved(t *testing.T) {
+	a := nal(0x41, []byte{0xaa, 0x80})
+	b := nal(0x41, []byte{0xbb, 0x80})
+	c := nal(0x41, []byte{0xcc, 0xdd, 0xee, 0x80})
+	// MTAP16 with DONB 10: b has DON 11 at timestamp 3000, a DON 10 at 0
+	mtap := []byte{0x60 | RTP_MTAP16, 0, 10}
+	mtap = append(mtap, 0, byte(len(b)+3), 1, 0x0b, 0xb8)
+	mtap = append(mtap, b...)
+	mtap = append(mtap, 0, byte(len(a)+3), 0, 0, 0)
+	mtap = append(mtap, a...)
+	// FU-B then FU-A carry c with DON 12
+	fuB := append([]byte{0x40 | RTP_FU_B, 0x81, 0, 12}, c[1:3]...)
+	fuEnd := append([]byte{0x40 | RTP_FU_A, 0x41}, c[3:]...)
+
+	accessUnits := []*RTPAccessUnit{}
+	d := NewRTPDepacketizer(func(au *RTPAccessUnit) { accessUnits = append(accessUnits, au) })
+	d.Push(rtpPacket(t, 1, 0, false, mtap))
+	d.Push(rtpPacket(t, 2, 6000, false, fuB))
+	d.Push(rtpPacket(t, 3, 6000, true, fuEnd))
+	d.Flush()
+	if len(accessUnits) != 3 {
+		t.Fatalf("expected 3 access units, got %d\n", len(accessUnits))
+	}
+	for i, want := range []struct {
+		timestamp uint32
+		data      []byte
+		don       int
+	}{{0, a, 10}, {3000, b, 11}, {6000, c, 12}} {
+		au := accessUnits[i]
+		if au.Timestamp != want.timestamp || len(au.NalUnits) != 1 || !bytes.Equal(au.NalUnits[0].Data, want.data) || au.NalUnits[0].DON != want.don {
+			t.Fatalf("access unit %d: expected %x at %d, got %+v\n", i, want.data, want.timestamp, au)
+		}
+	}
+}
+
+func TestRTPResync(t *testing.T) {
+	slice := nal(0x41, bitsToBytes(pSliceBits(1)))
+	accessUnits := []*RTPAccessUnit{}
+	d := NewRTPDepacketizer(func(au *RTPAccessUnit) { accessUnits = append(accessUnits, au) })
+	d.ResyncPackets = 4
+	for i := 0; i < 5; i++ {
+		d.Push(rtpPacket(t, uint16(40000+i), uint32(3000*i), true, slice))
+	}
+	// The sender restarts with sequence numbers behind the window
+	for i := 0; i < 10; i++ {
+		d.Push(rtpPacket(t, uint16(30000+i), uint32(3000*i), true, slice))
+	}
+	d.Flush()
+	if d.Stats.Late != 3 || d.Stats.Resyncs != 1 {
+		t.Fatalf("unexpected stats %+v\n", d.Stats)
+	}
+	// The first three packets of the new run were given up on
+	if len(accessUnits) != 12 || accessUnits[5].Timestamp != 9000 {
+		t.Fatalf("expected 12 access units resuming at 9000, got %d\n", len(accessUnits))
+	}
+}
+
+// Writes datagrams to port 5004 as a libpcap capture of Ethernet frames
+func writeCapture(t *testing.T, datagrams [][]byte) string {
+	capture := &bytes.Buffer{}
+	binary.Write(capture, binary.LittleEndian, []uint32{0xa1b2c3d4, 0x00040002, 0, 0, 65535, PCAP_LINKTYPE_ETHERNET})
+	for i, datagram := range datagrams {
+		udp := append([]byte{0x13, 0x8c, 0x13, 0x8c, byte((len(datagram) + 8) >> 8), byte(len(datagram) + 8), 0, 0}, datagram...)
+		ip := append([]byte{0x45, 0, byte((len(udp) + 20) >> 8), byte(len(udp) + 20), 0, 0, 0x40, 0, 64, 17, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2}, udp...)
+		frame := append(make([]byte, 12), 0x08, 0x00)
+		frame = append(frame, ip...)
+		binary.Write(capture, binary.LittleEndian, []uint32{uint32(1700000000 + i), 0, uint32(len(frame)), uint32(len(frame))})
+		capture.Write(frame)
+	}
+	path := filepath.Join(t.TempDir(), "camera.pcap")
+	if err := os.WriteFile(path, capture.Bytes(), 0644); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	return path
+}
+
+func TestReadRTPCapture(t *testing.T) {
+	sps, pps, sei, p1, p2 := roundTripNalUnits()
+	datagrams := [][]byte{
+		rtpBytes(1, 0, false, stapA(sps, pps, sei)),
+		rtpBytes(2, 0, true, p1),
+		rtpBytes(3, 3000, true, p2),
+	}
+	f, err := os.Open(writeCapture(t, datagrams))
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	defer f.Close()
+	packets, err := ReadRTPCapture(f, 5004)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if len(packets) != 3 || packets[2].Time.Unix() != 1700000002 || packets[0].SrcPort != 5004 {
+		t.Fatalf("unexpected packets %+v\n", packets)
+	}
+
+	stream := &bytes.Buffer{}
+	d := NewRTPDepacketizer(func(au *RTPAccessUnit) { stream.Write(au.AnnexB()) })
+	for _, packet := range packets {
+		d.Push(packet.RTPPacket)
+	}
+	d.Flush()
+	decodeRoundTrip(t, "capture", func(d *Decoder) error { return d.Decode(stream) })
+}
+
+func TestReadRTPCaptureCorruptLength(t *testing.T) {
+	capture, err := os.ReadFile(writeCapture(t, [][]byte{rtpBytes(1, 0, true, []byte{0x41, 0x80})}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	// A record claiming 4 GB is not allocated
+	binary.LittleEndian.PutUint32(capture[24+8:], 0xffffffff)
+	if _, err := ReadRTPCapture(bytes.NewReader(capture), 0); !errors.Is(err, ErrInvalidCapture) {
+		t.Fatalf("expected ErrInvalidCapture, got %v\n", err)
+	}
+}
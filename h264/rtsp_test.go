@@ -0,0 +1,268 @@
+package h264
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRTSPServer serves one session of the given packets to the first
+// client, asking for Basic or Digest authentication
+type fakeRTSPServer struct {
+	listener net.Listener
+	auth     string
+	packets  [][]byte
+	// keepOpen holds the session open after the packets until TEARDOWN
+	keepOpen bool
+	// requests are the methods seen, in order
+	requests []string
+	errs     chan error
+}
+
+func newFakeRTSPServer(t *testing.T, auth string, packets [][]byte) *fakeRTSPServer {
+	return startFakeRTSPServer(t, &fakeRTSPServer{auth: auth, packets: packets})
+}
+
+func startFakeRTSPServer(t *testing.T, s *fakeRTSPServer) *fakeRTSPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("no loopback TCP: %v\n", err)
+	}
+	s.listener, s.errs = listener, make(chan error, 1)
+	go func() {
+		s.errs <- s.serve()
+	}()
+	return s
+}
+
+func (s *fakeRTSPServer) url() string {
+	return fmt.Sprintf("rtsp://admin:secret@%s/stream", s.listener.Addr())
+}
+
+func (s *fakeRTSPServer) serve() error {
+	defer s.listener.Close()
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	text := textproto.NewReader(bufio.NewReader(conn))
+	base := fmt.Sprintf("rtsp://%s/stream/", s.listener.Addr())
+	sdp := strings.Join([]string{
+		"v=0",
+		"o=- 0 0 IN IP4 127.0.0.1",
+		"s=camera",
+		"t=0 0",
+		"m=video 0 RTP/AVP 96",
+		"a=rtpmap:96 H264/90000",
+		"a=fmtp:96 packetization-mode=1;profile-level-id=42001e;sprop-parameter-sets=" +
+			base64.StdEncoding.EncodeToString(nal(0x67, bitsToBytes(baselineSPSBits))) + "," +
+			base64.StdEncoding.EncodeToString(nal(0x68, bitsToBytes(baselinePPSBits))),
+		"a=control:trackID=0",
+		"",
+	}, "\r\n")
+	var udpConn net.Conn
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return nil
+		}
+		header, err := text.ReadMIMEHeader()
+		if err != nil {
+			return err
+		}
+		method, uri := strings.Fields(line)[0], strings.Fields(line)[1]
+		s.requests = append(s.requests, method)
+		cseq := header.Get("CSeq")
+		authorization := header.Get("Authorization")
+		switch {
+		case s.auth == "basic" && authorization != "Basic "+base64.StdEncoding.EncodeToString([]byte("admin:secret")),
+			s.auth == "digest" && authorization == "":
+			challenge := `Basic realm="camera"`
+			if s.auth == "digest" {
+				challenge = `Digest realm="camera", nonce="abc123"`
+			}
+			fmt.Fprintf(conn, "RTSP/1.0 401 Unauthorized\r\nCSeq: %s\r\nWWW-Authenticate: %s\r\n\r\n", cseq, challenge)
+			continue
+		case s.auth == "digest":
+			ha1 := md5Hex("admin:camera:secret")
+			want := md5Hex(ha1 + ":abc123:" + md5Hex(method+":"+uri))
+			if parseAuthParameters(strings.TrimPrefix(authorization, "Digest "))["response"] != want {
+				return fmt.Errorf("bad digest response in %q", authorization)
+			}
+		}
+		switch method {
+		case "OPTIONS":
+			fmt.Fprintf(conn, "RTSP/1.0 200 OK\r\nCSeq: %s\r\nPublic: OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN\r\n\r\n", cseq)
+		case "DESCRIBE":
+			fmt.Fprintf(conn, "RTSP/1.0 200 OK\r\nCSeq: %s\r\nContent-Base: %s\r\nContent-Type: application/sdp\r\nContent-Length: %d\r\n\r\n%s", cseq, base, len(sdp), sdp)
+		case "SETUP":
+			if uri != base+"trackID=0" {
+				return fmt.Errorf("SETUP of %s", uri)
+			}
+			transport := header.Get("Transport")
+			if strings.Contains(transport, "client_port=") {
+				var rtpPort, rtcpPort int
+				fmt.Sscanf(transport[strings.Index(transport, "client_port="):], "client_port=%d-%d", &rtpPort, &rtcpPort)
+				if udpConn, err = net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", rtpPort)); err != nil {
+					return err
+				}
+				defer udpConn.Close()
+				transport += ";server_port=6970-6971"
+			} else {
+				// Channels other than those asked for
+				transport = strings.Replace(transport, "interleaved=0-1", "interleaved=2-3", 1)
+			}
+			fmt.Fprintf(conn, "RTSP/1.0 200 OK\r\nCSeq: %s\r\nSession: 12345678;timeout=60\r\nTransport: %s\r\n\r\n", cseq, transport)
+		case "PLAY":
+			if header.Get("Session") != "12345678" {
+				return fmt.Errorf("PLAY without session")
+			}
+			fmt.Fprintf(conn, "RTSP/1.0 200 OK\r\nCSeq: %s\r\nSession: 12345678\r\n\r\n", cseq)
+			for _, packet := range s.packets {
+				if udpConn != nil {
+					udpConn.Write(packet)
+					continue
+				}
+				conn.Write(append([]byte{'$', 2, byte(len(packet) >> 8), byte(len(packet))}, packet...))
+				// RTCP on the channel after is skipped
+				conn.Write([]byte{'$', 3, 0, 2, 0x80, 0xc8})
+			}
+			if udpConn == nil && !s.keepOpen {
+				return nil
+			}
+		case "TEARDOWN":
+			return nil
+		}
+	}
+}
+
+// The packets of two pictures after a recovery point
+func fakeCameraPackets(t *testing.T) [][]byte {
+	p := NewRTPPacketizer(1200)
+	datagrams := [][]byte{}
+	_, _, sei, p1, p2 := roundTripNalUnits()
+	for i, au := range [][][]byte{{sei, p1}, {p2}} {
+		packets, err := p.Packetize(au, uint32(3000*i))
+		if err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+		for _, packet := range packets {
+			datagrams = append(datagrams, packet.Bytes())
+		}
+	}
+	return datagrams
+}
+
+func TestParseSDP(t *testing.T) {
+	session, err := ParseSDP("v=0\r\nm=audio 0 RTP/AVP 97\r\na=rtpmap:97 MPEG4-GENERIC/48000\r\n" +
+		"m=video 0 RTP/AVP 96\r\na=rtpmap:96 H264/90000\r\n" +
+		"a=fmtp:96 packetization-mode=1; profile-level-id=64001F; sprop-parameter-sets=Z0IAHg==,aM4=\r\na=control:video\r\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	media, parameters, err := session.H264()
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if media.Control != "video" || parameters.PayloadType != 96 || parameters.PacketizationMode != 1 {
+		t.Fatalf("unexpected media %+v %+v\n", media, parameters)
+	}
+	if parameters.ProfileLevelID != [3]byte{0x64, 0x00, 0x1f} || len(parameters.SPS) != 1 || len(parameters.PPS) != 1 {
+		t.Fatalf("unexpected parameters %+v\n", parameters)
+	}
+	if !bytes.Equal(parameters.SPS[0], []byte{0x67, 0x42, 0x00, 0x1e}) {
+		t.Fatalf("unexpected SPS %x\n", parameters.SPS[0])
+	}
+}
+
+func TestRTSPClientTCP(t *testing.T) {
+	server := newFakeRTSPServer(t, "digest", fakeCameraPackets(t))
+	var got frameNums
+	if err := PullRTSP(server.url(), RTSP_TRANSPORT_TCP, WithFrameHandler(&got)); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if err := <-server.errs; err != nil {
+		t.Fatalf("server: %v\n", err)
+	}
+	checkRoundTrip(t, "RTSP", got)
+	if strings.Join(server.requests, " ") != "OPTIONS OPTIONS DESCRIBE SETUP PLAY" {
+		t.Fatalf("unexpected requests %v\n", server.requests)
+	}
+}
+
+func TestRTSPClientDecoderError(t *testing.T) {
+	server := startFakeRTSPServer(t, &fakeRTSPServer{packets: fakeCameraPackets(t), keepOpen: true})
+	decoded := make(chan error, 1)
+	go func() {
+		// An invalid length size fails the decoder at once
+		decoded <- PullRTSP(server.url(), RTSP_TRANSPORT_TCP, WithFraming(FRAMING_AVCC), WithNALLengthSize(5))
+	}()
+	select {
+	case err := <-decoded:
+		if err == nil {
+			t.Fatalf("expected the decoder error\n")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Decode kept reading after the decoder failed\n")
+	}
+	if err := <-server.errs; err != nil {
+		t.Fatalf("server: %v\n", err)
+	}
+}
+
+func TestRTSPClientUDP(t *testing.T) {
+	packets := fakeCameraPackets(t)
+	server := newFakeRTSPServer(t, "basic", packets)
+	c, err := DialRTSP(server.url(), RTSP_TRANSPORT_UDP)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if _, err := c.Options(); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if _, err := c.Describe(); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if c.H264.ProfileLevelID != [3]byte{0x42, 0x00, 0x1e} {
+		t.Fatalf("unexpected profile-level-id %x\n", c.H264.ProfileLevelID)
+	}
+	if err := c.Setup(); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if err := c.Play(); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+
+	stream := &bytes.Buffer{}
+	stream.Write(annexB(append(c.H264.SPS, c.H264.PPS...)...))
+	d := NewRTPDepacketizer(func(au *RTPAccessUnit) { stream.Write(au.AnnexB()) })
+	received := 0
+	c.ReadPackets(func(packet *RTPPacket) error {
+		d.Push(packet)
+		if received++; received == len(packets) {
+			c.Close()
+		}
+		return nil
+	})
+	d.Flush()
+	if err := <-server.errs; err != nil {
+		t.Fatalf("server: %v\n", err)
+	}
+	var got frameNums
+	if err := NewDecoder(WithFrameHandler(&got)).Decode(stream); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 pictures, got %v\n", got)
+	}
+	if server.requests[len(server.requests)-1] != "TEARDOWN" {
+		t.Fatalf("expected TEARDOWN, got %v\n", server.requests)
+	}
+}
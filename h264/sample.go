@@ -0,0 +1,140 @@
+package h264
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// Sample is one access unit read from a container, with the timestamps the
+// container gives it
+type Sample struct {
+	// NalUnits are whole NAL units without start codes or length fields
+	NalUnits [][]byte
+	// PTS and DTS are only meaningful when Timestamped is set
+	PTS, DTS    time.Duration
+	Timestamped bool
+	// Keyframe is set when the container marks the sample as a random
+	// access point
+	Keyframe bool
+}
+
+// SampleReader is implemented by container demuxers. ReadSample returns
+// io.EOF after the last sample.
+type SampleReader interface {
+	ReadSample() (*Sample, error)
+}
+
+// NewSampleReader returns an H264Reader decoding the samples of a
+// container. Pictures take the PTS and DTS of the sample holding their
+// first slice.
+func (d *Decoder) NewSampleReader(samples SampleReader) *H264Reader {
+	h := d.NewReader(nil)
+	h.Samples = samples
+	return h
+}
+
+// DecodeSamples reads samples until the container ends. The end of the
+// container is not an error.
+func (d *Decoder) DecodeSamples(samples SampleReader) error {
+	return d.NewSampleReader(samples).Decode()
+}
+
+// Queues the NAL units of the next sample
+func (h *H264Reader) readSample() error {
+	for {
+		sample, err := h.Samples.ReadSample()
+		if err != nil {
+			return err
+		}
+		if len(sample.NalUnits) == 0 {
+			continue
+		}
+		h.sample = sample
+		h.queuedNalUnits = append(h.queuedNalUnits, sample.NalUnits...)
+		return nil
+	}
+}
+
+// Replaces the derived timestamps of a picture with those of the sample
+// it started in
+func (h *H264Reader) stampFromSample(frame *Frame) {
+	if h.sample == nil || !h.sample.Timestamped {
+		return
+	}
+	frame.PTS, frame.DTS = h.sample.PTS, h.sample.DTS
+	frame.PTS90k, frame.DTS90k = ticks90kHz(frame.PTS), ticks90kHz(frame.DTS)
+}
+
+// SplitAnnexB returns the NAL units of an Annex B buffer, without start
+// codes and trailing zero bytes
+func SplitAnnexB(data []byte) [][]byte {
+	nalUnits := [][]byte{}
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			nalUnits = appendNalUnit(nalUnits, data[start:i])
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 {
+		nalUnits = appendNalUnit(nalUnits, data[start:])
+	}
+	return nalUnits
+}
+
+func appendNalUnit(nalUnits [][]byte, nalUnit []byte) [][]byte {
+	for len(nalUnit) > 0 && nalUnit[len(nalUnit)-1] == 0 {
+		nalUnit = nalUnit[:len(nalUnit)-1]
+	}
+	if len(nalUnit) == 0 {
+		return nalUnits
+	}
+	return append(nalUnits, nalUnit)
+}
+
+// Converts 90 kHz ticks to a duration, rounding up so that ticks90kHz
+// gives back the same count
+func duration90kHz(ticks int64) time.Duration {
+	return time.Duration(ticks/90000)*time.Second + time.Duration((ticks%90000*int64(time.Second)+89999)/90000)
+}
+
+// SplitLengthPrefixed returns the NAL units of an AVCC buffer whose NAL
+// units are led by lengthSize byte lengths
+func SplitLengthPrefixed(data []byte, lengthSize int) ([][]byte, error) {
+	nalUnits := [][]byte{}
+	r := bytes.NewReader(data)
+	for {
+		_, nalUnit, err := readLengthPrefixed(r, lengthSize)
+		if err == io.EOF {
+			return nalUnits, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(nalUnit) > 0 {
+			nalUnits = append(nalUnits, nalUnit)
+		}
+	}
+}
+
+// Returns the NAL units of a file format sample with 4 byte lengths,
+// leaving out the parameter sets its avcC record carries and access unit
+// delimiters, which file formats have no use for
+func lengthPrefixedSampleData(nalUnits [][]byte) []byte {
+	data := []byte{}
+	for _, nalUnit := range nalUnits {
+		switch int(nalUnit[0] & 0x1f) {
+		case NALU_TYPE_SPS, NALU_TYPE_PPS, NALU_TYPE_ACCESS_UNIT_DELIMITER:
+			continue
+		}
+		data = binary.BigEndian.AppendUint32(data, uint32(len(nalUnit)))
+		data = append(data, nalUnit...)
+	}
+	return data
+}
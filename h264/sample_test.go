@@ -0,0 +1,73 @@
+package h264
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecorderRoundTrip(t *testing.T) {
+	// Each recorder writes the pictures of a decoded stream in a container
+	// its demuxer reads back, one sample per picture
+	sps, pps, sei, p1, p2 := roundTripNalUnits()
+	stream := annexB(sps, pps, sei, p1, p2)
+	for _, test := range []struct {
+		name string
+		// newRecorder returns a recorder writing to w and what ends it
+		newRecorder func(w io.WriteSeeker) (FrameHandler, func() error)
+		newDemuxer  func(r io.ReadSeeker) (SampleReader, error)
+	}{
+		{
+			"TS",
+			func(w io.WriteSeeker) (FrameHandler, func() error) { m := NewTSMuxer(w); return m, m.Err },
+			func(r io.ReadSeeker) (SampleReader, error) { return NewTSDemuxer(r), nil },
+		},
+		{
+			"fragmented MP4",
+			func(w io.WriteSeeker) (FrameHandler, func() error) { r := NewFMP4Recorder(w); return r, r.Close },
+			func(r io.ReadSeeker) (SampleReader, error) { return NewMP4Demuxer(r) },
+		},
+		{
+			"Matroska",
+			func(w io.WriteSeeker) (FrameHandler, func() error) { m := NewMKVMuxer(w); return m, m.Close },
+			func(r io.ReadSeeker) (SampleReader, error) { return NewMKVDemuxer(r) },
+		},
+	} {
+		file, err := os.Create(filepath.Join(t.TempDir(), "recording"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+		defer file.Close()
+		recorder, finish := test.newRecorder(file)
+		if err := NewDecoder(WithFrameHandler(recorder)).Decode(bytes.NewReader(stream)); err != nil {
+			t.Fatalf("%s: unexpected error: %v\n", test.name, err)
+		}
+		if err := finish(); err != nil {
+			t.Fatalf("%s: unexpected error: %v\n", test.name, err)
+		}
+		demux := func() SampleReader {
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				t.Fatalf("unexpected error: %v\n", err)
+			}
+			demuxer, err := test.newDemuxer(file)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v\n", test.name, err)
+			}
+			return demuxer
+		}
+
+		samples := readSamples(t, demux())
+		if len(samples) != 2 {
+			t.Fatalf("%s: expected 2 samples, got %d\n", test.name, len(samples))
+		}
+		for i, slice := range [][]byte{p1, p2} {
+			nalUnits := samples[i].NalUnits
+			if !bytes.Equal(nalUnits[len(nalUnits)-1], slice) {
+				t.Fatalf("%s: sample %d ends in %x\n", test.name, i, nalUnits[len(nalUnits)-1])
+			}
+		}
+		decodeRoundTrip(t, test.name, func(d *Decoder) error { return d.DecodeSamples(demux()) })
+	}
+}
@@ -0,0 +1,159 @@
+package h264
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SessionDescription holds the parts of an SDP session description, RFC
+// 4566, needed to receive its media
+type SessionDescription struct {
+	// Control is the session level a=control attribute
+	Control string
+	Media   []MediaDescription
+}
+
+// MediaDescription is one m= section of a session description
+type MediaDescription struct {
+	// Type is video, audio and so on
+	Type     string
+	Port     int
+	Protocol string
+	Formats  []int
+	Control  string
+	// RTPMap and FMTP hold the a=rtpmap and a=fmtp attributes by payload
+	// type. FMTP parameter names are lower case.
+	RTPMap map[int]string
+	FMTP   map[int]map[string]string
+}
+
+// H264Parameters are the RFC 6184 8.1 media type parameters of an H.264
+// stream
+type H264Parameters struct {
+	PayloadType       int
+	PacketizationMode int
+	// ProfileLevelID is profile_idc, the constraint flags and level_idc
+	ProfileLevelID [3]byte
+	// SPS and PPS hold the NAL units of sprop-parameter-sets
+	SPS [][]byte
+	PPS [][]byte
+}
+
+// ParseSDP parses a session description
+func ParseSDP(sdp string) (*SessionDescription, error) {
+	session := &SessionDescription{}
+	var media *MediaDescription
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if len(line) < 2 || line[1] != '=' {
+			continue
+		}
+		value := line[2:]
+		switch line[0] {
+		case 'm':
+			fields := strings.Fields(value)
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("SDP: malformed media line %q", line)
+			}
+			port, err := strconv.Atoi(strings.SplitN(fields[1], "/", 2)[0])
+			if err != nil {
+				return nil, fmt.Errorf("SDP: media port in %q: %w", line, err)
+			}
+			session.Media = append(session.Media, MediaDescription{
+				Type:     fields[0],
+				Port:     port,
+				Protocol: fields[2],
+				RTPMap:   map[int]string{},
+				FMTP:     map[int]map[string]string{},
+			})
+			media = &session.Media[len(session.Media)-1]
+			for _, format := range fields[3:] {
+				if payloadType, err := strconv.Atoi(format); err == nil {
+					media.Formats = append(media.Formats, payloadType)
+				}
+			}
+		case 'a':
+			name, attribute, _ := strings.Cut(value, ":")
+			switch {
+			case name == "control" && media == nil:
+				session.Control = attribute
+			case name == "control":
+				media.Control = attribute
+			case name == "rtpmap" && media != nil:
+				format, encoding, _ := strings.Cut(attribute, " ")
+				if payloadType, err := strconv.Atoi(format); err == nil {
+					media.RTPMap[payloadType] = encoding
+				}
+			case name == "fmtp" && media != nil:
+				format, parameters, _ := strings.Cut(attribute, " ")
+				payloadType, err := strconv.Atoi(format)
+				if err != nil {
+					continue
+				}
+				media.FMTP[payloadType] = map[string]string{}
+				for _, parameter := range strings.Split(parameters, ";") {
+					key, v, _ := strings.Cut(strings.TrimSpace(parameter), "=")
+					if key != "" {
+						media.FMTP[payloadType][strings.ToLower(key)] = v
+					}
+				}
+			}
+		}
+	}
+	return session, nil
+}
+
+// H264 returns the first H.264 video media of the session
+func (s *SessionDescription) H264() (*MediaDescription, *H264Parameters, error) {
+	for i := range s.Media {
+		media := &s.Media[i]
+		if media.Type != "video" {
+			continue
+		}
+		for _, payloadType := range media.Formats {
+			if !strings.HasPrefix(strings.ToUpper(media.RTPMap[payloadType]), "H264/") {
+				continue
+			}
+			parameters, err := media.h264Parameters(payloadType)
+			return media, parameters, err
+		}
+	}
+	return nil, nil, fmt.Errorf("SDP: no H264 video media")
+}
+
+func (m *MediaDescription) h264Parameters(payloadType int) (*H264Parameters, error) {
+	parameters := &H264Parameters{PayloadType: payloadType}
+	fmtp := m.FMTP[payloadType]
+	if mode, ok := fmtp["packetization-mode"]; ok {
+		v, err := strconv.Atoi(mode)
+		if err != nil {
+			return nil, fmt.Errorf("SDP: packetization-mode %q: %w", mode, err)
+		}
+		parameters.PacketizationMode = v
+	}
+	if id, ok := fmtp["profile-level-id"]; ok {
+		b, err := hex.DecodeString(id)
+		if err != nil || len(b) != 3 {
+			return nil, fmt.Errorf("SDP: profile-level-id %q", id)
+		}
+		copy(parameters.ProfileLevelID[:], b)
+	}
+	if sets, ok := fmtp["sprop-parameter-sets"]; ok {
+		for _, set := range strings.Split(sets, ",") {
+			nalUnit, err := base64.StdEncoding.DecodeString(strings.TrimSpace(set))
+			if err != nil || len(nalUnit) == 0 {
+				return nil, fmt.Errorf("SDP: sprop-parameter-sets entry %q", set)
+			}
+			switch int(nalUnit[0] & 0x1f) {
+			case NALU_TYPE_SPS:
+				parameters.SPS = append(parameters.SPS, nalUnit)
+			case NALU_TYPE_PPS:
+				parameters.PPS = append(parameters.PPS, nalUnit)
+			}
+		}
+	}
+	return parameters, nil
+}
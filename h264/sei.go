@@ -0,0 +1,160 @@
+package h264
+
+import (
+	"fmt"
+)
+
+// Annex D.1 payloadType values
+const (
+	SEI_TYPE_BUFFERING_PERIOD               = 0
+	SEI_TYPE_PIC_TIMING                     = 1
+	SEI_TYPE_PAN_SCAN_RECT                  = 2
+	SEI_TYPE_FILLER_PAYLOAD                 = 3
+	SEI_TYPE_USER_DATA_REGISTERED_ITU_T_T35 = 4
+	SEI_TYPE_USER_DATA_UNREGISTERED         = 5
+	SEI_TYPE_RECOVERY_POINT                 = 6
+	SEI_TYPE_DEC_REF_PIC_MARKING_REPETITION = 7
+	SEI_TYPE_SPARE_PIC                      = 8
+	SEI_TYPE_SCENE_INFO                     = 9
+	SEI_TYPE_SUB_SEQ_INFO                   = 10
+	SEI_TYPE_SUB_SEQ_LAYER_CHARACTERISTICS  = 11
+	SEI_TYPE_SUB_SEQ_CHARACTERISTICS        = 12
+	SEI_TYPE_FULL_FRAME_FREEZE              = 13
+	SEI_TYPE_FULL_FRAME_FREEZE_RELEASE      = 14
+	SEI_TYPE_FULL_FRAME_SNAPSHOT            = 15
+	SEI_TYPE_MOTION_CONSTRAINED_SLICE_GROUP = 18
+	SEI_TYPE_FILM_GRAIN_CHARACTERISTICS     = 19
+	SEI_TYPE_DEBLOCKING_FILTER_DISPLAY      = 20
+	SEI_TYPE_STEREO_VIDEO_INFO              = 21
+	SEI_TYPE_FRAME_PACKING_ARRANGEMENT      = 45
+	SEI_TYPE_DISPLAY_ORIENTATION            = 47
+	SEI_TYPE_MASTERING_DISPLAY_COLOUR       = 137
+	SEI_TYPE_CONTENT_LIGHT_LEVEL            = 144
+	SEI_TYPE_ALTERNATIVE_TRANSFER           = 147
+)
+
+var (
+	SEIPayloadType = map[int]string{
+		0:   "buffering period",
+		1:   "pic timing",
+		2:   "pan-scan rect",
+		3:   "filler payload",
+		4:   "user data registered ITU-T T.35",
+		5:   "user data unregistered",
+		6:   "recovery point",
+		7:   "dec ref pic marking repetition",
+		8:   "spare pic",
+		9:   "scene info",
+		10:  "sub seq info",
+		11:  "sub seq layer characteristics",
+		12:  "sub seq characteristics",
+		13:  "full frame freeze",
+		14:  "full frame freeze release",
+		15:  "full frame snapshot",
+		18:  "motion constrained slice group set",
+		19:  "film grain characteristics",
+		20:  "deblocking filter display preference",
+		21:  "stereo video info",
+		45:  "frame packing arrangement",
+		47:  "display orientation",
+		137: "mastering display colour volume",
+		144: "content light level information",
+		147: "alternative transfer characteristics",
+	}
+	seiDecoders = map[int]SEIDecoder{
+		SEI_TYPE_USER_DATA_UNREGISTERED: decodeUserDataUnregistered,
+	}
+)
+
+// SEIMessage is one sei_message of an SEI NAL unit, 7.3.2.3.1. Payload is
+// always the raw sei_payload. Value holds the decoded payload when a
+// decoder is registered for PayloadType and it succeeded.
+type SEIMessage struct {
+	PayloadType int
+	PayloadSize int
+	Payload     []byte
+	Value       interface{}
+}
+
+// SEIDecoder decodes one sei_payload read by b, which holds only the
+// payload bytes. videoStream is the stream the SEI NAL unit was found in
+// and is nil when no SPS has been seen yet.
+type SEIDecoder func(videoStream *VideoStream, b *BitReader) (interface{}, error)
+
+// RegisterSEIDecoder sets the decoder used for payloadType, replacing any
+// existing one. It is meant to be called from init.
+func RegisterSEIDecoder(payloadType int, decoder SEIDecoder) {
+	seiDecoders[payloadType] = decoder
+}
+
+// UserDataUnregistered is the user_data_unregistered payload, D.1.6
+type UserDataUnregistered struct {
+	UUID [16]byte
+	Data []byte
+}
+
+func decodeUserDataUnregistered(videoStream *VideoStream, b *BitReader) (interface{}, error) {
+	buf := b.Bytes()
+	if len(buf) < 16 {
+		return nil, fmt.Errorf("user data unregistered: %w", ErrTruncated)
+	}
+	u := UserDataUnregistered{Data: buf[16:]}
+	copy(u.UUID[:], buf)
+	return u, nil
+}
+
+func NewSEI(videoStream *VideoStream, rbsp []byte) ([]*SEIMessage, error) {
+	return parseSEI(videoStream, &BitReader{bytes: rbsp})
+}
+
+// 7.3.2.3 sei_rbsp. A payload whose decoder fails is kept with its raw
+// bytes only.
+func parseSEI(videoStream *VideoStream, b *BitReader) ([]*SEIMessage, error) {
+	messages := []*SEIMessage{}
+	for b.MoreRBSPData() {
+		// 7.3.2.3.1 payloadType and payloadSize are sums of ff_byte runs
+		message := SEIMessage{
+			PayloadType: seiVarLength(b, "PayloadType"),
+			PayloadSize: seiVarLength(b, "PayloadSize"),
+		}
+		if err := b.Err(); err != nil {
+			return messages, fmt.Errorf("SEI: %w", err)
+		}
+		payload, err := b.ReadBytes(message.PayloadSize)
+		if err != nil {
+			return messages, fmt.Errorf("SEI %s: %w: payload of %d bytes", seiPayloadName(message.PayloadType), ErrTruncated, message.PayloadSize)
+		}
+		message.Payload = payload
+		if decoder, ok := seiDecoders[message.PayloadType]; ok {
+			value, err := decoder(videoStream, b.child(payload))
+			if err != nil {
+				b.logger().Warn("keeping raw SEI payload", "payloadType", message.PayloadType, "err", err)
+			} else {
+				message.Value = value
+			}
+		}
+		messages = append(messages, &message)
+	}
+	return messages, rbspTrailingBits(b)
+}
+
+// Reads a payloadType or payloadSize, coded as a run of 0xff bytes each
+// adding 255 followed by a final byte
+func seiVarLength(b *BitReader, name string) int {
+	v := 0
+	for b.Err() == nil {
+		next := b.NextField(name, 8)
+		v += next
+		if next != 0xff {
+			break
+		}
+	}
+	return v
+}
+
+func seiPayloadName(payloadType int) string {
+	if name, ok := SEIPayloadType[payloadType]; ok {
+		return name
+	}
+	return fmt.Sprintf("payload type %d", payloadType)
+}
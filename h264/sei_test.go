@@ -0,0 +1,49 @@
+package h264
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNewSEI(t *testing.T) {
+	unregistered := append(bytes.Repeat([]byte{0xaa}, 16), 'h', 'i')
+	rbsp := []byte{5, byte(len(unregistered))}
+	rbsp = append(rbsp, unregistered...)
+	// payloadType 300 is coded as 0xff 0x2d
+	rbsp = append(rbsp, 0xff, 0x2d, 2, 0x12, 0x34)
+	rbsp = append(rbsp, 0x80)
+
+	messages, err := NewSEI(nil, rbsp)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d\n", len(messages))
+	}
+	u, ok := messages[0].Value.(UserDataUnregistered)
+	if !ok || u.UUID[0] != 0xaa || string(u.Data) != "hi" {
+		t.Fatalf("unexpected user data unregistered %#v\n", messages[0].Value)
+	}
+	raw := messages[1]
+	if raw.PayloadType != 300 || raw.PayloadSize != 2 || raw.Value != nil || !bytes.Equal(raw.Payload, []byte{0x12, 0x34}) {
+		t.Fatalf("unexpected raw message %+v\n", raw)
+	}
+}
+
+func TestRegisterSEIDecoder(t *testing.T) {
+	defer delete(seiDecoders, 200)
+	RegisterSEIDecoder(200, func(videoStream *VideoStream, b *BitReader) (interface{}, error) {
+		return b.NextField("Value", 8), b.Err()
+	})
+	messages, err := NewSEI(nil, []byte{200, 1, 7, 0x80})
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if len(messages) != 1 || messages[0].Value != 7 {
+		t.Fatalf("expected decoded value 7, got %+v\n", messages)
+	}
+	// A payload running past the NAL unit
+	if _, err := NewSEI(nil, []byte{200, 9, 7, 0x80}); err == nil {
+		t.Fatalf("expected an error for a truncated payload\n")
+	}
+}
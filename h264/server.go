@@ -4,11 +4,12 @@ import (
 	// "github.com/nareix/joy4/av"
 	// 	"github.com/nareix/joy4/codec/h264parser"
 	// "github.com/nareix/joy4/format/ts"
+	"fmt"
 	"io"
-	"log"
 	"net"
 	"os"
 	"os/signal"
+	"time"
 )
 
 // InitialNALU indicates the start of a h264 packet
@@ -18,20 +19,18 @@ import (
 var (
 	InitialNALU   = []byte{0, 0, 0, 1}
 	Initial3BNALU = []byte{0, 0, 1}
-	logger        *log.Logger
 	streamOffset  = 0
 )
 
-func init() {
-	logger = log.New(os.Stderr, "streamer ", log.Lshortfile|log.Lmicroseconds)
-}
+// Reports whether packet ends with a start code. The zero_byte of a 4 byte
+// start code is left to the NAL unit before it.
 func isStartSequence(packet []byte) bool {
-	if len(packet) < len(InitialNALU) {
+	if len(packet) < len(Initial3BNALU) {
 		return false
 	}
-	naluSegment := packet[len(packet)-4:]
-	for i := range InitialNALU {
-		if naluSegment[i] != InitialNALU[i] {
+	naluSegment := packet[len(packet)-len(Initial3BNALU):]
+	for i := range Initial3BNALU {
+		if naluSegment[i] != Initial3BNALU[i] {
 			return false
 		}
 	}
@@ -58,115 +57,331 @@ func isStartCodeOnePrefix(buf []byte) bool {
 			return false
 		}
 	}
-	logger.Printf("debug: found start code one prefix byte\n")
 	return true
 }
-func readNalUnit(r *H264Reader) (*NalUnit, *BitReader) {
+
+// Returns the next NAL unit of an Annex B byte stream. At the end of the
+// stream the error is the underlying read error, otherwise it describes why
+// the NAL unit could not be parsed and the caller may skip it.
+func readAnnexBNalUnit(r *H264Reader) (*NalUnit, *BitReader, error) {
 	// Read to start of NAL
-	logger.Printf("debug: Seeking NAL %d start\n", len(r.NalUnits))
 	r.LogStreamPosition()
 	for !isStartSequence(r.Bytes()) {
 		if err := r.BufferToReader(1); err != nil {
-			return nil, nil
+			return nil, nil, err
 		}
 	}
-	/*
-		if !r.IsStarted {
-			logger.Printf("debug: skipping initial NAL zero byte spaces\n")
-			r.LogStreamPosition()
-			// Annex B.2 Step 1
-			if err := r.Discard(1); err != nil {
-				logger.Printf("error: while discarding empty byte (Annex B.2:1): %v\n", err)
-				return nil
-			}
-			if err := r.Discard(2); err != nil {
-				logger.Printf("error: while discarding start code prefix one 3bytes (Annex B.2:2): %v\n", err)
-				return nil
-			}
-		}
-	*/
 	_, startOffset, _ := r.StreamPosition()
-	logger.Printf("debug: Seeking next NAL start\n")
-	r.LogStreamPosition()
-	// Read to start of next NAL
-	_, so, _ := r.StreamPosition()
-	for so == startOffset || !isStartSequence(r.Bytes()) {
-		_, so, _ = r.StreamPosition()
-		if err := r.BufferToReader(1); err != nil {
-			return nil, nil
+	r.prefixBytes = len(Initial3BNALU)
+	if startOffset > len(Initial3BNALU) && r.Bytes()[startOffset-len(InitialNALU)] == 0 {
+		r.prefixBytes = len(InitialNALU)
+	}
+	// Read to start of next NAL, or the end of the stream which also ends
+	// the last NAL unit
+	var readErr error
+	for {
+		if readErr = r.BufferToReader(1); readErr != nil {
+			break
+		}
+		if isStartSequence(r.Bytes()) {
+			break
 		}
 	}
-	// logger.Printf("debug: PreRewind %#v\n", r.Bytes())
-	// Rewind back the length of the start sequence
-	// r.RewindBytes(4)
-	// logger.Printf("debug: PostRewind %#v\n", r.Bytes())
 	_, endOffset, _ := r.StreamPosition()
-	logger.Printf("debug: found NAL unit with %d bytes from %d to %d\n", endOffset-startOffset, startOffset, endOffset)
-	nalUnitReader := &BitReader{bytes: r.Bytes()[startOffset:]}
-	r.NalUnits = append(r.NalUnits, nalUnitReader)
-	r.LogStreamPosition()
-	logger.Printf("debug: NAL Header: %#v\n", nalUnitReader.Bytes()[0:8])
-	nalUnit := NewNalUnit(nalUnitReader.Bytes(), len(nalUnitReader.Bytes()))
-	return nalUnit, nalUnitReader
+	buf := r.Bytes()[startOffset:endOffset]
+	switch {
+	case readErr == nil:
+		// The buffer ends with the next start code, which is not part of this NAL
+		buf = buf[:len(buf)-len(Initial3BNALU)]
+	case readErr != io.EOF || len(buf) == 0:
+		return nil, nil, readErr
+	}
+	// A NAL unit never ends in a zero byte, B.2; these are trailing_zero_8bits
+	// or the zero_byte of the next start code
+	for len(buf) > 0 && buf[len(buf)-1] == 0 {
+		buf = buf[:len(buf)-1]
+	}
+	if len(buf) == 0 {
+		return nil, r.child(buf), fmt.Errorf("%w: empty NAL unit", ErrTruncated)
+	}
+	return r.nalUnitFromBytes(buf)
 }
 
-func handleConnection(connection io.Reader) {
-	logger.Printf("debug: handling connection\n")
-	streamFilename := "/home/bruce/devel/go/src/github.com/mrmod/cvnightlife/output.mp4"
-	_ = os.Remove(streamFilename)
-	debugFile, err := os.Create(streamFilename)
-	if err != nil {
-		panic(err)
-	}
-	streamReader := &H264Reader{
-		Stream:    connection,
-		BitReader: &BitReader{bytes: []byte{}},
-		DebugFile: debugFile,
-	}
-	c := make(chan os.Signal, 1)
-	signal.Notify(c)
-	go func() {
-		logger.Printf("debug: waiting on signals\n")
-		s := <-c
-		logger.Printf("info: %v received, closing stream file\n", s)
-		streamReader.DebugFile.Close()
-		os.Exit(0)
-	}()
-
+// Decodes a slice NAL unit, converting a parser panic into an error so a
+// single corrupt slice cannot take down the connection
+func (h *H264Reader) decodeSlice(videoStream *VideoStream, nalUnit *NalUnit) (sliceContext *SliceContext, err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			logger.Printf("fatal: recovered: %v\n", r)
-			logger.Printf("info: closing streamfile\n")
-			streamReader.DebugFile.Close()
-			os.Exit(1)
+			sliceContext = nil
+			err = fmt.Errorf("slice decode failed: %v", r)
 		}
 	}()
+	return parseSliceContext(videoStream, nalUnit, h.child(nalUnit.RBSP()), true)
+}
+
+// Adds a slice to the picture being assembled, emitting the previous
+// picture first when the slice starts a new one
+func (h *H264Reader) addSlice(videoStream *VideoStream, nalUnit *NalUnit) {
+	sliceContext, err := h.decodeSlice(videoStream, nalUnit)
+	if sliceContext == nil {
+		start := readSliceStart(videoStream.SPS, nalUnit.RBSP())
+		firstMb := -1
+		if start != nil {
+			firstMb = start.FirstMbInSlice
+		}
+		h.logger().Warn("dropping slice", "nalUnitType", NALUnitType[nalUnit.Type], "firstMb", firstMb, "err", err)
+		if videoStream.Frame == nil {
+			h.newFrame(videoStream, nalUnit, nil)
+		}
+		videoStream.Frame.addLostSlice(videoStream.SPS, nalUnit, start)
+		return
+	}
+	header := sliceContext.Slice.Header
+	if frame := videoStream.Frame; frame != nil {
+		if frame.hasSliceStart(sliceFirstMbAddr(sliceContext.SPS, header)) {
+			h.finishFrame(videoStream)
+		} else if frame.lastSlice != nil && sliceContext.IsNewPicture(frame.lastSlice) {
+			h.finishFrame(videoStream)
+		}
+	}
+	if videoStream.Frame == nil {
+		h.newFrame(videoStream, nalUnit, header)
+	}
+	if err != nil {
+		// Only the slice data was lost
+		h.logger().Warn("dropping slice data", "nalUnitType", NALUnitType[nalUnit.Type], "firstMb", header.FirstMbInSlice, "err", err)
+		videoStream.Frame.addLostSlice(sliceContext.SPS, nalUnit, header)
+		videoStream.Frame.lastSlice = sliceContext
+		return
+	}
+	videoStream.Frame.addSlice(sliceContext)
+	videoStream.Slices = append(videoStream.Slices, sliceContext)
+}
+
+// Starts a picture, handing it the SEI messages of its access unit. header
+// is nil when the first slice of the picture was unreadable.
+func (h *H264Reader) newFrame(videoStream *VideoStream, nalUnit *NalUnit, header *SliceHeader) {
+	if header == nil {
+		videoStream.Frame = NewFrame(videoStream.SPS, videoStream.PPS, &SliceHeader{})
+	} else {
+		videoStream.Frame = NewFrame(videoStream.SPS, videoStream.PPS, header)
+		videoStream.Frame.PicOrderCnt = videoStream.poc.picOrderCnt(videoStream.SPS, nalUnit, header)
+		h.startRandomAccess(videoStream.SPS, header)
+	}
+	videoStream.Frame.SEI = h.pendingSEI
+	videoStream.Frame.Bytes = h.pendingBytes
+	videoStream.Frame.NalUnits = h.pendingNalUnits
+	h.pendingBytes = 0
+	h.pendingNalUnits = nil
+	videoStream.Frame.Timing = videoStream.hrd.pictureTiming(videoStream.SPS, h.pendingSEI)
+	h.timestamps.stamp(videoStream.Frame, time.Now())
+	h.stampFromSample(videoStream.Frame)
+	h.pendingSEI = nil
+}
+
+// Returns the stream of the most recent SPS, or nil before the first
+func (h *H264Reader) currentVideoStream() *VideoStream {
+	if len(h.VideoStreams) == 0 {
+		return nil
+	}
+	return h.VideoStreams[len(h.VideoStreams)-1]
+}
+
+// Counts and conceals the macroblocks the current picture is missing and
+// hands it to the FrameHandler
+func (h *H264Reader) finishFrame(videoStream *VideoStream) {
+	frame := videoStream.Frame
+	if frame == nil {
+		return
+	}
+	videoStream.Frame = nil
+	frame.countLost()
+	frame.conceal(videoStream.lastReference)
+	if frame.Loss.LostMbs > 0 {
+		h.logger().Info("concealed macroblocks",
+			"frameNum", frame.FrameNum,
+			"lost", frame.Loss.LostMbs,
+			"total", frame.Loss.TotalMbs,
+			"spatial", frame.Loss.SpatialMbs,
+			"temporal", frame.Loss.TemporalMbs,
+			"lostSlices", frame.Loss.LostSlices)
+	}
+	if frame.Reference {
+		videoStream.lastReference = frame
+	}
+	if h.accessUnitHandler != nil {
+		h.accessUnitHandler.HandleFrame(frame)
+	}
+	if !h.recovered(frame) {
+		h.logger().Debug("suppressing picture before recovery point", "frameNum", frame.FrameNum)
+		return
+	}
+	if h.FrameHandler != nil {
+		h.FrameHandler.HandleFrame(frame)
+	}
+}
+
+func (h *H264Reader) finishAllFrames() {
+	for _, videoStream := range h.VideoStreams {
+		h.finishFrame(videoStream)
+	}
+}
+
+// Decode reads NAL units until the stream ends, emitting pictures to the
+// FrameHandler. NAL units that fail to parse are logged and skipped.
+func (h *H264Reader) Decode() error {
 	for {
-		nalUnit, nalReader := readNalUnit(streamReader)
-		_ = nalReader
+		nalUnit, nalReader, err := readNalUnit(h)
+		if nalUnit == nil && nalReader == nil {
+			h.finishAllFrames()
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err != nil {
+			h.logger().Warn("skipping NAL unit", "err", err)
+			continue
+		}
+		// Size in the byte stream, counted towards its access unit
+		nalBytes := h.prefixBytes + len(nalReader.Bytes())
+		raw := nalReader.Bytes()[:len(nalReader.Bytes()):len(nalReader.Bytes())]
 		switch nalUnit.Type {
 		case NALU_TYPE_SPS:
-			sps := NewSPS(nalUnit.rbsp, false)
-			streamReader.VideoStreams = append(
-				streamReader.VideoStreams,
-				&VideoStream{SPS: sps},
+			h.finishAllFrames()
+			h.pendingBytes += nalBytes
+			h.pendingNalUnits = append(h.pendingNalUnits, raw)
+			sps, err := parseSPS(h.child(nalUnit.RBSP()), false)
+			if err != nil {
+				h.logger().Warn("skipping SPS", "err", err)
+				continue
+			}
+			sps.refIdc = nalUnit.RefIdc
+			if h.spsByID == nil {
+				h.spsByID = map[int]*SPS{}
+			}
+			h.spsByID[sps.ID] = sps
+			if videoStream := h.currentVideoStream(); videoStream != nil && sameSequence(videoStream.SPS, sps) {
+				// A repeated SPS keeps the state of its stream, such as
+				// HRD timing and the reference used for concealment
+				videoStream.SPS = sps
+				continue
+			}
+			h.VideoStreams = append(
+				h.VideoStreams,
+				&VideoStream{SPS: sps, spsByID: h.spsByID},
 			)
 		case NALU_TYPE_PPS:
-			videoStream := streamReader.VideoStreams[len(streamReader.VideoStreams)-1]
-			videoStream.PPS = NewPPS(videoStream.SPS, nalUnit.RBSP(), false)
+			h.finishAllFrames()
+			h.pendingBytes += nalBytes
+			h.pendingNalUnits = append(h.pendingNalUnits, raw)
+			videoStream := h.currentVideoStream()
+			if videoStream == nil {
+				h.logger().Debug("skipping PPS before any SPS")
+				h.skippedNalUnits++
+				continue
+			}
+			pps, err := parsePPS(videoStream.SPS, h.child(nalUnit.RBSP()), false)
+			if err != nil {
+				h.logger().Warn("skipping PPS", "err", err)
+				continue
+			}
+			pps.refIdc = nalUnit.RefIdc
+			videoStream.PPS = pps
+		case NALU_TYPE_SEI_SINFO:
+			// 7.4.1.2.3 SEI starts a new access unit
+			h.finishAllFrames()
+			h.pendingBytes += nalBytes
+			h.pendingNalUnits = append(h.pendingNalUnits, raw)
+			messages, err := parseSEI(h.currentVideoStream(), h.child(nalUnit.RBSP()))
+			if err != nil {
+				h.logger().Warn("SEI NAL unit incomplete", "messages", len(messages), "err", err)
+			}
+			h.pendingSEI = append(h.pendingSEI, messages...)
+		case NALU_TYPE_END_OF_SEQUENCE:
+			// 7.4.1.2.3 The end of sequence is the last NAL unit of its
+			// access unit but for an end of stream
+			if videoStream := h.currentVideoStream(); videoStream != nil && videoStream.Frame != nil {
+				videoStream.Frame.Bytes += nalBytes
+				videoStream.Frame.NalUnits = append(videoStream.Frame.NalUnits, raw)
+				h.finishAllFrames()
+			} else {
+				h.pendingBytes += nalBytes
+				h.pendingNalUnits = append(h.pendingNalUnits, raw)
+			}
+		case NALU_TYPE_ACCESS_UNIT_DELIMITER:
+			// 7.4.1.2.3 This always starts a new access unit
+			h.finishAllFrames()
+			// SEI from an access unit whose slices were all lost
+			h.pendingSEI = nil
+			h.pendingBytes = nalBytes
+			h.pendingNalUnits = [][]byte{raw}
 		case NALU_TYPE_SLICE_IDR_PICTURE:
 			fallthrough
 		case NALU_TYPE_SLICE_NON_IDR_PICTURE:
-			videoStream := streamReader.VideoStreams[len(streamReader.VideoStreams)-1]
-			logger.Printf("info: frame number %d\n", len(videoStream.Slices))
-			sliceContext := NewSliceContext(videoStream, nalUnit, nalUnit.RBSP(), true)
-			videoStream.Slices = append(videoStream.Slices, sliceContext)
+			videoStream := h.currentVideoStream()
+			if videoStream == nil || videoStream.PPS == nil {
+				h.logger().Debug("skipping slice while waiting for SPS and PPS")
+				h.skippedNalUnits++
+				continue
+			}
+			if !h.acquireRandomAccess(nalUnit) {
+				h.logger().Debug("skipping slice while waiting for a random access point")
+				continue
+			}
+			h.addSlice(videoStream, nalUnit)
+			if frame := videoStream.Frame; frame != nil {
+				frame.Bytes += nalBytes
+				frame.VCLBytes += len(raw)
+				frame.NalUnits = append(frame.NalUnits, raw)
+			}
+		default:
+			// Filler data and the like end the access unit they follow
+			if videoStream := h.currentVideoStream(); videoStream != nil && videoStream.Frame != nil {
+				videoStream.Frame.Bytes += nalBytes
+				if nalUnit.Type == NALU_TYPE_FILLER_DATA {
+					videoStream.Frame.VCLBytes += len(raw)
+				}
+				videoStream.Frame.NalUnits = append(videoStream.Frame.NalUnits, raw)
+			} else {
+				h.pendingBytes += nalBytes
+				h.pendingNalUnits = append(h.pendingNalUnits, raw)
+			}
+		}
+	}
+}
+
+func handleConnection(frameHandler FrameHandler, connection io.Reader, opts ...DecoderOption) {
+	opts = append(opts, WithFrameHandler(frameHandler))
+	streamReader := NewDecoder(opts...).NewReader(connection)
+	streamFilename := "/home/bruce/devel/go/src/github.com/mrmod/cvnightlife/output.mp4"
+	_ = os.Remove(streamFilename)
+	if debugFile, err := os.Create(streamFilename); err == nil {
+		streamReader.DebugFile = debugFile
+		c := make(chan os.Signal, 1)
+		signal.Notify(c)
+		go func() {
+			s := <-c
+			streamReader.logger().Info("closing stream file", "signal", s)
+			streamReader.DebugFile.Close()
+			os.Exit(0)
+		}()
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			streamReader.logger().Error("connection aborted", "err", r)
 		}
+		if streamReader.DebugFile != nil {
+			streamReader.DebugFile.Close()
+		}
+	}()
+	if err := streamReader.Decode(); err != nil {
+		streamReader.logger().Error("stream ended", "err", err)
 	}
 }
 
-func ByteStreamReader(connection net.Conn) {
-	logger.Printf("opened bytestream\n")
+func ByteStreamReader(connection net.Conn, opts ...DecoderOption) {
 	defer connection.Close()
-	handleConnection(connection)
+	handleConnection(nil, connection, opts...)
 }
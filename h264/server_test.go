@@ -1,16 +1,181 @@
 package h264
 
 import (
+	"bytes"
+	"fmt"
 	"os"
 	"testing"
 )
 
+// Counts the pictures handed to it
+type counter struct {
+	frames int
+}
+
+func (c *counter) HandleFrame(*Frame) {
+	c.frames++
+}
+
+// Records the frame_num of each picture handed to it
+type frameNums []int
+
+func (f *frameNums) HandleFrame(frame *Frame) {
+	*f = append(*f, frame.FrameNum)
+}
+
+// Returns the NAL units the round trip tests carry: an SPS, a PPS and a
+// recovery point SEI ahead of the P slices of pictures 1 and 2
+func roundTripNalUnits() (sps, pps, sei, p1, p2 []byte) {
+	return nal(0x67, bitsToBytes(baselineSPSBits)), nal(0x68, bitsToBytes(baselinePPSBits)), recoveryPointSEI(),
+		nal(0x41, bitsToBytes(pSliceBits(1))), nal(0x41, bitsToBytes(pSliceBits(2)))
+}
+
+// Fails unless got is pictures 1 and 2 of the round trip NAL units
+func checkRoundTrip(t *testing.T, name string, got frameNums) {
+	t.Helper()
+	if len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Fatalf("%s: expected pictures 1 and 2, got %v\n", name, got)
+	}
+}
+
+// Decodes with decode and checks the pictures of the round trip NAL units
+// come out
+func decodeRoundTrip(t *testing.T, name string, decode func(*Decoder) error) {
+	t.Helper()
+	var got frameNums
+	if err := decode(NewDecoder(WithFrameHandler(&got))); err != nil {
+		t.Fatalf("%s: unexpected error: %v\n", name, err)
+	}
+	checkRoundTrip(t, name, got)
+}
+
 func TestHandleConnection(t *testing.T) {
 	input := "../sample.h264"
 	f, err := os.Open(input)
+	if os.IsNotExist(err) {
+		t.Skipf("no sample stream at %s\n", input)
+	}
 	if err != nil {
 		t.Fatalf("Error opening sample: %v\n", err)
 	}
 	frameCounter := &counter{0}
 	handleConnection(frameCounter, f)
 }
+
+// PPS 0 on SPS 0, CAVLC, no optional fields
+const baselinePPSBits = "1 1 0 0 1 1 1 0 00 1 1 1 0 0 0 1"
+
+// A P slice of a reference picture covering all 300 macroblocks with
+// mb_skip_run. frame_num is 4 bits and pic_order_cnt_lsb 6 bits.
+func pSliceBits(frameNum int) string {
+	bits := "1 00110 1 "
+	for i := 3; i >= 0; i-- {
+		bits += string("01"[frameNum>>uint(i)&1])
+	}
+	pocLsb := 2 * frameNum
+	bits += " "
+	for i := 5; i >= 0; i-- {
+		bits += string("01"[pocLsb>>uint(i)&1])
+	}
+	return bits + " 0 0 0 1 00000000100101101 1"
+}
+
+func annexB(nalUnits ...[]byte) []byte {
+	stream := []byte{}
+	for _, nalUnit := range nalUnits {
+		stream = append(stream, InitialNALU...)
+		stream = append(stream, nalUnit...)
+	}
+	return stream
+}
+
+func nal(header byte, rbsp []byte) []byte {
+	return append([]byte{header}, rbsp...)
+}
+
+func TestRandomAccessFromRecoveryPoint(t *testing.T) {
+	// recovery_frame_cnt 2, exact_match_flag 1
+	recoveryPoint := bitsToBytes("011 1 0 00 1")
+	sei := append([]byte{SEI_TYPE_RECOVERY_POINT, byte(len(recoveryPoint))}, recoveryPoint...)
+	sei = append(sei, 0x80)
+	stream := annexB(
+		// A connection joining mid-stream sees slices before parameter sets
+		nal(0x41, bitsToBytes(pSliceBits(3))),
+		nal(0x67, bitsToBytes(baselineSPSBits)),
+		nal(0x68, bitsToBytes(baselinePPSBits)),
+		nal(0x41, bitsToBytes(pSliceBits(4))),
+		nal(0x06, sei),
+		nal(0x41, bitsToBytes(pSliceBits(5))),
+		nal(0x41, bitsToBytes(pSliceBits(6))),
+		nal(0x41, bitsToBytes(pSliceBits(7))),
+		nal(0x41, bitsToBytes(pSliceBits(8))),
+		nal(0x09, []byte{0x10}),
+	)
+	var got frameNums
+	reader := NewDecoder(WithFrameHandler(&got)).NewReader(bytes.NewReader(stream))
+	if err := reader.Decode(); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if len(got) != 2 || got[0] != 7 || got[1] != 8 {
+		t.Fatalf("expected pictures 7 and 8, got %v\n", got)
+	}
+	ra := reader.RandomAccess
+	if ra == nil || ra.IDR || ra.FrameNum != 5 || ra.RecoveryFrameNum != 7 || !ra.RecoveryPoint.ExactMatch {
+		t.Fatalf("unexpected random access point %+v\n", ra)
+	}
+	if ra.SkippedNalUnits != 2 {
+		t.Fatalf("expected 2 skipped NAL units, got %d\n", ra.SkippedNalUnits)
+	}
+}
+
+func TestEndOfSequenceEndsAccessUnit(t *testing.T) {
+	endOfSequence := []byte{0x0a}
+	stream := annexB(
+		nal(0x67, bitsToBytes(baselineSPSBits)),
+		nal(0x68, bitsToBytes(baselinePPSBits)),
+		recoveryPointSEI(),
+		nal(0x41, bitsToBytes(pSliceBits(1))),
+		endOfSequence,
+		nal(0x41, bitsToBytes(pSliceBits(2))),
+	)
+	var frames frameList
+	if err := NewDecoder(WithFrameHandler(&frames)).Decode(bytes.NewReader(stream)); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("expected 2 pictures, got %d\n", len(frames))
+	}
+	first, second := frames[0].NalUnits, frames[1].NalUnits
+	if !bytes.Equal(first[len(first)-1], endOfSequence) || len(second) != 1 {
+		t.Fatalf("expected the end of sequence to end the first access unit, got %x and %x\n", first, second)
+	}
+}
+
+func TestRandomAccessRecoveryFrameLost(t *testing.T) {
+	// recovery_frame_cnt 2
+	recoveryPoint := bitsToBytes("011 1 0 00 1")
+	sei := append([]byte{SEI_TYPE_RECOVERY_POINT, byte(len(recoveryPoint))}, recoveryPoint...)
+	sei = append(sei, 0x80)
+	for _, c := range []struct {
+		frameNums []int
+		expected  string
+	}{
+		// frame_num 7 is lost
+		{[]int{5, 6, 8, 9}, "[8 9]"},
+		// Counting wraps at MaxFrameNum 16, and frame_num 0 is skipped
+		{[]int{14, 15, 1, 2}, "[1 2]"},
+	} {
+		nalUnits := [][]byte{nal(0x67, bitsToBytes(baselineSPSBits)), nal(0x68, bitsToBytes(baselinePPSBits)), nal(0x06, sei)}
+		for _, frameNum := range c.frameNums {
+			nalUnits = append(nalUnits, nal(0x41, bitsToBytes(pSliceBits(frameNum))))
+		}
+		nalUnits = append(nalUnits, nal(0x09, []byte{0x10}))
+		var got frameNums
+		if err := NewDecoder(WithFrameHandler(&got)).Decode(bytes.NewReader(annexB(nalUnits...))); err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+		if fmt.Sprint(got) != c.expected {
+			t.Fatalf("frame_nums %v: expected pictures %s, got %v\n", c.frameNums, c.expected, got)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package h264
 
 import (
 	"fmt"
+	"log/slog"
 	"math"
 )
 
@@ -9,6 +10,16 @@ type VideoStream struct {
 	SPS    *SPS
 	PPS    *PPS
 	Slices []*SliceContext
+	// Frame is the picture currently being assembled
+	Frame *Frame
+	// lastReference is the last reference picture, from which lost
+	// macroblocks of inter pictures are concealed
+	lastReference *Frame
+	poc           pocState
+	hrd           hrdState
+	// spsByID holds every SPS of the reader by seq_parameter_set_id, for
+	// SEI that names one
+	spsByID map[int]*SPS
 }
 type SliceContext struct {
 	*NalUnit
@@ -72,6 +83,9 @@ type SliceHeader struct {
 	DifferenceOfPicNumsMinus1        int
 	LongTermFrameIdx                 int
 	MaxLongTermFrameIdxPlus1         int
+	// MMCO5 is set when memory_management_control_operation 5 was present,
+	// which resets frame_num and picture order counting
+	MMCO5 bool
 }
 
 type SliceData struct {
@@ -266,7 +280,7 @@ func MbPred(sliceContext *SliceContext, b *BitReader, rbsp []byte) {
 
 					cabac = initCabac(binarization, sliceContext)
 					_ = cabac
-					logger.Printf("TODO: ae for PevIntra4x4PredModeFlag[%d]\n", luma4x4BlkIdx)
+					b.todo("ae(v) PrevIntra4x4PredModeFlag")
 				} else {
 					v = b.NextField(fmt.Sprintf("PrevIntra4x4PredModeFlag[%d]", luma4x4BlkIdx), 1)
 				}
@@ -281,7 +295,7 @@ func MbPred(sliceContext *SliceContext, b *BitReader, rbsp []byte) {
 							sliceContext.Slice.Data)
 						binarization.Decode(sliceContext, b, rbsp)
 
-						logger.Printf("TODO: ae for RemIntra4x4PredMode[%d]\n", luma4x4BlkIdx)
+						b.todo("ae(v) RemIntra4x4PredMode")
 					} else {
 						v = b.NextField(fmt.Sprintf("RemIntra4x4PredMode[%d]", luma4x4BlkIdx), 3)
 					}
@@ -303,7 +317,7 @@ func MbPred(sliceContext *SliceContext, b *BitReader, rbsp []byte) {
 					binarization := NewBinarization("PrevIntra8x8PredModeFlag", sliceContext.Slice.Data)
 					binarization.Decode(sliceContext, b, rbsp)
 
-					logger.Printf("TODO: ae for PrevIntra8x8PredModeFlag[%d]\n", luma8x8BlkIdx)
+					b.todo("ae(v) PrevIntra8x8PredModeFlag")
 				} else {
 					v = b.NextField(fmt.Sprintf("PrevIntra8x8PredModeFlag[%d]", luma8x8BlkIdx), 1)
 				}
@@ -317,7 +331,7 @@ func MbPred(sliceContext *SliceContext, b *BitReader, rbsp []byte) {
 							sliceContext.Slice.Data)
 						binarization.Decode(sliceContext, b, rbsp)
 
-						logger.Printf("TODO: ae for RemIntra8x8PredMode[%d]\n", luma8x8BlkIdx)
+						b.todo("ae(v) RemIntra8x8PredMode")
 					} else {
 						v = b.NextField(fmt.Sprintf("RemIntra8x8PredMode[%d]", luma8x8BlkIdx), 3)
 					}
@@ -339,7 +353,7 @@ func MbPred(sliceContext *SliceContext, b *BitReader, rbsp []byte) {
 					sliceContext.Slice.Data)
 				binarization.Decode(sliceContext, b, rbsp)
 
-				logger.Printf("TODO: ae for IntraChromaPredMode\n")
+				b.todo("ae(v) IntraChromaPredMode")
 			} else {
 				sliceContext.Slice.Data.IntraChromaPredMode = ue(b.golomb())
 			}
@@ -349,7 +363,7 @@ func MbPred(sliceContext *SliceContext, b *BitReader, rbsp []byte) {
 		for mbPartIdx := 0; mbPartIdx < NumMbPart(sliceContext.NalUnit, sliceContext.SPS, sliceContext.Slice.Header, sliceContext.Slice.Data); mbPartIdx++ {
 			sliceContext.Update(sliceContext.Slice.Header, sliceContext.Slice.Data)
 			if (sliceContext.Slice.Header.NumRefIdxL0ActiveMinus1 > 0 || sliceContext.Slice.Data.MbFieldDecodingFlag != sliceContext.Slice.Header.FieldPic) && MbPartPredMode(sliceContext.Slice.Data, sliceType, sliceContext.Slice.Data.MbType, mbPartIdx) != "Pred_L1" {
-				logger.Printf("\tTODO: refIdxL0[%d] te or ae(v)\n", mbPartIdx)
+				b.todo("te(v) or ae(v) RefIdxL0")
 				if len(sliceContext.Slice.Data.RefIdxL0) < mbPartIdx {
 					sliceContext.Slice.Data.RefIdxL0 = append(
 						sliceContext.Slice.Data.RefIdxL0, make([]int, mbPartIdx-len(sliceContext.Slice.Data.RefIdxL0)+1)...)
@@ -361,7 +375,7 @@ func MbPred(sliceContext *SliceContext, b *BitReader, rbsp []byte) {
 						sliceContext.Slice.Data)
 					binarization.Decode(sliceContext, b, rbsp)
 
-					logger.Printf("TODO: ae for RefIdxL0[%d]\n", mbPartIdx)
+					b.todo("ae(v) RefIdxL0")
 				} else {
 					// TODO: Only one reference picture is used for inter-prediction,
 					// then the value should be 0
@@ -406,7 +420,7 @@ func MbPred(sliceContext *SliceContext, b *BitReader, rbsp []byte) {
 							binarization.Decode(sliceContext, b, rbsp)
 
 						}
-						logger.Printf("TODO: ae for MvdL0[%d][0][%d]\n", mbPartIdx, compIdx)
+						b.todo("ae(v) MvdL0")
 					} else {
 						sliceContext.Slice.Data.MvdL0[mbPartIdx][0][compIdx] = se(b.golomb())
 					}
@@ -442,7 +456,7 @@ func MbPred(sliceContext *SliceContext, b *BitReader, rbsp []byte) {
 
 						}
 						// TODO: se(v) or ae(v)
-						logger.Printf("TODO: ae for MvdL1[%d][0][%d]\n", mbPartIdx, compIdx)
+						b.todo("ae(v) MvdL1")
 					} else {
 						sliceContext.Slice.Data.MvdL1[mbPartIdx][0][compIdx] = se(b.golomb())
 					}
@@ -557,7 +571,7 @@ func CurrMbAddr(sps *SPS, header *SliceHeader) int {
 		mbaffFrameFlag = 1
 	}
 
-	return header.FirstMbInSlice * (1 * mbaffFrameFlag)
+	return header.FirstMbInSlice * (1 + mbaffFrameFlag)
 }
 
 func MbaffFrameFlag(sps *SPS, header *SliceHeader) int {
@@ -567,10 +581,23 @@ func MbaffFrameFlag(sps *SPS, header *SliceHeader) int {
 	return 0
 }
 
+// Reads slice_data, converting a parser panic into an error
+func parseSliceData(sliceContext *SliceContext, b *BitReader) (data *SliceData, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			data = nil
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	data = NewSliceData(sliceContext, b)
+	return data, b.Err()
+}
+
 func NewSliceData(sliceContext *SliceContext, b *BitReader) *SliceData {
 	var cabac *CABAC
-	logger.Printf("debug: SliceData starts at ByteOffset: %d BitOffset %d\n", b.byteOffset, b.bitOffset)
-	logger.Printf("debug: \t== %d bytes remain ==\n", len(b.bytes)-b.byteOffset)
+	if b.logEnabled(slog.LevelDebug) {
+		b.logger().Debug("slice data", "byteOffset", b.byteOffset, "bitOffset", b.bitOffset, "remainingBytes", len(b.bytes)-b.byteOffset)
+	}
 	sliceContext.Slice.Data = &SliceData{BitReader: b}
 	flagField := func() bool {
 		if v := b.NextField("", 1); v == 1 {
@@ -589,17 +616,14 @@ func NewSliceData(sliceContext *SliceContext, b *BitReader) *SliceData {
 	if sliceContext.SPS.MBAdaptiveFrameField && !sliceContext.Slice.Header.FieldPic {
 		mbaffFrameFlag = 1
 	}
-	currMbAddr := sliceContext.Slice.Header.FirstMbInSlice * (1 * mbaffFrameFlag)
+	currMbAddr := sliceContext.Slice.Header.FirstMbInSlice * (1 + mbaffFrameFlag)
 
 	moreDataFlag := true
 	prevMbSkipped := 0
 	sliceContext.Slice.Data.SliceTypeName = sliceTypeMap[sliceContext.Slice.Header.SliceType]
 	sliceContext.Slice.Data.MbTypeName = MbTypeName(sliceContext.Slice.Data.SliceTypeName, sliceContext.Slice.Data.MbType)
-	logger.Printf("debug: \tSliceData: Processing moreData: %v\n", moreDataFlag)
 	for moreDataFlag {
-		logger.Printf("debug: \tLooking for more sliceContext.Slice.Data in slice type %s\n", sliceContext.Slice.Data.SliceTypeName)
 		if sliceContext.Slice.Data.SliceTypeName != "I" && sliceContext.Slice.Data.SliceTypeName != "SI" {
-			logger.Printf("debug: \tNonI/SI slice, processing moreData\n")
 			if sliceContext.PPS.EntropyCodingMode == 0 {
 				sliceContext.Slice.Data.MbSkipRun = ue(b.golomb())
 				if sliceContext.Slice.Data.MbSkipRun > 0 {
@@ -610,13 +634,14 @@ func NewSliceData(sliceContext *SliceContext, b *BitReader) *SliceData {
 					currMbAddr = nextMbAddress(currMbAddr, sliceContext.SPS, sliceContext.PPS, sliceContext.Slice.Header)
 				}
 				if sliceContext.Slice.Data.MbSkipRun > 0 {
-					logger.Printf("debug: \tNon-I/SI: Checking for more sliceContext.Slice.Data %d:%d:%d\n", b.byteOffset, b.bitOffset, len(b.Bytes()))
 					moreDataFlag = b.MoreRBSPData()
 				}
 			} else {
 				sliceContext.Slice.Data.MbSkipFlag = flagField()
 
-				logger.Printf("debug: \tNon-I/SI: Eval MbSkipFlag[%v] %d:%d:%d\n", sliceContext.Slice.Data.MbSkipFlag, b.byteOffset, b.bitOffset, len(b.Bytes()))
+				if b.logEnabled(slog.LevelDebug) {
+					b.logger().Debug("mb_skip_flag", "value", sliceContext.Slice.Data.MbSkipFlag, "mbAddr", currMbAddr)
+				}
 				moreDataFlag = !sliceContext.Slice.Data.MbSkipFlag
 			}
 		}
@@ -627,7 +652,7 @@ func NewSliceData(sliceContext *SliceContext, b *BitReader) *SliceData {
 					binarization := NewBinarization("MbFieldDecodingFlag", sliceContext.Slice.Data)
 					binarization.Decode(sliceContext, b, b.Bytes())
 
-					logger.Printf("TODO: ae for MbFieldDecodingFlag\n")
+					b.todo("ae(v) MbFieldDecodingFlag")
 				} else {
 					sliceContext.Slice.Data.MbFieldDecodingFlag = flagField()
 				}
@@ -641,14 +666,14 @@ func NewSliceData(sliceContext *SliceContext, b *BitReader) *SliceData {
 				_ = cabac
 				binarization.Decode(sliceContext, b, b.Bytes())
 				if binarization.PrefixSuffix {
-					logger.Printf("debug: MBType binarization has prefix and suffix\n")
+					b.todo("MbType prefix and suffix binarization")
 				}
 				bits := []int{}
 				for binIdx := 0; binarization.IsBinStringMatch(bits); binIdx++ {
 					newBit := b.ReadOneBit()
 					if binarization.UseDecodeBypass == 1 {
 						// DecodeBypass
-						logger.Printf("TODO: decodeBypass is set: 9.3.3.2.3")
+						b.todo("DecodeBypass 9.3.3.2.3")
 						codIRange, codIOffset := initDecodingEngine(sliceContext.Slice.Data.BitReader)
 						// Initialize the decoder
 						// TODO: When should the suffix of MaxBinIdxCtx be used and when just the prefix?
@@ -679,17 +704,19 @@ func NewSliceData(sliceContext *SliceContext, b *BitReader) *SliceData {
 							binarization.MaxBinIdxCtx.Prefix,
 							binarization.CtxIdxOffset.Prefix)
 						if binarization.MaxBinIdxCtx.IsPrefixSuffix {
-							logger.Printf("TODO: Handle PrefixSuffix binarization\n")
+							b.todo("PrefixSuffix binarization")
+						}
+						if b.logEnabled(slog.LevelDebug) {
+							b.logger().Debug("mb_type ctxIdx", "binIdx", binIdx, "ctxIdx", ctxIdx)
 						}
-						logger.Printf("debug: MBType ctxIdx for %d is %d\n", binIdx, ctxIdx)
 						// Then 9.3.3.2
 						codIRange, codIOffset := initDecodingEngine(b)
-						logger.Printf("debug: coding engine initialized: %d/%d\n", codIRange, codIOffset)
+						_, _ = codIRange, codIOffset
 					}
 					bits = append(bits, newBit)
 				}
 
-				logger.Printf("TODO: ae for MBType\n")
+				b.todo("ae(v) MbType")
 			} else {
 				sliceContext.Slice.Data.MbType = ue(b.golomb())
 			}
@@ -727,7 +754,7 @@ func NewSliceData(sliceContext *SliceContext, b *BitReader) *SliceData {
 			} else {
 				noSubMbPartSizeLessThan8x8Flag := 1
 				if sliceContext.Slice.Data.MbTypeName == "I_NxN" && MbPartPredMode(sliceContext.Slice.Data, sliceContext.Slice.Data.SliceTypeName, sliceContext.Slice.Data.MbType, 0) != "Intra_16x16" && NumMbPart(sliceContext.NalUnit, sliceContext.SPS, sliceContext.Slice.Header, sliceContext.Slice.Data) == 4 {
-					logger.Printf("\tTODO: subMbPred\n")
+					b.todo("subMbPred")
 					/*
 						subMbType := SubMbPred(sliceContext.Slice.Data.MbType)
 						for mbPartIdx := 0; mbPartIdx < 4; mbPartIdx++ {
@@ -750,7 +777,7 @@ func NewSliceData(sliceContext *SliceContext, b *BitReader) *SliceData {
 							cabac = initCabac(binarization, sliceContext)
 							binarization.Decode(sliceContext, b, b.Bytes())
 
-							logger.Println("TODO: ae(v) for TransformSize8x8Flag")
+							b.todo("ae(v) TransformSize8x8Flag")
 						} else {
 							sliceContext.Slice.Data.TransformSize8x8Flag = flagField()
 						}
@@ -759,13 +786,13 @@ func NewSliceData(sliceContext *SliceContext, b *BitReader) *SliceData {
 				}
 				if MbPartPredMode(sliceContext.Slice.Data, sliceContext.Slice.Data.SliceTypeName, sliceContext.Slice.Data.MbType, 0) != "Intra_16x16" {
 					// TODO: me, ae
-					logger.Printf("TODO: CodedBlockPattern pending me/ae implementation\n")
+					b.todo("me(v) or ae(v) CodedBlockPattern")
 					if sliceContext.PPS.EntropyCodingMode == 1 {
 						binarization := NewBinarization("CodedBlockPattern", sliceContext.Slice.Data)
 						cabac = initCabac(binarization, sliceContext)
 						binarization.Decode(sliceContext, b, b.Bytes())
 
-						logger.Printf("TODO: ae for CodedBlockPattern\n")
+						b.todo("ae(v) CodedBlockPattern")
 					} else {
 						sliceContext.Slice.Data.CodedBlockPattern = me(
 							b.golomb(),
@@ -781,7 +808,7 @@ func NewSliceData(sliceContext *SliceContext, b *BitReader) *SliceData {
 							cabac = initCabac(binarization, sliceContext)
 							binarization.Decode(sliceContext, b, b.Bytes())
 
-							logger.Printf("TODO: ae for TranformSize8x8Flag\n")
+							b.todo("ae(v) TransformSize8x8Flag")
 						} else {
 							sliceContext.Slice.Data.TransformSize8x8Flag = flagField()
 						}
@@ -794,7 +821,7 @@ func NewSliceData(sliceContext *SliceContext, b *BitReader) *SliceData {
 						cabac = initCabac(binarization, sliceContext)
 						binarization.Decode(sliceContext, b, b.Bytes())
 
-						logger.Printf("TODO: ae for MbQpDelta\n")
+						b.todo("ae(v) MbQpDelta")
 					} else {
 						sliceContext.Slice.Data.MbQpDelta = se(b.golomb())
 					}
@@ -804,7 +831,6 @@ func NewSliceData(sliceContext *SliceContext, b *BitReader) *SliceData {
 
 		} // END MacroblockLayer
 		if sliceContext.PPS.EntropyCodingMode == 0 {
-			logger.Printf("debug: \tNon-I/SI: Again Checking for more sliceContext.Slice.Data %d:%d:%d\n", b.byteOffset, b.bitOffset, len(b.Bytes()))
 			moreDataFlag = b.MoreRBSPData()
 		} else {
 			if sliceContext.Slice.Data.SliceTypeName != "I" && sliceContext.Slice.Data.SliceTypeName != "SI" {
@@ -815,12 +841,13 @@ func NewSliceData(sliceContext *SliceContext, b *BitReader) *SliceData {
 				}
 			}
 			if mbaffFrameFlag == 1 && currMbAddr%2 == 0 {
-				logger.Printf("debug: \tNon-I/SI: More sliceContext.Slice.Data at currMbAddr[%v] sliceContext.Slice.Data %d:%d:%d\n", currMbAddr, b.byteOffset, b.bitOffset, len(b.Bytes()))
 				moreDataFlag = true
 			} else {
 				// TODO: ae implementation
 				sliceContext.Slice.Data.EndOfSliceFlag = flagField() // ae(b.golomb())
-				logger.Printf("debug: \tNon-I/SI: End of slice[%v] %d:%d:%d\n", sliceContext.Slice.Data.EndOfSliceFlag, b.byteOffset, b.bitOffset, len(b.Bytes()))
+				if b.logEnabled(slog.LevelDebug) {
+					b.logger().Debug("end_of_slice_flag", "value", sliceContext.Slice.Data.EndOfSliceFlag, "mbAddr", currMbAddr)
+				}
 				moreDataFlag = !sliceContext.Slice.Data.EndOfSliceFlag
 			}
 		}
@@ -829,14 +856,79 @@ func NewSliceData(sliceContext *SliceContext, b *BitReader) *SliceData {
 	return sliceContext.Slice.Data
 }
 
+// 7.4.1.2.4: Reports whether the slice is the first VCL NAL unit of a new
+// primary coded picture following the slice prev
+func (c *SliceContext) IsNewPicture(prev *SliceContext) bool {
+	a, b := prev.Slice.Header, c.Slice.Header
+	if a.FrameNum != b.FrameNum || a.PPSID != b.PPSID {
+		return true
+	}
+	if a.FieldPic != b.FieldPic || a.BottomField != b.BottomField {
+		return true
+	}
+	if (prev.NalUnit.RefIdc == 0) != (c.NalUnit.RefIdc == 0) {
+		return true
+	}
+	idrA := prev.NalUnit.Type == NALU_TYPE_SLICE_IDR_PICTURE
+	idrB := c.NalUnit.Type == NALU_TYPE_SLICE_IDR_PICTURE
+	if idrA != idrB || (idrA && a.IDRPicID != b.IDRPicID) {
+		return true
+	}
+	switch c.SPS.PicOrderCountType {
+	case 0:
+		if a.PicOrderCntLsb != b.PicOrderCntLsb || a.DeltaPicOrderCntBottom != b.DeltaPicOrderCntBottom {
+			return true
+		}
+	case 1:
+		for i := 0; i < len(a.DeltaPicOrderCnt) && i < len(b.DeltaPicOrderCnt); i++ {
+			if a.DeltaPicOrderCnt[i] != b.DeltaPicOrderCnt[i] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (c *SliceContext) Update(header *SliceHeader, data *SliceData) {
 	c.Slice = &Slice{Header: header, Data: data}
 }
-func NewSliceContext(videoStream *VideoStream, nalUnit *NalUnit, rbsp []byte, showPacket bool) *SliceContext {
+func NewSliceContext(videoStream *VideoStream, nalUnit *NalUnit, rbsp []byte, showPacket bool) (*SliceContext, error) {
+	return parseSliceContext(videoStream, nalUnit, &BitReader{bytes: rbsp}, showPacket)
+}
+
+// Parses the slice layer RBSP held by b. When only the slice data fails
+// the returned context holds the header along with the error.
+func parseSliceContext(videoStream *VideoStream, nalUnit *NalUnit, b *BitReader, showPacket bool) (*SliceContext, error) {
+	sliceContext, err := parseSliceHeader(videoStream, nalUnit, b)
+	if err != nil {
+		return nil, err
+	}
+	data, err := parseSliceData(sliceContext, b)
+	sliceContext.Slice.Data = data
+	if err != nil {
+		// The header is still good for picture boundaries and ordering
+		return sliceContext, fmt.Errorf("slice data: %w", err)
+	}
+	if showPacket {
+		debugPacket(b, "slice header", sliceContext.Slice.Header)
+		debugPacket(b, "slice data", sliceContext.Slice.Data)
+	}
+	return sliceContext, nil
+}
+
+// Parses the slice header of the slice layer RBSP held by b, 7.3.3,
+// leaving b at the slice data
+func parseSliceHeader(videoStream *VideoStream, nalUnit *NalUnit, b *BitReader) (*SliceContext, error) {
+	rbsp := b.Bytes()
 	sps := videoStream.SPS
 	pps := videoStream.PPS
-	logger.Printf("debug: %s RBSP %d bytes %d bits == \n", NALUnitType[nalUnit.Type], len(rbsp), len(rbsp)*8)
-	logger.Printf("debug: \t%#v\n", rbsp[0:8])
+	if sps == nil || pps == nil {
+		return nil, fmt.Errorf("%s: no active SPS/PPS", NALUnitType[nalUnit.Type])
+	}
+	b.logger().Debug("slice RBSP", "nalUnitType", nalUnit.Type, "bytes", len(rbsp))
+	if len(rbsp) == 0 {
+		return nil, fmt.Errorf("slice header: %w", ErrTruncated)
+	}
 	var idrPic bool
 	if nalUnit.Type == 5 {
 		idrPic = true
@@ -847,7 +939,6 @@ func NewSliceContext(videoStream *VideoStream, nalUnit *NalUnit, rbsp []byte, sh
 	} else {
 		header.ChromaArrayType = sps.ChromaFormat
 	}
-	b := &BitReader{bytes: rbsp}
 	flagField := func() bool {
 		if v := b.NextField("", 1); v == 1 {
 			return true
@@ -856,14 +947,23 @@ func NewSliceContext(videoStream *VideoStream, nalUnit *NalUnit, rbsp []byte, sh
 	}
 	header.FirstMbInSlice = ue(b.golomb())
 	header.SliceType = ue(b.golomb())
+	if err := firstError(
+		checkRange("FirstMbInSlice", header.FirstMbInSlice, 0, PicSizeInMbs(sps, &header)-1),
+		checkRange("SliceType", header.SliceType, 0, 9),
+	); err != nil {
+		return nil, err
+	}
 	sliceType := sliceTypeMap[header.SliceType]
-	logger.Printf("debug: %s (%s) slice of %d bytes\n", NALUnitType[nalUnit.Type], sliceType, len(rbsp))
+	b.logger().Debug("slice", "nalUnitType", nalUnit.Type, "sliceType", sliceType)
 	header.PPSID = ue(b.golomb())
+	if err := checkRange("PPSID", header.PPSID, 0, 255); err != nil {
+		return nil, err
+	}
 	if sps.UseSeparateColorPlane {
 		header.ColorPlaneID = b.NextField("ColorPlaneID", 2)
 	}
-	// TODO: See 7.4.3
-	// header.FrameNum = b.NextField("FrameNum", 0)
+	// 7.4.3 frame_num is Log2MaxFrameNumMinus4 + 4 bits
+	header.FrameNum = b.NextField("FrameNum", sps.Log2MaxFrameNumMinus4+4)
 	if !sps.FrameMbsOnly {
 		header.FieldPic = flagField()
 		if header.FieldPic {
@@ -872,6 +972,9 @@ func NewSliceContext(videoStream *VideoStream, nalUnit *NalUnit, rbsp []byte, sh
 	}
 	if idrPic {
 		header.IDRPicID = ue(b.golomb())
+		if err := checkRange("IDRPicID", header.IDRPicID, 0, 65535); err != nil {
+			return nil, err
+		}
 	}
 	if sps.PicOrderCountType == 0 {
 		header.PicOrderCntLsb = b.NextField("PicOrderCntLsb", sps.Log2MaxPicOrderCntLSBMin4+4)
@@ -880,6 +983,7 @@ func NewSliceContext(videoStream *VideoStream, nalUnit *NalUnit, rbsp []byte, sh
 		}
 	}
 	if sps.PicOrderCountType == 1 && !sps.DeltaPicOrderAlwaysZero {
+		header.DeltaPicOrderCnt = make([]int, 2)
 		header.DeltaPicOrderCnt[0] = se(b.golomb())
 		if pps.BottomFieldPicOrderInFramePresent && !header.FieldPic {
 			header.DeltaPicOrderCnt[1] = se(b.golomb())
@@ -891,7 +995,10 @@ func NewSliceContext(videoStream *VideoStream, nalUnit *NalUnit, rbsp []byte, sh
 	if sliceType == "B" {
 		header.DirectSpatialMvPred = flagField()
 	}
-	if sliceType == "B" || sliceType == "SP" || sliceType == "B" {
+	// 7.4.3 inferred from the PPS defaults unless overridden
+	header.NumRefIdxL0ActiveMinus1 = pps.NumRefIdxL0DefaultActiveMinus1
+	header.NumRefIdxL1ActiveMinus1 = pps.NumRefIdxL1DefaultActiveMinus1
+	if sliceType == "P" || sliceType == "SP" || sliceType == "B" {
 		header.NumRefIdxActiveOverride = flagField()
 		if header.NumRefIdxActiveOverride {
 			header.NumRefIdxL0ActiveMinus1 = ue(b.golomb())
@@ -900,6 +1007,12 @@ func NewSliceContext(videoStream *VideoStream, nalUnit *NalUnit, rbsp []byte, sh
 			}
 		}
 	}
+	if err := firstError(
+		checkRange("NumRefIdxL0ActiveMinus1", header.NumRefIdxL0ActiveMinus1, 0, 31),
+		checkRange("NumRefIdxL1ActiveMinus1", header.NumRefIdxL1ActiveMinus1, 0, 31),
+	); err != nil {
+		return nil, err
+	}
 
 	if nalUnit.Type == 20 || nalUnit.Type == 21 {
 		// Annex H
@@ -910,7 +1023,7 @@ func NewSliceContext(videoStream *VideoStream, nalUnit *NalUnit, rbsp []byte, sh
 		if header.SliceType%5 != 2 && header.SliceType%5 != 4 {
 			header.RefPicListModificationFlagL0 = flagField()
 			if header.RefPicListModificationFlagL0 {
-				for header.ModificationOfPicNums != 3 {
+				for header.ModificationOfPicNums != 3 && b.Err() == nil {
 					header.ModificationOfPicNums = ue(b.golomb())
 					if header.ModificationOfPicNums == 0 || header.ModificationOfPicNums == 1 {
 						header.AbsDiffPicNumMinus1 = ue(b.golomb())
@@ -924,7 +1037,8 @@ func NewSliceContext(videoStream *VideoStream, nalUnit *NalUnit, rbsp []byte, sh
 		if header.SliceType%5 == 1 {
 			header.RefPicListModificationFlagL1 = flagField()
 			if header.RefPicListModificationFlagL1 {
-				for header.ModificationOfPicNums != 3 {
+				header.ModificationOfPicNums = 0
+				for header.ModificationOfPicNums != 3 && b.Err() == nil {
 					header.ModificationOfPicNums = ue(b.golomb())
 					if header.ModificationOfPicNums == 0 || header.ModificationOfPicNums == 1 {
 						header.AbsDiffPicNumMinus1 = ue(b.golomb())
@@ -991,7 +1105,10 @@ func NewSliceContext(videoStream *VideoStream, nalUnit *NalUnit, rbsp []byte, sh
 			header.AdaptiveRefPicMarkingModeFlag = flagField()
 			if header.AdaptiveRefPicMarkingModeFlag {
 				header.MemoryManagementControlOperation = ue(b.golomb())
-				for header.MemoryManagementControlOperation != 0 {
+				for header.MemoryManagementControlOperation != 0 && b.Err() == nil {
+					if err := checkRange("MemoryManagementControlOperation", header.MemoryManagementControlOperation, 0, 6); err != nil {
+						return nil, err
+					}
 					if header.MemoryManagementControlOperation == 1 || header.MemoryManagementControlOperation == 3 {
 						header.DifferenceOfPicNumsMinus1 = ue(b.golomb())
 					}
@@ -1004,6 +1121,10 @@ func NewSliceContext(videoStream *VideoStream, nalUnit *NalUnit, rbsp []byte, sh
 					if header.MemoryManagementControlOperation == 4 {
 						header.MaxLongTermFrameIdxPlus1 = ue(b.golomb())
 					}
+					if header.MemoryManagementControlOperation == 5 {
+						header.MMCO5 = true
+					}
+					header.MemoryManagementControlOperation = ue(b.golomb())
 				}
 			}
 		} // end decRefPicMarking
@@ -1025,24 +1146,31 @@ func NewSliceContext(videoStream *VideoStream, nalUnit *NalUnit, rbsp []byte, sh
 			header.SliceBetaOffsetDiv2 = se(b.golomb())
 		}
 	}
+	if err := b.Err(); err != nil {
+		return nil, fmt.Errorf("slice header: %w", err)
+	}
+	qpBdOffsetY := 6 * sps.BitDepthLumaMinus8
+	if err := firstError(
+		checkRange("CabacInitIDC", header.CabacInit, 0, 2),
+		checkRange("SliceQPY", SliceQPy(pps, &header), -qpBdOffsetY, 51),
+		checkRange("DisableDeblockingFilterIDC", header.DisableDeblockingFilter, 0, 2),
+		checkRange("SliceAlphaC0OffsetDiv2", header.SliceAlphaC0OffsetDiv2, -6, 6),
+		checkRange("SliceBetaOffsetDiv2", header.SliceBetaOffsetDiv2, -6, 6),
+	); err != nil {
+		return nil, err
+	}
 	if pps.NumSliceGroupsMinus1 > 0 && pps.SliceGroupMapType >= 3 && pps.SliceGroupMapType <= 5 {
 		header.SliceGroupChangeCycle = b.NextField(
 			"SliceGroupChangeCycle",
 			int(math.Ceil(math.Log2(float64(pps.PicSizeInMapUnitsMinus1/pps.SliceGroupChangeRateMinus1+1)))))
 	}
 
-	sliceContext := &SliceContext{
+	return &SliceContext{
 		NalUnit: nalUnit,
 		SPS:     sps,
 		PPS:     pps,
 		Slice: &Slice{
 			Header: &header,
 		},
-	}
-	sliceContext.Slice.Data = NewSliceData(sliceContext, b)
-	if showPacket {
-		debugPacket("debug: Header", sliceContext.Slice.Header)
-		debugPacket("debug: Data", sliceContext.Slice.Data)
-	}
-	return sliceContext
+	}, nil
 }
@@ -0,0 +1,273 @@
+package h264
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// Image formats of snapshots
+const (
+	SNAPSHOT_FORMAT_JPEG = iota
+	SNAPSHOT_FORMAT_PNG
+)
+
+var SnapshotFormat = map[int]string{
+	SNAPSHOT_FORMAT_JPEG: "JPEG",
+	SNAPSHOT_FORMAT_PNG:  "PNG",
+}
+
+var snapshotExtension = map[int]string{
+	SNAPSHOT_FORMAT_JPEG: ".jpg",
+	SNAPSHOT_FORMAT_PNG:  ".png",
+}
+
+// SnapshotMetadata describes a snapshot and the stream it was taken from.
+// With Metadata set a Snapshotter writes it next to each image as JSON.
+type SnapshotMetadata struct {
+	Image string `json:"image"`
+	// PTS is the presentation time of the picture in seconds
+	PTS    float64 `json:"pts"`
+	PTS90k int64   `json:"pts_90k"`
+	IDR    bool    `json:"idr"`
+	// Width and Height are of the image, DisplayWidth and DisplayHeight
+	// of the pictures of the stream after cropping
+	Width         int    `json:"width"`
+	Height        int    `json:"height"`
+	DisplayWidth  int    `json:"display_width"`
+	DisplayHeight int    `json:"display_height"`
+	Profile       string `json:"profile"`
+	Level         string `json:"level"`
+	Codec         string `json:"codec"`
+}
+
+// Snapshotter writes decoded pictures to Dir as still images, named by
+// their presentation time in milliseconds, such as 000000012345.jpg. A
+// picture whose name is taken, as after a timestamp wrap or a restart,
+// gets a suffix such as 000000012345-1.jpg. By default it takes every IDR
+// picture; Every takes every Nth picture instead, and Count stops after
+// that many.
+//
+// Samples are not reconstructed, so images are mid-grey; they carry the
+// size, timing and metadata of the pictures, not their content.
+//
+//	snapshots := NewSnapshotter("/tmp/stills", SNAPSHOT_FORMAT_JPEG)
+//	snapshots.Count = 1
+//	err := NewDecoder(WithFrameHandler(snapshots)).Decode(connection)
+type Snapshotter struct {
+	Dir    string
+	Format int
+	// Quality is the JPEG quality from 1 to 100
+	Quality int
+	// Every takes every Nth picture in decoding order when above zero,
+	// else IDR pictures
+	Every int
+	// Count is the most snapshots written, unlimited when zero
+	Count int
+	// Width and Height scale the images. When one of them is zero it
+	// follows the display aspect ratio, sample aspect ratio included.
+	Width, Height int
+	// Metadata writes a SnapshotMetadata JSON file beside each image
+	Metadata bool
+	Logger   *slog.Logger
+
+	err error
+	// frames counts the pictures seen, written the snapshots written
+	frames, written int
+}
+
+// NewSnapshotter returns a snapshotter of IDR pictures at JPEG quality 90
+func NewSnapshotter(dir string, format int) *Snapshotter {
+	return &Snapshotter{Dir: dir, Format: format, Quality: 90}
+}
+
+func (s *Snapshotter) logger() *slog.Logger {
+	if s.Logger == nil {
+		return discardLogger
+	}
+	return s.Logger
+}
+
+// Err returns the first error writing a snapshot. Once set, frames are
+// ignored.
+func (s *Snapshotter) Err() error {
+	return s.err
+}
+
+// Done is set once Count snapshots are written, so decoding can stop
+func (s *Snapshotter) Done() bool {
+	return s.Count > 0 && s.written >= s.Count
+}
+
+// HandleFrame writes a snapshot of the picture when it is one taken
+func (s *Snapshotter) HandleFrame(frame *Frame) {
+	if s.err != nil || s.Done() {
+		return
+	}
+	s.frames++
+	if s.Every > 0 && (s.frames-1)%s.Every != 0 || s.Every <= 0 && !frame.IDR {
+		return
+	}
+	s.err = s.writeSnapshot(frame)
+}
+
+func (s *Snapshotter) writeSnapshot(frame *Frame) error {
+	var encoded bytes.Buffer
+	width, height, err := s.WriteImage(&encoded, frame)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(s.Dir, fmt.Sprintf("%012d", frame.PTS.Milliseconds()))
+	name, err = writeFileExclusive(name, snapshotExtension[s.Format], encoded.Bytes())
+	if err != nil {
+		return err
+	}
+	imageName := filepath.Base(name) + snapshotExtension[s.Format]
+	s.written++
+	s.logger().Info("wrote snapshot", "name", imageName, "pts", frame.PTS, "width", width, "height", height)
+	if !s.Metadata {
+		return nil
+	}
+	metadata := NewSnapshotMetadata(frame)
+	metadata.Image, metadata.Width, metadata.Height = imageName, width, height
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(name+".json", append(data, '\n'))
+}
+
+// Writes data to the first of name, name-1, name-2 and so on that does not
+// exist with the extension ext, returning the name taken. The file is
+// linked into place whole, so it is never replaced nor seen part written.
+func writeFileExclusive(name, ext string, data []byte) (string, error) {
+	tmp := name + ext + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+	for i := 0; ; i++ {
+		taken := name
+		if i > 0 {
+			taken = fmt.Sprintf("%s-%d", name, i)
+		}
+		err := os.Link(tmp, taken+ext)
+		if err == nil {
+			return taken, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", err
+		}
+	}
+}
+
+// WriteImage converts a picture to RGB, scales it and encodes it to w,
+// returning the size of the image
+func (s *Snapshotter) WriteImage(w io.Writer, frame *Frame) (width, height int, err error) {
+	picture, err := frame.RGBA()
+	if err != nil {
+		return 0, 0, err
+	}
+	width, height = snapshotSize(frame.SPS, picture.Rect.Dx(), picture.Rect.Dy(), s.Width, s.Height)
+	picture = scaleRGBA(picture, width, height)
+	switch s.Format {
+	case SNAPSHOT_FORMAT_JPEG:
+		err = jpeg.Encode(w, picture, &jpeg.Options{Quality: s.Quality})
+	case SNAPSHOT_FORMAT_PNG:
+		err = png.Encode(w, picture)
+	default:
+		err = fmt.Errorf("h264: unknown snapshot format %d", s.Format)
+	}
+	return width, height, err
+}
+
+// NewSnapshotMetadata describes a picture and its SPS, without the image
+func NewSnapshotMetadata(frame *Frame) *SnapshotMetadata {
+	displayWidth, displayHeight := frame.SPS.DisplaySize()
+	return &SnapshotMetadata{
+		PTS:           frame.PTS.Seconds(),
+		PTS90k:        frame.PTS90k,
+		IDR:           frame.IDR,
+		DisplayWidth:  displayWidth,
+		DisplayHeight: displayHeight,
+		Profile:       frame.SPS.ProfileName(),
+		Level:         frame.SPS.LevelName(),
+		Codec:         frame.SPS.Codec(),
+	}
+}
+
+// Returns the size of an image of a picture of width by height samples
+// scaled to targetWidth by targetHeight, either of which follows the
+// display aspect ratio when zero
+func snapshotSize(sps *SPS, width, height, targetWidth, targetHeight int) (int, int) {
+	// The display width of the picture in samples of its height
+	displayWidth := float64(width)
+	if sarWidth, sarHeight := sps.SampleAspectRatio(); sarWidth > 0 && sarHeight > 0 {
+		displayWidth = displayWidth * float64(sarWidth) / float64(sarHeight)
+	}
+	switch {
+	case targetWidth > 0 && targetHeight > 0:
+		return targetWidth, targetHeight
+	case targetWidth > 0:
+		return targetWidth, max(1, int(float64(targetWidth)*float64(height)/displayWidth+0.5))
+	case targetHeight > 0:
+		return max(1, int(float64(targetHeight)*displayWidth/float64(height)+0.5)), targetHeight
+	}
+	return max(1, int(displayWidth+0.5)), height
+}
+
+// Returns img scaled to width by height. Images are halved by averaging
+// 2x2 blocks while twice the size or more, then resampled bilinearly, so
+// downscaling does not alias.
+func scaleRGBA(img *image.RGBA, width, height int) *image.RGBA {
+	for img.Rect.Dx() >= 2*width && img.Rect.Dy() >= 2*height {
+		img = halveRGBA(img)
+	}
+	srcWidth, srcHeight := img.Rect.Dx(), img.Rect.Dy()
+	if srcWidth == width && srcHeight == height {
+		return img
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	// Sample centres map onto sample centres
+	xScale, yScale := float64(srcWidth)/float64(width), float64(srcHeight)/float64(height)
+	for y := 0; y < height; y++ {
+		sy := min(max((float64(y)+0.5)*yScale-0.5, 0), float64(srcHeight-1))
+		y0 := int(sy)
+		y1, fy := min(y0+1, srcHeight-1), sy-float64(y0)
+		for x := 0; x < width; x++ {
+			sx := min(max((float64(x)+0.5)*xScale-0.5, 0), float64(srcWidth-1))
+			x0 := int(sx)
+			x1, fx := min(x0+1, srcWidth-1), sx-float64(x0)
+			out := scaled.Pix[y*scaled.Stride+4*x:]
+			for c := 0; c < 4; c++ {
+				top := float64(img.Pix[y0*img.Stride+4*x0+c])*(1-fx) + float64(img.Pix[y0*img.Stride+4*x1+c])*fx
+				bottom := float64(img.Pix[y1*img.Stride+4*x0+c])*(1-fx) + float64(img.Pix[y1*img.Stride+4*x1+c])*fx
+				out[c] = byte(top*(1-fy) + bottom*fy + 0.5)
+			}
+		}
+	}
+	return scaled
+}
+
+// Returns img at half its size, each sample the average of a 2x2 block
+func halveRGBA(img *image.RGBA) *image.RGBA {
+	half := image.NewRGBA(image.Rect(0, 0, img.Rect.Dx()/2, img.Rect.Dy()/2))
+	for y := 0; y < half.Rect.Dy(); y++ {
+		top, bottom := img.Pix[2*y*img.Stride:], img.Pix[(2*y+1)*img.Stride:]
+		out := half.Pix[y*half.Stride:]
+		for i := 0; i < 4*half.Rect.Dx(); i++ {
+			j := i/4*8 + i%4
+			out[i] = byte((int(top[j]) + int(top[j+4]) + int(bottom[j]) + int(bottom[j+4]) + 2) / 4)
+		}
+	}
+	return half
+}
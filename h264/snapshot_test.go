@@ -0,0 +1,156 @@
+package h264
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotter(t *testing.T) {
+	sps := colourSPS(MATRIX_BT709, true)
+	sps.Profile, sps.Level = PROFILE_IDC_HIGH, 40
+	dir := t.TempDir()
+	s := NewSnapshotter(dir, SNAPSHOT_FORMAT_PNG)
+	s.Count, s.Width, s.Metadata = 2, 8, true
+	for i := 0; i < 6; i++ {
+		frame := rgbTestFrame(sps, 1, 8, uint16(20*i), 128, 128)
+		frame.IDR = i%2 == 1
+		frame.PTS = time.Duration(i) * 40 * time.Millisecond
+		s.HandleFrame(frame)
+	}
+	if err := s.Err(); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if !s.Done() {
+		t.Fatalf("expected the snapshotter to be done\n")
+	}
+	names, _ := filepath.Glob(filepath.Join(dir, "*"))
+	for i := range names {
+		names[i] = filepath.Base(names[i])
+	}
+	if fmt.Sprint(names) != "[000000000040.json 000000000040.png 000000000120.json 000000000120.png]" {
+		t.Fatalf("unexpected files %v\n", names)
+	}
+
+	file, err := os.Open(filepath.Join(dir, "000000000120.png"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	defer file.Close()
+	img, err := png.Decode(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if r, _, _, _ := img.At(3, 3).RGBA(); img.Bounds() != image.Rect(0, 0, 8, 8) || r>>8 != 60 {
+		t.Fatalf("unexpected image %v of red %d\n", img.Bounds(), r>>8)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "000000000120.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	var metadata SnapshotMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	expected := SnapshotMetadata{Image: "000000000120.png", PTS: 0.12, IDR: true, Width: 8, Height: 8,
+		DisplayWidth: 16, DisplayHeight: 16, Profile: "High", Level: "4", Codec: "avc1.640028"}
+	if metadata != expected {
+		t.Fatalf("unexpected metadata %+v\n", metadata)
+	}
+}
+
+func TestSnapshotterEvery(t *testing.T) {
+	s := NewSnapshotter(t.TempDir(), SNAPSHOT_FORMAT_JPEG)
+	s.Every = 3
+	sps := colourSPS(MATRIX_BT709, false)
+	for i := 0; i < 7; i++ {
+		frame := rgbTestFrame(sps, 1, 8, 100, 128, 128)
+		frame.PTS = time.Duration(i) * time.Second
+		s.HandleFrame(frame)
+	}
+	if s.Err() != nil || s.written != 3 {
+		t.Fatalf("expected 3 snapshots, got %d and %v\n", s.written, s.Err())
+	}
+}
+
+func TestSnapshotterSamePTS(t *testing.T) {
+	// Pictures of the same presentation time, as after a restart, keep
+	// their own files
+	dir := t.TempDir()
+	sps := colourSPS(MATRIX_BT709, false)
+	for run := 0; run < 2; run++ {
+		s := NewSnapshotter(dir, SNAPSHOT_FORMAT_PNG)
+		s.Metadata = true
+		for i := 0; i < 2; i++ {
+			frame := rgbTestFrame(sps, 1, 8, 100, 128, 128)
+			frame.IDR, frame.PTS = true, time.Second
+			s.HandleFrame(frame)
+		}
+		if err := s.Err(); err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+	}
+	names, _ := filepath.Glob(filepath.Join(dir, "*.png"))
+	for i := range names {
+		names[i] = filepath.Base(names[i])
+	}
+	if fmt.Sprint(names) != "[000000001000-1.png 000000001000-2.png 000000001000-3.png 000000001000.png]" {
+		t.Fatalf("unexpected files %v\n", names)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "000000001000-2.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	var metadata SnapshotMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil || metadata.Image != "000000001000-2.png" {
+		t.Fatalf("unexpected metadata %+v %v\n", metadata, err)
+	}
+}
+
+func TestSnapshotSize(t *testing.T) {
+	square := &SPS{}
+	// 720x576 with 16:11 samples is 1047 square samples wide
+	wide := &SPS{AspectRatioInfoPresent: true, AspectRatio: 4}
+	for _, test := range []struct {
+		sps                             *SPS
+		width, height, targetW, targetH int
+		expected                        string
+	}{
+		{square, 1920, 1080, 0, 0, "[1920 1080]"},
+		{square, 1920, 1080, 640, 0, "[640 360]"},
+		{square, 1920, 1080, 0, 270, "[480 270]"},
+		{square, 1920, 1080, 100, 100, "[100 100]"},
+		{wide, 720, 576, 0, 0, "[1047 576]"},
+		{wide, 720, 576, 0, 288, "[524 288]"},
+	} {
+		width, height := snapshotSize(test.sps, test.width, test.height, test.targetW, test.targetH)
+		if got := fmt.Sprint([]int{width, height}); got != test.expected {
+			t.Fatalf("expected %s, got %s\n", test.expected, got)
+		}
+	}
+}
+
+func TestScaleRGBA(t *testing.T) {
+	// Alternating black and white columns average to grey
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for i := range img.Pix {
+		if i/4%2 == 1 {
+			img.Pix[i] = 0xff
+		}
+	}
+	scaled := scaleRGBA(img, 3, 2)
+	if scaled.Rect != image.Rect(0, 0, 3, 2) {
+		t.Fatalf("unexpected size %v\n", scaled.Rect)
+	}
+	for i, v := range scaled.Pix {
+		if v < 126 || v > 129 {
+			t.Fatalf("byte %d: expected grey, got %d\n", i, v)
+		}
+	}
+}
@@ -1,7 +1,26 @@
 package h264
 
-import "fmt"
-import "strings"
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+)
+
+// HRDParameters is the hrd_parameters of the VUI, E.1.2. The slices are
+// indexed by SchedSelIdx.
+type HRDParameters struct {
+	CpbCntMinus1                       int
+	BitRateScale                       int
+	CpbSizeScale                       int
+	BitRateValueMinus1                 []int
+	CpbSizeValueMinus1                 []int
+	Cbr                                []bool
+	InitialCpbRemovalDelayLengthMinus1 int
+	CpbRemovalDelayLengthMinus1        int
+	DpbOutputDelayLengthMinus1         int
+	TimeOffsetLength                   int
+}
 
 // Specification Page 43 7.3.2.1.1
 // Range is always inclusive
@@ -47,59 +66,142 @@ type SPS struct {
 	// Page 77
 	PicWidthInMbsMinus1 int
 	// Page 77
-	PicHeightInMapUnitsMinus1          int
-	FrameMbsOnly                       bool
-	MBAdaptiveFrameField               bool
-	Direct8x8Inference                 bool
-	FrameCropping                      bool
-	FrameCropLeftOffset                int
-	FrameCropRightOffset               int
-	FrameCropTopOffset                 int
-	FrameCropBottomOffset              int
-	VuiParametersPresent               bool
-	VuiParameters                      []int
-	AspectRatioInfoPresent             bool
-	AspectRatio                        int
-	SarWidth                           int
-	SarHeight                          int
-	OverscanInfoPresent                bool
-	OverscanAppropriate                bool
-	VideoSignalTypePresent             bool
-	VideoFormat                        int
-	VideoFullRange                     bool
-	ColorDescriptionPresent            bool
-	ColorPrimaries                     int
-	TransferCharacteristics            int
-	MatrixCoefficients                 int
-	ChromaLocInfoPresent               bool
-	ChromaSampleLocTypeTopField        int
-	ChromaSampleLocTypeBottomField     int
-	CpbCntMinus1                       int
-	BitRateScale                       int
-	CpbSizeScale                       int
-	BitRateValueMinus1                 []int
-	Cbr                                []bool
-	InitialCpbRemovalDelayLengthMinus1 int
-	CpbRemovalDelayLengthMinus1        int
-	CpbSizeValueMinus1                 []int
-	DpbOutputDelayLengthMinus1         int
-	TimeOffsetLength                   int
-	TimingInfoPresent                  bool
-	NumUnitsInTick                     int
-	TimeScale                          int
-	NalHrdParametersPresent            bool
-	FixedFrameRate                     bool
-	VclHrdParametersPresent            bool
-	LowHrdDelay                        bool
-	PicStructPresent                   bool
-	BitstreamRestriction               bool
-	MotionVectorsOverPicBoundaries     bool
-	MaxBytesPerPicDenom                int
-	MaxBitsPerMbDenom                  int
-	Log2MaxMvLengthHorizontal          int
-	Log2MaxMvLengthVertical            int
-	MaxDecFrameBuffering               int
-	MaxNumReorderFrames                int
+	PicHeightInMapUnitsMinus1      int
+	FrameMbsOnly                   bool
+	MBAdaptiveFrameField           bool
+	Direct8x8Inference             bool
+	FrameCropping                  bool
+	FrameCropLeftOffset            int
+	FrameCropRightOffset           int
+	FrameCropTopOffset             int
+	FrameCropBottomOffset          int
+	VuiParametersPresent           bool
+	VuiParameters                  []int
+	AspectRatioInfoPresent         bool
+	AspectRatio                    int
+	SarWidth                       int
+	SarHeight                      int
+	OverscanInfoPresent            bool
+	OverscanAppropriate            bool
+	VideoSignalTypePresent         bool
+	VideoFormat                    int
+	VideoFullRange                 bool
+	ColorDescriptionPresent        bool
+	ColorPrimaries                 int
+	TransferCharacteristics        int
+	MatrixCoefficients             int
+	ChromaLocInfoPresent           bool
+	ChromaSampleLocTypeTopField    int
+	ChromaSampleLocTypeBottomField int
+	// HRDParameters are those of the NAL HRD, or of the VCL HRD when it is
+	// the only one. VclHrd holds the VCL HRD whenever it is present.
+	HRDParameters
+	VclHrd                         HRDParameters
+	TimingInfoPresent              bool
+	NumUnitsInTick                 int
+	TimeScale                      int
+	NalHrdParametersPresent        bool
+	FixedFrameRate                 bool
+	VclHrdParametersPresent        bool
+	LowHrdDelay                    bool
+	PicStructPresent               bool
+	BitstreamRestriction           bool
+	MotionVectorsOverPicBoundaries bool
+	MaxBytesPerPicDenom            int
+	MaxBitsPerMbDenom              int
+	Log2MaxMvLengthHorizontal      int
+	Log2MaxMvLengthVertical        int
+	MaxDecFrameBuffering           int
+	MaxNumReorderFrames            int
+	rbsp                           []byte
+	// refIdc is the nal_ref_idc of the NAL unit carrying the SPS, 0 when
+	// it was parsed from the RBSP alone
+	refIdc int
+}
+
+// Profiles whose SPS carries chroma_format_idc and the bit depths, 7.3.2.1.1
+var chromaFormatProfiles = []int{100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135}
+
+// RBSP is the seq_parameter_set_rbsp the SPS was parsed from
+func (sps *SPS) RBSP() []byte {
+	return sps.rbsp
+}
+
+// DisplaySize is the size of the decoded frame after the SPS frame
+// cropping, 7.4.2.1.1
+func (sps *SPS) DisplaySize() (width, height int) {
+	left, right, top, bottom := sps.cropping()
+	return PicWidthInMbs(sps)*16 - left - right, FrameHeightInMbs(sps)*16 - top - bottom
+}
+
+// Returns the frame cropping offsets in luma samples of a frame,
+// 7.4.2.1.1
+func (sps *SPS) cropping() (left, right, top, bottom int) {
+	if !sps.FrameCropping {
+		return 0, 0, 0, 0
+	}
+	cropUnitX, cropUnitY := 1, 2-flagVal(sps.FrameMbsOnly)
+	if sps.ChromaFormat != 0 && !sps.UseSeparateColorPlane {
+		cropUnitX = SubWidthC(sps)
+		cropUnitY *= SubHeightC(sps)
+	}
+	return cropUnitX * sps.FrameCropLeftOffset, cropUnitX * sps.FrameCropRightOffset,
+		cropUnitY * sps.FrameCropTopOffset, cropUnitY * sps.FrameCropBottomOffset
+}
+
+// Sample aspect ratios of aspect_ratio_idc 1 to 16, Table E-1
+var sampleAspectRatios = [][2]int{
+	{1, 1}, {12, 11}, {10, 11}, {16, 11}, {40, 33}, {24, 11}, {20, 11}, {32, 11},
+	{80, 33}, {18, 11}, {15, 11}, {64, 33}, {160, 99}, {4, 3}, {3, 2}, {2, 1},
+}
+
+// SampleAspectRatio is the sample aspect ratio of the VUI, Table E-1, or
+// 0:0 when it is unspecified
+func (sps *SPS) SampleAspectRatio() (width, height int) {
+	switch {
+	case !sps.AspectRatioInfoPresent:
+		return 0, 0
+	case sps.AspectRatio == 255:
+		// Extended_SAR
+		return sps.SarWidth, sps.SarHeight
+	case sps.AspectRatio >= 1 && sps.AspectRatio <= len(sampleAspectRatios):
+		return sampleAspectRatios[sps.AspectRatio-1][0], sampleAspectRatios[sps.AspectRatio-1][1]
+	}
+	return 0, 0
+}
+
+// Codec is the RFC 6381 codecs parameter of the stream, as used by HLS
+// and DASH manifests, such as avc1.42001e
+func (sps *SPS) Codec() string {
+	constraints := sps.Constraint0<<7 | sps.Constraint1<<6 | sps.Constraint2<<5 |
+		sps.Constraint3<<4 | sps.Constraint4<<3 | sps.Constraint5<<2
+	return fmt.Sprintf("avc1.%02x%02x%02x", sps.Profile, constraints, sps.Level)
+}
+
+// ProfileName names profile_idc as Annex A does, telling Constrained
+// Baseline apart by constraint_set1_flag, A.2.1.1
+func (sps *SPS) ProfileName() string {
+	if sps.Profile == PROFILE_IDC_BASELINE && sps.Constraint1 == 1 {
+		return "Constrained Baseline"
+	}
+	if name, ok := ProfileIDC[sps.Profile]; ok {
+		return name
+	}
+	return fmt.Sprintf("profile %d", sps.Profile)
+}
+
+// LevelName names level_idc as Table A-1 does, such as 3.1. Level 1b is
+// level_idc 11 with constraint_set3_flag in the Baseline, Main and
+// Extended profiles, or level_idc 9, A.3.1 and A.3.3.
+func (sps *SPS) LevelName() string {
+	level1b := isInList([]int{PROFILE_IDC_BASELINE, PROFILE_IDC_MAIN, PROFILE_IDC_EXTENDED}, sps.Profile)
+	if sps.Level == 9 || sps.Level == 11 && sps.Constraint3 == 1 && level1b {
+		return "1b"
+	}
+	if sps.Level%10 == 0 {
+		return fmt.Sprint(sps.Level / 10)
+	}
+	return fmt.Sprintf("%d.%d", sps.Level/10, sps.Level%10)
 }
 
 var (
@@ -163,11 +265,14 @@ func isInList(l []int, term int) bool {
 	}
 	return false
 }
-func debugPacket(name string, packet interface{}) {
-	logger.Printf("debug: %s packet\n", name)
-	for _, line := range strings.Split(fmt.Sprintf("%+v", packet), " ") {
-		logger.Printf("debug: \t%#v\n", line)
+
+// Logs every field of packet at debug level
+func debugPacket(b *BitReader, name string, packet interface{}) {
+	if !b.logEnabled(slog.LevelDebug) {
+		return
 	}
+	fields := strings.Split(strings.Trim(fmt.Sprintf("%+v", packet), "&{}"), " ")
+	b.logger().Debug("packet", "name", name, "fields", fields)
 }
 func scalingList(b *BitReader, scalingList []int, sizeOfScalingList int, defaultScalingMatrix []int) {
 	lastScale := 8
@@ -189,30 +294,42 @@ func scalingList(b *BitReader, scalingList []int, sizeOfScalingList int, default
 		lastScale = scalingList[i]
 	}
 }
-func NewSPS(rbsp []byte, showPacket bool) *SPS {
-	logger.Printf("debug: SPS RBSP %d bytes %d bits\n", len(rbsp), len(rbsp)*8)
-	logger.Printf("debug: \t%#v\n", rbsp[0:8])
-	sps := SPS{}
-	b := &BitReader{bytes: rbsp}
-	hrdParameters := func() {
-		sps.CpbCntMinus1 = ue(b.golomb())
-		sps.BitRateScale = b.NextField("BitRateScale", 4)
-		sps.CpbSizeScale = b.NextField("CPBSizeScale", 4)
+func NewSPS(rbsp []byte, showPacket bool) (*SPS, error) {
+	return parseSPS(&BitReader{bytes: rbsp}, showPacket)
+}
+
+// Parses the seq_parameter_set_rbsp held by b
+func parseSPS(b *BitReader, showPacket bool) (*SPS, error) {
+	rbsp := b.Bytes()
+	b.logger().Debug("SPS RBSP", "bytes", len(rbsp), "head", headBytes(rbsp, 8))
+	// profile_idc, constraint flags, level_idc and one ue(v)
+	if len(rbsp) < 4 {
+		return nil, fmt.Errorf("SPS: %w: %d bytes", ErrTruncated, len(rbsp))
+	}
+	sps := SPS{rbsp: rbsp}
+	// E.1.2
+	hrdParameters := func(hrd *HRDParameters) error {
+		hrd.CpbCntMinus1 = ue(b.golomb())
+		if err := checkRange("CpbCntMinus1", hrd.CpbCntMinus1, 0, 31); err != nil {
+			return err
+		}
+		hrd.BitRateScale = b.NextField("BitRateScale", 4)
+		hrd.CpbSizeScale = b.NextField("CPBSizeScale", 4)
 		// SchedSelIdx E1.2
-		for sseli := 0; sseli <= sps.CpbCntMinus1; sseli++ {
-			sps.BitRateValueMinus1 = append(sps.BitRateValueMinus1, ue(b.golomb()))
-			sps.CpbSizeValueMinus1 = append(sps.CpbSizeValueMinus1, ue(b.golomb()))
+		for sseli := 0; sseli <= hrd.CpbCntMinus1; sseli++ {
+			hrd.BitRateValueMinus1 = append(hrd.BitRateValueMinus1, ue(b.golomb()))
+			hrd.CpbSizeValueMinus1 = append(hrd.CpbSizeValueMinus1, ue(b.golomb()))
 			if v := b.NextField(fmt.Sprintf("CBR[%d]", sseli), 1); v == 1 {
-				sps.Cbr = append(sps.Cbr, true)
+				hrd.Cbr = append(hrd.Cbr, true)
 			} else {
-				sps.Cbr = append(sps.Cbr, false)
+				hrd.Cbr = append(hrd.Cbr, false)
 			}
-
-			sps.InitialCpbRemovalDelayLengthMinus1 = b.NextField("InitialCpbRemovalDelayLengthMinus1", 5)
-			sps.CpbRemovalDelayLengthMinus1 = b.NextField("CpbRemovalDelayLengthMinus1", 5)
-			sps.DpbOutputDelayLengthMinus1 = b.NextField("DpbOutputDelayLengthMinus1", 5)
-			sps.TimeOffsetLength = b.NextField("TimeOffsetLength", 5)
 		}
+		hrd.InitialCpbRemovalDelayLengthMinus1 = b.NextField("InitialCpbRemovalDelayLengthMinus1", 5)
+		hrd.CpbRemovalDelayLengthMinus1 = b.NextField("CpbRemovalDelayLengthMinus1", 5)
+		hrd.DpbOutputDelayLengthMinus1 = b.NextField("DpbOutputDelayLengthMinus1", 5)
+		hrd.TimeOffsetLength = b.NextField("TimeOffsetLength", 5)
+		return b.Err()
 	}
 	sps.Profile = b.NextField("ProfileIDC", 8)
 	sps.Constraint0 = b.NextField("Constraint0", 1)
@@ -225,11 +342,17 @@ func NewSPS(rbsp []byte, showPacket bool) *SPS {
 	sps.Level = b.NextField("LevelIDC", 8)
 	// sps.ID = b.NextField("SPSID", 6) // proper
 	sps.ID = ue(b.golomb())
-	sps.ChromaFormat = ue(b.golomb())
-	// This should be done only for certain ProfileIDC:
-	isProfileIDC := []int{100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135}
+	if !isInList(chromaFormatProfiles, sps.Profile) && !isInList([]int{PROFILE_IDC_BASELINE, PROFILE_IDC_MAIN, PROFILE_IDC_EXTENDED}, sps.Profile) {
+		return nil, fmt.Errorf("%w: profile_idc %d", ErrUnsupportedProfile, sps.Profile)
+	}
+	// 7.4.2.1.1 chroma_format_idc is inferred to be 1 when not present
+	sps.ChromaFormat = 1
 	// SpecialProfileCase1
-	if isInList(isProfileIDC, sps.Profile) {
+	if isInList(chromaFormatProfiles, sps.Profile) {
+		sps.ChromaFormat = ue(b.golomb())
+		if err := checkRange("ChromaFormatIDC", sps.ChromaFormat, 0, 3); err != nil {
+			return nil, err
+		}
 		if sps.ChromaFormat == 3 {
 			if v := b.NextField("SeperateColorPlaneFlag", 1); v == 1 {
 				sps.UseSeparateColorPlane = true
@@ -255,7 +378,7 @@ func NewSPS(rbsp []byte, showPacket bool) *SPS {
 			if sps.ChromaFormat != 3 {
 				max = 8
 			}
-			logger.Printf("debug: \tbuilding Scaling matrix for %d elements\n", max)
+			b.logger().Debug("building scaling matrix", "elements", max)
 			for i := 0; i < max; i++ {
 				if v := b.NextField(fmt.Sprintf("SeqScalingListPresentFlag[%d]", i), 1); v == 1 {
 					sps.SeqScalingList = append(sps.SeqScalingList, true)
@@ -299,6 +422,9 @@ func NewSPS(rbsp []byte, showPacket bool) *SPS {
 		sps.OffsetForNonRefPic = se(b.golomb())
 		sps.OffsetForTopToBottomField = se(b.golomb())
 		sps.NumRefFramesInPicOrderCntCycle = ue(b.golomb())
+		if err := checkRange("NumRefFramesInPicOrderCntCycle", sps.NumRefFramesInPicOrderCntCycle, 0, 255); err != nil {
+			return nil, err
+		}
 
 		for i := 0; i < sps.NumRefFramesInPicOrderCntCycle; i++ {
 			sps.OffsetForRefFrameList = append(
@@ -343,7 +469,7 @@ func NewSPS(rbsp []byte, showPacket bool) *SPS {
 		}
 		if sps.AspectRatioInfoPresent {
 			sps.AspectRatio = b.NextField("AspectRatioIDC", 8)
-			EXTENDED_SAR := 999
+			EXTENDED_SAR := 255
 			if sps.AspectRatio == EXTENDED_SAR {
 				sps.SarWidth = b.NextField("SARWidth", 16)
 				sps.SarHeight = b.NextField("SARHeight", 16)
@@ -398,13 +524,20 @@ func NewSPS(rbsp []byte, showPacket bool) *SPS {
 			sps.NalHrdParametersPresent = true
 		}
 		if sps.NalHrdParametersPresent {
-			hrdParameters()
+			if err := hrdParameters(&sps.HRDParameters); err != nil {
+				return nil, fmt.Errorf("SPS NAL HRD: %w", err)
+			}
 		}
 		if v := b.NextField("VCLHRDParametersPresent", 1); v == 1 {
 			sps.VclHrdParametersPresent = true
 		}
 		if sps.VclHrdParametersPresent {
-			hrdParameters()
+			if err := hrdParameters(&sps.VclHrd); err != nil {
+				return nil, fmt.Errorf("SPS VCL HRD: %w", err)
+			}
+			if !sps.NalHrdParametersPresent {
+				sps.HRDParameters = sps.VclHrd
+			}
 		}
 		if sps.NalHrdParametersPresent || sps.VclHrdParametersPresent {
 			if v := b.NextField("LowHRDDelayFlag", 1); v == 1 {
@@ -430,8 +563,89 @@ func NewSPS(rbsp []byte, showPacket bool) *SPS {
 		}
 
 	} // End VuiParameters Annex E.1.1
+	if err := b.Err(); err != nil {
+		return nil, fmt.Errorf("SPS: %w", err)
+	}
+	if err := sps.validate(); err != nil {
+		return nil, err
+	}
 	if showPacket {
-		debugPacket("SPS", sps)
+		debugPacket(b, "SPS", sps)
+	}
+	return &sps, nil
+}
+
+// 7.4.2.1.1 and E.2.1 semantic limits
+func (sps *SPS) validate() error {
+	err := firstError(
+		checkRange("SPSID", sps.ID, 0, 31),
+		checkRange("BitDepthLumaMinus8", sps.BitDepthLumaMinus8, 0, 6),
+		checkRange("BitDepthChromaMinus8", sps.BitDepthChromaMinus8, 0, 6),
+		checkRange("Log2MaxFrameNumMinus4", sps.Log2MaxFrameNumMinus4, 0, 12),
+		checkRange("PicOrderCntType", sps.PicOrderCountType, 0, 2),
+		checkRange("Log2MaxPicOrderCntLsbMinus4", sps.Log2MaxPicOrderCntLSBMin4, 0, 12),
+		// MaxDpbFrames is at most 16 for every level
+		checkRange("MaxNumRefFrames", sps.MaxNumRefFrames, 0, 16),
+		checkRange("ChromaSampleLocTypeTopField", sps.ChromaSampleLocTypeTopField, 0, 5),
+		checkRange("ChromaSampleLocTypeBottomField", sps.ChromaSampleLocTypeBottomField, 0, 5),
+		checkRange("MaxBytesPerPicDenom", sps.MaxBytesPerPicDenom, 0, 16),
+		checkRange("MaxBitsPerMbDenom", sps.MaxBitsPerMbDenom, 0, 16),
+		checkRange("Log2MaxMvLengthHorizontal", sps.Log2MaxMvLengthHorizontal, 0, 16),
+		checkRange("Log2MaxMvLengthVertical", sps.Log2MaxMvLengthVertical, 0, 16),
+		checkRange("MaxDecFrameBuffering", sps.MaxDecFrameBuffering, 0, 16),
+		checkRange("MaxNumReorderFrames", sps.MaxNumReorderFrames, 0, sps.MaxDecFrameBuffering),
+	)
+	if err != nil {
+		return err
+	}
+	if sps.TimingInfoPresent {
+		// Both are read as 32 bits, so only zero is out of range
+		if err := firstError(
+			checkRange("NumUnitsInTick", sps.NumUnitsInTick, 1, math.MaxInt),
+			checkRange("TimeScale", sps.TimeScale, 1, math.MaxInt),
+		); err != nil {
+			return err
+		}
+	}
+	if sps.FrameCropping {
+		// 7-19 to 7-22: the crop window must not be empty
+		cropUnitX, cropUnitY := 1, 2-flagVal(sps.FrameMbsOnly)
+		if sps.ChromaFormat != 0 && !sps.UseSeparateColorPlane {
+			cropUnitX = SubWidthC(sps)
+			cropUnitY *= SubHeightC(sps)
+		}
+		width := PicWidthInMbs(sps) * 16
+		height := FrameHeightInMbs(sps) * 16
+		if err := firstError(
+			checkRange("FrameCropLeftOffset+FrameCropRightOffset", cropUnitX*(sps.FrameCropLeftOffset+sps.FrameCropRightOffset), 0, width-1),
+			checkRange("FrameCropTopOffset+FrameCropBottomOffset", cropUnitY*(sps.FrameCropTopOffset+sps.FrameCropBottomOffset), 0, height-1),
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reports whether b can replace a without starting a new coded video
+// sequence: same id, picture size, sampling and frame numbering
+func sameSequence(a, b *SPS) bool {
+	return a.ID == b.ID &&
+		a.Profile == b.Profile &&
+		PicWidthInMbs(a) == PicWidthInMbs(b) &&
+		FrameHeightInMbs(a) == FrameHeightInMbs(b) &&
+		a.FrameMbsOnly == b.FrameMbsOnly &&
+		a.ChromaFormat == b.ChromaFormat &&
+		a.BitDepthLumaMinus8 == b.BitDepthLumaMinus8 &&
+		a.BitDepthChromaMinus8 == b.BitDepthChromaMinus8 &&
+		a.Log2MaxFrameNumMinus4 == b.Log2MaxFrameNumMinus4 &&
+		a.PicOrderCountType == b.PicOrderCountType &&
+		a.Log2MaxPicOrderCntLSBMin4 == b.Log2MaxPicOrderCntLSBMin4
+}
+
+// Returns up to n leading bytes of buf for logging
+func headBytes(buf []byte, n int) []byte {
+	if len(buf) < n {
+		return buf
 	}
-	return &sps
+	return buf[:n]
 }
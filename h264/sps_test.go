@@ -0,0 +1,101 @@
+package h264
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Packs a string of 0 and 1 into bytes, ignoring spaces and zero padding
+// the final byte
+func bitsToBytes(bits string) []byte {
+	bits = strings.Replace(bits, " ", "", -1)
+	buf := make([]byte, (len(bits)+7)/8)
+	for i, c := range bits {
+		if c == '1' {
+			buf[i/8] |= 1 << uint(7-i%8)
+		}
+	}
+	return buf
+}
+
+// Baseline, level 3.0, 320x240
+const baselineSPSBits = "01000010 00000000 00011110" +
+	" 1 1 1 011 010 0" +
+	" 000010100 0001111" +
+	" 1 1 0 0 1"
+
+func TestNewSPS(t *testing.T) {
+	sps, err := NewSPS(bitsToBytes(baselineSPSBits), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if sps.Profile != PROFILE_IDC_BASELINE || sps.Level != 30 {
+		t.Fatalf("expected profile 66 level 30, got %d %d\n", sps.Profile, sps.Level)
+	}
+	if sps.ChromaFormat != 1 {
+		t.Fatalf("expected inferred chroma format 1, got %d\n", sps.ChromaFormat)
+	}
+	if w, h := PicWidthInMbs(sps)*16, FrameHeightInMbs(sps)*16; w != 320 || h != 240 {
+		t.Fatalf("expected 320x240, got %dx%d\n", w, h)
+	}
+}
+
+func TestNewSPSTruncated(t *testing.T) {
+	rbsp := bitsToBytes(baselineSPSBits)
+	if _, err := NewSPS(rbsp[:5], false); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("expected ErrTruncated, got %v\n", err)
+	}
+	if _, err := NewSPS(rbsp[:2], false); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("expected ErrTruncated, got %v\n", err)
+	}
+}
+
+func TestNewSPSUnsupportedProfile(t *testing.T) {
+	rbsp := bitsToBytes(baselineSPSBits)
+	rbsp[0] = 1
+	if _, err := NewSPS(rbsp, false); !errors.Is(err, ErrUnsupportedProfile) {
+		t.Fatalf("expected ErrUnsupportedProfile, got %v\n", err)
+	}
+}
+
+func TestNewSPSInvalidValue(t *testing.T) {
+	// seq_parameter_set_id of 40
+	rbsp := bitsToBytes("01000010 00000000 00011110 00000101001 1 1 011 010 0 000010100 0001111 1 1 0 0 1")
+	_, err := NewSPS(rbsp, false)
+	var invalid ErrInvalidValue
+	if !errors.As(err, &invalid) {
+		t.Fatalf("expected ErrInvalidValue, got %v\n", err)
+	}
+	if invalid.Field != "SPSID" || invalid.Value != 40 || invalid.Range != [2]int{0, 31} {
+		t.Fatalf("unexpected error %+v\n", invalid)
+	}
+}
+
+func TestSe(t *testing.T) {
+	// codeNum 0..4 map to 0, 1, -1, 2, -2
+	for bits, want := range map[string]int{"1": 0, "010": 1, "011": -1, "00100": 2, "00101": -2} {
+		b := &BitReader{bytes: bitsToBytes(bits)}
+		if v := se(b.golomb()); v != want {
+			t.Fatalf("se(%s) = %d, expected %d\n", bits, v, want)
+		}
+	}
+}
+
+func TestProfileAndLevelNames(t *testing.T) {
+	for _, test := range []struct {
+		sps            *SPS
+		profile, level string
+	}{
+		{&SPS{Profile: PROFILE_IDC_BASELINE, Constraint1: 1, Level: 30}, "Constrained Baseline", "3"},
+		{&SPS{Profile: PROFILE_IDC_MAIN, Constraint3: 1, Level: 11}, "Main", "1b"},
+		{&SPS{Profile: PROFILE_IDC_HIGH, Constraint3: 1, Level: 11}, "High", "1.1"},
+		{&SPS{Profile: 118, Level: 41}, "profile 118", "4.1"},
+		// CAVLC 4:4:4 Intra sits below High in profile_idc
+		{&SPS{Profile: 44, Constraint3: 1, Level: 11}, "profile 44", "1.1"},
+	} {
+		if profile, level := test.sps.ProfileName(), test.sps.LevelName(); profile != test.profile || level != test.level {
+			t.Fatalf("expected %s %s, got %s %s\n", test.profile, test.level, profile, level)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package h264
+
+import (
+	"time"
+)
+
+// FrameRate is the frame rate signalled by the VUI timing info, or 0 when
+// the SPS has none. Per E.2.1 a clock tick is the duration of a field, so
+// a frame lasts two ticks whether the stream is frame or field coded.
+func (sps *SPS) FrameRate() float64 {
+	if !sps.TimingInfoPresent || sps.NumUnitsInTick == 0 {
+		return 0
+	}
+	return float64(sps.TimeScale) / float64(2*sps.NumUnitsInTick)
+}
+
+// Duration of one clock tick, 0 without timing info
+func (sps *SPS) tick() time.Duration {
+	if !sps.TimingInfoPresent || sps.TimeScale == 0 {
+		return 0
+	}
+	return time.Duration(int64(sps.NumUnitsInTick) * int64(time.Second) / int64(sps.TimeScale))
+}
+
+// Converts a timestamp to the 90 kHz clock of MPEG systems
+func ticks90kHz(d time.Duration) int64 {
+	// In two parts so that a day of 90 kHz ticks does not overflow
+	return int64(d/time.Second)*90000 + int64(d%time.Second)*90000/int64(time.Second)
+}
+
+// Clocks a picture's timestamps can come from
+const (
+	timestampsFromHRD = iota + 1
+	timestampsFromVUI
+	timestampsFromArrival
+)
+
+// timestampState assigns decoding and presentation times to pictures in
+// decoding order. Whichever clock a picture is stamped from, times carry
+// on from the pictures before it.
+type timestampState struct {
+	started bool
+	// source is the clock of the last picture stamped, lastDTS and
+	// lastArrival its decoding and arrival times
+	source      int
+	lastDTS     time.Duration
+	lastArrival time.Time
+	// hrdOffset moves HRD times onto the timeline of the stream
+	hrdOffset time.Duration
+	nextDTS   time.Duration
+	// anchor is the presentation time of PicOrderCnt anchorPOC, the
+	// first picture since the last IDR picture or
+	// memory_management_control_operation 5
+	anchor    time.Duration
+	anchorPOC int
+	// pocStep is the PicOrderCnt difference of consecutive frames, 2
+	// until frames one apart are seen
+	pocStep      int
+	lastFramePOC int
+	framePOCSeen bool
+}
+
+// Sets the PTS and DTS of frame. HRD times from pic timing SEI are used
+// when present, otherwise the VUI frame duration for each frame's step of
+// PicOrderCnt, otherwise the arrival time of the picture.
+func (t *timestampState) stamp(frame *Frame, arrival time.Time) {
+	tick := frame.SPS.tick()
+	source := timestampsFromArrival
+	switch {
+	case frame.Timing != nil && frame.Timing.HRDTimes:
+		source = timestampsFromHRD
+	case tick > 0:
+		source = timestampsFromVUI
+	}
+	// The time from the last picture when changing clocks
+	gap := arrival.Sub(t.lastArrival)
+	if tick > 0 {
+		gap = 2 * tick
+	}
+	switching := t.started && source != t.source
+
+	switch source {
+	case timestampsFromHRD:
+		if !t.started {
+			t.hrdOffset = 0
+		} else if switching {
+			t.hrdOffset = t.lastDTS + gap - frame.Timing.CpbRemovalTime
+		}
+		frame.DTS = frame.Timing.CpbRemovalTime + t.hrdOffset
+		frame.PTS = frame.Timing.DpbOutputTime + t.hrdOffset
+	case timestampsFromVUI:
+		if switching {
+			t.nextDTS = t.lastDTS + gap
+		}
+		frame.DTS = t.nextDTS
+		frame.PTS = t.vuiPTS(frame, tick, !t.started || switching)
+		t.nextDTS += 2 * tick
+		if frame.FieldPic {
+			t.nextDTS -= tick
+		}
+	default:
+		if t.started {
+			frame.DTS = t.lastDTS + gap
+		}
+		frame.PTS = frame.DTS
+	}
+	frame.DTS90k = ticks90kHz(frame.DTS)
+	frame.PTS90k = ticks90kHz(frame.PTS)
+	t.started = true
+	t.source = source
+	t.lastDTS = frame.DTS
+	t.lastArrival = arrival
+}
+
+// Returns the presentation time of frame from its PicOrderCnt, a frame
+// lasting two clock ticks, E.2.1. restart anchors the times anew, as for
+// the first picture.
+func (t *timestampState) vuiPTS(frame *Frame, tick time.Duration, restart bool) time.Duration {
+	if t.pocStep == 0 {
+		t.pocStep = 2
+	}
+	if restart || frame.IDR || frame.MMCO5 {
+		// Room for pictures that follow in decoding order but precede
+		// in output order
+		t.anchor = frame.DTS + time.Duration(reorderFrames(frame.SPS))*2*tick
+		t.anchorPOC = frame.PicOrderCnt
+		t.framePOCSeen = false
+	}
+	if !frame.FieldPic {
+		// Frames one PicOrderCnt apart count one per frame rather than
+		// one per field
+		if delta := frame.PicOrderCnt - t.lastFramePOC; t.framePOCSeen && (delta == 1 || delta == -1) {
+			t.pocStep = 1
+		}
+		t.lastFramePOC, t.framePOCSeen = frame.PicOrderCnt, true
+	}
+	pts := t.anchor + time.Duration(frame.PicOrderCnt-t.anchorPOC)*2*tick/time.Duration(t.pocStep)
+	if frame.MMCO5 {
+		// Later pictures count from this one as PicOrderCnt 0
+		t.anchor, t.anchorPOC, t.lastFramePOC = pts, 0, 0
+	}
+	return pts
+}
@@ -0,0 +1,280 @@
+package h264
+
+import (
+	"fmt"
+	"time"
+)
+
+func init() {
+	RegisterSEIDecoder(SEI_TYPE_BUFFERING_PERIOD, decodeBufferingPeriod)
+	RegisterSEIDecoder(SEI_TYPE_PIC_TIMING, decodePicTiming)
+}
+
+var (
+	// Table D-1 pic_struct
+	PicStructName = map[int]string{
+		0: "frame",
+		1: "top field",
+		2: "bottom field",
+		3: "top field, bottom field",
+		4: "bottom field, top field",
+		5: "top field, bottom field, top field repeated",
+		6: "bottom field, top field, bottom field repeated",
+		7: "frame doubling",
+		8: "frame tripling",
+	}
+	// Table D-1 NumClockTS
+	numClockTS = []int{1, 1, 1, 2, 2, 3, 3, 2, 3}
+)
+
+// BufferingPeriod is the buffering_period payload, D.1.2. The delays are
+// indexed by SchedSelIdx and count in units of a 90 kHz clock.
+type BufferingPeriod struct {
+	SPSID                           int
+	NalInitialCpbRemovalDelay       []int
+	NalInitialCpbRemovalDelayOffset []int
+	VclInitialCpbRemovalDelay       []int
+	VclInitialCpbRemovalDelayOffset []int
+}
+
+// PicTiming is the pic_timing payload, D.1.3. The delays count clock ticks
+// of the SPS timing info and are only present with HRD parameters.
+type PicTiming struct {
+	CpbDpbDelaysPresent bool
+	CpbRemovalDelay     int
+	DpbOutputDelay      int
+	PicStructPresent    bool
+	PicStruct           int
+	ClockTimestamps     []ClockTimestamp
+}
+
+// ClockTimestamp is one clock timestamp of a pic_timing SEI, D.2.3. Fields
+// absent from the SEI carry the values of the previous clock timestamp.
+type ClockTimestamp struct {
+	CtType         int
+	NuitFieldBased bool
+	CountingType   int
+	FullTimestamp  bool
+	Discontinuity  bool
+	CntDropped     bool
+	NFrames        int
+	Seconds        int
+	Minutes        int
+	Hours          int
+	TimeOffset     int
+}
+
+// Timecode formats the timestamp as HH:MM:SS:FF, with a ; before the
+// frames when frames are dropped from the count
+func (c ClockTimestamp) Timecode() string {
+	separator := ":"
+	if c.CntDropped || c.CountingType == 4 {
+		separator = ";"
+	}
+	return fmt.Sprintf("%02d:%02d:%02d%s%02d", c.Hours, c.Minutes, c.Seconds, separator, c.NFrames)
+}
+
+// Time is clockTimestamp of D-2 as a duration. It is zero when the SPS
+// has no timing info.
+func (c ClockTimestamp) Time(sps *SPS) time.Duration {
+	if !sps.TimingInfoPresent || sps.TimeScale == 0 {
+		return 0
+	}
+	nuitFieldBased := 0
+	if c.NuitFieldBased {
+		nuitFieldBased = 1
+	}
+	ticks := int64((c.Hours*60+c.Minutes)*60+c.Seconds)*int64(sps.TimeScale) +
+		int64(c.NFrames)*int64(sps.NumUnitsInTick)*int64(1+nuitFieldBased) +
+		int64(c.TimeOffset)
+	return time.Duration(ticks * int64(time.Second) / int64(sps.TimeScale))
+}
+
+// PictureTiming is the timing a picture gets from its SEI under the
+// hypothetical reference decoder of Annex C
+type PictureTiming struct {
+	PicStructPresent bool
+	PicStruct        int
+	ClockTimestamps  []ClockTimestamp
+	// HRDTimes is set when CpbRemovalTime and DpbOutputTime are known,
+	// which needs a buffering period SEI at or before the picture. Both
+	// count from the arrival of the first bit of the first access unit
+	// with a buffering period.
+	HRDTimes       bool
+	CpbRemovalTime time.Duration
+	DpbOutputTime  time.Duration
+}
+
+// hrdState carries timing between access units of a stream
+type hrdState struct {
+	// Clock timestamp fields are inferred from the previous ones
+	lastClockTimestamps [3]ClockTimestamp
+	// Nominal removal time of the last picture with a buffering period
+	bufferingPeriodRemoval time.Duration
+	bufferingPeriodSeen    bool
+}
+
+// D.1.2. The delays are read with the HRD parameters of the SPS the
+// buffering period names, which need not be the active one.
+func decodeBufferingPeriod(videoStream *VideoStream, b *BitReader) (interface{}, error) {
+	if videoStream == nil || videoStream.SPS == nil {
+		return nil, fmt.Errorf("buffering period: no active SPS")
+	}
+	bufferingPeriod := BufferingPeriod{SPSID: ue(b.golomb())}
+	if err := checkRange("SPSID", bufferingPeriod.SPSID, 0, 31); err != nil {
+		return nil, err
+	}
+	sps := videoStream.spsByID[bufferingPeriod.SPSID]
+	if sps == nil && videoStream.SPS.ID == bufferingPeriod.SPSID {
+		sps = videoStream.SPS
+	}
+	if sps == nil {
+		return nil, fmt.Errorf("buffering period: no SPS %d", bufferingPeriod.SPSID)
+	}
+	// Each loop runs over the SchedSelIdx of its own HRD
+	initialDelays := func(hrd *HRDParameters) (delays, offsets []int) {
+		length := hrd.InitialCpbRemovalDelayLengthMinus1 + 1
+		for i := 0; i <= hrd.CpbCntMinus1; i++ {
+			delays = append(delays, b.NextField("InitialCpbRemovalDelay", length))
+			offsets = append(offsets, b.NextField("InitialCpbRemovalDelayOffset", length))
+		}
+		return delays, offsets
+	}
+	if sps.NalHrdParametersPresent {
+		bufferingPeriod.NalInitialCpbRemovalDelay, bufferingPeriod.NalInitialCpbRemovalDelayOffset = initialDelays(&sps.HRDParameters)
+	}
+	if sps.VclHrdParametersPresent {
+		bufferingPeriod.VclInitialCpbRemovalDelay, bufferingPeriod.VclInitialCpbRemovalDelayOffset = initialDelays(&sps.VclHrd)
+	}
+	if err := b.Err(); err != nil {
+		return nil, fmt.Errorf("buffering period: %w", err)
+	}
+	return bufferingPeriod, nil
+}
+
+// D.1.3
+func decodePicTiming(videoStream *VideoStream, b *BitReader) (interface{}, error) {
+	if videoStream == nil || videoStream.SPS == nil {
+		return nil, fmt.Errorf("pic timing: no active SPS")
+	}
+	sps := videoStream.SPS
+	picTiming := PicTiming{
+		CpbDpbDelaysPresent: sps.NalHrdParametersPresent || sps.VclHrdParametersPresent,
+		PicStructPresent:    sps.PicStructPresent,
+	}
+	if picTiming.CpbDpbDelaysPresent {
+		picTiming.CpbRemovalDelay = b.NextField("CpbRemovalDelay", sps.CpbRemovalDelayLengthMinus1+1)
+		picTiming.DpbOutputDelay = b.NextField("DpbOutputDelay", sps.DpbOutputDelayLengthMinus1+1)
+	}
+	if picTiming.PicStructPresent {
+		picTiming.PicStruct = b.NextField("PicStruct", 4)
+		if err := checkRange("PicStruct", picTiming.PicStruct, 0, len(numClockTS)-1); err != nil {
+			return nil, err
+		}
+		state := &videoStream.hrd
+		for i := 0; i < numClockTS[picTiming.PicStruct]; i++ {
+			if b.NextField("ClockTimestampFlag", 1) == 0 {
+				continue
+			}
+			c := state.lastClockTimestamps[i]
+			c.CtType = b.NextField("CtType", 2)
+			c.NuitFieldBased = b.NextField("NuitFieldBasedFlag", 1) == 1
+			c.CountingType = b.NextField("CountingType", 5)
+			c.FullTimestamp = b.NextField("FullTimestampFlag", 1) == 1
+			c.Discontinuity = b.NextField("DiscontinuityFlag", 1) == 1
+			c.CntDropped = b.NextField("CntDroppedFlag", 1) == 1
+			c.NFrames = b.NextField("NFrames", 8)
+			if c.FullTimestamp {
+				c.Seconds = b.NextField("SecondsValue", 6)
+				c.Minutes = b.NextField("MinutesValue", 6)
+				c.Hours = b.NextField("HoursValue", 5)
+			} else if b.NextField("SecondsFlag", 1) == 1 {
+				c.Seconds = b.NextField("SecondsValue", 6)
+				if b.NextField("MinutesFlag", 1) == 1 {
+					c.Minutes = b.NextField("MinutesValue", 6)
+					if b.NextField("HoursFlag", 1) == 1 {
+						c.Hours = b.NextField("HoursValue", 5)
+					}
+				}
+			}
+			c.TimeOffset = 0
+			if sps.TimeOffsetLength > 0 {
+				// i(v), two's complement
+				c.TimeOffset = b.NextField("TimeOffset", sps.TimeOffsetLength)
+				if c.TimeOffset >= 1<<uint(sps.TimeOffsetLength-1) {
+					c.TimeOffset -= 1 << uint(sps.TimeOffsetLength)
+				}
+			}
+			if err := firstError(
+				checkRange("SecondsValue", c.Seconds, 0, 59),
+				checkRange("MinutesValue", c.Minutes, 0, 59),
+				checkRange("HoursValue", c.Hours, 0, 23),
+			); err != nil {
+				return nil, err
+			}
+			state.lastClockTimestamps[i] = c
+			picTiming.ClockTimestamps = append(picTiming.ClockTimestamps, c)
+		}
+	}
+	if err := b.Err(); err != nil {
+		return nil, fmt.Errorf("pic timing: %w", err)
+	}
+	return picTiming, nil
+}
+
+// C.1.2 and C.2.2: Derives the nominal CPB removal time and DPB output time
+// of the picture from its access unit's SEI. Returns nil without a pic
+// timing SEI. SchedSelIdx 0 is used.
+func (h *hrdState) pictureTiming(sps *SPS, messages []*SEIMessage) *PictureTiming {
+	var bufferingPeriod *BufferingPeriod
+	var picTiming *PicTiming
+	for _, message := range messages {
+		switch v := message.Value.(type) {
+		case BufferingPeriod:
+			bufferingPeriod = &v
+		case PicTiming:
+			picTiming = &v
+		}
+	}
+	if picTiming == nil {
+		return nil
+	}
+	timing := &PictureTiming{
+		PicStructPresent: picTiming.PicStructPresent,
+		PicStruct:        picTiming.PicStruct,
+		ClockTimestamps:  picTiming.ClockTimestamps,
+	}
+	if !picTiming.CpbDpbDelaysPresent || !sps.TimingInfoPresent || sps.TimeScale == 0 {
+		return timing
+	}
+	tc := func(ticks int) time.Duration {
+		return time.Duration(int64(ticks) * int64(sps.NumUnitsInTick) * int64(time.Second) / int64(sps.TimeScale))
+	}
+
+	var removal time.Duration
+	switch {
+	case bufferingPeriod != nil && !h.bufferingPeriodSeen:
+		// C-6: the first picture is removed after its initial delay
+		delay := 0
+		if len(bufferingPeriod.NalInitialCpbRemovalDelay) > 0 {
+			delay = bufferingPeriod.NalInitialCpbRemovalDelay[0]
+		} else if len(bufferingPeriod.VclInitialCpbRemovalDelay) > 0 {
+			delay = bufferingPeriod.VclInitialCpbRemovalDelay[0]
+		}
+		removal = time.Duration(int64(delay) * int64(time.Second) / 90000)
+	case h.bufferingPeriodSeen:
+		// C-7: cpb_removal_delay counts from the last buffering period
+		removal = h.bufferingPeriodRemoval + tc(picTiming.CpbRemovalDelay)
+	default:
+		return timing
+	}
+	if bufferingPeriod != nil {
+		h.bufferingPeriodRemoval = removal
+		h.bufferingPeriodSeen = true
+	}
+	timing.HRDTimes = true
+	timing.CpbRemovalTime = removal
+	// C-12
+	timing.DpbOutputTime = removal + tc(picTiming.DpbOutputDelay)
+	return timing
+}
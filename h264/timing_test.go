@@ -0,0 +1,180 @@
+package h264
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// 25 fps, NAL HRD with 24 bit initial delays and 8 bit removal and output
+// delays, pic_struct present, no time offsets
+func hrdVideoStream() *VideoStream {
+	return &VideoStream{SPS: &SPS{
+		TimingInfoPresent:       true,
+		NumUnitsInTick:          1,
+		TimeScale:               50,
+		NalHrdParametersPresent: true,
+		HRDParameters: HRDParameters{
+			InitialCpbRemovalDelayLengthMinus1: 23,
+			CpbRemovalDelayLengthMinus1:        7,
+			DpbOutputDelayLengthMinus1:         7,
+		},
+		PicStructPresent: true,
+	}}
+}
+
+func TestPicTiming(t *testing.T) {
+	videoStream := hrdVideoStream()
+	// buffering_period: sps 0, initial delay 9000 (100 ms), offset 0
+	bufferingPeriod := bitsToBytes("1 000000000010001100101000 000000000000000000000000 1")
+	// pic_timing: cpb_removal_delay 0, dpb_output_delay 4, pic_struct 0
+	// and a full clock timestamp of 01:02:03:04
+	picTiming := bitsToBytes("00000000 00000100 0000 1 00 0 00000 1 0 0 00000100 000011 000010 00001 1")
+	rbsp := append([]byte{SEI_TYPE_BUFFERING_PERIOD, byte(len(bufferingPeriod))}, bufferingPeriod...)
+	rbsp = append(rbsp, SEI_TYPE_PIC_TIMING, byte(len(picTiming)))
+	rbsp = append(rbsp, picTiming...)
+	rbsp = append(rbsp, 0x80)
+
+	messages, err := NewSEI(videoStream, rbsp)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	timing := videoStream.hrd.pictureTiming(videoStream.SPS, messages)
+	if timing == nil || !timing.HRDTimes {
+		t.Fatalf("expected HRD times, got %+v\n", timing)
+	}
+	if timing.CpbRemovalTime != 100*time.Millisecond || timing.DpbOutputTime != 180*time.Millisecond {
+		t.Fatalf("unexpected removal %v and output %v\n", timing.CpbRemovalTime, timing.DpbOutputTime)
+	}
+	if len(timing.ClockTimestamps) != 1 {
+		t.Fatalf("expected a clock timestamp, got %+v\n", timing.ClockTimestamps)
+	}
+	clock := timing.ClockTimestamps[0]
+	if tc := clock.Timecode(); tc != "01:02:03:04" {
+		t.Fatalf("unexpected timecode %s\n", tc)
+	}
+	if d := clock.Time(videoStream.SPS); d != time.Hour+2*time.Minute+3*time.Second+80*time.Millisecond {
+		t.Fatalf("unexpected clock time %v\n", d)
+	}
+
+	// The next picture is removed 2 ticks after the buffering period
+	picTiming = bitsToBytes("00000010 00000010 0000 0 1")
+	next, err := NewSEI(videoStream, append([]byte{SEI_TYPE_PIC_TIMING, byte(len(picTiming))}, append(picTiming, 0x80)...))
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	timing = videoStream.hrd.pictureTiming(videoStream.SPS, next)
+	if timing.CpbRemovalTime != 140*time.Millisecond || timing.DpbOutputTime != 180*time.Millisecond {
+		t.Fatalf("unexpected removal %v and output %v\n", timing.CpbRemovalTime, timing.DpbOutputTime)
+	}
+}
+
+func TestBufferingPeriodHRDs(t *testing.T) {
+	// The active SPS 0 has no HRD. The buffering period names SPS 1, whose
+	// NAL HRD has one CPB with 8 bit delays and VCL HRD two with 4 bit ones.
+	videoStream := &VideoStream{SPS: &SPS{}, spsByID: map[int]*SPS{1: {
+		ID:                      1,
+		NalHrdParametersPresent: true,
+		HRDParameters:           HRDParameters{InitialCpbRemovalDelayLengthMinus1: 7},
+		VclHrdParametersPresent: true,
+		VclHrd:                  HRDParameters{CpbCntMinus1: 1, InitialCpbRemovalDelayLengthMinus1: 3},
+	}}}
+	// seq_parameter_set_id 1, NAL 200 and 1, VCL 3, 4, 5 and 6
+	bufferingPeriod := bitsToBytes("010 11001000 00000001 0011 0100 0101 0110 1")
+	messages, err := NewSEI(videoStream, append(append([]byte{SEI_TYPE_BUFFERING_PERIOD, byte(len(bufferingPeriod))}, bufferingPeriod...), 0x80))
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	v := messages[0].Value.(BufferingPeriod)
+	if v.SPSID != 1 || fmt.Sprint(v.NalInitialCpbRemovalDelay, v.NalInitialCpbRemovalDelayOffset) != "[200] [1]" ||
+		fmt.Sprint(v.VclInitialCpbRemovalDelay, v.VclInitialCpbRemovalDelayOffset) != "[3 5] [4 6]" {
+		t.Fatalf("unexpected buffering period %+v\n", v)
+	}
+
+	// An SPS that was never received leaves the payload undecoded
+	bufferingPeriod = bitsToBytes("011 1")
+	messages, err = NewSEI(videoStream, append(append([]byte{SEI_TYPE_BUFFERING_PERIOD, byte(len(bufferingPeriod))}, bufferingPeriod...), 0x80))
+	if err != nil || messages[0].Value != nil {
+		t.Fatalf("expected no buffering period for SPS 2, got %+v %v\n", messages[0].Value, err)
+	}
+}
+
+func TestTimestampsFromVUI(t *testing.T) {
+	// 25 fps with one B picture between references
+	sps := &SPS{TimingInfoPresent: true, NumUnitsInTick: 1, TimeScale: 50, BitstreamRestriction: true, MaxNumReorderFrames: 1, MaxDecFrameBuffering: 2}
+	if rate := sps.FrameRate(); rate != 25 {
+		t.Fatalf("expected 25 fps, got %v\n", rate)
+	}
+	state := timestampState{}
+	frames := []*Frame{
+		{SPS: sps, IDR: true, PicOrderCnt: 0},
+		{SPS: sps, PicOrderCnt: 4},
+		{SPS: sps, PicOrderCnt: 2},
+		{SPS: sps, PicOrderCnt: 8},
+		{SPS: sps, PicOrderCnt: 6},
+	}
+	for _, frame := range frames {
+		state.stamp(frame, time.Now())
+	}
+	ms := time.Millisecond
+	wantDTS := []time.Duration{0, 40 * ms, 80 * ms, 120 * ms, 160 * ms}
+	wantPTS := []time.Duration{40 * ms, 120 * ms, 80 * ms, 200 * ms, 160 * ms}
+	for i, frame := range frames {
+		if frame.DTS != wantDTS[i] || frame.PTS != wantPTS[i] {
+			t.Fatalf("picture %d: expected DTS %v PTS %v, got %v %v\n", i, wantDTS[i], wantPTS[i], frame.DTS, frame.PTS)
+		}
+		if frame.PTS90k != int64(frame.PTS/ms)*90 {
+			t.Fatalf("picture %d: unexpected 90 kHz PTS %d\n", i, frame.PTS90k)
+		}
+	}
+}
+
+func TestTimestampsPOCStep(t *testing.T) {
+	// 25 fps, PicOrderCnt counting one per frame with one B picture
+	sps := &SPS{TimingInfoPresent: true, NumUnitsInTick: 1, TimeScale: 50, BitstreamRestriction: true, MaxNumReorderFrames: 1, MaxDecFrameBuffering: 2}
+	state := timestampState{}
+	var pts []time.Duration
+	for i, poc := range []int{0, 2, 1, 4, 3} {
+		frame := &Frame{SPS: sps, IDR: i == 0, PicOrderCnt: poc}
+		state.stamp(frame, time.Now())
+		pts = append(pts, frame.PTS)
+	}
+	// The step is known from the third picture, so the second was given
+	// a time for a step of 2
+	ms := time.Millisecond
+	if fmt.Sprint(pts) != fmt.Sprint([]time.Duration{40 * ms, 80 * ms, 80 * ms, 200 * ms, 160 * ms}) {
+		t.Fatalf("unexpected presentation times %v\n", pts)
+	}
+}
+
+func TestTimestampsChangingClock(t *testing.T) {
+	// Arrival times until the SPS has timing info, then HRD times, then
+	// VUI times: each carries on from the picture before
+	start := time.Now()
+	ms := time.Millisecond
+	noTiming := &SPS{}
+	vui := &SPS{TimingInfoPresent: true, NumUnitsInTick: 1, TimeScale: 50}
+	hrd := func(removal, output time.Duration) *PictureTiming {
+		return &PictureTiming{HRDTimes: true, CpbRemovalTime: removal, DpbOutputTime: output}
+	}
+	frames := []struct {
+		frame   *Frame
+		arrival time.Duration
+	}{
+		{&Frame{SPS: noTiming, IDR: true}, 0},
+		{&Frame{SPS: noTiming}, 30 * ms},
+		{&Frame{SPS: vui, Timing: hrd(5*time.Second, 5*time.Second+40*ms)}, 70 * ms},
+		{&Frame{SPS: vui, Timing: hrd(5*time.Second+40*ms, 5*time.Second+80*ms)}, 110 * ms},
+		{&Frame{SPS: vui, PicOrderCnt: 4}, 150 * ms},
+	}
+	var dts, pts []time.Duration
+	state := timestampState{}
+	for _, f := range frames {
+		state.stamp(f.frame, start.Add(f.arrival))
+		dts, pts = append(dts, f.frame.DTS), append(pts, f.frame.PTS)
+	}
+	if fmt.Sprint(dts) != fmt.Sprint([]time.Duration{0, 30 * ms, 70 * ms, 110 * ms, 150 * ms}) ||
+		fmt.Sprint(pts[:4]) != fmt.Sprint([]time.Duration{0, 30 * ms, 110 * ms, 150 * ms}) {
+		t.Fatalf("unexpected times %v %v\n", dts, pts)
+	}
+}
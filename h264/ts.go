@@ -0,0 +1,421 @@
+package h264
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+)
+
+// MPEG-2 transport stream, ISO/IEC 13818-1
+const (
+	TS_PACKET_SIZE = 188
+	TS_SYNC_BYTE   = 0x47
+	TS_PID_PAT     = 0x0000
+	TS_PID_NULL    = 0x1fff
+)
+
+// stream_type of the PMT, 2.4.4.9 Table 2-34
+const (
+	TS_STREAM_TYPE_MPEG2_VIDEO = 0x02
+	TS_STREAM_TYPE_AAC         = 0x0f
+	TS_STREAM_TYPE_H264        = 0x1b
+	TS_STREAM_TYPE_H265        = 0x24
+)
+
+var TSStreamType = map[int]string{
+	TS_STREAM_TYPE_MPEG2_VIDEO: "MPEG-2 video",
+	TS_STREAM_TYPE_AAC:         "AAC audio",
+	TS_STREAM_TYPE_H264:        "H.264 video",
+	TS_STREAM_TYPE_H265:        "H.265 video",
+}
+
+// ErrInvalidTS is returned for input that is not a transport stream
+var ErrInvalidTS = errors.New("h264: invalid transport stream")
+
+// TSStats counts problems met while demuxing
+type TSStats struct {
+	Packets int
+	// SyncLosses are packets not starting with the sync byte, after which
+	// the stream was searched for the next one
+	SyncLosses int
+	// Discontinuities are continuity_counter jumps, 2.4.3.3, that were not
+	// signalled by a discontinuity_indicator
+	Discontinuities int
+	Duplicates      int
+	TransportErrors int
+	CRCErrors       int
+	// DroppedPES are video PES packets missing data or malformed
+	DroppedPES int
+}
+
+// TSDemuxer reads the H.264 video of an MPEG-2 transport stream. The PAT
+// and PMT are followed to the first elementary stream of stream_type 0x1B
+// and its PES packets are returned as samples, one per PES packet.
+//
+// A PES packet hit by a continuity counter discontinuity or a transport
+// error is dropped whole and decoding resumes with the next one. A picture
+// that loses some of its slices this way has the macroblocks they covered
+// counted in Frame.Loss; a picture lost whole is not handed on.
+type TSDemuxer struct {
+	// ProgramNumber selects a program of the PAT. When 0 the first program
+	// is used.
+	ProgramNumber int
+	// PMTPID and VideoPID are set once the PAT and PMT have been read
+	PMTPID   int
+	VideoPID int
+	// Streams holds the stream_type of each elementary PID of the program
+	Streams map[int]int
+	Stats   TSStats
+	Logger  *slog.Logger
+
+	r      io.Reader
+	packet []byte
+	err    error
+	// continuity holds the last continuity_counter of each PID
+	continuity map[int]int
+	// psi holds partial sections by PID
+	psi map[int][]byte
+	// The video PES packet being reassembled
+	pes             []byte
+	pesStarted      bool
+	pesBroken       bool
+	pesRandomAccess bool
+	// lastDTS unwraps the 33 bit timestamps
+	lastDTS     int64
+	timestamped bool
+	ready       []*Sample
+}
+
+// NewTSDemuxer returns a demuxer reading r, a .ts file, a TCP connection
+// or a UDP connection carrying whole TS packets in each datagram
+func NewTSDemuxer(r io.Reader) *TSDemuxer {
+	if conn, ok := r.(net.PacketConn); ok {
+		if c, ok := conn.(net.Conn); ok {
+			r = &datagramReader{conn: c, buf: make([]byte, 65536)}
+		}
+	}
+	return &TSDemuxer{
+		Streams:    map[int]int{},
+		r:          r,
+		packet:     make([]byte, TS_PACKET_SIZE),
+		continuity: map[int]int{},
+		psi:        map[int][]byte{},
+	}
+}
+
+func (d *TSDemuxer) logger() *slog.Logger {
+	if d.Logger == nil {
+		return discardLogger
+	}
+	return d.Logger
+}
+
+// ReadSample returns the next access unit of the video stream with the
+// timestamps of its PES packet
+func (d *TSDemuxer) ReadSample() (*Sample, error) {
+	for len(d.ready) == 0 {
+		if d.err != nil {
+			return nil, d.err
+		}
+		if err := d.readPacket(); err != nil {
+			d.flushPES()
+			d.err = err
+			continue
+		}
+		d.Stats.Packets++
+		d.demux(d.packet)
+	}
+	sample := d.ready[0]
+	d.ready = d.ready[1:]
+	return sample, nil
+}
+
+// Reads one packet, searching for the sync byte when it is not where
+// expected
+func (d *TSDemuxer) readPacket() error {
+	if _, err := io.ReadFull(d.r, d.packet); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			d.logger().Warn("transport stream ends in a partial packet")
+			return io.EOF
+		}
+		return err
+	}
+	for d.packet[0] != TS_SYNC_BYTE {
+		d.Stats.SyncLosses++
+		offset := 1
+		for offset < len(d.packet) && d.packet[offset] != TS_SYNC_BYTE {
+			offset++
+		}
+		if d.Stats.Packets == 0 && d.Stats.SyncLosses > 8 {
+			return fmt.Errorf("%w: no sync byte", ErrInvalidTS)
+		}
+		n := copy(d.packet, d.packet[offset:])
+		if _, err := io.ReadFull(d.r, d.packet[n:]); err != nil {
+			return io.EOF
+		}
+	}
+	return nil
+}
+
+// 2.4.3.2
+func (d *TSDemuxer) demux(packet []byte) {
+	pid := int(packet[1]&0x1f)<<8 | int(packet[2])
+	if pid == TS_PID_NULL {
+		return
+	}
+	if packet[1]&0x80 != 0 {
+		d.Stats.TransportErrors++
+		if pid == d.VideoPID {
+			d.pesBroken = true
+		}
+		return
+	}
+	payloadUnitStart := packet[1]&0x40 != 0
+	adaptationFieldControl := packet[3] >> 4 & 3
+	continuityCounter := int(packet[3] & 0x0f)
+	payload := packet[4:]
+	discontinuity, randomAccess := false, false
+	if adaptationFieldControl&2 != 0 {
+		length := int(payload[0])
+		if length > len(payload)-1 {
+			d.logger().Warn("adaptation field overruns packet", "pid", pid, "length", length)
+			return
+		}
+		if length > 0 {
+			discontinuity = payload[1]&0x80 != 0
+			randomAccess = payload[1]&0x40 != 0
+		}
+		payload = payload[1+length:]
+	}
+	if adaptationFieldControl&1 == 0 {
+		// The counter only advances with a payload
+		return
+	}
+
+	// 2.4.3.3
+	last, seen := d.continuity[pid]
+	d.continuity[pid] = continuityCounter
+	switch {
+	case !seen || discontinuity:
+	case continuityCounter == last:
+		d.Stats.Duplicates++
+		return
+	case continuityCounter != (last+1)&0x0f:
+		d.Stats.Discontinuities++
+		d.logger().Info("continuity counter discontinuity", "pid", pid, "expected", (last+1)&0x0f, "got", continuityCounter)
+		delete(d.psi, pid)
+		if pid == d.VideoPID {
+			d.pesBroken = true
+		}
+	}
+
+	switch {
+	case pid == TS_PID_PAT || (pid == d.PMTPID && d.PMTPID != 0):
+		d.readSection(pid, payloadUnitStart, payload)
+	case pid == d.VideoPID && d.VideoPID != 0:
+		d.readPES(payloadUnitStart, randomAccess, payload)
+	}
+}
+
+// Gathers a PSI section spread over packets, 2.4.4.2
+func (d *TSDemuxer) readSection(pid int, payloadUnitStart bool, payload []byte) {
+	if payloadUnitStart {
+		if len(payload) == 0 || 1+int(payload[0]) > len(payload) {
+			return
+		}
+		pointer := int(payload[0])
+		if buf, ok := d.psi[pid]; ok {
+			d.parseSection(pid, append(buf, payload[1:1+pointer]...))
+		}
+		d.psi[pid] = append([]byte{}, payload[1+pointer:]...)
+	} else if buf, ok := d.psi[pid]; ok {
+		d.psi[pid] = append(buf, payload...)
+	} else {
+		return
+	}
+	if buf := d.psi[pid]; len(buf) >= 3 && len(buf) >= 3+sectionLength(buf) {
+		delete(d.psi, pid)
+		d.parseSection(pid, buf)
+	}
+}
+
+func sectionLength(section []byte) int {
+	return int(section[1]&0x0f)<<8 | int(section[2])
+}
+
+func (d *TSDemuxer) parseSection(pid int, section []byte) {
+	if len(section) < 3 || len(section) < 3+sectionLength(section) {
+		return
+	}
+	section = section[:3+sectionLength(section)]
+	if len(section) < 12 {
+		return
+	}
+	if crc32MPEG(section) != 0 {
+		d.Stats.CRCErrors++
+		d.logger().Warn("PSI section CRC mismatch", "pid", pid, "tableID", section[0])
+		return
+	}
+	// current_next_indicator
+	if section[5]&1 == 0 {
+		return
+	}
+	body := section[8 : len(section)-4]
+	switch {
+	case pid == TS_PID_PAT && section[0] == 0x00:
+		// 2.4.4.3
+		for i := 0; i+4 <= len(body); i += 4 {
+			program := int(body[i])<<8 | int(body[i+1])
+			pmtPID := int(body[i+2]&0x1f)<<8 | int(body[i+3])
+			// Program 0 is the network PID
+			if program == 0 || (d.ProgramNumber != 0 && program != d.ProgramNumber) {
+				continue
+			}
+			if pmtPID != d.PMTPID {
+				d.logger().Info("found program", "program", program, "pmtPID", pmtPID)
+				d.PMTPID = pmtPID
+			}
+			return
+		}
+	case pid == d.PMTPID && section[0] == 0x02:
+		// 2.4.4.8
+		if len(body) < 4 {
+			return
+		}
+		programInfoLength := int(body[2]&0x0f)<<8 | int(body[3])
+		streams := map[int]int{}
+		videoPID := 0
+		for i := 4 + programInfoLength; i+5 <= len(body); {
+			streamType := int(body[i])
+			elementaryPID := int(body[i+1]&0x1f)<<8 | int(body[i+2])
+			streams[elementaryPID] = streamType
+			if streamType == TS_STREAM_TYPE_H264 && videoPID == 0 {
+				videoPID = elementaryPID
+			}
+			i += 5 + (int(body[i+3]&0x0f)<<8 | int(body[i+4]))
+		}
+		d.Streams = streams
+		if videoPID != d.VideoPID {
+			d.flushPES()
+			d.logger().Info("found H.264 stream", "pid", videoPID)
+			d.VideoPID = videoPID
+		}
+	}
+}
+
+// Gathers a PES packet of the video stream, 2.4.3.6. An unbounded PES
+// packet ends when the next one starts.
+func (d *TSDemuxer) readPES(payloadUnitStart, randomAccess bool, payload []byte) {
+	if payloadUnitStart {
+		d.flushPES()
+		d.pes = append([]byte{}, payload...)
+		d.pesStarted, d.pesBroken, d.pesRandomAccess = true, false, randomAccess
+	} else if d.pesStarted && !d.pesBroken {
+		d.pes = append(d.pes, payload...)
+	}
+	if !d.pesStarted || d.pesBroken || len(d.pes) < 6 {
+		return
+	}
+	if length := int(d.pes[4])<<8 | int(d.pes[5]); length > 0 && len(d.pes) >= 6+length {
+		d.pes = d.pes[:6+length]
+		d.flushPES()
+	}
+}
+
+// Turns the PES packet gathered into a sample
+func (d *TSDemuxer) flushPES() {
+	if !d.pesStarted {
+		return
+	}
+	d.pesStarted = false
+	pes := d.pes
+	if d.pesBroken {
+		d.Stats.DroppedPES++
+		d.logger().Info("dropping PES packet with missing data", "bytes", len(pes))
+		return
+	}
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 || 9+int(pes[8]) > len(pes) {
+		d.Stats.DroppedPES++
+		d.logger().Warn("dropping malformed PES packet", "bytes", len(pes))
+		return
+	}
+	ptsDTSFlags, headerLength := pes[7]>>6, int(pes[8])
+	sample := &Sample{Keyframe: d.pesRandomAccess}
+	if ptsDTSFlags&2 != 0 && headerLength >= 5 {
+		pts := pesTimestamp(pes[9:])
+		dts := pts
+		if ptsDTSFlags == 3 && headerLength >= 10 {
+			dts = pesTimestamp(pes[14:])
+		}
+		if d.timestamped {
+			dts = unwrapTimestamp(d.lastDTS, dts)
+		}
+		pts = unwrapTimestamp(dts, pts)
+		d.lastDTS, d.timestamped = dts, true
+		sample.PTS, sample.DTS, sample.Timestamped = duration90kHz(pts), duration90kHz(dts), true
+	}
+	sample.NalUnits = SplitAnnexB(pes[9+headerLength:])
+	for _, nalUnit := range sample.NalUnits {
+		if nalUnit[0]&0x1f == NALU_TYPE_SLICE_IDR_PICTURE {
+			sample.Keyframe = true
+		}
+	}
+	d.ready = append(d.ready, sample)
+}
+
+// Reads a 33 bit PTS or DTS with its marker bits, 2.4.3.7
+func pesTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+// Returns the value of the 33 bit timestamp ts nearest to reference
+func unwrapTimestamp(reference, ts int64) int64 {
+	const wrap = 1 << 33
+	ts += reference / wrap * wrap
+	if ts-reference > wrap/2 {
+		ts -= wrap
+	} else if reference-ts > wrap/2 {
+		ts += wrap
+	}
+	return ts
+}
+
+// CRC_32 of PSI sections, Annex A: polynomial 0x04C11DB7, not reflected.
+// A section including its CRC_32 field sums to 0.
+func crc32MPEG(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// datagramReader reads a connection one datagram at a time. A short Read
+// of a UDP connection would discard the rest of the datagram.
+type datagramReader struct {
+	conn    net.Conn
+	buf     []byte
+	pending []byte
+}
+
+func (r *datagramReader) Read(p []byte) (int, error) {
+	if len(r.pending) == 0 {
+		n, err := r.conn.Read(r.buf)
+		if err != nil {
+			return 0, err
+		}
+		r.pending = r.buf[:n]
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,288 @@
+package h264
+
+import (
+	"bytes"
+	"io"
+	"time"
+)
+
+// tsMuxDelay is how far the PCR runs behind the DTS, the time an access
+// unit may spend in the decoder buffer
+const tsMuxDelay = 700 * time.Millisecond
+
+// TSMuxer writes H.264 access units as a single program MPEG-2 transport
+// stream, ISO/IEC 13818-1, without re-encoding. Each access unit is one
+// PES packet carrying its PTS and DTS, led by an access unit delimiter.
+// The PCR is carried on the video PID. The PAT and PMT are repeated ahead
+// of every IDR access unit, whose first packet sets the
+// random_access_indicator, and at least every PSIInterval.
+//
+// A TSMuxer is a FrameHandler, so a decoder can record what it reads:
+//
+//	muxer := NewTSMuxer(file)
+//	err := NewDecoder(WithFrameHandler(muxer)).Decode(connection)
+type TSMuxer struct {
+	ProgramNumber int
+	PMTPID        int
+	VideoPID      int
+	// TimestampOffset is added to every PTS and DTS so the PCR, which
+	// runs behind, does not start below zero
+	TimestampOffset time.Duration
+	PSIInterval     time.Duration
+
+	w          io.Writer
+	err        error
+	continuity map[int]int
+	psiWritten bool
+	lastPSI    time.Duration
+}
+
+// NewTSMuxer returns a muxer writing program 1 with its PMT on PID 0x1000
+// and video on PID 0x100
+func NewTSMuxer(w io.Writer) *TSMuxer {
+	return &TSMuxer{
+		ProgramNumber:   1,
+		PMTPID:          0x1000,
+		VideoPID:        0x100,
+		TimestampOffset: 2 * tsMuxDelay,
+		PSIInterval:     500 * time.Millisecond,
+		w:               w,
+		continuity:      map[int]int{},
+	}
+}
+
+// Err returns the first write error. Once set, nothing more is written.
+func (m *TSMuxer) Err() error {
+	return m.err
+}
+
+// HandleFrame writes the access unit of a decoded picture with the
+// picture's timestamps
+func (m *TSMuxer) HandleFrame(frame *Frame) {
+	sliceTypes := make([]int, 0, len(frame.Slices))
+	for _, slice := range frame.Slices {
+		sliceTypes = append(sliceTypes, slice.Slice.Header.SliceType)
+	}
+	m.write(frame.NalUnits, sliceTypes, frame.IDR, frame.PTS, frame.DTS)
+}
+
+// WriteSample writes an access unit read from another container
+func (m *TSMuxer) WriteSample(sample *Sample) error {
+	return m.WriteAccessUnit(sample.NalUnits, sample.PTS, sample.DTS)
+}
+
+// WriteAccessUnit writes the NAL units of one access unit, without start
+// codes, as a PES packet
+func (m *TSMuxer) WriteAccessUnit(nalUnits [][]byte, pts, dts time.Duration) error {
+	sliceTypes := []int{}
+	idr := false
+	for _, nalUnit := range nalUnits {
+		if len(nalUnit) == 0 {
+			continue
+		}
+		switch int(nalUnit[0] & 0x1f) {
+		case NALU_TYPE_SLICE_IDR_PICTURE:
+			idr = true
+			fallthrough
+		case NALU_TYPE_SLICE_NON_IDR_PICTURE:
+			if sliceType := sliceTypeOf(nalUnit); sliceType >= 0 {
+				sliceTypes = append(sliceTypes, sliceType)
+			}
+		}
+	}
+	m.write(nalUnits, sliceTypes, idr, pts, dts)
+	return m.err
+}
+
+// Reads slice_type from a slice NAL unit, -1 when it is unreadable
+func sliceTypeOf(nalUnit []byte) (sliceType int) {
+	defer func() {
+		if r := recover(); r != nil {
+			sliceType = -1
+		}
+	}()
+	n, err := NewNalUnit(nalUnit, len(nalUnit))
+	if err != nil {
+		return -1
+	}
+	b := &BitReader{bytes: n.RBSP()}
+	_ = ue(b.golomb())
+	return ue(b.golomb())
+}
+
+// primary_pic_type of an access unit delimiter, Table 7-5, as masks of
+// slice_type % 5: P 0, B 1, I 2, SP 3 and SI 4
+var primaryPicTypeSliceTypes = []int{
+	1 << 2,
+	1<<2 | 1<<0,
+	1<<2 | 1<<0 | 1<<1,
+	1 << 4,
+	1<<4 | 1<<3,
+	1<<2 | 1<<4,
+	1<<2 | 1<<4 | 1<<0 | 1<<3,
+	0x1f,
+}
+
+// Returns an access unit delimiter allowing the slice types given
+func accessUnitDelimiter(sliceTypes []int) []byte {
+	used := 0
+	for _, sliceType := range sliceTypes {
+		used |= 1 << (sliceType % 5)
+	}
+	primaryPicType := len(primaryPicTypeSliceTypes) - 1
+	if len(sliceTypes) > 0 {
+		for i, allowed := range primaryPicTypeSliceTypes {
+			if used&^allowed == 0 {
+				primaryPicType = i
+				break
+			}
+		}
+	}
+	// 7.3.2.4 with rbsp_trailing_bits
+	return NewNalUnitBytes(0, NALU_TYPE_ACCESS_UNIT_DELIMITER, []byte{byte(primaryPicType<<5 | 0x10)})
+}
+
+func (m *TSMuxer) write(nalUnits [][]byte, sliceTypes []int, idr bool, pts, dts time.Duration) {
+	// Empty NAL units carry nothing and have no header to read
+	nonEmpty := make([][]byte, 0, len(nalUnits))
+	for _, nalUnit := range nalUnits {
+		if len(nalUnit) > 0 {
+			nonEmpty = append(nonEmpty, nalUnit)
+		}
+	}
+	nalUnits = nonEmpty
+	if m.err != nil || len(nalUnits) == 0 {
+		return
+	}
+	if !m.psiWritten || idr || dts-m.lastPSI >= m.PSIInterval {
+		m.writePSI()
+		m.psiWritten, m.lastPSI = true, dts
+	}
+
+	// 7.4.1.2.3 the delimiter comes first
+	if nalUnits[0][0]&0x1f != NALU_TYPE_ACCESS_UNIT_DELIMITER {
+		nalUnits = append([][]byte{accessUnitDelimiter(sliceTypes)}, nalUnits...)
+	}
+	buf := &bytes.Buffer{}
+	annexB, _ := NewAnnexBWriter(buf, 3)
+	if err := annexB.WriteAccessUnit(nalUnits); err != nil {
+		m.err = err
+		return
+	}
+
+	// 2.4.3.6 with PES_packet_length 0, allowed for video in a transport
+	// stream
+	ptsTicks := ticks90kHz(pts + m.TimestampOffset)
+	dtsTicks := ticks90kHz(dts + m.TimestampOffset)
+	pes := []byte{0, 0, 1, 0xe0, 0, 0, 0x84, 0x80, 5}
+	pes = appendPESTimestamp(pes, 2, ptsTicks)
+	if dtsTicks != ptsTicks {
+		pes[7], pes[8] = 0xc0, 10
+		pes[9] |= 0x10
+		pes = appendPESTimestamp(pes, 1, dtsTicks)
+	}
+	pes = append(pes, buf.Bytes()...)
+
+	pcr := ticks90kHz(dts + m.TimestampOffset - tsMuxDelay)
+	if pcr < 0 {
+		pcr = 0
+	}
+	m.writePayload(m.VideoPID, pes, pcr, idr)
+}
+
+// Writes the PAT and PMT, each in one packet
+func (m *TSMuxer) writePSI() {
+	// 2.4.4.3
+	pat := psiSection(0x00, 1, []byte{
+		byte(m.ProgramNumber >> 8), byte(m.ProgramNumber), 0xe0 | byte(m.PMTPID>>8), byte(m.PMTPID),
+	})
+	m.writePayload(TS_PID_PAT, append([]byte{0}, pat...), -1, false)
+	// 2.4.4.8 with the PCR on the video PID
+	pmt := psiSection(0x02, m.ProgramNumber, []byte{
+		0xe0 | byte(m.VideoPID>>8), byte(m.VideoPID), 0xf0, 0,
+		TS_STREAM_TYPE_H264, 0xe0 | byte(m.VideoPID>>8), byte(m.VideoPID), 0xf0, 0,
+	})
+	m.writePayload(m.PMTPID, append([]byte{0}, pmt...), -1, false)
+}
+
+// Returns a PSI section with version 0, current, numbered 0 of 0
+func psiSection(tableID byte, id int, body []byte) []byte {
+	length := 5 + len(body) + 4
+	section := []byte{tableID, 0xb0 | byte(length>>8), byte(length), byte(id >> 8), byte(id), 0xc1, 0, 0}
+	section = append(section, body...)
+	crc := crc32MPEG(section)
+	return append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+// Writes a PTS or DTS with its marker bits, 2.4.3.7
+func appendPESTimestamp(buf []byte, prefix byte, ts int64) []byte {
+	ts &= 1<<33 - 1
+	return append(buf,
+		prefix<<4|byte(ts>>29)&0x0e|1,
+		byte(ts>>22),
+		byte(ts>>14)&0xfe|1,
+		byte(ts>>7),
+		byte(ts<<1)|1,
+	)
+}
+
+// Splits payload into packets of pid, 2.4.3.2. The first packet carries
+// the PCR when pcr is not negative. Adaptation field stuffing fills the
+// last packet, 2.4.3.5.
+func (m *TSMuxer) writePayload(pid int, payload []byte, pcr int64, randomAccess bool) {
+	packet := make([]byte, 0, TS_PACKET_SIZE)
+	for first := true; (first || len(payload) > 0) && m.err == nil; first = false {
+		// adaptation is the adaptation field after its length byte
+		hasAdaptation, adaptation := false, []byte{}
+		if first && (pcr >= 0 || randomAccess) {
+			hasAdaptation = true
+			flags := byte(0)
+			if randomAccess {
+				flags |= 0x40
+			}
+			adaptation = append(adaptation, flags)
+			if pcr >= 0 {
+				adaptation[0] |= 0x10
+				base := pcr & (1<<33 - 1)
+				adaptation = append(adaptation, byte(base>>25), byte(base>>17), byte(base>>9), byte(base>>1), byte(base<<7)|0x7e, 0)
+			}
+		}
+		room := TS_PACKET_SIZE - 4
+		if hasAdaptation {
+			room -= 1 + len(adaptation)
+		}
+		if len(payload) < room {
+			if !hasAdaptation {
+				hasAdaptation = true
+				room--
+			}
+			stuffing := room - len(payload)
+			if stuffing > 0 && len(adaptation) == 0 {
+				adaptation = append(adaptation, 0)
+				stuffing--
+			}
+			adaptation = append(adaptation, bytes.Repeat([]byte{0xff}, stuffing)...)
+		}
+		packet = m.packetHeader(packet[:0], pid, first, hasAdaptation)
+		if hasAdaptation {
+			packet = append(packet, byte(len(adaptation)))
+			packet = append(packet, adaptation...)
+		}
+		n := TS_PACKET_SIZE - len(packet)
+		packet = append(packet, payload[:n]...)
+		payload = payload[n:]
+		_, m.err = m.w.Write(packet)
+	}
+}
+
+func (m *TSMuxer) packetHeader(packet []byte, pid int, payloadUnitStart, adaptation bool) []byte {
+	packet = append(packet, TS_SYNC_BYTE, byte(pid>>8)&0x1f, byte(pid), 0x10|byte(m.continuity[pid]))
+	if payloadUnitStart {
+		packet[1] |= 0x40
+	}
+	if adaptation {
+		packet[3] |= 0x20
+	}
+	m.continuity[pid] = (m.continuity[pid] + 1) & 0x0f
+	return packet
+}
@@ -0,0 +1,69 @@
+package h264
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func readSamples(t *testing.T, samples SampleReader) []*Sample {
+	read := []*Sample{}
+	for {
+		sample, err := samples.ReadSample()
+		if err == io.EOF {
+			return read
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+		read = append(read, sample)
+	}
+}
+
+func TestTSMuxer(t *testing.T) {
+	sps := nal(0x67, bitsToBytes(baselineSPSBits))
+	pps := nal(0x68, bitsToBytes(baselinePPSBits))
+	// first_mb_in_slice 0, slice_type 7
+	idr := nal(0x65, bitsToBytes("1 0001000 1"))
+	p := nal(0x41, bitsToBytes(pSliceBits(1)))
+	out := &bytes.Buffer{}
+	m := NewTSMuxer(out)
+	if err := m.WriteAccessUnit([][]byte{sps, pps, idr}, 80*time.Millisecond, 0); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	// An empty NAL unit is skipped
+	if err := m.WriteAccessUnit([][]byte{{}, p}, 40*time.Millisecond, 40*time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if out.Len()%TS_PACKET_SIZE != 0 {
+		t.Fatalf("expected whole packets, got %d bytes\n", out.Len())
+	}
+	// PAT, PMT, the IDR access unit with PCR and random access, then the
+	// next access unit without PSI
+	packets := out.Bytes()
+	if packets[TS_PACKET_SIZE*2+3]&0x20 == 0 || packets[TS_PACKET_SIZE*2+5] != 0x50 || packets[TS_PACKET_SIZE*3+1] != 0x41 {
+		t.Fatalf("expected PCR and random_access_indicator on the IDR access unit\n")
+	}
+
+	samples := readSamples(t, NewTSDemuxer(bytes.NewReader(packets)))
+	if len(samples) != 2 {
+		t.Fatalf("expected 2 samples, got %d\n", len(samples))
+	}
+	offset := m.TimestampOffset
+	if samples[0].PTS != 80*time.Millisecond+offset || samples[0].DTS != offset || samples[1].PTS != samples[1].DTS {
+		t.Fatalf("unexpected timestamps %v %v %v %v\n", samples[0].PTS, samples[0].DTS, samples[1].PTS, samples[1].DTS)
+	}
+	if !samples[0].Keyframe || samples[1].Keyframe {
+		t.Fatalf("expected only the first sample to be a keyframe\n")
+	}
+	// primary_pic_type 0 for I slices, 1 for P
+	for i, aud := range []byte{0x10, 0x30} {
+		if len(samples[i].NalUnits) == 0 || !bytes.Equal(samples[i].NalUnits[0], []byte{0x09, aud}) {
+			t.Fatalf("sample %d: expected access unit delimiter %x, got %x\n", i, aud, samples[i].NalUnits)
+		}
+	}
+	if !bytes.Equal(samples[0].NalUnits[3], idr) || !bytes.Equal(samples[1].NalUnits[1], p) {
+		t.Fatalf("NAL units changed\n")
+	}
+}
@@ -0,0 +1,157 @@
+package h264
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+type frameList []*Frame
+
+func (f *frameList) HandleFrame(frame *Frame) {
+	*f = append(*f, frame)
+}
+
+// tsTestStream packetizes PSI sections and PES packets
+type tsTestStream struct {
+	continuity map[int]int
+	packets    [][]byte
+}
+
+func (s *tsTestStream) write(pid int, payload []byte, randomAccess bool) {
+	if s.continuity == nil {
+		s.continuity = map[int]int{}
+	}
+	for first := true; first || len(payload) > 0; first = false {
+		flags := byte(0)
+		if first && randomAccess {
+			flags = 0x40
+		}
+		adaptationLength, room := -1, 184
+		if flags != 0 {
+			adaptationLength, room = 1, 182
+		}
+		if len(payload) < room {
+			if adaptationLength < 0 {
+				adaptationLength, room = 0, 183
+			}
+			adaptationLength += room - len(payload)
+		}
+		packet := []byte{TS_SYNC_BYTE, byte(pid >> 8), byte(pid), 0x10 | byte(s.continuity[pid])}
+		if first {
+			packet[1] |= 0x40
+		}
+		s.continuity[pid] = (s.continuity[pid] + 1) & 0x0f
+		if adaptationLength >= 0 {
+			packet[3] |= 0x20
+			packet = append(packet, byte(adaptationLength))
+			if adaptationLength > 0 {
+				packet = append(packet, flags)
+				packet = append(packet, bytes.Repeat([]byte{0xff}, adaptationLength-1)...)
+			}
+		}
+		n := TS_PACKET_SIZE - len(packet)
+		packet = append(packet, payload[:n]...)
+		payload = payload[n:]
+		s.packets = append(s.packets, packet)
+	}
+}
+
+func (s *tsTestStream) bytes() []byte {
+	return bytes.Join(s.packets, nil)
+}
+
+func tsSection(tableID byte, id int, body []byte) []byte {
+	length := 5 + len(body) + 4
+	section := []byte{0, tableID, 0xb0 | byte(length>>8), byte(length), byte(id >> 8), byte(id), 0xc1, 0, 0}
+	section = append(section, body...)
+	crc := crc32MPEG(section[1:])
+	return append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+func pesTimestampBytes(prefix byte, ts int64) []byte {
+	ts &= 1<<33 - 1
+	return []byte{prefix<<4 | byte(ts>>29)&0x0e | 1, byte(ts >> 22), byte(ts>>14)&0xfe | 1, byte(ts >> 7), byte(ts<<1) | 1}
+}
+
+func tsPES(pts, dts int64, nalUnits ...[]byte) []byte {
+	pes := []byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0xc0, 10}
+	pes = append(pes, pesTimestampBytes(3, pts)...)
+	pes = append(pes, pesTimestampBytes(1, dts)...)
+	return append(pes, annexB(nalUnits...)...)
+}
+
+// A program with H.264 video on PID 0x100 and AAC on PID 0x101
+func tsTestProgram() *tsTestStream {
+	s := &tsTestStream{}
+	s.write(TS_PID_PAT, tsSection(0x00, 1, []byte{0, 1, 0xf0, 0x00}), false)
+	s.write(0x1000, tsSection(0x02, 1, []byte{
+		0xe1, 0x00, 0xf0, 0x00,
+		TS_STREAM_TYPE_H264, 0xe1, 0x00, 0xf0, 0x00,
+		TS_STREAM_TYPE_AAC, 0xe1, 0x01, 0xf0, 0x00,
+	}), false)
+	return s
+}
+
+func TestTSDemuxer(t *testing.T) {
+	s := tsTestProgram()
+	sps := nal(0x67, bitsToBytes(baselineSPSBits))
+	pps := nal(0x68, bitsToBytes(baselinePPSBits))
+	s.write(0x100, tsPES(1<<33-1500+3003, 1<<33-1500, sps, pps, recoveryPointSEI(), nal(0x41, bitsToBytes(pSliceBits(1)))), true)
+	s.write(0x101, []byte{0, 0, 1, 0xc0, 0, 3, 0x80, 0, 0}, false)
+	// Filler data spreads the PES packet over several TS packets; the PTS
+	// wraps
+	s.write(0x100, tsPES(1503+3003, 1503, nal(0x41, bitsToBytes(pSliceBits(2))), nal(0x0c, bytes.Repeat([]byte{0xff}, 500))), false)
+	stream := append([]byte{1, 2, 3, 4, 5}, s.bytes()...)
+
+	demuxer := NewTSDemuxer(bytes.NewReader(stream))
+	var frames frameList
+	if err := NewDecoder(WithFrameHandler(&frames)).DecodeSamples(demuxer); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if demuxer.VideoPID != 0x100 || demuxer.Streams[0x101] != TS_STREAM_TYPE_AAC || demuxer.Stats.SyncLosses != 1 {
+		t.Fatalf("unexpected demuxer state %+v\n", demuxer)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("expected 2 pictures, got %d\n", len(frames))
+	}
+	for i, want := range [][2]int64{{1<<33 - 1500, 1<<33 - 1500 + 3003}, {1<<33 + 1503, 1<<33 + 1503 + 3003}} {
+		if frames[i].DTS90k != want[0] || frames[i].PTS90k != want[1] {
+			t.Fatalf("picture %d: expected DTS %d PTS %d, got %d %d\n", i, want[0], want[1], frames[i].DTS90k, frames[i].PTS90k)
+		}
+	}
+}
+
+func TestTSDemuxerDiscontinuity(t *testing.T) {
+	s := tsTestProgram()
+	for i := 1; i <= 3; i++ {
+		s.write(0x100, tsPES(int64(3003*i), int64(3003*i), nal(0x41, bitsToBytes(pSliceBits(i))), nal(0x0c, bytes.Repeat([]byte{0xff}, 300))), i == 1)
+	}
+	// Packets 0 and 1 are the PAT and PMT and each PES packet takes 2.
+	// Packet 3 is repeated and the end of the second PES packet is lost.
+	packets := append([][]byte{}, s.packets[:4]...)
+	packets = append(packets, s.packets[3], s.packets[4])
+	packets = append(packets, s.packets[6:]...)
+
+	demuxer := NewTSDemuxer(bytes.NewReader(bytes.Join(packets, nil)))
+	samples := []*Sample{}
+	for {
+		sample, err := demuxer.ReadSample()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+		samples = append(samples, sample)
+	}
+	if demuxer.Stats.Discontinuities != 1 || demuxer.Stats.Duplicates != 1 || demuxer.Stats.DroppedPES != 1 {
+		t.Fatalf("unexpected stats %+v\n", demuxer.Stats)
+	}
+	if len(samples) != 2 || samples[0].DTS != duration90kHz(3003) || samples[1].DTS != duration90kHz(9009) {
+		t.Fatalf("expected the first and third samples, got %d\n", len(samples))
+	}
+	if !samples[0].Keyframe || samples[1].Keyframe {
+		t.Fatalf("expected only the first sample to be a keyframe\n")
+	}
+}
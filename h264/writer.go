@@ -0,0 +1,256 @@
+package h264
+
+import (
+	"fmt"
+	"io"
+)
+
+// AddEmulationPrevention returns rbsp with an emulation_prevention_three_byte
+// inserted wherever a byte of 0x00 to 0x03 follows two zero bytes, 7.4.1,
+// so the result cannot contain a start code. An RBSP ending in a zero
+// byte, as with cabac_zero_words, gets a final 0x03.
+func AddEmulationPrevention(rbsp []byte) []byte {
+	buf := make([]byte, 0, len(rbsp)+len(rbsp)/64)
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 3 {
+			buf = append(buf, 3)
+			zeros = 0
+		}
+		buf = append(buf, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	if len(buf) > 0 && buf[len(buf)-1] == 0 {
+		buf = append(buf, 3)
+	}
+	return buf
+}
+
+// NewNalUnitBytes builds a NAL unit with a one byte header around rbsp
+func NewNalUnitBytes(refIdc, nalUnitType int, rbsp []byte) []byte {
+	header := byte(refIdc&3<<5 | nalUnitType&0x1f)
+	return append([]byte{header}, AddEmulationPrevention(rbsp)...)
+}
+
+// Bytes serialises the NAL unit: its header, including the SVC, MVC or
+// 3D-AVC extension, followed by the RBSP with emulation prevention
+func (n *NalUnit) Bytes() []byte {
+	return append(n.header(), AddEmulationPrevention(n.rbsp)...)
+}
+
+// 7.3.1
+func (n *NalUnit) header() []byte {
+	header := []byte{byte(n.ForbiddenZeroBit&1<<7 | n.RefIdc&3<<5 | n.Type&0x1f)}
+	if n.Type != 14 && n.Type != 20 && n.Type != 21 {
+		return header
+	}
+	var bits uint32
+	var count uint
+	put := func(v int, size uint) {
+		bits = bits<<size | uint32(v)&(1<<size-1)
+		count += size
+	}
+	switch {
+	case n.Type != 21 && n.SvcExtensionFlag == 1:
+		put(1, 1)
+		put(n.IdrFlag, 1)
+		put(n.PriorityId, 6)
+		put(n.NoInterLayerPredFlag, 1)
+		put(n.DependencyId, 3)
+		put(n.QualityId, 4)
+		put(n.TemporalId, 3)
+		put(n.UseRefBasePicFlag, 1)
+		put(n.DiscardableFlag, 1)
+		put(n.OutputFlag, 1)
+		put(n.ReservedThree2Bits, 2)
+	case n.Type == 21 && n.Avc3dExtensionFlag == 1:
+		put(1, 1)
+		put(n.ViewIdx, 8)
+		put(n.DepthFlag, 1)
+		put(n.NonIdrFlag, 1)
+		put(n.TemporalId, 3)
+		put(n.AnchorPicFlag, 1)
+		put(n.InterViewFlag, 1)
+	default:
+		put(0, 1)
+		put(n.NonIdrFlag, 1)
+		put(n.PriorityId, 6)
+		put(n.ViewId, 10)
+		put(n.TemporalId, 3)
+		put(n.AnchorPicFlag, 1)
+		put(n.InterViewFlag, 1)
+		put(n.ReservedOneBit, 1)
+	}
+	for ; count > 0; count -= 8 {
+		header = append(header, byte(bits>>(count-8)))
+	}
+	return header
+}
+
+// AnnexBWriter writes NAL units as an Annex B byte stream
+type AnnexBWriter struct {
+	w io.Writer
+	// StartCodeSize is 3 or 4. Parameter sets and the first NAL unit of an
+	// access unit always get the 4 byte form, B.1.2.
+	StartCodeSize int
+}
+
+func NewAnnexBWriter(w io.Writer, startCodeSize int) (*AnnexBWriter, error) {
+	if err := checkRange("StartCodeSize", startCodeSize, 3, 4); err != nil {
+		return nil, err
+	}
+	return &AnnexBWriter{w: w, StartCodeSize: startCodeSize}, nil
+}
+
+// WriteNalUnit writes a start code and nalUnit, which must already carry
+// its emulation prevention bytes
+func (a *AnnexBWriter) WriteNalUnit(nalUnit []byte) error {
+	return a.writeNalUnit(nalUnit, false)
+}
+
+// WriteAccessUnit writes the NAL units of one access unit
+func (a *AnnexBWriter) WriteAccessUnit(nalUnits [][]byte) error {
+	for i, nalUnit := range nalUnits {
+		if err := a.writeNalUnit(nalUnit, i == 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *AnnexBWriter) writeNalUnit(nalUnit []byte, firstInAccessUnit bool) error {
+	if len(nalUnit) == 0 {
+		return fmt.Errorf("%w: empty NAL unit", ErrTruncated)
+	}
+	startCode := InitialNALU
+	nalUnitType := int(nalUnit[0] & 0x1f)
+	if a.StartCodeSize == 3 && !firstInAccessUnit && nalUnitType != NALU_TYPE_SPS && nalUnitType != NALU_TYPE_PPS {
+		startCode = Initial3BNALU
+	}
+	if _, err := a.w.Write(startCode); err != nil {
+		return err
+	}
+	_, err := a.w.Write(nalUnit)
+	return err
+}
+
+// AVCCWriter writes NAL units each preceded by its length, as in the
+// samples of MP4 and Matroska files
+type AVCCWriter struct {
+	w io.Writer
+	// LengthSize is the size of the length field, 1, 2 or 4 bytes
+	LengthSize int
+}
+
+func NewAVCCWriter(w io.Writer, lengthSize int) (*AVCCWriter, error) {
+	if lengthSize != 1 && lengthSize != 2 && lengthSize != 4 {
+		return nil, ErrInvalidValue{Field: "LengthSize", Value: lengthSize, Range: [2]int{1, 4}}
+	}
+	return &AVCCWriter{w: w, LengthSize: lengthSize}, nil
+}
+
+// WriteNalUnit writes the length of nalUnit and nalUnit
+func (a *AVCCWriter) WriteNalUnit(nalUnit []byte) error {
+	if len(nalUnit) == 0 {
+		return fmt.Errorf("%w: empty NAL unit", ErrTruncated)
+	}
+	if maxLength := 1<<uint(8*a.LengthSize) - 1; len(nalUnit) > maxLength {
+		return ErrInvalidValue{Field: "NALUnitLength", Value: len(nalUnit), Range: [2]int{1, maxLength}}
+	}
+	lengthField := make([]byte, a.LengthSize)
+	for i := range lengthField {
+		lengthField[i] = byte(len(nalUnit) >> uint(8*(a.LengthSize-1-i)))
+	}
+	if _, err := a.w.Write(lengthField); err != nil {
+		return err
+	}
+	_, err := a.w.Write(nalUnit)
+	return err
+}
+
+// WriteAccessUnit writes the NAL units of one access unit, making one
+// sample
+func (a *AVCCWriter) WriteAccessUnit(nalUnits [][]byte) error {
+	for _, nalUnit := range nalUnits {
+		if err := a.WriteNalUnit(nalUnit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewAVCDecoderConfigurationRecordFor builds the avcC record for a stream
+// using sps and its picture parameter sets, with 4 byte NAL unit lengths
+func NewAVCDecoderConfigurationRecordFor(sps *SPS, pps ...*PPS) (*AVCDecoderConfigurationRecord, error) {
+	if sps == nil || len(sps.RBSP()) == 0 {
+		return nil, fmt.Errorf("%w: no SPS RBSP", ErrInvalidAVCConfig)
+	}
+	record := &AVCDecoderConfigurationRecord{
+		ConfigurationVersion: 1,
+		AVCProfileIndication: sps.Profile,
+		ProfileCompatibility: sps.Constraint0<<7 | sps.Constraint1<<6 | sps.Constraint2<<5 |
+			sps.Constraint3<<4 | sps.Constraint4<<3 | sps.Constraint5<<2,
+		AVCLevelIndication: sps.Level,
+		LengthSizeMinusOne: 3,
+		SPS:                [][]byte{NewNalUnitBytes(parameterSetRefIdc(sps.refIdc), NALU_TYPE_SPS, sps.RBSP())},
+	}
+	for _, p := range pps {
+		if len(p.RBSP()) == 0 {
+			return nil, fmt.Errorf("%w: no PPS RBSP", ErrInvalidAVCConfig)
+		}
+		record.PPS = append(record.PPS, NewNalUnitBytes(parameterSetRefIdc(p.refIdc), NALU_TYPE_PPS, p.RBSP()))
+	}
+	if isInList(chromaFormatProfiles, record.AVCProfileIndication) {
+		record.HighProfileExtension = true
+		record.ChromaFormat = sps.ChromaFormat
+		record.BitDepthLumaMinus8 = sps.BitDepthLumaMinus8
+		record.BitDepthChromaMinus8 = sps.BitDepthChromaMinus8
+	}
+	return record, nil
+}
+
+// Returns the nal_ref_idc a parameter set was carried with, or 3 when it
+// is unknown. Parameter sets never have nal_ref_idc 0, 7.4.1.
+func parameterSetRefIdc(refIdc int) int {
+	if refIdc == 0 {
+		return 3
+	}
+	return refIdc
+}
+
+// Bytes serialises the record as an avcC box payload
+func (c *AVCDecoderConfigurationRecord) Bytes() []byte {
+	buf := []byte{
+		byte(c.ConfigurationVersion),
+		byte(c.AVCProfileIndication),
+		byte(c.ProfileCompatibility),
+		byte(c.AVCLevelIndication),
+		0xfc | byte(c.LengthSizeMinusOne&3),
+		0xe0 | byte(len(c.SPS)&0x1f),
+	}
+	buf = appendParameterSetNalUnits(buf, c.SPS)
+	buf = append(buf, byte(len(c.PPS)))
+	buf = appendParameterSetNalUnits(buf, c.PPS)
+	if c.HighProfileExtension {
+		buf = append(buf,
+			0xfc|byte(c.ChromaFormat&3),
+			0xf8|byte(c.BitDepthLumaMinus8&7),
+			0xf8|byte(c.BitDepthChromaMinus8&7),
+			byte(len(c.SPSExt)),
+		)
+		buf = appendParameterSetNalUnits(buf, c.SPSExt)
+	}
+	return buf
+}
+
+func appendParameterSetNalUnits(buf []byte, nalUnits [][]byte) []byte {
+	for _, nalUnit := range nalUnits {
+		buf = append(buf, byte(len(nalUnit)>>8), byte(len(nalUnit)))
+		buf = append(buf, nalUnit...)
+	}
+	return buf
+}
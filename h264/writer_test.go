@@ -0,0 +1,158 @@
+package h264
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAddEmulationPrevention(t *testing.T) {
+	tests := []struct {
+		rbsp, want []byte
+	}{
+		{[]byte{0, 0, 1}, []byte{0, 0, 3, 1}},
+		{[]byte{0, 0, 0, 0}, []byte{0, 0, 3, 0, 0, 3}},
+		{[]byte{0, 0, 3, 0, 0, 4}, []byte{0, 0, 3, 3, 0, 0, 4}},
+		{[]byte{0x80, 0, 0}, []byte{0x80, 0, 0, 3}},
+		{[]byte{0, 1, 0, 2}, []byte{0, 1, 0, 2}},
+	}
+	for _, test := range tests {
+		got := AddEmulationPrevention(test.rbsp)
+		if !bytes.Equal(got, test.want) {
+			t.Fatalf("%x: expected %x, got %x\n", test.rbsp, test.want, got)
+		}
+		nalUnit, err := NewNalUnit(append([]byte{0x01}, got...), len(got)+1)
+		if err != nil {
+			t.Fatalf("%x: unexpected error: %v\n", test.rbsp, err)
+		}
+		if !bytes.Equal(nalUnit.RBSP(), test.rbsp) {
+			t.Fatalf("%x: round trip gave %x\n", test.rbsp, nalUnit.RBSP())
+		}
+	}
+}
+
+func TestNalUnitBytes(t *testing.T) {
+	// An MVC prefix NAL unit has a 3 byte extension header
+	data := []byte{0x6e, 0x40, 0x00, 0x27, 0x00, 0x00, 0x03, 0x01, 0x80}
+	nalUnit, err := NewNalUnit(data, len(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if got := nalUnit.Bytes(); !bytes.Equal(got, data) {
+		t.Fatalf("expected %x, got %x\n", data, got)
+	}
+}
+
+func TestWriters(t *testing.T) {
+	sps := nal(0x67, bitsToBytes(baselineSPSBits))
+	pps := nal(0x68, bitsToBytes(baselinePPSBits))
+	slice := nal(0x41, bitsToBytes(pSliceBits(1)))
+
+	annexB := &bytes.Buffer{}
+	w, err := NewAnnexBWriter(annexB, 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if err := w.WriteAccessUnit([][]byte{sps, pps, recoveryPointSEI(), slice}); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	want := []byte{}
+	for i, nalUnit := range [][]byte{sps, pps, recoveryPointSEI(), slice} {
+		if i < 2 {
+			want = append(want, InitialNALU...)
+		} else {
+			want = append(want, Initial3BNALU...)
+		}
+		want = append(want, nalUnit...)
+	}
+	if !bytes.Equal(annexB.Bytes(), want) {
+		t.Fatalf("expected Annex B %x, got %x\n", want, annexB.Bytes())
+	}
+	if _, err := NewAnnexBWriter(annexB, 2); err == nil {
+		t.Fatalf("expected an error for 2 byte start codes\n")
+	}
+
+	avcc := &bytes.Buffer{}
+	a, err := NewAVCCWriter(avcc, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if err := a.WriteAccessUnit([][]byte{recoveryPointSEI(), slice}); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if want := lengthPrefixed(2, recoveryPointSEI(), slice); !bytes.Equal(avcc.Bytes(), want) {
+		t.Fatalf("expected AVCC %x, got %x\n", want, avcc.Bytes())
+	}
+	a, _ = NewAVCCWriter(avcc, 1)
+	if err := a.WriteNalUnit(make([]byte, 256)); err == nil {
+		t.Fatalf("expected an error for a NAL unit longer than its length field\n")
+	}
+}
+
+func TestNewAVCDecoderConfigurationRecordFor(t *testing.T) {
+	sps, err := NewSPS(bitsToBytes(baselineSPSBits), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	pps, err := NewPPS(sps, bitsToBytes(baselinePPSBits), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	record, err := NewAVCDecoderConfigurationRecordFor(sps, pps)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	parsed, err := NewAVCDecoderConfigurationRecord(record.Bytes())
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if parsed.AVCProfileIndication != PROFILE_IDC_BASELINE || parsed.AVCLevelIndication != 30 || parsed.LengthSize() != 4 {
+		t.Fatalf("unexpected record %+v\n", parsed)
+	}
+	if len(parsed.SPS) != 1 || !bytes.Equal(parsed.SPS[0], nal(0x67, bitsToBytes(baselineSPSBits))) {
+		t.Fatalf("unexpected SPS %x\n", parsed.SPS)
+	}
+
+	// The record is enough to decode AVCC samples
+	var got frameNums
+	samples := lengthPrefixed(4, recoveryPointSEI(), nal(0x41, bitsToBytes(pSliceBits(1))))
+	if err := NewDecoder(WithFrameHandler(&got), WithAVCDecoderConfigurationRecord(parsed)).Decode(bytes.NewReader(samples)); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if len(got) != 1 || got[0] != 1 {
+		t.Fatalf("expected picture 1, got %v\n", got)
+	}
+}
+
+func TestNewAVCDecoderConfigurationRecordForHigh(t *testing.T) {
+	// High profile, level 3.0, 4:2:0 with 10 bit luma, 320x240
+	highSPSBits := "01100100 00000000 00011110" +
+		" 1 010 011 1 0 0" +
+		" 1 1 011 010 0" +
+		" 000010100 0001111" +
+		" 1 1 0 0 1"
+	// Parameter sets carried with nal_ref_idc 1
+	sps := nal(0x27, bitsToBytes(highSPSBits))
+	pps := nal(0x28, bitsToBytes(baselinePPSBits))
+	var frames frameList
+	stream := annexB(sps, pps, recoveryPointSEI(), nal(0x41, bitsToBytes(pSliceBits(1))))
+	if err := NewDecoder(WithFrameHandler(&frames)).Decode(bytes.NewReader(stream)); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if len(frames) != 1 {
+		t.Fatalf("expected one picture, got %d\n", len(frames))
+	}
+	record, err := NewAVCDecoderConfigurationRecordFor(frames[0].SPS, frames[0].PPS)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	parsed, err := NewAVCDecoderConfigurationRecord(record.Bytes())
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if !parsed.HighProfileExtension || parsed.ChromaFormat != 1 || parsed.BitDepthLumaMinus8 != 2 || parsed.BitDepthChromaMinus8 != 0 {
+		t.Fatalf("unexpected High profile extension %+v\n", parsed)
+	}
+	if len(parsed.SPS) != 1 || !bytes.Equal(parsed.SPS[0], sps) || len(parsed.PPS) != 1 || !bytes.Equal(parsed.PPS[0], pps) {
+		t.Fatalf("unexpected parameter sets %x %x\n", parsed.SPS, parsed.PPS)
+	}
+}
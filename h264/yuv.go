@@ -0,0 +1,325 @@
+package h264
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Raw planar YUV layouts. I420, I422 and I444 write each plane in turn,
+// one byte per sample at 8 bits and two little endian bytes above.
+// P010 writes the luma plane then interleaved Cb and Cr, 4:2:0 in two
+// little endian bytes per sample with the value in the high bits.
+const (
+	YUV_FORMAT_I420 = iota
+	YUV_FORMAT_I422
+	YUV_FORMAT_I444
+	YUV_FORMAT_P010
+)
+
+var YUVFormat = map[int]string{
+	YUV_FORMAT_I420: "I420",
+	YUV_FORMAT_I422: "I422",
+	YUV_FORMAT_I444: "I444",
+	YUV_FORMAT_P010: "P010",
+}
+
+var (
+	// ErrYUVFormat is returned for a picture that does not fit the layout
+	// written, such as 4:2:2 pictures as I420
+	ErrYUVFormat = errors.New("h264: picture does not fit the YUV format")
+	// ErrFieldPicture is returned by writers of frames for a field
+	// picture. Their HandleFrame skips field pictures instead.
+	ErrFieldPicture = errors.New("h264: field pictures are not written")
+)
+
+// The chroma_format_idc each raw layout holds, Table 6-1
+var yuvFormatChromaFormat = map[int]int{
+	YUV_FORMAT_I420: 1,
+	YUV_FORMAT_I422: 2,
+	YUV_FORMAT_I444: 3,
+	YUV_FORMAT_P010: 1,
+}
+
+// yuvWindow is the part of a picture's planes that is written, the
+// display area left by the SPS frame cropping
+type yuvWindow struct {
+	x, y, width, height int
+	// subWidth and subHeight are SubWidthC and SubHeightC, 0 for
+	// monochrome
+	subWidth, subHeight int
+}
+
+func newYUVWindow(frame *Frame) (yuvWindow, error) {
+	if frame.FieldPic {
+		return yuvWindow{}, ErrFieldPicture
+	}
+	left, right, top, bottom := frame.SPS.cropping()
+	window := yuvWindow{x: left, y: top, width: frame.Width - left - right, height: frame.Height - top - bottom}
+	if frame.ChromaWidth > 0 {
+		window.subWidth, window.subHeight = frame.Width/frame.ChromaWidth, frame.Height/frame.ChromaHeight
+	}
+	return window, nil
+}
+
+// Appends a plane of width samples per row inside the window, scaled down
+// by sub, in size bytes per sample shifted left by shift. A nil plane is
+// written at mid-range for bitDepth.
+func (w yuvWindow) appendPlane(buf []byte, plane []uint16, width, subWidth, subHeight, size, shift, bitDepth int) []byte {
+	x, y := w.x/subWidth, w.y/subHeight
+	cols, rows := (w.width+subWidth-1)/subWidth, (w.height+subHeight-1)/subHeight
+	for row := y; row < y+rows; row++ {
+		for col := x; col < x+cols; col++ {
+			v := uint16(1) << (bitDepth - 1)
+			if plane != nil {
+				v = plane[row*width+col]
+			}
+			v <<= shift
+			if size == 1 {
+				buf = append(buf, byte(v))
+			} else {
+				buf = append(buf, byte(v), byte(v>>8))
+			}
+		}
+	}
+	return buf
+}
+
+// Appends the cropped planes of a picture in the layout of
+// chromaFormat: the luma plane, then Cb and Cr. Monochrome pictures get
+// mid-range chroma planes unless chromaFormat is 0. Samples take two
+// bytes when either bit depth is above 8.
+func appendYUVPlanes(buf []byte, frame *Frame, window yuvWindow, chromaFormat int) []byte {
+	size := 1
+	if frame.BitDepthLuma > 8 || frame.BitDepthChroma > 8 {
+		size = 2
+	}
+	buf = window.appendPlane(buf, frame.Luma, frame.Width, 1, 1, size, 0, frame.BitDepthLuma)
+	if chromaFormat == 0 {
+		return buf
+	}
+	subWidth, subHeight := window.subWidth, window.subHeight
+	cb, cr, chromaWidth := frame.Cb, frame.Cr, frame.ChromaWidth
+	if subWidth == 0 {
+		subWidth, subHeight = []int{0, 2, 2, 1}[chromaFormat], []int{0, 2, 1, 1}[chromaFormat]
+		cb, cr = nil, nil
+	}
+	for _, plane := range [][]uint16{cb, cr} {
+		buf = window.appendPlane(buf, plane, chromaWidth, subWidth, subHeight, size, 0, frame.BitDepthChroma)
+	}
+	return buf
+}
+
+// Returns the chroma_format_idc of a picture from its planes
+func frameChromaFormat(frame *Frame) int {
+	switch {
+	case frame.ChromaWidth == 0:
+		return 0
+	case frame.ChromaHeight < frame.Height:
+		return 1
+	case frame.ChromaWidth < frame.Width:
+		return 2
+	}
+	return 3
+}
+
+// RawYUVWriter writes the display area of each picture as raw planar YUV
+// with no header, as reference decoders write their output. Pictures are
+// written in the order given; a DisplayOrder in front of the writer puts
+// them in display order. Field pictures are skipped and counted.
+//
+//	w := NewRawYUVWriter(file, YUV_FORMAT_I420)
+//	order := &DisplayOrder{Handler: w}
+//	err := NewDecoder(WithFrameHandler(order)).Decode(stream)
+//	order.Flush()
+type RawYUVWriter struct {
+	Format int
+	// SkippedFields counts the field pictures HandleFrame skipped
+	SkippedFields int
+
+	w   io.Writer
+	err error
+	buf []byte
+}
+
+// NewRawYUVWriter returns a writer of pictures to w in format, one of the
+// YUV_FORMAT_ constants
+func NewRawYUVWriter(w io.Writer, format int) *RawYUVWriter {
+	return &RawYUVWriter{Format: format, w: w}
+}
+
+// Err returns the first error. Once set, pictures are ignored.
+func (y *RawYUVWriter) Err() error {
+	return y.err
+}
+
+func (y *RawYUVWriter) HandleFrame(frame *Frame) {
+	if frame.FieldPic {
+		y.SkippedFields++
+		return
+	}
+	if y.err == nil {
+		y.err = y.WriteFrame(frame)
+	}
+}
+
+// WriteFrame writes one picture. Monochrome pictures are written with
+// mid-range chroma.
+func (y *RawYUVWriter) WriteFrame(frame *Frame) error {
+	window, err := newYUVWindow(frame)
+	if err != nil {
+		return err
+	}
+	chromaFormat, ok := yuvFormatChromaFormat[y.Format]
+	if !ok {
+		return fmt.Errorf("%w: unknown format %d", ErrYUVFormat, y.Format)
+	}
+	if frameChroma := frameChromaFormat(frame); frameChroma != 0 && frameChroma != chromaFormat {
+		return fmt.Errorf("%w: chroma_format_idc %d as %s", ErrYUVFormat, frameChroma, YUVFormat[y.Format])
+	}
+	if y.Format != YUV_FORMAT_P010 {
+		y.buf = appendYUVPlanes(y.buf[:0], frame, window, chromaFormat)
+		_, err = y.w.Write(y.buf)
+		return err
+	}
+
+	// P010 holds up to 10 bits in the high bits of 16
+	if frame.BitDepthLuma > 10 || frame.BitDepthChroma > 10 {
+		return fmt.Errorf("%w: bit depth %d as P010", ErrYUVFormat, max(frame.BitDepthLuma, frame.BitDepthChroma))
+	}
+	buf := window.appendPlane(y.buf[:0], frame.Luma, frame.Width, 1, 1, 2, 16-frame.BitDepthLuma, frame.BitDepthLuma)
+	cb := window.appendPlane(nil, frame.Cb, frame.ChromaWidth, 2, 2, 2, 16-frame.BitDepthChroma, frame.BitDepthChroma)
+	cr := window.appendPlane(nil, frame.Cr, frame.ChromaWidth, 2, 2, 2, 16-frame.BitDepthChroma, frame.BitDepthChroma)
+	if window.subWidth == 0 {
+		cb = window.appendPlane(nil, nil, 0, 2, 2, 2, 16-frame.BitDepthChroma, frame.BitDepthChroma)
+		cr = cb
+	}
+	for i := 0; i < len(cb); i += 2 {
+		buf = append(buf, cb[i], cb[i+1], cr[i], cr[i+1])
+	}
+	y.buf = buf
+	_, err = y.w.Write(buf)
+	return err
+}
+
+// Y4MWriter writes the display area of each picture as a YUV4MPEG2
+// stream. The header takes the size and chroma format of the first
+// picture, the frame rate of the VUI timing info and the sample aspect
+// ratio of the VUI. Samples above 8 bits are two little endian bytes.
+// As with RawYUVWriter, a DisplayOrder in front of the writer puts
+// pictures in display order and field pictures are skipped. Each picture
+// is one Write to w, so buffering is left to the caller.
+type Y4MWriter struct {
+	// FrameRate is used when the SPS has no timing info, as a numerator
+	// and a denominator
+	FrameRate [2]int
+	// SkippedFields counts the field pictures HandleFrame skipped
+	SkippedFields int
+
+	w   io.Writer
+	err error
+	// header is the stream header written, which later pictures must
+	// share
+	header string
+	buf    []byte
+}
+
+// NewY4MWriter returns a writer of pictures to w assuming 25 frames per
+// second without VUI timing info
+func NewY4MWriter(w io.Writer) *Y4MWriter {
+	return &Y4MWriter{FrameRate: [2]int{25, 1}, w: w}
+}
+
+// Err returns the first error. Once set, pictures are ignored.
+func (y *Y4MWriter) Err() error {
+	return y.err
+}
+
+func (y *Y4MWriter) HandleFrame(frame *Frame) {
+	if frame.FieldPic {
+		y.SkippedFields++
+		return
+	}
+	if y.err == nil {
+		y.err = y.WriteFrame(frame)
+	}
+}
+
+// WriteFrame writes one picture, writing the stream header first. A
+// picture that does not fit the header, of another size or chroma
+// format, returns ErrSequenceChanged.
+func (y *Y4MWriter) WriteFrame(frame *Frame) error {
+	window, err := newYUVWindow(frame)
+	if err != nil {
+		return err
+	}
+	header := y4mHeader(frame, window, y.FrameRate)
+	switch y.header {
+	case "":
+		if _, err := io.WriteString(y.w, header); err != nil {
+			return err
+		}
+		y.header = header
+	case header:
+	default:
+		return ErrSequenceChanged
+	}
+	y.buf = append(y.buf[:0], "FRAME\n"...)
+	y.buf = appendYUVPlanes(y.buf, frame, window, frameChromaFormat(frame))
+	_, err = y.w.Write(y.buf)
+	return err
+}
+
+// Returns the YUV4MPEG2 stream header of a picture with the W, H, F, I,
+// A and C tags
+func y4mHeader(frame *Frame, window yuvWindow, defaultRate [2]int) string {
+	sps := frame.SPS
+	rate := defaultRate
+	if sps.FrameRate() > 0 {
+		// A frame is two clock ticks, E.2.1
+		rate = [2]int{sps.TimeScale, 2 * sps.NumUnitsInTick}
+	}
+	divisor := gcd(rate[0], rate[1])
+	interlacing := "p"
+	if !sps.FrameMbsOnly {
+		interlacing = "?"
+	}
+	sarWidth, sarHeight := sps.SampleAspectRatio()
+	return fmt.Sprintf("YUV4MPEG2 W%d H%d F%d:%d I%s A%d:%d C%s\n",
+		window.width, window.height, rate[0]/divisor, rate[1]/divisor, interlacing,
+		sarWidth, sarHeight, y4mColourSpace(frame))
+}
+
+// The C tag of a picture, as ffmpeg names them. 4:2:0 sits chroma
+// between luma rows and on luma columns, chroma_sample_loc_type 0.
+func y4mColourSpace(frame *Frame) string {
+	depth := ""
+	if bitDepth := max(frame.BitDepthLuma, frame.BitDepthChroma); bitDepth > 8 {
+		depth = fmt.Sprintf("p%d", bitDepth)
+	}
+	switch frameChromaFormat(frame) {
+	case 0:
+		if frame.BitDepthLuma > 8 {
+			return fmt.Sprintf("mono%d", frame.BitDepthLuma)
+		}
+		return "mono"
+	case 1:
+		if depth == "" {
+			return "420mpeg2"
+		}
+		return "420" + depth
+	case 2:
+		return "422" + depth
+	}
+	return "444" + depth
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	if a == 0 {
+		return 1
+	}
+	return a
+}
@@ -0,0 +1,156 @@
+package h264
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// Returns a 4:2:0 picture of 16x16 samples whose luma samples are their
+// column plus value and whose chroma samples are 128 and 64 plus value
+func yuvTestFrame(sps *SPS, bitDepth, value int) *Frame {
+	frame := &Frame{SPS: sps, Width: 16, Height: 16, ChromaWidth: 8, ChromaHeight: 8, BitDepthLuma: bitDepth, BitDepthChroma: bitDepth}
+	frame.Luma = make([]uint16, 16*16)
+	for i := range frame.Luma {
+		frame.Luma[i] = uint16(i%16 + value)
+	}
+	frame.Cb, frame.Cr = make([]uint16, 8*8), make([]uint16, 8*8)
+	for i := range frame.Cb {
+		frame.Cb[i], frame.Cr[i] = uint16(128+value), uint16(64+value)
+	}
+	return frame
+}
+
+func TestY4MWriter(t *testing.T) {
+	// 2 columns cropped on the right and 4 rows at the bottom
+	sps := &SPS{ChromaFormat: 1, FrameMbsOnly: true, FrameCropping: true, FrameCropRightOffset: 1, FrameCropBottomOffset: 2,
+		TimingInfoPresent: true, NumUnitsInTick: 1001, TimeScale: 60000, AspectRatioInfoPresent: true, AspectRatio: 2}
+	var out bytes.Buffer
+	w := NewY4MWriter(&out)
+	w.HandleFrame(yuvTestFrame(sps, 8, 0))
+	w.HandleFrame(yuvTestFrame(sps, 8, 1))
+	if err := w.Err(); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	header := "YUV4MPEG2 W14 H12 F30000:1001 Ip A12:11 C420mpeg2\n"
+	data := out.Bytes()
+	if !bytes.HasPrefix(data, []byte(header)) {
+		t.Fatalf("unexpected header %q\n", data[:bytes.IndexByte(data, '\n')+1])
+	}
+	frameSize := len("FRAME\n") + 14*12 + 2*7*6
+	if len(data) != len(header)+2*frameSize {
+		t.Fatalf("expected %d bytes, got %d\n", len(header)+2*frameSize, len(data))
+	}
+	second := data[len(header)+frameSize:]
+	if !bytes.HasPrefix(second, []byte("FRAME\n")) {
+		t.Fatalf("no FRAME before the second picture\n")
+	}
+	planes := second[len("FRAME\n"):]
+	if planes[0] != 1 || planes[13] != 14 || planes[14] != 1 {
+		t.Fatalf("unexpected luma % x\n", planes[:16])
+	}
+	if cb, cr := planes[14*12], planes[14*12+7*6]; cb != 129 || cr != 65 {
+		t.Fatalf("unexpected chroma %d %d\n", cb, cr)
+	}
+
+	// Field pictures are skipped without ending the stream
+	field := yuvTestFrame(sps, 8, 0)
+	field.FieldPic = true
+	w.HandleFrame(field)
+	if w.Err() != nil || w.SkippedFields != 1 || out.Len() != len(data) {
+		t.Fatalf("field picture not skipped: %v %d\n", w.Err(), w.SkippedFields)
+	}
+	if err := w.WriteFrame(field); !errors.Is(err, ErrFieldPicture) {
+		t.Fatalf("expected ErrFieldPicture, got %v\n", err)
+	}
+
+	// A picture of another size does not fit the header
+	frame := yuvTestFrame(&SPS{ChromaFormat: 1, FrameMbsOnly: true}, 8, 0)
+	w.HandleFrame(frame)
+	if !errors.Is(w.Err(), ErrSequenceChanged) {
+		t.Fatalf("expected ErrSequenceChanged, got %v\n", w.Err())
+	}
+}
+
+func TestY4MHeader(t *testing.T) {
+	for _, test := range []struct {
+		sps      *SPS
+		bitDepth int
+		mono     bool
+		header   string
+	}{
+		{&SPS{ChromaFormat: 1, FrameMbsOnly: true}, 8, false, "YUV4MPEG2 W16 H16 F25:1 Ip A0:0 C420mpeg2\n"},
+		{&SPS{ChromaFormat: 1, AspectRatioInfoPresent: true, AspectRatio: 255, SarWidth: 4, SarHeight: 3}, 10, false, "YUV4MPEG2 W16 H16 F25:1 I? A4:3 C420p10\n"},
+		{&SPS{ChromaFormat: 0, FrameMbsOnly: true}, 8, true, "YUV4MPEG2 W16 H16 F25:1 Ip A0:0 Cmono\n"},
+		{&SPS{ChromaFormat: 0, FrameMbsOnly: true}, 12, true, "YUV4MPEG2 W16 H16 F25:1 Ip A0:0 Cmono12\n"},
+	} {
+		frame := yuvTestFrame(test.sps, test.bitDepth, 0)
+		if test.mono {
+			frame.ChromaWidth, frame.ChromaHeight, frame.Cb, frame.Cr = 0, 0, nil, nil
+		}
+		window, err := newYUVWindow(frame)
+		if err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+		if header := y4mHeader(frame, window, [2]int{25, 1}); header != test.header {
+			t.Fatalf("expected %q, got %q\n", test.header, header)
+		}
+	}
+}
+
+func TestRawYUVWriter(t *testing.T) {
+	sps := &SPS{ChromaFormat: 1, FrameMbsOnly: true}
+	var out bytes.Buffer
+	w := NewRawYUVWriter(&out, YUV_FORMAT_I420)
+	w.HandleFrame(yuvTestFrame(sps, 8, 0))
+	if err := w.Err(); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if out.Len() != 16*16*3/2 || out.Bytes()[16*16] != 128 || out.Bytes()[16*16+8*8] != 64 {
+		t.Fatalf("unexpected I420 picture of %d bytes\n", out.Len())
+	}
+
+	// 10 bit samples are two little endian bytes, in the high bits for
+	// P010 with Cb and Cr interleaved
+	out.Reset()
+	w = NewRawYUVWriter(&out, YUV_FORMAT_P010)
+	w.HandleFrame(yuvTestFrame(sps, 10, 512))
+	if err := w.Err(); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	data := out.Bytes()
+	if len(data) != 2*16*16*3/2 {
+		t.Fatalf("unexpected P010 picture of %d bytes\n", len(data))
+	}
+	chroma := data[2*16*16:]
+	if got := fmt.Sprintf("% x", data[2:4]); got != "40 80" {
+		t.Fatalf("unexpected luma sample %s\n", got)
+	}
+	if got := fmt.Sprintf("% x", chroma[:4]); got != "00 a0 00 90" {
+		t.Fatalf("unexpected chroma samples %s\n", got)
+	}
+
+	// 4:2:0 pictures are not I444
+	w = NewRawYUVWriter(&out, YUV_FORMAT_I444)
+	w.HandleFrame(yuvTestFrame(sps, 8, 0))
+	if !errors.Is(w.Err(), ErrYUVFormat) {
+		t.Fatalf("expected ErrYUVFormat, got %v\n", w.Err())
+	}
+}
+
+func TestDisplayOrder(t *testing.T) {
+	sps := &SPS{MaxNumReorderFrames: 1, BitstreamRestriction: true}
+	var got []int
+	order := &DisplayOrder{Handler: FrameHandlerFunc(func(frame *Frame) {
+		got = append(got, frame.PicOrderCnt)
+	})}
+	// I P B P B in decoding order, then an IDR
+	for i, poc := range []int{0, 4, 2, 8, 6, 0} {
+		order.HandleFrame(&Frame{SPS: sps, PicOrderCnt: poc, IDR: i == 0 || i == 5})
+	}
+	order.Flush()
+	if fmt.Sprint(got) != "[0 2 4 6 8 0]" {
+		t.Fatalf("unexpected display order %v\n", got)
+	}
+}
@@ -3,6 +3,9 @@ package main
 import "github.com/mrmod/cvnightlife/h264"
 import "net"
 import "fmt"
+import "log/slog"
+import "os"
+import "time"
 
 func main() {
 	port := "8000"
@@ -12,12 +15,42 @@ func main() {
 	}
 	fmt.Printf("listening for h264 bytestreams on %s\n", port)
 	defer server.Close()
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	rtmpPort := "1935"
+	rtmpServer, err := net.Listen("tcp", ":"+rtmpPort)
+	if err != nil {
+		panic(fmt.Sprintf("failed to listen %s\n", err))
+	}
+	fmt.Printf("listening for RTMP publishers on %s\n", rtmpPort)
+	defer rtmpServer.Close()
+	go func() {
+		for {
+			connection, err := rtmpServer.Accept()
+			if err != nil {
+				panic(fmt.Sprintf("connection failed %s\n", err))
+			}
+			go h264.RTMPStreamReader(connection, h264.WithLogger(logger), h264.WithFrameHandler(h264.FrameHandlerFunc(observeFrameRate)))
+		}
+	}()
+	if rtspURL != "" {
+		go func() {
+			for {
+				// The URL is not printed as it may hold credentials
+				fmt.Printf("pulling H.264 over RTSP\n")
+				err := h264.PullRTSP(rtspURL, h264.RTSP_TRANSPORT_TCP, h264.WithLogger(logger), h264.WithFrameHandler(h264.FrameHandlerFunc(observeFrameRate)))
+				logger.Warn("RTSP session ended", "err", err)
+				// Cameras drop sessions, so pull again after a pause
+				time.Sleep(5 * time.Second)
+			}
+		}()
+	}
 	for {
 		connection, err := server.Accept()
 		if err != nil {
 			panic(fmt.Sprintf("connection failed %s\n", err))
 		}
-		go h264.ByteStreamReader(connection)
+		go h264.ByteStreamReader(connection, h264.WithLogger(logger), h264.WithFrameHandler(h264.FrameHandlerFunc(observeFrameRate)))
 		// hand connection to ReadMuxer
 	}
 }